@@ -150,6 +150,40 @@ func (m *Machine) SetInstanceStatus(status string) error {
 	return result.OneError()
 }
 
+// InstanceDisplayName returns the display name of the machine's instance.
+func (m *Machine) InstanceDisplayName() (string, error) {
+	var results params.StringResults
+	args := params.Entities{Entities: []params.Entity{
+		{Tag: m.tag.String()},
+	}}
+	err := m.facade.FacadeCall("InstanceDisplayName", args, &results)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if len(results.Results) != 1 {
+		err := errors.Errorf("expected 1 result, got %d", len(results.Results))
+		return "", err
+	}
+	result := results.Results[0]
+	if result.Error != nil {
+		return "", result.Error
+	}
+	return result.Result, nil
+}
+
+// SetInstanceDisplayName sets the display name of the machine's instance.
+func (m *Machine) SetInstanceDisplayName(name string) error {
+	var result params.ErrorResults
+	args := params.SetInstancesDisplayName{Entities: []params.InstanceDisplayName{
+		{Tag: m.tag.String(), DisplayName: name},
+	}}
+	err := m.facade.FacadeCall("SetInstanceDisplayName", args, &result)
+	if err != nil {
+		return err
+	}
+	return result.OneError()
+}
+
 // ProviderAddresses returns all addresses of the machine known to the
 // cloud provider.
 func (m *Machine) ProviderAddresses() ([]network.Address, error) {
@@ -98,6 +98,19 @@ var machineErrorTests = []struct {
 		return m.SetInstanceStatus("")
 	},
 	resultsRef: params.ErrorResults{},
+}, {
+	method: "InstanceDisplayName",
+	wrapper: func(m *instancepoller.Machine) error {
+		_, err := m.InstanceDisplayName()
+		return err
+	},
+	resultsRef: params.StringResults{},
+}, {
+	method: "SetInstanceDisplayName",
+	wrapper: func(m *instancepoller.Machine) error {
+		return m.SetInstanceDisplayName("")
+	},
+	resultsRef: params.ErrorResults{},
 }, {
 	method: "ProviderAddresses",
 	wrapper: func(m *instancepoller.Machine) error {
@@ -233,6 +246,36 @@ func (s *MachineSuite) TestSetInstanceStatusSuccess(c *gc.C) {
 	c.Check(called, gc.Equals, 1)
 }
 
+func (s *MachineSuite) TestInstanceDisplayNameSuccess(c *gc.C) {
+	var called int
+	results := params.StringResults{
+		Results: []params.StringResult{{Result: "web-server"}},
+	}
+	apiCaller := successAPICaller(c, "InstanceDisplayName", entitiesArgs, results, &called)
+	machine := instancepoller.NewMachine(apiCaller, s.tag, params.Alive)
+	name, err := machine.InstanceDisplayName()
+	c.Check(err, jc.ErrorIsNil)
+	c.Check(name, gc.Equals, "web-server")
+	c.Check(called, gc.Equals, 1)
+}
+
+func (s *MachineSuite) TestSetInstanceDisplayNameSuccess(c *gc.C) {
+	var called int
+	expectArgs := params.SetInstancesDisplayName{
+		Entities: []params.InstanceDisplayName{{
+			Tag:         "machine-42",
+			DisplayName: "web-server",
+		}}}
+	results := params.ErrorResults{
+		Results: []params.ErrorResult{{Error: nil}},
+	}
+	apiCaller := successAPICaller(c, "SetInstanceDisplayName", expectArgs, results, &called)
+	machine := instancepoller.NewMachine(apiCaller, s.tag, params.Alive)
+	err := machine.SetInstanceDisplayName("web-server")
+	c.Check(err, jc.ErrorIsNil)
+	c.Check(called, gc.Equals, 1)
+}
+
 func (s *MachineSuite) TestProviderAddressesSuccess(c *gc.C) {
 	var called int
 	addresses := network.NewAddresses("2001:db8::1", "0.1.2.3")
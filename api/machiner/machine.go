@@ -10,6 +10,7 @@ import (
 	"github.com/juju/juju/api/common"
 	"github.com/juju/juju/api/watcher"
 	"github.com/juju/juju/apiserver/params"
+	"github.com/juju/juju/instance"
 	"github.com/juju/juju/network"
 )
 
@@ -70,6 +71,22 @@ func (m *Machine) SetMachineAddresses(addresses []network.Address) error {
 	return result.OneError()
 }
 
+// SetDetectedContainerType records the type of container that the
+// machine agent has found it is running inside.
+func (m *Machine) SetDetectedContainerType(ctype instance.ContainerType) error {
+	var result params.ErrorResults
+	args := params.SetMachinesContainerType{
+		Entities: []params.MachineContainerType{
+			{Tag: m.tag.String(), ContainerType: ctype},
+		},
+	}
+	err := m.st.facade.FacadeCall("SetDetectedContainerType", args, &result)
+	if err != nil {
+		return err
+	}
+	return result.OneError()
+}
+
 // EnsureDead sets the machine lifecycle to Dead if it is Alive or
 // Dying. It does nothing otherwise.
 func (m *Machine) EnsureDead() error {
@@ -2423,6 +2423,7 @@ func (s *clientSuite) TestClientWatchAll(c *gc.C) {
 			EnvUUID:                 s.State.EnvironUUID(),
 			Id:                      m.Id(),
 			InstanceId:              "i-0",
+			Nonce:                   agent.BootstrapNonce,
 			Status:                  multiwatcher.Status("pending"),
 			StatusData:              map[string]interface{}{},
 			Life:                    multiwatcher.Life("alive"),
@@ -194,6 +194,46 @@ func (a *InstancePollerAPI) SetInstanceStatus(args params.SetInstancesStatus) (p
 	return result, nil
 }
 
+// InstanceDisplayName returns the display name of the instance of
+// each given entity. Only machine tags are accepted.
+func (a *InstancePollerAPI) InstanceDisplayName(args params.Entities) (params.StringResults, error) {
+	result := params.StringResults{
+		Results: make([]params.StringResult, len(args.Entities)),
+	}
+	canAccess, err := a.accessMachine()
+	if err != nil {
+		return result, err
+	}
+	for i, arg := range args.Entities {
+		machine, err := a.getOneMachine(arg.Tag, canAccess)
+		if err == nil {
+			result.Results[i].Result, err = machine.InstanceDisplayName()
+		}
+		result.Results[i].Error = common.ServerError(err)
+	}
+	return result, nil
+}
+
+// SetInstanceDisplayName updates the display name of the instance
+// of each given entity. Only machine tags are accepted.
+func (a *InstancePollerAPI) SetInstanceDisplayName(args params.SetInstancesDisplayName) (params.ErrorResults, error) {
+	result := params.ErrorResults{
+		Results: make([]params.ErrorResult, len(args.Entities)),
+	}
+	canAccess, err := a.accessMachine()
+	if err != nil {
+		return result, err
+	}
+	for i, arg := range args.Entities {
+		machine, err := a.getOneMachine(arg.Tag, canAccess)
+		if err == nil {
+			err = machine.SetInstanceDisplayName(arg.DisplayName)
+		}
+		result.Results[i].Error = common.ServerError(err)
+	}
+	return result, nil
+}
+
 // AreManuallyProvisioned returns whether each given entity is
 // manually provisioned or not. Only machine tags are accepted.
 func (a *InstancePollerAPI) AreManuallyProvisioned(args params.Entities) (params.BoolResults, error) {
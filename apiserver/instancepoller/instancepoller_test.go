@@ -644,6 +644,91 @@ func (s *InstancePollerSuite) TestSetInstanceStatusFailure(c *gc.C) {
 	s.st.CheckFindEntityCall(c, 3, "3")
 }
 
+func (s *InstancePollerSuite) TestInstanceDisplayNameSuccess(c *gc.C) {
+	s.st.SetMachineInfo(c, machineInfo{id: "1", displayName: "foo"})
+	s.st.SetMachineInfo(c, machineInfo{id: "2", displayName: ""})
+
+	result, err := s.api.InstanceDisplayName(s.mixedEntities)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result, jc.DeepEquals, params.StringResults{
+		Results: []params.StringResult{
+			{Result: "foo"},
+			{Result: ""},
+			{Error: apiservertesting.NotFoundError("machine 42")},
+			{Error: apiservertesting.ServerError(`"service-unknown" is not a valid machine tag`)},
+			{Error: apiservertesting.ServerError(`"invalid-tag" is not a valid tag`)},
+			{Error: apiservertesting.ServerError(`"unit-missing-1" is not a valid machine tag`)},
+			{Error: apiservertesting.ServerError(`"" is not a valid tag`)},
+			{Error: apiservertesting.ServerError(`"42" is not a valid tag`)},
+		}},
+	)
+
+	s.st.CheckFindEntityCall(c, 0, "1")
+	s.st.CheckCall(c, 1, "InstanceDisplayName")
+	s.st.CheckFindEntityCall(c, 2, "2")
+	s.st.CheckCall(c, 3, "InstanceDisplayName")
+	s.st.CheckFindEntityCall(c, 4, "42")
+}
+
+func (s *InstancePollerSuite) TestSetInstanceDisplayNameSuccess(c *gc.C) {
+	s.st.SetMachineInfo(c, machineInfo{id: "1", displayName: "foo"})
+	s.st.SetMachineInfo(c, machineInfo{id: "2", displayName: ""})
+
+	result, err := s.api.SetInstanceDisplayName(params.SetInstancesDisplayName{
+		Entities: []params.InstanceDisplayName{
+			{Tag: "machine-1", DisplayName: ""},
+			{Tag: "machine-2", DisplayName: "new name"},
+			{Tag: "machine-42"},
+			{Tag: "service-unknown"},
+			{Tag: "invalid-tag"},
+			{Tag: "unit-missing-1"},
+			{Tag: ""},
+			{Tag: "42"},
+		}},
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result, jc.DeepEquals, s.mixedErrorResults)
+
+	s.st.CheckFindEntityCall(c, 0, "1")
+	s.st.CheckCall(c, 1, "SetInstanceDisplayName", "")
+	s.st.CheckFindEntityCall(c, 2, "2")
+	s.st.CheckCall(c, 3, "SetInstanceDisplayName", "new name")
+	s.st.CheckFindEntityCall(c, 4, "42")
+
+	// Ensure machine 2 was updated.
+	machine, err := s.st.Machine("2")
+	c.Assert(err, jc.ErrorIsNil)
+	name, err := machine.InstanceDisplayName()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(name, gc.Equals, "new name")
+}
+
+func (s *InstancePollerSuite) TestSetInstanceDisplayNameFailure(c *gc.C) {
+	s.st.SetErrors(
+		errors.New("pow!"),                   // m1 := FindEntity("1")
+		nil,                                  // m2 := FindEntity("2")
+		errors.New("FAIL"),                   // m2.SetInstanceDisplayName()
+		errors.NotProvisionedf("machine 42"), // FindEntity("3") (ensure wrapping is preserved)
+	)
+	s.st.SetMachineInfo(c, machineInfo{id: "1"})
+	s.st.SetMachineInfo(c, machineInfo{id: "2"})
+
+	result, err := s.api.SetInstanceDisplayName(params.SetInstancesDisplayName{
+		Entities: []params.InstanceDisplayName{
+			{Tag: "machine-1", DisplayName: "new"},
+			{Tag: "machine-2", DisplayName: "invalid"},
+			{Tag: "machine-3", DisplayName: ""},
+		}},
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result, jc.DeepEquals, s.machineErrorResults)
+
+	s.st.CheckFindEntityCall(c, 0, "1")
+	s.st.CheckFindEntityCall(c, 1, "2")
+	s.st.CheckCall(c, 2, "SetInstanceDisplayName", "invalid")
+	s.st.CheckFindEntityCall(c, 3, "3")
+}
+
 func (s *InstancePollerSuite) TestAreManuallyProvisionedSuccess(c *gc.C) {
 	s.st.SetMachineInfo(c, machineInfo{id: "1", isManual: true})
 	s.st.SetMachineInfo(c, machineInfo{id: "2", isManual: false})
@@ -208,6 +208,7 @@ type machineInfo struct {
 	instanceId        instance.Id
 	status            state.StatusInfo
 	instanceStatus    string
+	displayName       string
 	providerAddresses []network.Address
 	life              state.Life
 	isManual          bool
@@ -288,6 +289,31 @@ func (m *mockMachine) SetInstanceStatus(status string) error {
 	return nil
 }
 
+// InstanceDisplayName implements StateMachine.
+func (m *mockMachine) InstanceDisplayName() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.MethodCall(m, "InstanceDisplayName")
+	if err := m.NextErr(); err != nil {
+		return "", err
+	}
+	return m.displayName, nil
+}
+
+// SetInstanceDisplayName implements StateMachine.
+func (m *mockMachine) SetInstanceDisplayName(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.MethodCall(m, "SetInstanceDisplayName", name)
+	if err := m.NextErr(); err != nil {
+		return err
+	}
+	m.displayName = name
+	return nil
+}
+
 // Life implements StateMachine.
 func (m *mockMachine) Life() state.Life {
 	m.mu.Lock()
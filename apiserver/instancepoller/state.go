@@ -18,6 +18,8 @@ type StateMachine interface {
 	SetProviderAddresses(...network.Address) error
 	InstanceStatus() (string, error)
 	SetInstanceStatus(status string) error
+	InstanceDisplayName() (string, error)
+	SetInstanceDisplayName(name string) error
 	String() string
 	Refresh() error
 	Life() state.Life
@@ -98,6 +98,37 @@ func (api *MachinerAPI) SetMachineAddresses(args params.SetMachinesAddresses) (p
 	return results, nil
 }
 
+// SetDetectedContainerType records, for each given machine, the type
+// of container its agent has found it is running inside.
+func (api *MachinerAPI) SetDetectedContainerType(args params.SetMachinesContainerType) (params.ErrorResults, error) {
+	results := params.ErrorResults{
+		Results: make([]params.ErrorResult, len(args.Entities)),
+	}
+	canModify, err := api.getCanModify()
+	if err != nil {
+		return results, err
+	}
+	for i, arg := range args.Entities {
+		tag, err := names.ParseMachineTag(arg.Tag)
+		if err != nil {
+			results.Results[i].Error = common.ServerError(common.ErrPerm)
+			continue
+		}
+		err = common.ErrPerm
+		if canModify(tag) {
+			var m *state.Machine
+			m, err = api.getMachine(tag)
+			if err == nil {
+				err = m.SetDetectedContainerType(arg.ContainerType)
+			} else if errors.IsNotFound(err) {
+				err = common.ErrPerm
+			}
+		}
+		results.Results[i].Error = common.ServerError(err)
+	}
+	return results, nil
+}
+
 // Jobs returns the jobs assigned to the given entities.
 func (api *MachinerAPI) Jobs(args params.Entities) (params.JobsResults, error) {
 	result := params.JobsResults{
@@ -12,6 +12,7 @@ import (
 	"github.com/juju/juju/apiserver/machine"
 	"github.com/juju/juju/apiserver/params"
 	apiservertesting "github.com/juju/juju/apiserver/testing"
+	"github.com/juju/juju/instance"
 	"github.com/juju/juju/network"
 	"github.com/juju/juju/state"
 	"github.com/juju/juju/state/multiwatcher"
@@ -215,6 +216,31 @@ func (s *machinerSuite) TestSetEmptyMachineAddresses(c *gc.C) {
 	c.Assert(s.machine1.MachineAddresses(), gc.HasLen, 0)
 }
 
+func (s *machinerSuite) TestSetDetectedContainerType(c *gc.C) {
+	args := params.SetMachinesContainerType{Entities: []params.MachineContainerType{
+		{Tag: "machine-1", ContainerType: instance.LXC},
+		{Tag: "machine-0", ContainerType: instance.LXC},
+		{Tag: "machine-42", ContainerType: instance.LXC},
+	}}
+
+	result, err := s.machiner.SetDetectedContainerType(args)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result, gc.DeepEquals, params.ErrorResults{
+		Results: []params.ErrorResult{
+			{nil},
+			{apiservertesting.ErrUnauthorized},
+			{apiservertesting.ErrUnauthorized},
+		},
+	})
+
+	err = s.machine1.Refresh()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.machine1.DetectedContainerType(), gc.Equals, instance.LXC)
+	err = s.machine0.Refresh()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.machine0.DetectedContainerType(), gc.Equals, instance.ContainerType(""))
+}
+
 func (s *machinerSuite) TestJobs(c *gc.C) {
 	args := params.Entities{Entities: []params.Entity{
 		{Tag: "machine-1"},
@@ -372,6 +372,32 @@ type SetInstancesStatus struct {
 	Entities []InstanceStatus
 }
 
+// MachineContainerType holds a machine tag and the type of
+// container the machine's agent is running inside.
+type MachineContainerType struct {
+	Tag           string
+	ContainerType instance.ContainerType
+}
+
+// SetMachinesContainerType holds parameters for making a
+// SetDetectedContainerType() call.
+type SetMachinesContainerType struct {
+	Entities []MachineContainerType
+}
+
+// InstanceDisplayName holds an entity tag and the
+// display name of its instance.
+type InstanceDisplayName struct {
+	Tag         string
+	DisplayName string
+}
+
+// SetInstancesDisplayName holds parameters for making a
+// SetInstanceDisplayName() call.
+type SetInstancesDisplayName struct {
+	Entities []InstanceDisplayName
+}
+
 // ConstraintsResult holds machine constraints or an error.
 type ConstraintsResult struct {
 	Error       *Error
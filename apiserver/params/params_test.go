@@ -42,6 +42,7 @@ var marshalTestCases = []struct {
 			EnvUUID:                 "uuid",
 			Id:                      "Benji",
 			InstanceId:              "Shazam",
+			Nonce:                   "fake_nonce",
 			Status:                  "error",
 			StatusInfo:              "foo",
 			Life:                    multiwatcher.Life("alive"),
@@ -52,7 +53,19 @@ var marshalTestCases = []struct {
 			HardwareCharacteristics: &instance.HardwareCharacteristics{},
 		},
 	},
-	json: `["machine","change",{"EnvUUID": "uuid", "Id":"Benji","InstanceId":"Shazam","HasVote":false,"WantsVote":false,"Status":"error","StatusInfo":"foo","StatusData":null,"Life":"alive","Series":"trusty","SupportedContainers":["lxc"],"SupportedContainersKnown":false,"Jobs":["JobManageEnviron"],"Addresses":[],"HardwareCharacteristics":{}}]`,
+	json: `["machine","change",{"EnvUUID": "uuid", "Id":"Benji","InstanceId":"Shazam","DisplayName":"","InstanceStatus":"","Nonce":"fake_nonce","HasVote":false,"WantsVote":false,"Status":"error","StatusInfo":"foo","StatusData":null,"Life":"alive","Series":"trusty","SupportedContainers":["lxc"],"SupportedContainersKnown":false,"Jobs":["JobManageEnviron"],"Addresses":[],"HardwareCharacteristics":{}}]`,
+}, {
+	about: "MachineInfo Delta without jobs",
+	value: multiwatcher.Delta{
+		Entity: &multiwatcher.MachineInfo{
+			EnvUUID:   "uuid",
+			Id:        "Benji",
+			Life:      multiwatcher.Life("alive"),
+			Series:    "trusty",
+			Addresses: []network.Address{},
+		},
+	},
+	json: `["machine","change",{"EnvUUID": "uuid", "Id":"Benji","InstanceId":"","DisplayName":"","InstanceStatus":"","Nonce":"","HasVote":false,"WantsVote":false,"Status":"","StatusInfo":"","StatusData":null,"Life":"alive","Series":"trusty","SupportedContainers":null,"SupportedContainersKnown":false,"Addresses":[]}]`,
 }, {
 	about: "ServiceInfo Delta",
 	value: multiwatcher.Delta{
@@ -75,7 +88,7 @@ var marshalTestCases = []struct {
 			},
 		},
 	},
-	json: `["service","change",{"EnvUUID": "uuid", "CharmURL": "cs:quantal/name","Name":"Benji","Exposed":true,"Life":"dying","OwnerTag":"test-owner","MinUnits":42,"Constraints":{"arch":"armhf", "mem": 1024},"Config": {"hello":"goodbye","foo":false},"Subordinate":false,"Status":{"Current":"active", "Message":"all good", "Version": "", "Err": null, "Data": null, "Since": null}}]`,
+	json: `["service","change",{"EnvUUID": "uuid", "CharmURL": "cs:quantal/name","Name":"Benji","Exposed":true,"Life":"dying","OwnerTag":"test-owner","MinUnits":42,"Constraints":{"arch":"armhf", "mem": 1024},"Config": {"hello":"goodbye","foo":false},"Subordinate":false,"WorkloadVersion":"","Endpoints":null,"Status":{"Current":"active", "Message":"all good", "Version": "", "Err": null, "Data": null, "Since": null}}]`,
 }, {
 	about: "UnitInfo Delta",
 	value: multiwatcher.Delta{
@@ -108,7 +121,7 @@ var marshalTestCases = []struct {
 			},
 		},
 	},
-	json: `["unit", "change", {"EnvUUID": "uuid", "CharmURL": "cs:~user/precise/wordpress-42", "MachineId": "1", "Series": "precise", "Name": "Benji", "PublicAddress": "testing.invalid", "Service": "Shazam", "PrivateAddress": "10.0.0.1", "Ports": [{"Protocol": "http", "Number": 80}], "PortRanges": [{"FromPort": 80, "ToPort": 80, "Protocol": "http"}], "Status": "error", "StatusInfo": "foo", "StatusData": null, "WorkloadStatus":{"Current":"active", "Message":"all good", "Version": "", "Err": null, "Data": null, "Since": null}, "AgentStatus":{"Current":"idle", "Message":"", "Version": "", "Err": null, "Data": null, "Since": null}, "Subordinate": false}]`,
+	json: `["unit", "change", {"EnvUUID": "uuid", "CharmURL": "cs:~user/precise/wordpress-42", "MachineId": "1", "Series": "precise", "Name": "Benji", "PublicAddress": "testing.invalid", "Service": "Shazam", "PrivateAddress": "10.0.0.1", "Ports": [{"Protocol": "http", "Number": 80}], "PortRanges": [{"FromPort": 80, "ToPort": 80, "Protocol": "http"}], "Status": "error", "StatusInfo": "foo", "StatusData": null, "WorkloadStatus":{"Current":"active", "Message":"all good", "Version": "", "Err": null, "Data": null, "Since": null}, "AgentStatus":{"Current":"idle", "Message":"", "Version": "", "Err": null, "Data": null, "Since": null}, "Subordinate": false, "Leader": false, "Life": ""}]`,
 }, {
 	about: "RelationInfo Delta",
 	value: multiwatcher.Delta{
@@ -175,6 +188,49 @@ func (s *MarshalSuite) TestDeltaUnmarshalJSON(c *gc.C) {
 	}
 }
 
+func (s *MarshalSuite) TestDeltaRoundTrip(c *gc.C) {
+	deltas := []multiwatcher.Delta{{
+		Entity: &multiwatcher.MachineInfo{
+			EnvUUID:    "uuid",
+			Id:         "0",
+			InstanceId: "i-0",
+			Jobs:       []multiwatcher.MachineJob{multiwatcher.JobHostUnits},
+		},
+	}, {
+		Entity: &multiwatcher.ServiceInfo{
+			EnvUUID: "uuid",
+			Name:    "wordpress",
+			Exposed: true,
+		},
+	}, {
+		Entity: &multiwatcher.UnitInfo{
+			EnvUUID: "uuid",
+			Name:    "wordpress/0",
+			Service: "wordpress",
+			Ports:   []network.Port{{Protocol: "tcp", Number: 80}},
+		},
+	}, {
+		Removed: true,
+		Entity: &multiwatcher.RelationInfo{
+			EnvUUID: "uuid",
+			Key:     "logging:logging-directory wordpress:logging-dir",
+			Id:      1,
+		},
+	}, {
+		Entity: &multiwatcher.NetworkInfo{
+			EnvUUID: "uuid",
+			Name:    "net1",
+			CIDR:    "0.1.2.0/24",
+		},
+	}}
+	data, err := json.Marshal(deltas)
+	c.Assert(err, jc.ErrorIsNil)
+	var got []multiwatcher.Delta
+	err = json.Unmarshal(data, &got)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(got, jc.DeepEquals, deltas)
+}
+
 func (s *MarshalSuite) TestDeltaMarshalJSONCardinality(c *gc.C) {
 	err := json.Unmarshal([]byte(`[1,2]`), new(multiwatcher.Delta))
 	c.Check(err, gc.ErrorMatches, "Expected 3 elements in top-level of JSON but got 2")
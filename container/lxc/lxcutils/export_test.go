@@ -4,5 +4,5 @@
 package lxcutils
 
 var (
-	InitProcessCgroupFile = &initProcessCgroupFile
+	FSRoot = &fsRoot
 )
@@ -8,6 +8,7 @@ import (
 	"runtime"
 	stdtesting "testing"
 
+	"github.com/juju/errors"
 	jc "github.com/juju/testing/checkers"
 	ft "github.com/juju/testing/filetesting"
 	gc "gopkg.in/check.v1"
@@ -29,6 +30,13 @@ type LxcUtilsSuite struct {
 
 var _ = gc.Suite(&LxcUtilsSuite{})
 
+func (s *LxcUtilsSuite) SetUpTest(c *gc.C) {
+	s.BaseSuite.SetUpTest(c)
+	// Don't let the markers of the machine running
+	// the tests leak into them.
+	s.PatchValue(lxcutils.FSRoot, c.MkDir())
+}
+
 var lxcCgroupContents = `11:hugetlb:/lxc/juju-machine-1-lxc-0
 10:perf_event:/lxc/juju-machine-1-lxc-0
 9:blkio:/lxc/juju-machine-1-lxc-0
@@ -53,46 +61,227 @@ var hostCgroupContents = `11:hugetlb:/
 2:name=systemd:/
 `
 
+var systemdCgroupContents = `11:hugetlb:/
+10:perf_event:/
+9:blkio:/init.scope
+8:freezer:/
+7:devices:/init.scope
+6:memory:/init.scope
+5:cpuacct:/init.scope
+4:cpu:/init.scope
+3:cpuset:/
+2:name=systemd:/init.scope
+`
+
 var malformedCgroupFile = `some bogus content
 more bogus content`
 
 func (s *LxcUtilsSuite) TestRunningInsideLXCOnHost(c *gc.C) {
-	baseDir := c.MkDir()
-	cgroup := filepath.Join(baseDir, "cgroup")
-
-	ft.File{"cgroup", hostCgroupContents, 0400}.Create(c, baseDir)
-
-	s.PatchValue(lxcutils.InitProcessCgroupFile, cgroup)
+	// A bare-metal host has cgroups anchored at the
+	// root and no container markers at all.
+	s.setUpContainerMarkers(c, hostCgroupContents,
+		ft.Dir{"dev", 0755},
+		ft.Dir{"run/systemd", 0755},
+	)
 	runningInLXC, err := lxcutils.RunningInsideLXC()
 	c.Assert(err, jc.ErrorIsNil)
 	c.Assert(runningInLXC, jc.IsFalse)
 }
 
 func (s *LxcUtilsSuite) TestRunningInsideLXCOnLXCContainer(c *gc.C) {
-	baseDir := c.MkDir()
-	cgroup := filepath.Join(baseDir, "cgroup")
-
-	ft.File{"cgroup", lxcCgroupContents, 0400}.Create(c, baseDir)
-
-	s.PatchValue(lxcutils.InitProcessCgroupFile, cgroup)
+	s.setUpContainerMarkers(c, lxcCgroupContents,
+		ft.File{"proc/1/environ", "container=lxc\x00", 0400},
+		ft.Dir{"dev", 0755},
+	)
 	runningInLXC, err := lxcutils.RunningInsideLXC()
 	c.Assert(err, jc.ErrorIsNil)
 	c.Assert(runningInLXC, jc.IsTrue)
 }
 
 func (s *LxcUtilsSuite) TestRunningInsideLXCMissingCgroupFile(c *gc.C) {
-	s.PatchValue(lxcutils.InitProcessCgroupFile, "")
+	root := c.MkDir()
+	s.PatchValue(lxcutils.FSRoot, root)
 	_, err := lxcutils.RunningInsideLXC()
-	c.Assert(err.Error(), gc.Matches, "open : no such file or directory")
+	c.Assert(err.Error(), gc.Equals, "open "+filepath.Join(root, "proc/1/cgroup")+": no such file or directory")
 }
 
 func (s *LxcUtilsSuite) TestRunningInsideLXCMalformedCgroupFile(c *gc.C) {
-	baseDir := c.MkDir()
-	cgroup := filepath.Join(baseDir, "cgroup")
-
-	ft.File{"cgroup", malformedCgroupFile, 0400}.Create(c, baseDir)
-
-	s.PatchValue(lxcutils.InitProcessCgroupFile, cgroup)
+	s.setUpContainerMarkers(c, malformedCgroupFile)
 	_, err := lxcutils.RunningInsideLXC()
 	c.Assert(err.Error(), gc.Equals, "malformed cgroup file")
 }
+
+// setUpContainerMarkers lays out a filesystem root holding the
+// given init process cgroups and entries, and patches the
+// container detection to look there.
+func (s *LxcUtilsSuite) setUpContainerMarkers(c *gc.C, cgroupContents string, entries ...ft.Entry) {
+	root := c.MkDir()
+	ft.Entries{
+		ft.Dir{"proc/1", 0755},
+		ft.File{"proc/1/cgroup", cgroupContents, 0400},
+	}.Create(c, root)
+	ft.Entries(entries).Create(c, root)
+	s.PatchValue(lxcutils.FSRoot, root)
+}
+
+func (s *LxcUtilsSuite) assertRunningInsideContainer(c *gc.C, expect lxcutils.ContainerType, expectLXC bool) {
+	containerType, err := lxcutils.RunningInsideContainer()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(containerType, gc.Equals, expect)
+	runningInLXC, err := lxcutils.RunningInsideLXC()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(runningInLXC, gc.Equals, expectLXC)
+}
+
+func (s *LxcUtilsSuite) TestRunningInsideContainerOnHost(c *gc.C) {
+	s.setUpContainerMarkers(c, hostCgroupContents,
+		ft.Dir{"sys/class/dmi/id", 0755},
+		ft.File{"sys/class/dmi/id/product_name", "Precision T3610\n", 0444},
+	)
+	s.assertRunningInsideContainer(c, lxcutils.NoContainer, false)
+}
+
+func (s *LxcUtilsSuite) TestRunningInsideContainerLXCCgroup(c *gc.C) {
+	s.setUpContainerMarkers(c, lxcCgroupContents)
+	s.assertRunningInsideContainer(c, lxcutils.LXCContainer, true)
+}
+
+func (s *LxcUtilsSuite) TestRunningInsideContainerSystemdMarker(c *gc.C) {
+	s.setUpContainerMarkers(c, hostCgroupContents,
+		ft.Dir{"run/systemd", 0755},
+		ft.File{"run/systemd/container", "lxc\n", 0444},
+	)
+	s.assertRunningInsideContainer(c, lxcutils.LXCContainer, true)
+}
+
+func (s *LxcUtilsSuite) TestRunningInsideContainerInitEnviron(c *gc.C) {
+	s.setUpContainerMarkers(c, hostCgroupContents,
+		ft.File{"proc/1/environ", "PATH=/bin\x00container=lxc-libvirt\x00", 0400},
+	)
+	s.assertRunningInsideContainer(c, lxcutils.LXCContainer, true)
+}
+
+func (s *LxcUtilsSuite) TestRunningInsideContainerLXD(c *gc.C) {
+	s.setUpContainerMarkers(c, hostCgroupContents,
+		ft.File{"proc/1/environ", "container=lxc\x00", 0400},
+		ft.Dir{"dev/lxd", 0755},
+	)
+	s.assertRunningInsideContainer(c, lxcutils.LXDContainer, true)
+}
+
+func (s *LxcUtilsSuite) TestRunningInsideContainerKVM(c *gc.C) {
+	s.setUpContainerMarkers(c, hostCgroupContents,
+		ft.Dir{"sys/class/dmi/id", 0755},
+		ft.File{"sys/class/dmi/id/product_name", "KVM\n", 0444},
+	)
+	s.assertRunningInsideContainer(c, lxcutils.KVMContainer, false)
+}
+
+func (s *LxcUtilsSuite) TestRunningInsideContainerSystemdHost(c *gc.C) {
+	s.setUpContainerMarkers(c, systemdCgroupContents,
+		ft.Dir{"sys/class/dmi/id", 0755},
+		ft.File{"sys/class/dmi/id/product_name", "Precision T3610\n", 0444},
+	)
+	s.assertRunningInsideContainer(c, lxcutils.NoContainer, false)
+}
+
+func (s *LxcUtilsSuite) TestRunningInsideContainerSystemdKVM(c *gc.C) {
+	s.setUpContainerMarkers(c, systemdCgroupContents,
+		ft.Dir{"sys/class/dmi/id", 0755},
+		ft.File{"sys/class/dmi/id/product_name", "KVM\n", 0444},
+	)
+	s.assertRunningInsideContainer(c, lxcutils.KVMContainer, false)
+}
+
+func (s *LxcUtilsSuite) TestRunningInsideContainerUnifiedHost(c *gc.C) {
+	s.setUpContainerMarkers(c, "0::/init.scope\n",
+		ft.Dir{"sys/fs/cgroup", 0755},
+		ft.File{"sys/fs/cgroup/cgroup.controllers", "cpu memory pids\n", 0444},
+	)
+	s.assertRunningInsideContainer(c, lxcutils.NoContainer, false)
+}
+
+func (s *LxcUtilsSuite) TestRunningInsideContainerCgroupNamespace(c *gc.C) {
+	s.setUpContainerMarkers(c, "0::/init.scope\n",
+		ft.Dir{"sys/fs/cgroup", 0755},
+		ft.File{"sys/fs/cgroup/cgroup.controllers", "cpu memory pids\n", 0444},
+		ft.File{"sys/fs/cgroup/cgroup.type", "domain\n", 0444},
+	)
+	s.assertRunningInsideContainer(c, lxcutils.LXCContainer, true)
+}
+
+var nestedLXCCgroupContents = `4:cpu:/lxc/juju-machine-1-lxc-0/lxc/sandbox
+3:cpuset:/lxc/juju-machine-1-lxc-0/lxc/sandbox
+2:name=systemd:/lxc/juju-machine-1-lxc-0/lxc/sandbox
+`
+
+func (s *LxcUtilsSuite) assertContainerNestingDepth(c *gc.C, expect int) {
+	depth, err := lxcutils.ContainerNestingDepth()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(depth, gc.Equals, expect)
+}
+
+func (s *LxcUtilsSuite) TestContainerNestingDepthOnHost(c *gc.C) {
+	s.setUpContainerMarkers(c, hostCgroupContents)
+	s.assertContainerNestingDepth(c, 0)
+}
+
+func (s *LxcUtilsSuite) TestContainerNestingDepthInContainer(c *gc.C) {
+	s.setUpContainerMarkers(c, lxcCgroupContents)
+	s.assertContainerNestingDepth(c, 1)
+}
+
+func (s *LxcUtilsSuite) TestContainerNestingDepthInNestedContainer(c *gc.C) {
+	s.setUpContainerMarkers(c, nestedLXCCgroupContents)
+	s.assertContainerNestingDepth(c, 2)
+}
+
+func (s *LxcUtilsSuite) TestContainerNestingDepthHiddenCgroups(c *gc.C) {
+	// Without cgroup paths to go on, the container
+	// marker shows that we're in at least one.
+	root := c.MkDir()
+	ft.Entries{
+		ft.Dir{"run/systemd", 0755},
+		ft.File{"run/systemd/container", "lxc\n", 0444},
+	}.Create(c, root)
+	s.PatchValue(lxcutils.FSRoot, root)
+	s.assertContainerNestingDepth(c, 1)
+}
+
+func (s *LxcUtilsSuite) TestContainerNestingDepthNoProc(c *gc.C) {
+	s.assertContainerNestingDepth(c, 0)
+}
+
+func (s *LxcUtilsSuite) TestContainerName(c *gc.C) {
+	s.setUpContainerMarkers(c, lxcCgroupContents)
+	name, err := lxcutils.ContainerName()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(name, gc.Equals, "juju-machine-1-lxc-0")
+}
+
+func (s *LxcUtilsSuite) TestContainerNameNested(c *gc.C) {
+	s.setUpContainerMarkers(c, nestedLXCCgroupContents)
+	name, err := lxcutils.ContainerName()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(name, gc.Equals, "sandbox")
+}
+
+func (s *LxcUtilsSuite) TestContainerNameFromHostname(c *gc.C) {
+	s.setUpContainerMarkers(c, hostCgroupContents,
+		ft.File{"proc/1/environ", "container=lxc\x00", 0400},
+		ft.Dir{"etc", 0755},
+		ft.File{"etc/hostname", "juju-machine-2-lxc-1\n", 0444},
+	)
+	name, err := lxcutils.ContainerName()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(name, gc.Equals, "juju-machine-2-lxc-1")
+}
+
+func (s *LxcUtilsSuite) TestContainerNameOnHost(c *gc.C) {
+	s.setUpContainerMarkers(c, hostCgroupContents,
+		ft.Dir{"etc", 0755},
+		ft.File{"etc/hostname", "myhost\n", 0444},
+	)
+	_, err := lxcutils.ContainerName()
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
@@ -3,10 +3,51 @@
 
 package lxcutils
 
-var initProcessCgroupFile = "/proc/1/cgroup"
+// fsRoot holds the directory relative to which the
+// container markers are read.
+var fsRoot = "/"
+
+// ContainerType identifies the kind of container,
+// if any, that we are running inside.
+type ContainerType string
+
+const (
+	NoContainer  ContainerType = "none"
+	LXCContainer ContainerType = "lxc"
+	LXDContainer ContainerType = "lxd"
+	KVMContainer ContainerType = "kvm"
+)
 
 // RunningInsideLXC reports whether or not we are running inside an
-// LXC container.
+// LXC container. LXD containers are LXC containers underneath,
+// so it also reports true when running inside one of those.
 func RunningInsideLXC() (bool, error) {
-	return runningInsideLXC()
+	containerType, err := RunningInsideContainer()
+	if err != nil {
+		return false, err
+	}
+	return containerType == LXCContainer || containerType == LXDContainer, nil
+}
+
+// RunningInsideContainer returns the type of container that
+// we are running inside, or NoContainer if we are not running
+// inside one.
+func RunningInsideContainer() (ContainerType, error) {
+	return runningInsideContainer(fsRoot)
+}
+
+// ContainerNestingDepth returns the number of LXC containers we are
+// running inside: 0 when running on the host, 1 when inside a
+// container on the host, 2 when inside a container inside that,
+// and so on. Any part of /proc that cannot be read is taken
+// to hold no container markers.
+func ContainerNestingDepth() (int, error) {
+	return containerNestingDepth(fsRoot)
+}
+
+// ContainerName returns the name of the LXC container we are running
+// inside. It returns an error satisfying errors.IsNotFound if we are
+// not running inside an LXC container, or its name cannot be found.
+func ContainerName() (string, error) {
+	return containerName(fsRoot)
 }
@@ -5,14 +5,102 @@ package lxcutils
 
 import (
 	"bufio"
+	"bytes"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/juju/errors"
 )
 
-func runningInsideLXC() (bool, error) {
-	file, err := os.Open(initProcessCgroupFile)
+// runningInsideContainer returns the type of container we are
+// running inside, reading its markers relative to the given root.
+func runningInsideContainer(root string) (ContainerType, error) {
+	marker, err := containerMarker(root)
+	if err != nil {
+		return NoContainer, errors.Trace(err)
+	}
+	if strings.HasPrefix(marker, "lxc") {
+		return lxcOrLXD(root)
+	}
+	// A KVM guest is a host in its own right, whose init process
+	// may well sit in a cgroup of its own, so look for the marker
+	// the hypervisor leaves before looking at the cgroups.
+	product, err := readMarkerFile(root, "sys/class/dmi/id/product_name")
+	if err != nil {
+		return NoContainer, errors.Trace(err)
+	}
+	if strings.Contains(product, "KVM") {
+		return KVMContainer, nil
+	}
+	insideLXC, err := runningInsideLXC(root)
+	if err != nil {
+		return NoContainer, errors.Trace(err)
+	}
+	if insideLXC {
+		return lxcOrLXD(root)
+	}
+	return NoContainer, nil
+}
+
+// lxcOrLXD distinguishes LXD containers from plain LXC ones
+// by looking for the directory LXD shares with its containers.
+func lxcOrLXD(root string) (ContainerType, error) {
+	_, err := os.Stat(filepath.Join(root, "dev/lxd"))
+	if err == nil {
+		return LXDContainer, nil
+	}
+	if !os.IsNotExist(err) {
+		return NoContainer, errors.Trace(err)
+	}
+	return LXCContainer, nil
+}
+
+// containerMarker returns the value of the container variable set
+// in the environment of the init process, as recorded by systemd
+// or, failing that, as found in the init process's environment.
+// It returns an empty string if neither is available.
+func containerMarker(root string) (string, error) {
+	marker, err := readMarkerFile(root, "run/systemd/container")
+	if err != nil || marker != "" {
+		return marker, err
+	}
+	environ, err := readMarkerFile(root, "proc/1/environ")
+	if err != nil {
+		return "", err
+	}
+	for _, kv := range strings.Split(environ, "\x00") {
+		if strings.HasPrefix(kv, "container=") {
+			return strings.TrimPrefix(kv, "container="), nil
+		}
+	}
+	return "", nil
+}
+
+// readMarkerFile returns the trimmed contents of the file at the
+// given path relative to root, or an empty string if the file
+// does not exist or cannot be read by us.
+func readMarkerFile(root, path string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, path))
+	if os.IsNotExist(err) || os.IsPermission(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return string(bytes.TrimSpace(data)), nil
+}
+
+// runningInsideLXC reports whether the cgroups of the init process
+// found relative to the given root show that it is running in an
+// LXC container: either one of its cgroup paths is inside an lxc
+// directory, or the cgroup filesystem is mounted at a cgroup other
+// than the root one, as it is when LXC gives the container a cgroup
+// namespace. Other cgroup paths, such as the /init.scope in which
+// systemd places the init process, say nothing about containers.
+func runningInsideLXC(root string) (bool, error) {
+	file, err := os.Open(filepath.Join(root, "proc/1/cgroup"))
 	if err != nil {
 		return false, errors.Trace(err)
 	}
@@ -25,14 +113,129 @@ func runningInsideLXC() (bool, error) {
 		if len(fields) != 3 {
 			return false, errors.Errorf("malformed cgroup file")
 		}
-		if fields[2] != "/" {
-			// When running in a container the anchor point will be
-			// something other than "/".
+		if isLXCPath(fields[2]) {
 			return true, nil
 		}
 	}
 	if err := scanner.Err(); err != nil {
 		return false, errors.Annotate(err, "failed to read cgroup file")
 	}
-	return false, nil
+	return insideCgroupNamespace(root)
+}
+
+// isLXCPath reports whether the given cgroup path
+// is inside a cgroup created by LXC for a container.
+func isLXCPath(path string) bool {
+	for _, dir := range strings.Split(path, "/") {
+		if dir == "lxc" || strings.HasPrefix(dir, "lxc.payload") {
+			return true
+		}
+	}
+	return false
+}
+
+// insideCgroupNamespace reports whether the unified cgroup hierarchy
+// found relative to the given root is mounted at a cgroup other than
+// the root one. Only non-root cgroups have a cgroup.type file, so its
+// presence under /sys/fs/cgroup shows that the hierarchy we see has
+// been delegated to us by a container manager.
+func insideCgroupNamespace(root string) (bool, error) {
+	_, err := os.Stat(filepath.Join(root, "sys/fs/cgroup/cgroup.controllers"))
+	if os.IsNotExist(err) {
+		// Not the unified hierarchy.
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	_, err = os.Stat(filepath.Join(root, "sys/fs/cgroup/cgroup.type"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	return true, nil
+}
+
+// containerNestingDepth returns the number of LXC containers the init
+// process found relative to the given root is running inside. Each
+// level of nesting adds an lxc directory to the init process's cgroup
+// paths. When the cgroup paths are hidden from the container, the
+// container marker still tells us that there is at least one.
+func containerNestingDepth(root string) (int, error) {
+	cgroups, err := readMarkerFile(root, "proc/1/cgroup")
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	depth := 0
+	for _, path := range cgroupPaths(cgroups) {
+		n := 0
+		for _, dir := range strings.Split(path, "/") {
+			if dir == "lxc" {
+				n++
+			}
+		}
+		if n > depth {
+			depth = n
+		}
+	}
+	if depth > 0 {
+		return depth, nil
+	}
+	marker, err := containerMarker(root)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if strings.HasPrefix(marker, "lxc") {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// cgroupPaths returns the paths found in the given contents
+// of a cgroup file, skipping any lines that are malformed.
+func cgroupPaths(cgroups string) []string {
+	var paths []string
+	for _, line := range strings.Split(cgroups, "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) == 3 {
+			paths = append(paths, fields[2])
+		}
+	}
+	return paths
+}
+
+// containerName returns the name of the innermost LXC container
+// the init process found relative to the given root is running
+// inside. The name follows the last lxc directory in the init
+// process's cgroup paths; when those are hidden from the container,
+// the host name, which LXC sets to the container name, is used.
+func containerName(root string) (string, error) {
+	cgroups, err := readMarkerFile(root, "proc/1/cgroup")
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	for _, path := range cgroupPaths(cgroups) {
+		dirs := strings.Split(path, "/")
+		for i := len(dirs) - 2; i >= 0; i-- {
+			if dirs[i] == "lxc" && dirs[i+1] != "" {
+				return dirs[i+1], nil
+			}
+		}
+	}
+	marker, err := containerMarker(root)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if strings.HasPrefix(marker, "lxc") {
+		hostname, err := readMarkerFile(root, "etc/hostname")
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if hostname != "" {
+			return hostname, nil
+		}
+	}
+	return "", errors.NotFoundf("container")
 }
@@ -5,6 +5,16 @@
 
 package lxcutils
 
-func runningInsideLXC() (bool, error) {
-	return false, nil
+import "github.com/juju/errors"
+
+func runningInsideContainer(root string) (ContainerType, error) {
+	return NoContainer, nil
+}
+
+func containerNestingDepth(root string) (int, error) {
+	return 0, nil
+}
+
+func containerName(root string) (string, error) {
+	return "", errors.NotFoundf("container")
 }
@@ -410,6 +410,12 @@ func (inst *openstackInstance) Status() string {
 	return inst.getServerDetail().Status
 }
 
+// DisplayName returns the name of the server, as shown
+// in the OpenStack dashboard.
+func (inst *openstackInstance) DisplayName() string {
+	return inst.getServerDetail().Name
+}
+
 func (inst *openstackInstance) hardwareCharacteristics() *instance.HardwareCharacteristics {
 	hc := &instance.HardwareCharacteristics{Arch: inst.arch}
 	if inst.instType != nil {
@@ -4,14 +4,19 @@
 package state
 
 import (
+	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/juju/errors"
 	"github.com/juju/names"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 
+	"github.com/juju/juju/instance"
 	"github.com/juju/juju/network"
 	"github.com/juju/juju/state/multiwatcher"
 	"github.com/juju/juju/state/watcher"
@@ -22,6 +27,7 @@ import (
 type allWatcherStateBacking struct {
 	st               *State
 	collectionByName map[string]allWatcherStateCollection
+	watches          backingWatches
 }
 
 // allEnvWatcherStateBacking implements Backing by fetching entities
@@ -30,6 +36,43 @@ type allEnvWatcherStateBacking struct {
 	st               *State
 	stPool           *StatePool
 	collectionByName map[string]allWatcherStateCollection
+	watches          backingWatches
+}
+
+// backingWatches records the channels that a backing is watching
+// the collections with, so that unwatching a channel that is not
+// being watched, as can happen when a backing is torn down twice,
+// does nothing rather than upsetting the state watcher.
+type backingWatches struct {
+	mu    sync.Mutex
+	chans map[chan<- watcher.Change]bool
+}
+
+// add records that ch is being watched. It reports
+// whether ch was not already being watched.
+func (w *backingWatches) add(ch chan<- watcher.Change) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.chans[ch] {
+		return false
+	}
+	if w.chans == nil {
+		w.chans = make(map[chan<- watcher.Change]bool)
+	}
+	w.chans[ch] = true
+	return true
+}
+
+// remove records that ch is no longer being watched.
+// It reports whether ch was being watched.
+func (w *backingWatches) remove(ch chan<- watcher.Change) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.chans[ch] {
+		return false
+	}
+	delete(w.chans, ch)
+	return true
 }
 
 // allWatcherStateCollection holds information about a
@@ -40,6 +83,10 @@ type allWatcherStateCollection struct {
 	// name stores the name of the collection.
 	name string
 
+	// kind holds the kind of entity held in the collection.
+	// It is empty for a subsidiary collection.
+	kind string
+
 	// docType stores the type of document
 	// that we use for this collection.
 	docType reflect.Type
@@ -49,62 +96,145 @@ type allWatcherStateCollection struct {
 	subsidiary bool
 }
 
+// allWatcherCollections holds the collections that can be watched
+// by an allWatcher, indexed by name. See registerAllWatcherCollection.
+var allWatcherCollections = make(map[string]allWatcherStateCollection)
+
+func init() {
+	registerAllWatcherCollection(environmentsC, "environment", backingEnvironment{})
+	registerAllWatcherCollection(machinesC, "machine", backingMachine{})
+	registerAllWatcherCollection(unitsC, "unit", backingUnit{})
+	registerAllWatcherCollection(servicesC, "service", backingService{})
+	registerAllWatcherCollection(actionsC, "action", backingAction{})
+	registerAllWatcherCollection(relationsC, "relation", backingRelation{})
+	registerAllWatcherCollection(annotationsC, "annotation", backingAnnotation{})
+	registerAllWatcherCollection(blocksC, "block", backingBlock{})
+	registerAllWatcherCollection(networksC, "network", backingNetwork{})
+	registerAllWatcherCollection(volumesC, "volume", backingVolume{})
+	registerAllWatcherCollection(statusesC, "", backingStatus{})
+	registerAllWatcherCollection(constraintsC, "", backingConstraints{})
+	registerAllWatcherCollection(settingsC, "", backingSettings{})
+	registerAllWatcherCollection(openedPortsC, "", backingOpenedPorts{})
+	registerAllWatcherCollection(instanceDataC, "", backingInstanceData{})
+	registerAllWatcherCollection(leasesC, "", backingLease{})
+	registerAllWatcherCollection(volumeAttachmentsC, "", backingVolumeAttachment{})
+}
+
+// allWatcherCollectionNames holds the names of the collections
+// watched by the backing for a single environment, and
+// allEnvWatcherCollectionNames those watched by the backing for all
+// environments. A collection registered with
+// registerAllWatcherCollection is watched by a backing only once its
+// name has been added to the backing's list.
+var (
+	allWatcherCollectionNames = []string{
+		machinesC,
+		unitsC,
+		servicesC,
+		relationsC,
+		annotationsC,
+		statusesC,
+		constraintsC,
+		settingsC,
+		openedPortsC,
+		instanceDataC,
+		leasesC,
+		actionsC,
+		blocksC,
+		networksC,
+		volumesC,
+		volumeAttachmentsC,
+	}
+	allEnvWatcherCollectionNames = []string{
+		environmentsC,
+		machinesC,
+		unitsC,
+		servicesC,
+		relationsC,
+		annotationsC,
+		statusesC,
+		constraintsC,
+		settingsC,
+		openedPortsC,
+		instanceDataC,
+		leasesC,
+		networksC,
+		volumesC,
+		volumeAttachmentsC,
+	}
+)
+
+var backingEntityDocType = reflect.TypeOf((*backingEntityDoc)(nil)).Elem()
+
+// registerAllWatcherCollection registers the named collection so
+// that it can be watched by an allWatcher. The documents in the
+// collection are read into values of the type of doc, a pointer to
+// which must implement backingEntityDoc, and held as entities of the
+// given kind. If kind is empty, the collection is subsidiary: it is
+// used only to modify primary entities. It is intended to be called
+// from init functions; it panics if the collection name, document type
+// or entity kind has already been registered.
+func registerAllWatcherCollection(name, kind string, doc interface{}) {
+	docType := reflect.TypeOf(doc)
+	if !reflect.PtrTo(docType).Implements(backingEntityDocType) {
+		panic(errors.Errorf("collection %q has invalid document type %s", name, docType))
+	}
+	if _, ok := allWatcherCollections[name]; ok {
+		panic(errors.Errorf("duplicate collection name %q", name))
+	}
+	for _, collection := range allWatcherCollections {
+		if collection.docType == docType {
+			panic(errors.Errorf("duplicate collection type %s", docType))
+		}
+	}
+	collection := allWatcherStateCollection{
+		name:       name,
+		kind:       kind,
+		docType:    docType,
+		subsidiary: kind == "",
+	}
+	if err := checkCollectionKind(allWatcherCollections, collection); err != nil {
+		panic(err)
+	}
+	allWatcherCollections[name] = collection
+}
+
 // makeAllWatcherCollectionInfo returns a name indexed map of
 // allWatcherStateCollection instances for the collections specified.
 func makeAllWatcherCollectionInfo(collNames ...string) map[string]allWatcherStateCollection {
-	seenTypes := make(map[reflect.Type]struct{})
 	collectionByName := make(map[string]allWatcherStateCollection)
-
 	for _, collName := range collNames {
-		collection := allWatcherStateCollection{name: collName}
-		switch collName {
-		case environmentsC:
-			collection.docType = reflect.TypeOf(backingEnvironment{})
-		case machinesC:
-			collection.docType = reflect.TypeOf(backingMachine{})
-		case unitsC:
-			collection.docType = reflect.TypeOf(backingUnit{})
-		case servicesC:
-			collection.docType = reflect.TypeOf(backingService{})
-		case actionsC:
-			collection.docType = reflect.TypeOf(backingAction{})
-		case relationsC:
-			collection.docType = reflect.TypeOf(backingRelation{})
-		case annotationsC:
-			collection.docType = reflect.TypeOf(backingAnnotation{})
-		case blocksC:
-			collection.docType = reflect.TypeOf(backingBlock{})
-		case statusesC:
-			collection.docType = reflect.TypeOf(backingStatus{})
-			collection.subsidiary = true
-		case constraintsC:
-			collection.docType = reflect.TypeOf(backingConstraints{})
-			collection.subsidiary = true
-		case settingsC:
-			collection.docType = reflect.TypeOf(backingSettings{})
-			collection.subsidiary = true
-		case openedPortsC:
-			collection.docType = reflect.TypeOf(backingOpenedPorts{})
-			collection.subsidiary = true
-		default:
+		collection, ok := allWatcherCollections[collName]
+		if !ok {
 			panic(errors.Errorf("unknown collection %q", collName))
 		}
-
-		docType := collection.docType
-		if _, ok := seenTypes[docType]; ok {
-			panic(errors.Errorf("duplicate collection type %s", docType))
-		}
-		seenTypes[docType] = struct{}{}
-
 		if _, ok := collectionByName[collName]; ok {
 			panic(errors.Errorf("duplicate collection name %q", collName))
 		}
+		if err := checkCollectionKind(collectionByName, collection); err != nil {
+			panic(err)
+		}
 		collectionByName[collName] = collection
 	}
-
 	return collectionByName
 }
 
+// checkCollectionKind returns an error if the entities in the given
+// collection are of the same kind as those in any of the collections
+// in byName, so that each kind of entity is held in a single
+// collection and entity ids can't collide.
+func checkCollectionKind(byName map[string]allWatcherStateCollection, collection allWatcherStateCollection) error {
+	if collection.kind == "" {
+		return nil
+	}
+	for _, other := range byName {
+		if other.kind == collection.kind && other.name != collection.name {
+			return errors.Errorf("collections %q and %q both hold %s entities", other.name, collection.name, collection.kind)
+		}
+	}
+	return nil
+}
+
 type backingEnvironment environmentDoc
 
 func (e *backingEnvironment) updated(st *State, store *multiwatcherStore, id string) error {
@@ -138,11 +268,13 @@ func (m *backingMachine) updated(st *State, store *multiwatcherStore, id string)
 		EnvUUID:                  st.EnvironUUID(),
 		Id:                       m.Id,
 		Life:                     multiwatcher.Life(m.Life.String()),
+		Nonce:                    m.Nonce,
 		Series:                   m.Series,
 		Jobs:                     paramsJobsFromJobs(m.Jobs),
 		Addresses:                mergedAddresses(m.MachineAddresses, m.Addresses),
 		SupportedContainers:      m.SupportedContainers,
 		SupportedContainersKnown: m.SupportedContainersKnown,
+		ContainerType:            m.containerType(),
 		HasVote:                  m.HasVote,
 		WantsVote:                wantsVote(m.Jobs, m.NoVote),
 		StatusData:               make(map[string]interface{}),
@@ -162,9 +294,18 @@ func (m *backingMachine) updated(st *State, store *multiwatcherStore, id string)
 		// The entry already exists, so preserve the current status and
 		// instance data.
 		oldInfo := oldInfo.(*multiwatcher.MachineInfo)
+		if onlyMachineAddressesChanged(oldInfo, info) {
+			// This is the common case when the instance poller
+			// sets the provider addresses, so merge them into the
+			// existing info rather than rebuilding it.
+			updateMachineAddresses(store, info.EnvUUID, info.Id, info.Addresses)
+			return nil
+		}
 		info.Status = oldInfo.Status
 		info.StatusInfo = oldInfo.StatusInfo
 		info.InstanceId = oldInfo.InstanceId
+		info.DisplayName = oldInfo.DisplayName
+		info.InstanceStatus = oldInfo.InstanceStatus
 		info.HardwareCharacteristics = oldInfo.HardwareCharacteristics
 	}
 	// If the machine is been provisioned, fetch the instance id as required,
@@ -173,6 +314,8 @@ func (m *backingMachine) updated(st *State, store *multiwatcherStore, id string)
 		instanceData, err := getInstanceData(st, m.Id)
 		if err == nil {
 			info.InstanceId = string(instanceData.InstanceId)
+			info.DisplayName = instanceData.DisplayName
+			info.InstanceStatus = instanceData.Status
 			info.HardwareCharacteristics = hardwareCharacteristics(instanceData)
 		} else if !errors.IsNotFound(err) {
 			return err
@@ -182,6 +325,19 @@ func (m *backingMachine) updated(st *State, store *multiwatcherStore, id string)
 	return nil
 }
 
+// containerType returns the type of container hosting the machine: the
+// type recorded when the container was added or, for a machine that was
+// not added as a container, the type its agent found it is running in.
+func (m *backingMachine) containerType() instance.ContainerType {
+	if m.ContainerType != "" {
+		return instance.ContainerType(m.ContainerType)
+	}
+	if ctype := instance.ContainerType(m.DetectedContainerType); ctype != instance.NONE {
+		return ctype
+	}
+	return ""
+}
+
 func (m *backingMachine) removed(store *multiwatcherStore, envUUID, id string, _ *State) error {
 	store.Remove(multiwatcher.EntityId{
 		Kind:    "machine",
@@ -195,6 +351,46 @@ func (m *backingMachine) mongoId() string {
 	return m.DocID
 }
 
+// onlyMachineAddressesChanged reports whether the machine information
+// read from the machine document in newInfo differs from that held
+// in oldInfo in its addresses alone. It reports false if the instance
+// data of a provisioned machine has yet to be fetched.
+func onlyMachineAddressesChanged(oldInfo, newInfo *multiwatcher.MachineInfo) bool {
+	if newInfo.Nonce != "" && oldInfo.InstanceId == "" {
+		return false
+	}
+	return oldInfo.Life == newInfo.Life &&
+		oldInfo.Nonce == newInfo.Nonce &&
+		oldInfo.Series == newInfo.Series &&
+		reflect.DeepEqual(oldInfo.Jobs, newInfo.Jobs) &&
+		reflect.DeepEqual(oldInfo.SupportedContainers, newInfo.SupportedContainers) &&
+		oldInfo.SupportedContainersKnown == newInfo.SupportedContainersKnown &&
+		oldInfo.ContainerType == newInfo.ContainerType &&
+		oldInfo.HasVote == newInfo.HasVote &&
+		oldInfo.WantsVote == newInfo.WantsVote
+}
+
+// updateMachineAddresses sets the addresses of the given machine in
+// the store, keeping the rest of the information held on it. It does
+// nothing if the machine is not in the store or already has those
+// addresses, so that only a change of addresses is sent to watchers.
+// Watchers using partial deltas see a delta holding only the
+// addresses; see Multiwatcher.SetPartialDeltas.
+func updateMachineAddresses(store *multiwatcherStore, envUUID, id string, addresses []network.Address) {
+	info0 := store.Get(multiwatcher.EntityId{
+		Kind:    "machine",
+		EnvUUID: envUUID,
+		Id:      id,
+	})
+	info, ok := info0.(*multiwatcher.MachineInfo)
+	if !ok || reflect.DeepEqual(info.Addresses, addresses) {
+		return
+	}
+	newInfo := *info
+	newInfo.Addresses = append([]network.Address(nil), addresses...)
+	store.Update(&newInfo)
+}
+
 type backingUnit unitDoc
 
 func getUnitPortRangesAndPorts(st *State, unitName string) ([]network.PortRange, []network.Port, error) {
@@ -260,12 +456,14 @@ func (u *backingUnit) updated(st *State, store *multiwatcherStore, id string) er
 		Series:      u.Series,
 		MachineId:   u.MachineId,
 		Subordinate: u.Principal != "",
+		Life:        multiwatcher.Life(u.Life.String()),
 		StatusData:  make(map[string]interface{}),
 	}
 	if u.CharmURL != nil {
 		info.CharmURL = u.CharmURL.String()
 	}
 	oldInfo := store.Get(info.EntityId())
+	versionChanged := oldInfo == nil
 	if oldInfo == nil {
 		logger.Debugf("new unit %q added to backing state", u.Name)
 		// We're adding the entry for the first time,
@@ -314,6 +512,12 @@ func (u *backingUnit) updated(st *State, store *multiwatcherStore, id string) er
 		info.PortRanges = portRanges
 		info.Ports = compatiblePorts
 
+		leader, err := serviceLeader(st, u.Service)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		info.Leader = leader == u.Name
+
 	} else {
 		// The entry already exists, so preserve the current status and ports.
 		oldInfo := oldInfo.(*multiwatcher.UnitInfo)
@@ -325,7 +529,10 @@ func (u *backingUnit) updated(st *State, store *multiwatcherStore, id string) er
 		info.WorkloadStatus = oldInfo.WorkloadStatus
 		info.Ports = oldInfo.Ports
 		info.PortRanges = oldInfo.PortRanges
+		info.Leader = oldInfo.Leader
+		versionChanged = oldInfo.WorkloadStatus.Version != u.WorkloadVersion
 	}
+	info.WorkloadStatus.Version = u.WorkloadVersion
 	publicAddress, privateAddress, err := getUnitAddresses(st, u.Name)
 	if err != nil {
 		return err
@@ -333,6 +540,9 @@ func (u *backingUnit) updated(st *State, store *multiwatcherStore, id string) er
 	info.PublicAddress = publicAddress
 	info.PrivateAddress = privateAddress
 	store.Update(info)
+	if versionChanged {
+		updateServiceWorkloadVersion(store, info.EnvUUID, info.Service)
+	}
 	return nil
 }
 
@@ -359,14 +569,63 @@ func getUnitAddresses(st *State, unitName string) (string, string, error) {
 }
 
 func (u *backingUnit) removed(store *multiwatcherStore, envUUID, id string, _ *State) error {
-	store.Remove(multiwatcher.EntityId{
+	eid := multiwatcher.EntityId{
 		Kind:    "unit",
 		EnvUUID: envUUID,
 		Id:      id,
-	})
+	}
+	info, _ := store.Get(eid).(*multiwatcher.UnitInfo)
+	store.Remove(eid)
+	if info != nil && info.WorkloadStatus.Version != "" {
+		updateServiceWorkloadVersion(store, envUUID, info.Service)
+	}
 	return nil
 }
 
+// serviceWorkloadVersion returns the workload version of the named
+// service, as aggregated from the versions reported by its units in
+// the store: it is the version reported by the most units, with ties
+// broken in favour of the lexically smallest version. Units that
+// have not reported a version are ignored. The store keeps count of
+// the versions reported by each service's units as they change, so
+// this does not need to visit the units.
+func serviceWorkloadVersion(store *multiwatcherStore, envUUID, serviceName string) string {
+	counts := store.workloadVersions[multiwatcher.EntityId{
+		Kind:    "service",
+		EnvUUID: envUUID,
+		Id:      serviceName,
+	}]
+	var best string
+	bestCount := 0
+	for version, count := range counts {
+		if count > bestCount || count == bestCount && version < best {
+			best, bestCount = version, count
+		}
+	}
+	return best
+}
+
+// updateServiceWorkloadVersion recalculates the workload version
+// of the named service and updates the service in the store
+// if it has changed.
+func updateServiceWorkloadVersion(store *multiwatcherStore, envUUID, serviceName string) {
+	eid := (&multiwatcher.ServiceInfo{
+		EnvUUID: envUUID,
+		Name:    serviceName,
+	}).EntityId()
+	info, ok := store.Get(eid).(*multiwatcher.ServiceInfo)
+	if !ok {
+		return
+	}
+	version := serviceWorkloadVersion(store, envUUID, serviceName)
+	if version == info.WorkloadVersion {
+		return
+	}
+	newInfo := *info
+	newInfo.WorkloadVersion = version
+	store.Update(&newInfo)
+}
+
 func (u *backingUnit) mongoId() string {
 	return u.DocID
 }
@@ -403,12 +662,17 @@ func (svc *backingService) updated(st *State, store *multiwatcherStore, id strin
 			return errors.Trace(err)
 		}
 		info.Constraints = c
+		info.WorkloadVersion = serviceWorkloadVersion(store, info.EnvUUID, svc.Name)
 		needConfig = true
-		// Fetch the status.
 		service, err := st.Service(svc.Name)
 		if err != nil {
 			return errors.Trace(err)
 		}
+		info.Endpoints, err = serviceEndpoints(service)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		// Fetch the status.
 		serviceStatus, err := service.Status()
 		if err != nil {
 			logger.Warningf("reading service status for key %s: %v", key, err)
@@ -440,14 +704,25 @@ func (svc *backingService) updated(st *State, store *multiwatcherStore, id strin
 		// The entry already exists, so preserve the current status.
 		oldInfo := oldInfo.(*multiwatcher.ServiceInfo)
 		info.Constraints = oldInfo.Constraints
+		info.WorkloadVersion = oldInfo.WorkloadVersion
 		if info.CharmURL == oldInfo.CharmURL {
 			// The charm URL remains the same - we can continue to
-			// use the same config settings.
+			// use the same config settings and endpoints.
 			info.Config = oldInfo.Config
+			info.Endpoints = oldInfo.Endpoints
 		} else {
 			// The charm URL has changed - we need to fetch the
-			// settings from the new charm's settings doc.
+			// settings from the new charm's settings doc, and
+			// the endpoints from the new charm.
 			needConfig = true
+			service, err := st.Service(svc.Name)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			info.Endpoints, err = serviceEndpoints(service)
+			if err != nil {
+				return errors.Trace(err)
+			}
 		}
 	}
 	if needConfig {
@@ -461,6 +736,23 @@ func (svc *backingService) updated(st *State, store *multiwatcherStore, id strin
 	return nil
 }
 
+// serviceEndpoints returns the relation endpoints
+// of the given service's charm.
+func serviceEndpoints(service *Service) ([]multiwatcher.Endpoint, error) {
+	eps, err := service.Endpoints()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	result := make([]multiwatcher.Endpoint, len(eps))
+	for i, ep := range eps {
+		result[i] = multiwatcher.Endpoint{
+			ServiceName: ep.ServiceName,
+			Relation:    ep.Relation,
+		}
+	}
+	return result, nil
+}
+
 func (svc *backingService) removed(store *multiwatcherStore, envUUID, id string, _ *State) error {
 	store.Remove(multiwatcher.EntityId{
 		Kind:    "service",
@@ -519,8 +811,13 @@ func (a *backingAction) updated(st *State, store *multiwatcherStore, id string)
 type backingRelation relationDoc
 
 func (r *backingRelation) updated(st *State, store *multiwatcherStore, id string) error {
-	eps := make([]multiwatcher.Endpoint, len(r.Endpoints))
-	for i, ep := range r.Endpoints {
+	// Report the endpoints in the same order as they
+	// appear in the relation key.
+	sorted := make(epSlice, len(r.Endpoints))
+	copy(sorted, r.Endpoints)
+	sort.Sort(sorted)
+	eps := make([]multiwatcher.Endpoint, len(sorted))
+	for i, ep := range sorted {
 		eps[i] = multiwatcher.Endpoint{
 			ServiceName: ep.ServiceName,
 			Relation:    ep.Relation,
@@ -605,6 +902,151 @@ func (a *backingBlock) mongoId() string {
 	return a.DocID
 }
 
+type backingNetwork networkDoc
+
+func (n *backingNetwork) updated(st *State, store *multiwatcherStore, id string) error {
+	store.Update(&multiwatcher.NetworkInfo{
+		EnvUUID:    st.EnvironUUID(),
+		Name:       n.Name,
+		ProviderId: n.ProviderId,
+		CIDR:       n.CIDR,
+		VLANTag:    n.VLANTag,
+	})
+	return nil
+}
+
+func (n *backingNetwork) removed(store *multiwatcherStore, envUUID, id string, _ *State) error {
+	store.Remove(multiwatcher.EntityId{
+		Kind:    "network",
+		EnvUUID: envUUID,
+		Id:      id,
+	})
+	return nil
+}
+
+func (n *backingNetwork) mongoId() string {
+	return n.DocID
+}
+
+type backingVolume volumeDoc
+
+func (v *backingVolume) updated(st *State, store *multiwatcherStore, id string) error {
+	info := &multiwatcher.VolumeInfo{
+		EnvUUID: st.EnvironUUID(),
+		Name:    v.Name,
+		Life:    multiwatcher.Life(v.Life.String()),
+	}
+	if v.Info != nil {
+		info.Size = v.Info.Size
+		info.Pool = v.Info.Pool
+		info.VolumeId = v.Info.VolumeId
+	} else if v.Params != nil {
+		info.Size = v.Params.Size
+		info.Pool = v.Params.Pool
+	}
+	oldInfo := store.Get(info.EntityId())
+	if oldInfo == nil {
+		// We're adding the entry for the first time,
+		// so fetch the associated status and attachments.
+		volumeStatus, err := getStatus(st, volumeGlobalKey(v.Name), "volume")
+		if err != nil && !errors.IsNotFound(err) {
+			return errors.Trace(err)
+		}
+		if err == nil {
+			info.Status = multiwatcher.StatusInfo{
+				Current: multiwatcher.Status(volumeStatus.Status),
+				Message: volumeStatus.Message,
+				Data:    normaliseStatusData(volumeStatus.Data),
+				Since:   volumeStatus.Since,
+			}
+		}
+		attachments, err := st.VolumeAttachments(names.NewVolumeTag(v.Name))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, a := range attachments {
+			info.MachineIds = append(info.MachineIds, a.Machine().Id())
+		}
+		sort.Strings(info.MachineIds)
+	} else {
+		// The entry already exists, so preserve the current
+		// status and attachments.
+		oldInfo := oldInfo.(*multiwatcher.VolumeInfo)
+		info.Status = oldInfo.Status
+		info.MachineIds = oldInfo.MachineIds
+	}
+	store.Update(info)
+	return nil
+}
+
+func (v *backingVolume) removed(store *multiwatcherStore, envUUID, id string, _ *State) error {
+	store.Remove(multiwatcher.EntityId{
+		Kind:    "volume",
+		EnvUUID: envUUID,
+		Id:      id,
+	})
+	return nil
+}
+
+func (v *backingVolume) mongoId() string {
+	return v.DocID
+}
+
+type backingVolumeAttachment volumeAttachmentDoc
+
+func (a *backingVolumeAttachment) updated(st *State, store *multiwatcherStore, id string) error {
+	return updateVolumeMachines(store, st.EnvironUUID(), a.Volume, func(machineIds []string) []string {
+		for _, machineId := range machineIds {
+			if machineId == a.Machine {
+				return machineIds
+			}
+		}
+		machineIds = append(machineIds, a.Machine)
+		sort.Strings(machineIds)
+		return machineIds
+	})
+}
+
+func (a *backingVolumeAttachment) removed(store *multiwatcherStore, envUUID, id string, _ *State) error {
+	machineTag, volumeTag, err := ParseVolumeAttachmentId(id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return updateVolumeMachines(store, envUUID, volumeTag.Id(), func(machineIds []string) []string {
+		var remaining []string
+		for _, machineId := range machineIds {
+			if machineId != machineTag.Id() {
+				remaining = append(remaining, machineId)
+			}
+		}
+		return remaining
+	})
+}
+
+func (a *backingVolumeAttachment) mongoId() string {
+	panic("cannot find mongo id from volume attachment document")
+}
+
+// updateVolumeMachines replaces the machine ids of the given volume in
+// the store with the result of calling update on a copy of them. It
+// does nothing if the volume is not in the store.
+func updateVolumeMachines(store *multiwatcherStore, envUUID, name string, update func([]string) []string) error {
+	info0 := store.Get(multiwatcher.EntityId{
+		Kind:    "volume",
+		EnvUUID: envUUID,
+		Id:      name,
+	})
+	info, ok := info0.(*multiwatcher.VolumeInfo)
+	if !ok {
+		// The volume doesn't exist. Ignore the attachment until it does.
+		return nil
+	}
+	newInfo := *info
+	newInfo.MachineIds = update(append([]string(nil), info.MachineIds...))
+	store.Update(&newInfo)
+	return nil
+}
+
 type backingStatus statusDoc
 
 func (s *backingStatus) updated(st *State, store *multiwatcherStore, id string) error {
@@ -636,6 +1078,13 @@ func (s *backingStatus) updated(st *State, store *multiwatcherStore, id string)
 		newInfo.Status.Data = normaliseStatusData(s.StatusData)
 		newInfo.Status.Since = unixNanoToTime(s.Updated)
 		info0 = &newInfo
+	case *multiwatcher.VolumeInfo:
+		newInfo := *info
+		newInfo.Status.Current = multiwatcher.Status(s.Status)
+		newInfo.Status.Message = s.StatusInfo
+		newInfo.Status.Data = normaliseStatusData(s.StatusData)
+		newInfo.Status.Since = unixNanoToTime(s.Updated)
+		info0 = &newInfo
 	case *multiwatcher.MachineInfo:
 		newInfo := *info
 		newInfo.Status = multiwatcher.Status(s.Status)
@@ -903,6 +1352,112 @@ func (p *backingOpenedPorts) mongoId() string {
 	panic("cannot find mongo id from openedPorts document")
 }
 
+type backingInstanceData instanceData
+
+func (d *backingInstanceData) updated(st *State, store *multiwatcherStore, id string) error {
+	parentID := (&multiwatcher.MachineInfo{
+		EnvUUID: st.EnvironUUID(),
+		Id:      d.MachineId,
+	}).EntityId()
+	switch info := store.Get(parentID).(type) {
+	case nil:
+		// The parent info doesn't exist. Ignore the instance data
+		// until it does.
+		return nil
+	case *multiwatcher.MachineInfo:
+		newInfo := *info
+		newInfo.DisplayName = d.DisplayName
+		newInfo.InstanceStatus = d.Status
+		store.Update(&newInfo)
+	}
+	return nil
+}
+
+func (d *backingInstanceData) removed(*multiwatcherStore, string, string, *State) error {
+	// Instance data is only removed along with its machine,
+	// so do nothing.
+	return nil
+}
+
+func (d *backingInstanceData) mongoId() string {
+	panic("cannot find mongo id from instanceData document")
+}
+
+// backingLease holds the fields of a lease document that are
+// needed to track service leadership.
+type backingLease struct {
+	DocID     string `bson:"_id"`
+	Type      string `bson:"type"`
+	Namespace string `bson:"namespace"`
+	Name      string `bson:"name"`
+	Holder    string `bson:"holder"`
+}
+
+func (l *backingLease) updated(st *State, store *multiwatcherStore, id string) error {
+	if l.Type != "lease" || l.Namespace != serviceLeadershipNamespace {
+		return nil
+	}
+	updateUnitLeaders(store, st.EnvironUUID(), l.Name, l.Holder)
+	return nil
+}
+
+func (l *backingLease) removed(store *multiwatcherStore, envUUID, id string, _ *State) error {
+	// Lease document ids have the form "<type>#<namespace>#<name>#".
+	parts := strings.Split(id, "#")
+	if len(parts) != 4 || parts[0] != "lease" || parts[1] != serviceLeadershipNamespace {
+		return nil
+	}
+	// The lease has expired, so the service has no leader
+	// until a unit claims it again.
+	updateUnitLeaders(store, envUUID, parts[2], "")
+	return nil
+}
+
+func (l *backingLease) mongoId() string {
+	panic("cannot find mongo id from lease document")
+}
+
+// serviceLeaderLeaseId returns the id of the lease document
+// recording the leader of the named service.
+func serviceLeaderLeaseId(serviceName string) string {
+	return fmt.Sprintf("lease#%s#%s#", serviceLeadershipNamespace, serviceName)
+}
+
+// serviceLeader returns the name of the unit currently holding
+// leadership of the named service, or the empty string if there
+// is no leader.
+func serviceLeader(st *State, serviceName string) (string, error) {
+	leases, closer := st.getCollection(leasesC)
+	defer closer()
+	var doc backingLease
+	err := leases.FindId(serviceLeaderLeaseId(serviceName)).One(&doc)
+	if err == mgo.ErrNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Annotatef(err, "cannot read leader of service %q", serviceName)
+	}
+	return doc.Holder, nil
+}
+
+// updateUnitLeaders updates the Leader field of the units of the
+// named service in the store so that only the given leader unit
+// is marked as leader.
+func updateUnitLeaders(store *multiwatcherStore, envUUID, serviceName, leader string) {
+	for _, info := range store.All() {
+		unit, ok := info.(*multiwatcher.UnitInfo)
+		if !ok || unit.EnvUUID != envUUID || unit.Service != serviceName {
+			continue
+		}
+		isLeader := unit.Name == leader
+		if unit.Leader == isLeader {
+			continue
+		}
+		newInfo := *unit
+		newInfo.Leader = isLeader
+		store.Update(&newInfo)
+	}
+}
+
 // updateUnitPorts updates the Ports and PortRanges info of the given unit.
 func updateUnitPorts(st *State, store *multiwatcherStore, u *Unit) error {
 	eid, ok := backingEntityIdForGlobalKey(st.EnvironUUID(), u.globalKey())
@@ -965,6 +1520,11 @@ func backingEntityIdForGlobalKey(envUUID, key string) (multiwatcher.EntityId, bo
 			EnvUUID: envUUID,
 			Name:    id,
 		}).EntityId(), true
+	case 'v':
+		return (&multiwatcher.VolumeInfo{
+			EnvUUID: envUUID,
+			Name:    id,
+		}).EntityId(), true
 	default:
 		return multiwatcher.EntityId{}, false
 	}
@@ -992,19 +1552,7 @@ type backingEntityDoc interface {
 }
 
 func newAllWatcherStateBacking(st *State) Backing {
-	collections := makeAllWatcherCollectionInfo(
-		machinesC,
-		unitsC,
-		servicesC,
-		relationsC,
-		annotationsC,
-		statusesC,
-		constraintsC,
-		settingsC,
-		openedPortsC,
-		actionsC,
-		blocksC,
-	)
+	collections := makeAllWatcherCollectionInfo(allWatcherCollectionNames...)
 	return &allWatcherStateBacking{
 		st:               st,
 		collectionByName: collections,
@@ -1016,15 +1564,23 @@ func (b *allWatcherStateBacking) filterEnv(docID interface{}) bool {
 	return err == nil
 }
 
-// Watch watches all the collections.
+// Watch watches all the collections. Watching a
+// channel that is already being watched does nothing.
 func (b *allWatcherStateBacking) Watch(in chan<- watcher.Change) {
+	if !b.watches.add(in) {
+		return
+	}
 	for _, c := range b.collectionByName {
 		b.st.watcher.WatchCollectionWithFilter(c.name, in, b.filterEnv)
 	}
 }
 
-// Unwatch unwatches all the collections.
+// Unwatch unwatches all the collections. Unwatching a
+// channel that is not being watched does nothing.
 func (b *allWatcherStateBacking) Unwatch(in chan<- watcher.Change) {
+	if !b.watches.remove(in) {
+		return
+	}
 	for _, c := range b.collectionByName {
 		b.st.watcher.UnwatchCollection(c.name, in)
 	}
@@ -1032,7 +1588,9 @@ func (b *allWatcherStateBacking) Unwatch(in chan<- watcher.Change) {
 
 // GetAll fetches all items that we want to watch from the state.
 func (b *allWatcherStateBacking) GetAll(all *multiwatcherStore) error {
-	err := loadAllWatcherEntities(b.st, b.collectionByName, all)
+	err := loadAllInto(all, func(fresh *multiwatcherStore) error {
+		return loadAllWatcherEntities(b.st, b.collectionByName, fresh)
+	})
 	return errors.Trace(err)
 }
 
@@ -1041,7 +1599,10 @@ func (b *allWatcherStateBacking) GetAll(all *multiwatcherStore) error {
 func (b *allWatcherStateBacking) Changed(all *multiwatcherStore, change watcher.Change) error {
 	c, ok := b.collectionByName[change.C]
 	if !ok {
-		return errors.Errorf("unknown collection %q in fetch request", change.C)
+		// There's no entity kind for the collection, so there's
+		// nothing to fetch; don't let that stop the watcher.
+		logger.Debugf("ignoring change in unknown collection %q", change.C)
+		return nil
 	}
 	col, closer := b.st.getCollection(c.name)
 	defer closer()
@@ -1049,8 +1610,6 @@ func (b *allWatcherStateBacking) Changed(all *multiwatcherStore, change watcher.
 
 	id := b.st.localID(change.Id.(string))
 
-	// TODO(rog) investigate ways that this can be made more efficient
-	// than simply fetching each entity in turn.
 	// TODO(rog) avoid fetching documents that we have no interest
 	// in, such as settings changes to entities we don't care about.
 	err := col.FindId(id).One(doc)
@@ -1064,6 +1623,80 @@ func (b *allWatcherStateBacking) Changed(all *multiwatcherStore, change watcher.
 	return doc.updated(b.st, all, id)
 }
 
+// ChangedMany implements manyChanger. The documents for each run
+// of changes to the same collection are fetched in a single query.
+func (b *allWatcherStateBacking) ChangedMany(all *multiwatcherStore, changes []watcher.Change) error {
+	for len(changes) > 0 {
+		n := collectionRun(changes)
+		var err error
+		if n == 1 {
+			err = b.Changed(all, changes[0])
+		} else {
+			err = b.changedRun(all, changes[:n])
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		changes = changes[n:]
+	}
+	return nil
+}
+
+// changedRun handles the given changes, which must
+// all be to the same collection.
+func (b *allWatcherStateBacking) changedRun(all *multiwatcherStore, changes []watcher.Change) error {
+	c, ok := b.collectionByName[changes[0].C]
+	if !ok {
+		logger.Debugf("ignoring change in unknown collection %q", changes[0].C)
+		return nil
+	}
+	col, closer := b.st.getCollection(c.name)
+	defer closer()
+
+	// The ids in the changes are the documents' _id fields, so
+	// they can be looked up without adding environment prefixes.
+	ids := make([]string, len(changes))
+	for i, change := range changes {
+		ids[i] = change.Id.(string)
+	}
+	docs := make(map[string]backingEntityDoc)
+	iter := col.Find(bson.D{{"_id", bson.D{{"$in", ids}}}}).Iter()
+	var raw bson.Raw
+	for iter.Next(&raw) {
+		var idDoc struct {
+			Id string `bson:"_id"`
+		}
+		if err := raw.Unmarshal(&idDoc); err != nil {
+			iter.Close()
+			return errors.Trace(err)
+		}
+		doc := reflect.New(c.docType).Interface().(backingEntityDoc)
+		if err := raw.Unmarshal(doc); err != nil {
+			iter.Close()
+			return errors.Trace(err)
+		}
+		docs[idDoc.Id] = doc
+	}
+	if err := iter.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	for _, docId := range ids {
+		id := b.st.localID(docId)
+		doc, ok := docs[docId]
+		if !ok {
+			doc = reflect.New(c.docType).Interface().(backingEntityDoc)
+			if err := doc.removed(all, b.st.EnvironUUID(), id, b.st); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+		if err := doc.updated(b.st, all, id); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
 // Release implements the Backing interface.
 func (b *allWatcherStateBacking) Release() error {
 	// allWatcherStateBacking doesn't need to release anything.
@@ -1071,18 +1704,7 @@ func (b *allWatcherStateBacking) Release() error {
 }
 
 func newAllEnvWatcherStateBacking(st *State) Backing {
-	collections := makeAllWatcherCollectionInfo(
-		environmentsC,
-		machinesC,
-		unitsC,
-		servicesC,
-		relationsC,
-		annotationsC,
-		statusesC,
-		constraintsC,
-		settingsC,
-		openedPortsC,
-	)
+	collections := makeAllWatcherCollectionInfo(allEnvWatcherCollectionNames...)
 	return &allEnvWatcherStateBacking{
 		st:               st,
 		stPool:           NewStatePool(st),
@@ -1090,15 +1712,23 @@ func newAllEnvWatcherStateBacking(st *State) Backing {
 	}
 }
 
-// Watch watches all the collections.
+// Watch watches all the collections. Watching a
+// channel that is already being watched does nothing.
 func (b *allEnvWatcherStateBacking) Watch(in chan<- watcher.Change) {
+	if !b.watches.add(in) {
+		return
+	}
 	for _, c := range b.collectionByName {
 		b.st.watcher.WatchCollection(c.name, in)
 	}
 }
 
-// Unwatch unwatches all the collections.
+// Unwatch unwatches all the collections. Unwatching a
+// channel that is not being watched does nothing.
 func (b *allEnvWatcherStateBacking) Unwatch(in chan<- watcher.Change) {
+	if !b.watches.remove(in) {
+		return
+	}
 	for _, c := range b.collectionByName {
 		b.st.watcher.UnwatchCollection(c.name, in)
 	}
@@ -1110,19 +1740,21 @@ func (b *allEnvWatcherStateBacking) GetAll(all *multiwatcherStore) error {
 	if err != nil {
 		return errors.Annotate(err, "error loading environments")
 	}
-	for _, env := range envs {
-		st, err := b.st.ForEnviron(env.EnvironTag())
-		if err != nil {
-			return errors.Trace(err)
-		}
-		defer st.Close()
+	return loadAllInto(all, func(fresh *multiwatcherStore) error {
+		for _, env := range envs {
+			st, err := b.st.ForEnviron(env.EnvironTag())
+			if err != nil {
+				return errors.Trace(err)
+			}
+			defer st.Close()
 
-		err = loadAllWatcherEntities(st, b.collectionByName, all)
-		if err != nil {
-			return errors.Annotatef(err, "error loading entities for environment %v", env.UUID())
+			err = loadAllWatcherEntities(st, b.collectionByName, fresh)
+			if err != nil {
+				return errors.Annotatef(err, "error loading entities for environment %v", env.UUID())
+			}
 		}
-	}
-	return nil
+		return nil
+	})
 }
 
 // Changed updates the allWatcher's idea of the current state
@@ -1130,7 +1762,9 @@ func (b *allEnvWatcherStateBacking) GetAll(all *multiwatcherStore) error {
 func (b *allEnvWatcherStateBacking) Changed(all *multiwatcherStore, change watcher.Change) error {
 	c, ok := b.collectionByName[change.C]
 	if !ok {
-		return errors.Errorf("unknown collection %q in fetch request", change.C)
+		// See allWatcherStateBacking.Changed.
+		logger.Debugf("ignoring change in unknown collection %q", change.C)
+		return nil
 	}
 
 	envUUID, id, err := b.idForChange(change)
@@ -1198,6 +1832,23 @@ func (b *allEnvWatcherStateBacking) Release() error {
 	return errors.Trace(err)
 }
 
+// loadAllInto calls load to load entities into a fresh store and,
+// only if that succeeds, adds them to all. This means that a
+// document that cannot be loaded does not leave all holding some
+// entities from before the failure and not others.
+func loadAllInto(all *multiwatcherStore, load func(fresh *multiwatcherStore) error) error {
+	fresh := newStore()
+	if err := load(fresh); err != nil {
+		return err
+	}
+	// Add the entities oldest first, so that they
+	// keep the order in which they were loaded.
+	for e := fresh.list.Back(); e != nil; e = e.Prev() {
+		all.Update(e.Value.(*entityEntry).info)
+	}
+	return nil
+}
+
 func loadAllWatcherEntities(st *State, collectionByName map[string]allWatcherStateCollection, all *multiwatcherStore) error {
 	// Use a single new MongoDB connection for all the work here.
 	db, closer := st.newDB()
@@ -5,6 +5,7 @@ package state
 
 import (
 	"fmt"
+	"reflect"
 	"sort"
 	"time"
 
@@ -15,12 +16,15 @@ import (
 	"github.com/juju/utils"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/mgo.v2/bson"
 
 	"github.com/juju/juju/constraints"
 	"github.com/juju/juju/instance"
 	"github.com/juju/juju/network"
 	"github.com/juju/juju/state/multiwatcher"
 	"github.com/juju/juju/state/watcher"
+	"github.com/juju/juju/storage/provider"
+	"github.com/juju/juju/storage/provider/registry"
 	"github.com/juju/juju/testing"
 )
 
@@ -36,6 +40,10 @@ var (
 	_ backingEntityDoc = (*backingOpenedPorts)(nil)
 	_ backingEntityDoc = (*backingAction)(nil)
 	_ backingEntityDoc = (*backingBlock)(nil)
+	_ backingEntityDoc = (*backingInstanceData)(nil)
+	_ backingEntityDoc = (*backingLease)(nil)
+	_ backingEntityDoc = (*backingVolume)(nil)
+	_ backingEntityDoc = (*backingVolumeAttachment)(nil)
 )
 
 var dottedConfig = `
@@ -62,7 +70,10 @@ func (s *allWatcherBaseSuite) newState(c *gc.C) *State {
 
 // setUpScenario adds some entities to the state so that
 // we can check that they all get pulled in by
-// all(Env)WatcherStateBacking.GetAll.
+// all(Env)WatcherStateBacking.GetAll. Tests outside the
+// state package should use the equivalent
+// state/testing.SetUpMultiwatcherScenario instead, which
+// cannot be imported here.
 func (s *allWatcherBaseSuite) setUpScenario(c *gc.C, st *State, units int) (entities entityInfoSlice) {
 	envUUID := st.EnvironUUID()
 	add := func(e multiwatcher.EntityInfo) {
@@ -76,23 +87,46 @@ func (s *allWatcherBaseSuite) setUpScenario(c *gc.C, st *State, units int) (enti
 	// TODO(dfc) instance.Id should take a TAG!
 	err = m.SetProvisioned(instance.Id("i-"+m.Tag().String()), "fake_nonce", nil)
 	c.Assert(err, jc.ErrorIsNil)
+	err = m.SetInstanceStatus("running")
+	c.Assert(err, jc.ErrorIsNil)
+	err = m.SetSupportedContainers([]instance.ContainerType{instance.LXC})
+	c.Assert(err, jc.ErrorIsNil)
 	hc, err := m.HardwareCharacteristics()
 	c.Assert(err, jc.ErrorIsNil)
 	err = m.SetProviderAddresses(network.NewAddress("example.com"))
 	c.Assert(err, jc.ErrorIsNil)
 	add(&multiwatcher.MachineInfo{
-		EnvUUID:                 envUUID,
-		Id:                      "0",
-		InstanceId:              "i-machine-0",
-		Status:                  multiwatcher.Status("pending"),
-		StatusData:              map[string]interface{}{},
-		Life:                    multiwatcher.Life("alive"),
-		Series:                  "quantal",
-		Jobs:                    []multiwatcher.MachineJob{JobHostUnits.ToParams()},
-		Addresses:               m.Addresses(),
-		HardwareCharacteristics: hc,
-		HasVote:                 true,
-		WantsVote:               false,
+		EnvUUID:                  envUUID,
+		Id:                       "0",
+		InstanceId:               "i-machine-0",
+		InstanceStatus:           "running",
+		Nonce:                    "fake_nonce",
+		Status:                   multiwatcher.Status("pending"),
+		StatusData:               map[string]interface{}{},
+		Life:                     multiwatcher.Life("alive"),
+		Series:                   "quantal",
+		Jobs:                     []multiwatcher.MachineJob{JobHostUnits.ToParams()},
+		Addresses:                m.Addresses(),
+		HardwareCharacteristics:  hc,
+		SupportedContainers:      []instance.ContainerType{instance.LXC},
+		SupportedContainersKnown: true,
+		HasVote:                  true,
+		WantsVote:                false,
+	})
+
+	_, err = st.AddNetwork(NetworkInfo{
+		Name:       "net1",
+		ProviderId: "provider-net1",
+		CIDR:       "0.1.2.0/24",
+		VLANTag:    42,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	add(&multiwatcher.NetworkInfo{
+		EnvUUID:    envUUID,
+		Name:       "net1",
+		ProviderId: "provider-net1",
+		CIDR:       "0.1.2.0/24",
+		VLANTag:    42,
 	})
 
 	wordpress := AddTestingService(c, st, "wordpress", AddTestingCharm(c, st, "wordpress"), s.owner)
@@ -119,6 +153,7 @@ func (s *allWatcherBaseSuite) setUpScenario(c *gc.C, st *State, units int) (enti
 			Message: "Waiting for agent initialization to finish",
 			Data:    map[string]interface{}{},
 		},
+		Endpoints: serviceEndpointInfos(c, wordpress),
 	})
 	pairs := map[string]string{"x": "12", "y": "99"}
 	err = st.SetAnnotations(wordpress, pairs)
@@ -143,6 +178,7 @@ func (s *allWatcherBaseSuite) setUpScenario(c *gc.C, st *State, units int) (enti
 			Message: "Waiting for agent initialization to finish",
 			Data:    map[string]interface{}{},
 		},
+		Endpoints: serviceEndpointInfos(c, logging),
 	})
 
 	eps, err := st.InferEndpoints("logging", "wordpress")
@@ -167,9 +203,10 @@ func (s *allWatcherBaseSuite) setUpScenario(c *gc.C, st *State, units int) (enti
 		c.Assert(err, jc.ErrorIsNil)
 		c.Assert(m.Tag().String(), gc.Equals, fmt.Sprintf("machine-%d", i+1))
 
-		add(&multiwatcher.UnitInfo{
+		unitInfo := &multiwatcher.UnitInfo{
 			EnvUUID:     envUUID,
 			Name:        fmt.Sprintf("wordpress/%d", i),
+			Life:        multiwatcher.Life("alive"),
 			Service:     wordpress.Name(),
 			Series:      m.Series(),
 			MachineId:   m.Id(),
@@ -187,7 +224,8 @@ func (s *allWatcherBaseSuite) setUpScenario(c *gc.C, st *State, units int) (enti
 				Message: "",
 				Data:    map[string]interface{}{},
 			},
-		})
+		}
+		add(unitInfo)
 		pairs := map[string]string{"name": fmt.Sprintf("bar %d", i)}
 		err = st.SetAnnotations(wu, pairs)
 		c.Assert(err, jc.ErrorIsNil)
@@ -203,10 +241,11 @@ func (s *allWatcherBaseSuite) setUpScenario(c *gc.C, st *State, units int) (enti
 		c.Assert(err, jc.ErrorIsNil)
 		hc, err := m.HardwareCharacteristics()
 		c.Assert(err, jc.ErrorIsNil)
-		add(&multiwatcher.MachineInfo{
+		machineInfo := &multiwatcher.MachineInfo{
 			EnvUUID:                 envUUID,
 			Id:                      fmt.Sprint(i + 1),
 			InstanceId:              "i-" + m.Tag().String(),
+			Nonce:                   "fake_nonce",
 			Status:                  multiwatcher.Status("error"),
 			StatusInfo:              m.Tag().String(),
 			StatusData:              map[string]interface{}{},
@@ -217,10 +256,30 @@ func (s *allWatcherBaseSuite) setUpScenario(c *gc.C, st *State, units int) (enti
 			HardwareCharacteristics: hc,
 			HasVote:                 false,
 			WantsVote:               false,
-		})
+		}
+		add(machineInfo)
 		err = wu.AssignToMachine(m)
 		c.Assert(err, jc.ErrorIsNil)
 
+		// Give the first unit addresses and an open port so that we
+		// can check they're reported for it and its subordinate.
+		var publicAddress, privateAddress string
+		if i == 0 {
+			publicAddress, privateAddress = "1.2.3.4", "4.3.2.1"
+			err = m.SetProviderAddresses(
+				network.NewScopedAddress(publicAddress, network.ScopePublic),
+				network.NewScopedAddress(privateAddress, network.ScopeCloudLocal),
+			)
+			c.Assert(err, jc.ErrorIsNil)
+			err = wu.OpenPorts("tcp", 12345, 12345)
+			c.Assert(err, jc.ErrorIsNil)
+			machineInfo.Addresses = m.Addresses()
+			unitInfo.PublicAddress = publicAddress
+			unitInfo.PrivateAddress = privateAddress
+			unitInfo.Ports = []network.Port{{"tcp", 12345}}
+			unitInfo.PortRanges = []network.PortRange{{12345, 12345, "tcp"}}
+		}
+
 		deployer, ok := wu.DeployerTag()
 		c.Assert(ok, jc.IsTrue)
 		c.Assert(deployer, gc.Equals, names.NewMachineTag(fmt.Sprintf("%d", i+1)))
@@ -240,14 +299,17 @@ func (s *allWatcherBaseSuite) setUpScenario(c *gc.C, st *State, units int) (enti
 		c.Assert(ok, jc.IsTrue)
 		c.Assert(deployer, gc.Equals, names.NewUnitTag(fmt.Sprintf("wordpress/%d", i)))
 		add(&multiwatcher.UnitInfo{
-			EnvUUID:     envUUID,
-			Name:        fmt.Sprintf("logging/%d", i),
-			Service:     "logging",
-			Series:      "quantal",
-			Ports:       []network.Port{},
-			Status:      multiwatcher.Status("pending"),
-			StatusData:  map[string]interface{}{},
-			Subordinate: true,
+			EnvUUID:        envUUID,
+			Name:           fmt.Sprintf("logging/%d", i),
+			Life:           multiwatcher.Life("alive"),
+			Service:        "logging",
+			Series:         "quantal",
+			PublicAddress:  publicAddress,
+			PrivateAddress: privateAddress,
+			Ports:          []network.Port{},
+			Status:         multiwatcher.Status("pending"),
+			StatusData:     map[string]interface{}{},
+			Subordinate:    true,
 			WorkloadStatus: multiwatcher.StatusInfo{
 				Current: "unknown",
 				Message: "Waiting for agent initialization to finish",
@@ -263,6 +325,128 @@ func (s *allWatcherBaseSuite) setUpScenario(c *gc.C, st *State, units int) (enti
 	return
 }
 
+var _ = gc.Suite(&allWatcherCollectionSuite{})
+
+type allWatcherCollectionSuite struct {
+	testing.BaseSuite
+}
+
+// widgetInfo and backingWidget implement an entity
+// kind unknown to the rest of the allWatcher.
+type widgetInfo struct {
+	EnvUUID string
+	Id      string
+}
+
+func (i *widgetInfo) EntityId() multiwatcher.EntityId {
+	return multiwatcher.EntityId{
+		Kind:    "widget",
+		EnvUUID: i.EnvUUID,
+		Id:      i.Id,
+	}
+}
+
+func (i *widgetInfo) EntityName() string {
+	return ""
+}
+
+func (i *widgetInfo) Clone() multiwatcher.EntityInfo {
+	c := *i
+	return &c
+}
+
+type backingWidget struct {
+	DocID   string `bson:"_id"`
+	EnvUUID string `bson:"env-uuid"`
+}
+
+func (w *backingWidget) updated(st *State, store *multiwatcherStore, id string) error {
+	store.Update(&widgetInfo{EnvUUID: w.EnvUUID, Id: id})
+	return nil
+}
+
+func (w *backingWidget) removed(store *multiwatcherStore, envUUID, id string, _ *State) error {
+	store.Remove(multiwatcher.EntityId{Kind: "widget", EnvUUID: envUUID, Id: id})
+	return nil
+}
+
+func (w *backingWidget) mongoId() string {
+	return w.DocID
+}
+
+func (s *allWatcherCollectionSuite) TestRegisterCollection(c *gc.C) {
+	collections := make(map[string]allWatcherStateCollection)
+	for name, collection := range allWatcherCollections {
+		collections[name] = collection
+	}
+	s.PatchValue(&allWatcherCollections, collections)
+
+	registerAllWatcherCollection("widgets", "widget", backingWidget{})
+	byName := makeAllWatcherCollectionInfo(machinesC, "widgets")
+	c.Assert(byName, gc.HasLen, 2)
+	c.Assert(byName[machinesC].docType, gc.Equals, reflect.TypeOf(backingMachine{}))
+	collection := byName["widgets"]
+	c.Assert(collection.name, gc.Equals, "widgets")
+	c.Assert(collection.kind, gc.Equals, "widget")
+	c.Assert(collection.subsidiary, jc.IsFalse)
+
+	// Documents are dispatched to the registered type.
+	all := newStore()
+	doc := reflect.New(collection.docType).Interface().(backingEntityDoc)
+	err := doc.updated(nil, all, "w1")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(all.All(), jc.DeepEquals, []multiwatcher.EntityInfo{&widgetInfo{Id: "w1"}})
+}
+
+func (s *allWatcherCollectionSuite) TestRegisterCollectionDuplicates(c *gc.C) {
+	c.Assert(func() {
+		registerAllWatcherCollection(machinesC, "widget", backingWidget{})
+	}, gc.PanicMatches, `duplicate collection name "machines"`)
+	c.Assert(func() {
+		registerAllWatcherCollection("widgets", "widget", backingMachine{})
+	}, gc.PanicMatches, `duplicate collection type state.backingMachine`)
+	c.Assert(func() {
+		registerAllWatcherCollection("widgets", "machine", backingWidget{})
+	}, gc.PanicMatches, `collections "machines" and "widgets" both hold machine entities`)
+	c.Assert(func() {
+		registerAllWatcherCollection("widgets", "widget", widgetInfo{})
+	}, gc.PanicMatches, `collection "widgets" has invalid document type state.widgetInfo`)
+	c.Assert(func() {
+		makeAllWatcherCollectionInfo("widgets")
+	}, gc.PanicMatches, `unknown collection "widgets"`)
+}
+
+func (s *allWatcherCollectionSuite) TestCollectionKindsAreUnique(c *gc.C) {
+	// Bypass the checks made on registration to make
+	// two collections that hold the same kind of entity.
+	collections := make(map[string]allWatcherStateCollection)
+	for name, collection := range allWatcherCollections {
+		collections[name] = collection
+	}
+	collections["widgets"] = allWatcherStateCollection{
+		name:    "widgets",
+		kind:    "machine",
+		docType: reflect.TypeOf(backingWidget{}),
+	}
+	s.PatchValue(&allWatcherCollections, collections)
+
+	c.Assert(func() {
+		makeAllWatcherCollectionInfo(machinesC, "widgets")
+	}, gc.PanicMatches, `collections "machines" and "widgets" both hold machine entities`)
+
+	// Subsidiary collections modify other
+	// entities, so there may be several.
+	byName := makeAllWatcherCollectionInfo(machinesC, statusesC, settingsC)
+	c.Assert(byName, gc.HasLen, 3)
+	for name, collection := range allWatcherCollections {
+		if collection.kind != "" {
+			c.Check(collection.subsidiary, jc.IsFalse, gc.Commentf("collection %q", name))
+		} else {
+			c.Check(collection.subsidiary, jc.IsTrue, gc.Commentf("collection %q", name))
+		}
+	}
+}
+
 var _ = gc.Suite(&allWatcherStateSuite{})
 
 type allWatcherStateSuite struct {
@@ -291,6 +475,300 @@ func (s *allWatcherStateSuite) TestGetAllMultiEnv(c *gc.C) {
 	s.checkGetAll(c, expectEntities)
 }
 
+func (s *allWatcherStateSuite) TestGetAllVolumes(c *gc.C) {
+	registry.RegisterEnvironStorageProviders("someprovider", provider.LoopProviderType)
+	m, err := s.state.AddOneMachine(MachineTemplate{
+		Series: "quantal",
+		Jobs:   []MachineJob{JobHostUnits},
+		Volumes: []MachineVolumeParams{{
+			Volume: VolumeParams{Pool: "loop", Size: 1024},
+		}},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	b := newAllWatcherStateBacking(s.state)
+	all := newStore()
+	err = b.GetAll(all)
+	c.Assert(err, jc.ErrorIsNil)
+
+	info := all.Get(multiwatcher.EntityId{
+		Kind:    "volume",
+		EnvUUID: s.state.EnvironUUID(),
+		Id:      m.Id() + "/0",
+	})
+	c.Assert(info, gc.NotNil)
+	volumeInfo := info.(*multiwatcher.VolumeInfo)
+	substNilSinceTimeForStatus(c, &volumeInfo.Status)
+	c.Assert(volumeInfo, jc.DeepEquals, &multiwatcher.VolumeInfo{
+		EnvUUID:    s.state.EnvironUUID(),
+		Name:       m.Id() + "/0",
+		Life:       multiwatcher.Life("alive"),
+		Size:       1024,
+		Pool:       "loop",
+		MachineIds: []string{m.Id()},
+		Status: multiwatcher.StatusInfo{
+			Current: multiwatcher.Status(StatusPending),
+		},
+	})
+}
+
+func (s *allWatcherStateSuite) TestGetAllRegisteredCollection(c *gc.C) {
+	collections := make(map[string]allWatcherStateCollection)
+	for name, collection := range allWatcherCollections {
+		collections[name] = collection
+	}
+	s.PatchValue(&allWatcherCollections, collections)
+	registerAllWatcherCollection("widgets", "widget", backingWidget{})
+	names := append([]string{"widgets"}, allWatcherCollectionNames...)
+	s.PatchValue(&allWatcherCollectionNames, names)
+
+	widgets, closer := s.state.getRawCollection("widgets")
+	defer closer()
+	docID := s.state.docID("w1")
+	err := widgets.Insert(&backingWidget{
+		DocID:   docID,
+		EnvUUID: s.state.EnvironUUID(),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	b := newAllWatcherStateBacking(s.state)
+	defer b.Release()
+	all := newStore()
+	err = b.GetAll(all)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(all.All(), jc.DeepEquals, []multiwatcher.EntityInfo{
+		&widgetInfo{EnvUUID: s.state.EnvironUUID(), Id: docID},
+	})
+}
+
+func (s *allWatcherStateSuite) TestGetAllMachineAgentStatus(c *gc.C) {
+	m, err := s.state.AddMachine("quantal", JobHostUnits)
+	c.Assert(err, jc.ErrorIsNil)
+	err = m.SetStatus(StatusStarted, "", nil)
+	c.Assert(err, jc.ErrorIsNil)
+
+	b := newAllWatcherStateBacking(s.state)
+	all := newStore()
+	err = b.GetAll(all)
+	c.Assert(err, jc.ErrorIsNil)
+	info := all.Get(multiwatcher.EntityId{
+		Kind:    "machine",
+		EnvUUID: s.state.EnvironUUID(),
+		Id:      m.Id(),
+	})
+	c.Assert(info, gc.NotNil)
+	machineInfo := info.(*multiwatcher.MachineInfo)
+	c.Assert(machineInfo.Status, gc.Equals, multiwatcher.Status("started"))
+	c.Assert(machineInfo.StatusInfo, gc.Equals, "")
+
+	// An error reported by the agent is seen along with its message.
+	err = m.SetStatus(StatusError, "failure", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	err = b.Changed(all, watcher.Change{
+		C:  statusesC,
+		Id: s.state.docID("m#" + m.Id()),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	machineInfo = all.Get(info.EntityId()).(*multiwatcher.MachineInfo)
+	c.Assert(machineInfo.Status, gc.Equals, multiwatcher.Status("error"))
+	c.Assert(machineInfo.StatusInfo, gc.Equals, "failure")
+}
+
+func (s *allWatcherStateSuite) TestGetAllMachineContainerType(c *gc.C) {
+	host, err := s.state.AddMachine("quantal", JobHostUnits)
+	c.Assert(err, jc.ErrorIsNil)
+	container, err := s.state.AddMachineInsideMachine(MachineTemplate{
+		Series: "quantal",
+		Jobs:   []MachineJob{JobHostUnits},
+	}, host.Id(), instance.LXC)
+	c.Assert(err, jc.ErrorIsNil)
+
+	b := newAllWatcherStateBacking(s.state)
+	all := newStore()
+	err = b.GetAll(all)
+	c.Assert(err, jc.ErrorIsNil)
+	getMachine := func(id string) *multiwatcher.MachineInfo {
+		info := all.Get(multiwatcher.EntityId{
+			Kind:    "machine",
+			EnvUUID: s.state.EnvironUUID(),
+			Id:      id,
+		})
+		c.Assert(info, gc.NotNil)
+		return info.(*multiwatcher.MachineInfo)
+	}
+	c.Assert(getMachine(host.Id()).ContainerType, gc.Equals, instance.ContainerType(""))
+	c.Assert(getMachine(container.Id()).ContainerType, gc.Equals, instance.LXC)
+
+	// A machine that was not added as a container shows the type
+	// of container its agent reports it is running inside.
+	changed := func(m *Machine) {
+		err := b.Changed(all, watcher.Change{
+			C:  machinesC,
+			Id: s.state.docID(m.Id()),
+		})
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	err = host.SetDetectedContainerType("lxd")
+	c.Assert(err, jc.ErrorIsNil)
+	changed(host)
+	c.Assert(getMachine(host.Id()).ContainerType, gc.Equals, instance.ContainerType("lxd"))
+	err = host.SetDetectedContainerType(instance.NONE)
+	c.Assert(err, jc.ErrorIsNil)
+	changed(host)
+	c.Assert(getMachine(host.Id()).ContainerType, gc.Equals, instance.ContainerType(""))
+
+	// The type recorded when a container was added is kept.
+	err = container.SetDetectedContainerType("lxd")
+	c.Assert(err, jc.ErrorIsNil)
+	changed(container)
+	c.Assert(getMachine(container.Id()).ContainerType, gc.Equals, instance.LXC)
+}
+
+func (s *allWatcherStateSuite) TestUnwatchTwice(c *gc.C) {
+	b := newAllWatcherStateBacking(s.state)
+	defer b.Release()
+	testUnwatchTwice(c, s.state, b)
+}
+
+// testUnwatchTwice checks that the given backing may be unwatched
+// when it is not watching, and more than once, without panicking.
+func testUnwatchTwice(c *gc.C, st *State, b Backing) {
+	in := make(chan watcher.Change)
+	b.Unwatch(in)
+	b.Watch(in)
+	b.Unwatch(in)
+	b.Unwatch(in)
+	// Make sure the state watcher has handled the requests.
+	st.StartSync()
+}
+
+func (s *allWatcherStateSuite) TestUpdateMachineAddresses(c *gc.C) {
+	all := newStore()
+	m0 := &multiwatcher.MachineInfo{
+		EnvUUID:   "uuid",
+		Id:        "0",
+		Series:    "trusty",
+		Jobs:      []multiwatcher.MachineJob{multiwatcher.JobHostUnits},
+		Addresses: network.NewAddresses("10.0.0.1"),
+	}
+	all.Update(m0)
+	revno := all.latestRevno
+
+	addresses := network.NewAddresses("10.0.0.1", "10.0.0.2")
+	updateMachineAddresses(all, "uuid", "0", addresses)
+	expect := &multiwatcher.MachineInfo{
+		EnvUUID:   "uuid",
+		Id:        "0",
+		Series:    "trusty",
+		Jobs:      []multiwatcher.MachineJob{multiwatcher.JobHostUnits},
+		Addresses: addresses,
+	}
+	changes := all.ChangesSince(revno)
+	c.Assert(changes, jc.DeepEquals, []multiwatcher.Delta{{Entity: expect}})
+
+	// Setting the same addresses, or the addresses of
+	// an unknown machine, changes nothing.
+	revno = all.latestRevno
+	updateMachineAddresses(all, "uuid", "0", addresses)
+	updateMachineAddresses(all, "uuid", "1", addresses)
+	c.Assert(all.latestRevno, gc.Equals, revno)
+	c.Assert(all.All(), jc.DeepEquals, []multiwatcher.EntityInfo{expect})
+}
+
+func (s *allWatcherStateSuite) TestChangeMachineAddresses(c *gc.C) {
+	m, err := s.state.AddMachine("trusty", JobHostUnits)
+	c.Assert(err, jc.ErrorIsNil)
+	err = m.SetStatus(StatusStarted, "", nil)
+	c.Assert(err, jc.ErrorIsNil)
+
+	b := newAllWatcherStateBacking(s.state)
+	all := newStore()
+	err = b.GetAll(all)
+	c.Assert(err, jc.ErrorIsNil)
+	id := multiwatcher.EntityId{
+		Kind:    "machine",
+		EnvUUID: s.state.EnvironUUID(),
+		Id:      m.Id(),
+	}
+	// Mark the info held on the machine, so we can see that
+	// the new addresses are merged into it rather than the
+	// info being rebuilt from the machine document.
+	oldInfo := *all.Get(id).(*multiwatcher.MachineInfo)
+	oldInfo.StatusData = map[string]interface{}{"held": true}
+	all.Update(&oldInfo)
+	revno := all.latestRevno
+
+	// When only the addresses change, the rest of the
+	// information held on the machine is kept, so a
+	// partial delta holds only the addresses.
+	addresses := network.NewAddresses("10.0.0.1", "10.0.0.2")
+	err = m.SetProviderAddresses(addresses...)
+	c.Assert(err, jc.ErrorIsNil)
+	err = b.Changed(all, watcher.Change{
+		C:  machinesC,
+		Id: s.state.docID(m.Id()),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	changes := all.ChangesSince(revno)
+	c.Assert(changes, gc.HasLen, 1)
+	newInfo := changes[0].Entity.(*multiwatcher.MachineInfo)
+	c.Assert(newInfo.Addresses, jc.DeepEquals, addresses)
+	c.Assert(newInfo.Status, gc.Equals, multiwatcher.Status("started"))
+	c.Assert(newInfo.Series, gc.Equals, "trusty")
+	c.Assert(newInfo.Jobs, jc.DeepEquals, []multiwatcher.MachineJob{multiwatcher.JobHostUnits})
+	c.Assert(newInfo.StatusData, jc.DeepEquals, map[string]interface{}{"held": true})
+	partial, ok := multiwatcher.PartialDelta(&oldInfo, newInfo)
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(partial.Fields, jc.DeepEquals, []string{"Addresses"})
+}
+
+func (s *allWatcherStateSuite) TestGetAllLeavesStoreUntouchedOnError(c *gc.C) {
+	_, err := s.state.AddMachine("quantal", JobHostUnits)
+	c.Assert(err, jc.ErrorIsNil)
+	// A service without a charm URL cannot be loaded.
+	services, closer := s.state.getRawCollection(servicesC)
+	defer closer()
+	err = services.Insert(bson.M{
+		"_id":      s.state.docID("bad"),
+		"name":     "bad",
+		"env-uuid": s.state.EnvironUUID(),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	all := newStore()
+	all.Update(&multiwatcher.MachineInfo{
+		EnvUUID: s.state.EnvironUUID(),
+		Id:      "99",
+	})
+	before := all.All()
+	revno := all.latestRevno
+
+	b := newAllWatcherStateBacking(s.state)
+	err = b.GetAll(all)
+	c.Assert(err, gc.ErrorMatches, `failed to initialise backing for services:.*bad: charm url is nil`)
+	c.Assert(all.All(), jc.DeepEquals, before)
+	c.Assert(all.latestRevno, gc.Equals, revno)
+}
+
+func (s *allWatcherStateSuite) TestLoadAllIntoKeepsLoadOrder(c *gc.C) {
+	m0 := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}
+	svc := &multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "wordpress"}
+	u0 := &multiwatcher.UnitInfo{EnvUUID: "uuid", Name: "wordpress/0", Service: "wordpress"}
+	all := newStore()
+	err := loadAllInto(all, func(fresh *multiwatcherStore) error {
+		fresh.Update(m0)
+		fresh.Update(svc)
+		fresh.Update(u0)
+		return nil
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(all.ChangesSince(0), jc.DeepEquals, []multiwatcher.Delta{
+		{Entity: m0},
+		{Entity: svc},
+		{Entity: u0},
+	})
+}
+
 func (s *allWatcherStateSuite) checkGetAll(c *gc.C, expectEntities entityInfoSlice) {
 	b := newAllWatcherStateBacking(s.state)
 	all := newStore()
@@ -308,6 +786,19 @@ func serviceCharmURL(svc *Service) *charm.URL {
 	return url
 }
 
+func serviceEndpointInfos(c *gc.C, svc *Service) []multiwatcher.Endpoint {
+	eps, err := svc.Endpoints()
+	c.Assert(err, jc.ErrorIsNil)
+	infos := make([]multiwatcher.Endpoint, len(eps))
+	for i, ep := range eps {
+		infos[i] = multiwatcher.Endpoint{
+			ServiceName: ep.ServiceName,
+			Relation:    ep.Relation,
+		}
+	}
+	return infos
+}
+
 func setServiceConfigAttr(c *gc.C, svc *Service, attr string, val interface{}) {
 	err := svc.UpdateConfigSettings(charm.Settings{attr: val})
 	c.Assert(err, jc.ErrorIsNil)
@@ -511,6 +1002,88 @@ func (s *allWatcherStateSuite) TestChangeBlocks(c *gc.C) {
 	s.performChangeTestCases(c, changeTestFuncs)
 }
 
+func (s *allWatcherStateSuite) TestChangeNetworks(c *gc.C) {
+	changeTestFuncs := []changeTestFunc{
+		func(c *gc.C, st *State) changeTestCase {
+			return changeTestCase{
+				about: "no network in state, no network in store -> do nothing",
+				change: watcher.Change{
+					C:  networksC,
+					Id: st.docID("net1"),
+				}}
+		},
+		func(c *gc.C, st *State) changeTestCase {
+			return changeTestCase{
+				about: "network is removed if it's not in backing",
+				initialContents: []multiwatcher.EntityInfo{&multiwatcher.NetworkInfo{
+					EnvUUID: st.EnvironUUID(),
+					Name:    "net1",
+				}},
+				change: watcher.Change{
+					C:  networksC,
+					Id: st.docID("net1"),
+				}}
+		},
+		func(c *gc.C, st *State) changeTestCase {
+			_, err := st.AddNetwork(NetworkInfo{
+				Name:       "net1",
+				ProviderId: "provider-net1",
+				CIDR:       "0.1.2.0/24",
+			})
+			c.Assert(err, jc.ErrorIsNil)
+			return changeTestCase{
+				about: "network is added if it's in backing but not in store",
+				change: watcher.Change{
+					C:  networksC,
+					Id: st.docID("net1"),
+				},
+				expectContents: []multiwatcher.EntityInfo{&multiwatcher.NetworkInfo{
+					EnvUUID:    st.EnvironUUID(),
+					Name:       "net1",
+					ProviderId: "provider-net1",
+					CIDR:       "0.1.2.0/24",
+				}}}
+		},
+	}
+	s.performChangeTestCases(c, changeTestFuncs)
+}
+
+func (s *allWatcherStateSuite) TestEntityName(c *gc.C) {
+	s.setUpScenario(c, s.state, 1)
+	m, err := s.state.Machine("1")
+	c.Assert(err, jc.ErrorIsNil)
+	svc, err := s.state.Service("wordpress")
+	c.Assert(err, jc.ErrorIsNil)
+	u, err := s.state.Unit("wordpress/0")
+	c.Assert(err, jc.ErrorIsNil)
+	rel, err := s.state.KeyRelation("logging:logging-directory wordpress:logging-dir")
+	c.Assert(err, jc.ErrorIsNil)
+
+	b := newAllWatcherStateBacking(s.state)
+	all := newStore()
+	err = b.GetAll(all)
+	c.Assert(err, jc.ErrorIsNil)
+	envUUID := s.state.EnvironUUID()
+	for _, test := range []struct {
+		id  multiwatcher.EntityId
+		tag names.Tag
+	}{
+		{multiwatcher.EntityId{"machine", envUUID, m.Id()}, m.Tag()},
+		{multiwatcher.EntityId{"service", envUUID, svc.Name()}, svc.Tag()},
+		{multiwatcher.EntityId{"unit", envUUID, u.Name()}, u.Tag()},
+		{multiwatcher.EntityId{"relation", envUUID, rel.String()}, rel.Tag()},
+	} {
+		c.Logf("%v", test.id)
+		info := all.Get(test.id)
+		c.Assert(info, gc.NotNil)
+		c.Assert(info.EntityName(), gc.Equals, test.tag.String())
+	}
+}
+
+func (s *allWatcherStateSuite) TestChangeUnknownCollection(c *gc.C) {
+	testChangeUnknownCollection(c, s.performChangeTestCases)
+}
+
 func (s *allWatcherStateSuite) TestClosingPorts(c *gc.C) {
 	defer s.Reset(c)
 	// Init the test environment.
@@ -548,6 +1121,7 @@ func (s *allWatcherStateSuite) TestClosingPorts(c *gc.C) {
 		&multiwatcher.UnitInfo{
 			EnvUUID:        s.state.EnvironUUID(),
 			Name:           "wordpress/0",
+			Life:           multiwatcher.Life("alive"),
 			Service:        "wordpress",
 			Series:         "quantal",
 			MachineId:      "0",
@@ -575,40 +1149,334 @@ func (s *allWatcherStateSuite) TestClosingPorts(c *gc.C) {
 	// Close the ports.
 	err = u.ClosePorts("tcp", 12345, 12345)
 	c.Assert(err, jc.ErrorIsNil)
-	err = b.Changed(all, watcher.Change{
-		C:  openedPortsC,
-		Id: s.state.docID("m#0#n#juju-public"),
-	})
+	err = b.Changed(all, watcher.Change{
+		C:  openedPortsC,
+		Id: s.state.docID("m#0#n#juju-public"),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	entities = all.All()
+	assertEntitiesEqual(c, entities, []multiwatcher.EntityInfo{
+		&multiwatcher.UnitInfo{
+			EnvUUID:        s.state.EnvironUUID(),
+			Name:           "wordpress/0",
+			Life:           multiwatcher.Life("alive"),
+			Service:        "wordpress",
+			Series:         "quantal",
+			MachineId:      "0",
+			PublicAddress:  "1.2.3.4",
+			PrivateAddress: "4.3.2.1",
+			Ports:          []network.Port{},
+			PortRanges:     []network.PortRange{},
+			Status:         "pending",
+			StatusData:     map[string]interface{}{},
+			WorkloadStatus: multiwatcher.StatusInfo{
+				Current: "unknown",
+				Message: "Waiting for agent initialization to finish",
+				Data:    map[string]interface{}{},
+			},
+			AgentStatus: multiwatcher.StatusInfo{
+				Current: "allocating",
+				Data:    map[string]interface{}{},
+			},
+		},
+		&multiwatcher.MachineInfo{
+			EnvUUID: s.state.EnvironUUID(),
+			Id:      "0",
+		},
+	})
+}
+
+func (s *allWatcherStateSuite) TestServiceWorkloadVersion(c *gc.C) {
+	defer s.Reset(c)
+	wordpress := AddTestingService(c, s.state, "wordpress", AddTestingCharm(c, s.state, "wordpress"), s.owner)
+	var units []*Unit
+	for i, version := range []string{"1.1", "1.0", "1.1"} {
+		u, err := wordpress.AddUnit()
+		c.Assert(err, jc.ErrorIsNil)
+		err = u.SetWorkloadVersion(version)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Logf("unit %d has version %q", i, version)
+		units = append(units, u)
+	}
+	b := newAllWatcherStateBacking(s.state)
+	all := newStore()
+	err := b.GetAll(all)
+	c.Assert(err, jc.ErrorIsNil)
+	serviceId := (&multiwatcher.ServiceInfo{
+		EnvUUID: s.state.EnvironUUID(),
+		Name:    "wordpress",
+	}).EntityId()
+	info := all.Get(serviceId).(*multiwatcher.ServiceInfo)
+	c.Assert(info.WorkloadVersion, gc.Equals, "1.1")
+
+	// Move the majority of units to a new version and check
+	// that the service's version follows.
+	for _, u := range units[:2] {
+		err := u.SetWorkloadVersion("1.2")
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	rev := all.latestRevno
+	for _, u := range units[:2] {
+		err := b.Changed(all, watcher.Change{
+			C:  "units",
+			Id: s.state.docID(u.Name()),
+		})
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	var serviceVersions []string
+	for _, d := range all.ChangesSince(rev) {
+		if info, ok := d.Entity.(*multiwatcher.ServiceInfo); ok {
+			serviceVersions = append(serviceVersions, info.WorkloadVersion)
+		}
+	}
+	c.Assert(serviceVersions, jc.DeepEquals, []string{"1.2"})
+}
+
+func (s *allWatcherStateSuite) TestUnitLeader(c *gc.C) {
+	defer s.Reset(c)
+	wordpress := AddTestingService(c, s.state, "wordpress", AddTestingCharm(c, s.state, "wordpress"), s.owner)
+	for i := 0; i < 2; i++ {
+		_, err := wordpress.AddUnit()
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	b := newAllWatcherStateBacking(s.state)
+	all := newStore()
+	err := b.GetAll(all)
+	c.Assert(err, jc.ErrorIsNil)
+
+	leaders := func(deltas []multiwatcher.Delta) map[string]bool {
+		result := make(map[string]bool)
+		for _, d := range deltas {
+			if info, ok := d.Entity.(*multiwatcher.UnitInfo); ok {
+				result[info.Name] = info.Leader
+			}
+		}
+		return result
+	}
+	setLeader := func(holder string) []multiwatcher.Delta {
+		leases, closer := s.state.getRawCollection(leasesC)
+		defer closer()
+		id := s.state.docID(serviceLeaderLeaseId("wordpress"))
+		if holder == "" {
+			err := leases.RemoveId(id)
+			c.Assert(err, jc.ErrorIsNil)
+		} else {
+			_, err := leases.UpsertId(id, bson.M{"$set": bson.M{
+				"type":      "lease",
+				"namespace": serviceLeadershipNamespace,
+				"name":      "wordpress",
+				"holder":    holder,
+				"env-uuid":  s.state.EnvironUUID(),
+			}})
+			c.Assert(err, jc.ErrorIsNil)
+		}
+		rev := all.latestRevno
+		err := b.Changed(all, watcher.Change{C: leasesC, Id: id})
+		c.Assert(err, jc.ErrorIsNil)
+		return all.ChangesSince(rev)
+	}
+
+	c.Assert(leaders(all.ChangesSince(0)), jc.DeepEquals, map[string]bool{
+		"wordpress/0": false,
+		"wordpress/1": false,
+	})
+	c.Assert(leaders(setLeader("wordpress/0")), jc.DeepEquals, map[string]bool{
+		"wordpress/0": true,
+	})
+	c.Assert(leaders(setLeader("wordpress/1")), jc.DeepEquals, map[string]bool{
+		"wordpress/0": false,
+		"wordpress/1": true,
+	})
+	c.Assert(leaders(setLeader("")), jc.DeepEquals, map[string]bool{
+		"wordpress/1": false,
+	})
+}
+
+func (s *allWatcherStateSuite) TestUnitLifeTransitions(c *gc.C) {
+	defer s.Reset(c)
+	wordpress := AddTestingService(c, s.state, "wordpress", AddTestingCharm(c, s.state, "wordpress"), s.owner)
+	u, err := wordpress.AddUnit()
+	c.Assert(err, jc.ErrorIsNil)
+	// Once its agent has set a status, the unit is no
+	// longer removed directly when it is destroyed.
+	err = u.SetAgentStatus(StatusIdle, "", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	b := newAllWatcherStateBacking(s.state)
+	all := newStore()
+
+	lives := func(deltas []multiwatcher.Delta) []string {
+		var result []string
+		for _, d := range deltas {
+			if d.Removed {
+				result = append(result, "removed")
+			} else {
+				result = append(result, string(d.Entity.(*multiwatcher.UnitInfo).Life))
+			}
+		}
+		return result
+	}
+	unitChanged := func() {
+		err := b.Changed(all, watcher.Change{
+			C:  "units",
+			Id: s.state.docID("wordpress/0"),
+		})
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	// follow returns the changes seen by a watcher
+	// that last looked at the given revno.
+	follow := func(revno *int64) []string {
+		var deltas []multiwatcher.Delta
+		deltas, *revno = all.ChangesSinceLimit(*revno, 0)
+		return lives(deltas)
+	}
+
+	var current, lagging int64
+	unitChanged()
+	c.Assert(follow(&current), jc.DeepEquals, []string{"alive"})
+	lagging = current
+
+	err = u.Destroy()
+	c.Assert(err, jc.ErrorIsNil)
+	unitChanged()
+	c.Assert(follow(&current), jc.DeepEquals, []string{"dying"})
+
+	err = u.EnsureDead()
+	c.Assert(err, jc.ErrorIsNil)
+	unitChanged()
+	c.Assert(follow(&current), jc.DeepEquals, []string{"dead"})
+
+	// A watcher that missed the intermediate
+	// transitions sees only the latest one.
+	c.Assert(follow(&lagging), jc.DeepEquals, []string{"dead"})
+
+	err = u.Remove()
+	c.Assert(err, jc.ErrorIsNil)
+	unitChanged()
+	c.Assert(follow(&current), jc.DeepEquals, []string{"removed"})
+	c.Assert(follow(&lagging), jc.DeepEquals, []string{"removed"})
+
+	// A new watcher never saw the unit, so it sees nothing.
+	var fresh int64
+	c.Assert(follow(&fresh), gc.HasLen, 0)
+}
+
+func (s *allWatcherStateSuite) TestChangedMany(c *gc.C) {
+	var changes []watcher.Change
+	for i := 0; i < 3; i++ {
+		m, err := s.state.AddMachine("quantal", JobHostUnits)
+		c.Assert(err, jc.ErrorIsNil)
+		changes = append(changes, watcher.Change{
+			C:  machinesC,
+			Id: s.state.docID(m.Id()),
+		})
+	}
+	// A machine that has gone away is removed from the store.
+	changes = append(changes, watcher.Change{
+		C:  machinesC,
+		Id: s.state.docID("3"),
+	})
+	b := newAllWatcherStateBacking(s.state)
+	all := newStore()
+	all.Update(&multiwatcher.MachineInfo{
+		EnvUUID: s.state.EnvironUUID(),
+		Id:      "3",
+	})
+	err := b.(manyChanger).ChangedMany(all, changes)
+	c.Assert(err, jc.ErrorIsNil)
+	var ids []string
+	for _, info := range all.All() {
+		ids = append(ids, info.(*multiwatcher.MachineInfo).Id)
+	}
+	c.Assert(ids, jc.SameContents, []string{"0", "1", "2"})
+}
+
+func (s *allWatcherStateSuite) TestMachineScopedWatcher(c *gc.C) {
+	_, err := s.state.AddMachine("quantal", JobHostUnits)
+	c.Assert(err, jc.ErrorIsNil)
+	m1, err := s.state.AddMachine("quantal", JobHostUnits)
+	c.Assert(err, jc.ErrorIsNil)
+	wordpress := AddTestingService(c, s.state, "wordpress", AddTestingCharm(c, s.state, "wordpress"), s.owner)
+	u, err := wordpress.AddUnit()
+	c.Assert(err, jc.ErrorIsNil)
+
+	b := newAllWatcherStateBacking(s.state)
+	defer b.Release()
+	sm := newStoreManager(b)
+	defer sm.Stop()
+	w := NewMultiwatcher(sm)
+	w.SetMachine(m1.Id())
+	defer w.Stop()
+
+	// next returns the kind, id and removal of the entities
+	// in the next set of deltas.
+	type change struct {
+		kind, id string
+		removed  bool
+	}
+	next := func() []change {
+		s.state.StartSync()
+		deltas, err := w.NextWithTimeout(testing.LongWait)
+		c.Assert(err, jc.ErrorIsNil)
+		var changes []change
+		for _, d := range deltas {
+			id := d.Entity.EntityId()
+			changes = append(changes, change{id.Kind, id.Id, d.Removed})
+		}
+		return changes
+	}
+	c.Assert(next(), jc.DeepEquals, []change{{"machine", "1", false}})
+
+	err = u.AssignToMachine(m1)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(next(), jc.DeepEquals, []change{{"unit", "wordpress/0", false}})
+
+	err = u.UnassignFromMachine()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(next(), jc.DeepEquals, []change{{"unit", "wordpress/0", true}})
+}
+
+func (s *allWatcherStateSuite) TestErrorWatcher(c *gc.C) {
+	_, err := s.state.AddMachine("quantal", JobHostUnits)
+	c.Assert(err, jc.ErrorIsNil)
+	wordpress := AddTestingService(c, s.state, "wordpress", AddTestingCharm(c, s.state, "wordpress"), s.owner)
+	u, err := wordpress.AddUnit()
 	c.Assert(err, jc.ErrorIsNil)
-	entities = all.All()
-	assertEntitiesEqual(c, entities, []multiwatcher.EntityInfo{
-		&multiwatcher.UnitInfo{
-			EnvUUID:        s.state.EnvironUUID(),
-			Name:           "wordpress/0",
-			Service:        "wordpress",
-			Series:         "quantal",
-			MachineId:      "0",
-			PublicAddress:  "1.2.3.4",
-			PrivateAddress: "4.3.2.1",
-			Ports:          []network.Port{},
-			PortRanges:     []network.PortRange{},
-			Status:         "pending",
-			StatusData:     map[string]interface{}{},
-			WorkloadStatus: multiwatcher.StatusInfo{
-				Current: "unknown",
-				Message: "Waiting for agent initialization to finish",
-				Data:    map[string]interface{}{},
-			},
-			AgentStatus: multiwatcher.StatusInfo{
-				Current: "allocating",
-				Data:    map[string]interface{}{},
-			},
-		},
-		&multiwatcher.MachineInfo{
-			EnvUUID: s.state.EnvironUUID(),
-			Id:      "0",
-		},
-	})
+
+	b := newAllWatcherStateBacking(s.state)
+	defer b.Release()
+	sm := newStoreManager(b)
+	defer sm.Stop()
+	w := NewErrorWatcher(sm)
+	defer w.Stop()
+
+	// next returns the kind, id and removal of the entities
+	// in the next set of deltas.
+	type change struct {
+		kind, id string
+		removed  bool
+	}
+	next := func() []change {
+		s.state.StartSync()
+		deltas, err := w.NextWithTimeout(testing.LongWait)
+		c.Assert(err, jc.ErrorIsNil)
+		var changes []change
+		for _, d := range deltas {
+			id := d.Entity.EntityId()
+			changes = append(changes, change{id.Kind, id.Id, d.Removed})
+		}
+		return changes
+	}
+
+	// Nothing is in error, so only the unit is
+	// reported once its agent reports an error.
+	err = u.SetAgentStatus(StatusError, "hook failed", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(next(), jc.DeepEquals, []change{{"unit", "wordpress/0", false}})
+
+	// Once the unit recovers, it is reported as removed.
+	err = u.SetAgentStatus(StatusIdle, "", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(next(), jc.DeepEquals, []change{{"unit", "wordpress/0", true}})
 }
 
 func (s *allWatcherStateSuite) TestSettings(c *gc.C) {
@@ -658,6 +1526,36 @@ func (s *allWatcherStateSuite) TestSettings(c *gc.C) {
 	})
 }
 
+func (s *allWatcherStateSuite) TestServiceConfigChange(c *gc.C) {
+	svc := AddTestingService(c, s.state, "dummy-service", AddTestingCharm(c, s.state, "dummy"), s.owner)
+
+	b := newAllWatcherStateBacking(s.state)
+	defer b.Release()
+	sm := newStoreManager(b)
+	defer sm.Stop()
+	w := NewMultiwatcher(sm)
+	defer w.Stop()
+
+	// nextConfig returns the config of the service
+	// in the next set of deltas.
+	nextConfig := func() map[string]interface{} {
+		s.state.StartSync()
+		deltas, err := w.NextWithTimeout(testing.LongWait)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(deltas, gc.HasLen, 1)
+		info, ok := deltas[0].Entity.(*multiwatcher.ServiceInfo)
+		c.Assert(ok, jc.IsTrue, gc.Commentf("unexpected entity %#v", deltas[0].Entity))
+		return info.Config
+	}
+	c.Assert(nextConfig(), gc.HasLen, 0)
+
+	// Changing the service's config is reported.
+	setServiceConfigAttr(c, svc, "username", "foo")
+	c.Assert(nextConfig(), jc.DeepEquals, map[string]interface{}{"username": "foo"})
+	setServiceConfigAttr(c, svc, "outlook", "foo@bar")
+	c.Assert(nextConfig(), jc.DeepEquals, map[string]interface{}{"outlook": "foo@bar", "username": "foo"})
+}
+
 // TestStateWatcher tests the integration of the state watcher
 // with the state-based backing. Most of the logic is tested elsewhere -
 // this just tests end-to-end.
@@ -777,6 +1675,7 @@ func (s *allWatcherStateSuite) TestStateWatcher(c *gc.C) {
 			EnvUUID:                 s.state.EnvironUUID(),
 			Id:                      "0",
 			InstanceId:              "i-0",
+			Nonce:                   "bootstrap_nonce",
 			Status:                  multiwatcher.Status("pending"),
 			StatusData:              map[string]interface{}{},
 			Life:                    multiwatcher.Life("alive"),
@@ -819,11 +1718,13 @@ func (s *allWatcherStateSuite) TestStateWatcher(c *gc.C) {
 				Message: "Waiting for agent initialization to finish",
 				Data:    map[string]interface{}{},
 			},
+			Endpoints: serviceEndpointInfos(c, wordpress),
 		},
 	}, {
 		Entity: &multiwatcher.UnitInfo{
 			EnvUUID:    s.state.EnvironUUID(),
 			Name:       "wordpress/0",
+			Life:       multiwatcher.Life("alive"),
 			Service:    "wordpress",
 			Series:     "quantal",
 			MachineId:  "2",
@@ -1180,6 +2081,16 @@ func (s *allEnvWatcherStateSuite) TestChangeEnvironments(c *gc.C) {
 	s.performChangeTestCases(c, changeTestFuncs)
 }
 
+func (s *allEnvWatcherStateSuite) TestChangeUnknownCollection(c *gc.C) {
+	testChangeUnknownCollection(c, s.performChangeTestCases)
+}
+
+func (s *allEnvWatcherStateSuite) TestUnwatchTwice(c *gc.C) {
+	b := newAllEnvWatcherStateBacking(s.state)
+	defer b.Release()
+	testUnwatchTwice(c, s.state, b)
+}
+
 func (s *allEnvWatcherStateSuite) TestChangeForDeadEnv(c *gc.C) {
 	// Ensure an entity is removed when a change is seen but
 	// the environment the entity belonged to has already died.
@@ -1393,6 +2304,7 @@ func (s *allEnvWatcherStateSuite) TestStateWatcher(c *gc.C) {
 			EnvUUID:                 st0.EnvironUUID(),
 			Id:                      "0",
 			InstanceId:              "i-0",
+			Nonce:                   "bootstrap_nonce",
 			Status:                  multiwatcher.Status("pending"),
 			StatusData:              map[string]interface{}{},
 			Life:                    multiwatcher.Life("alive"),
@@ -1435,11 +2347,13 @@ func (s *allEnvWatcherStateSuite) TestStateWatcher(c *gc.C) {
 				Message: "Waiting for agent initialization to finish",
 				Data:    map[string]interface{}{},
 			},
+			Endpoints: serviceEndpointInfos(c, wordpress),
 		},
 	}, {
 		Entity: &multiwatcher.UnitInfo{
 			EnvUUID:    st1.EnvironUUID(),
 			Name:       "wordpress/0",
+			Life:       multiwatcher.Life("alive"),
 			Service:    "wordpress",
 			Series:     "quantal",
 			MachineId:  "1",
@@ -1633,6 +2547,73 @@ func testChangeMachines(c *gc.C, runChangeTests func(*gc.C, []changeTestFunc)) {
 						WantsVote:  false,
 					}}}
 		},
+		func(c *gc.C, st *State) changeTestCase {
+			m, err := st.AddMachine("quantal", JobHostUnits)
+			c.Assert(err, jc.ErrorIsNil)
+			err = m.SetProvisioned("i-0", "provisioning_nonce", nil)
+			c.Assert(err, jc.ErrorIsNil)
+
+			return changeTestCase{
+				about: "machine nonce is reported once the machine is provisioned",
+				initialContents: []multiwatcher.EntityInfo{&multiwatcher.MachineInfo{
+					EnvUUID: st.EnvironUUID(),
+					Id:      "0",
+					Status:  multiwatcher.Status("pending"),
+				}},
+				change: watcher.Change{
+					C:  "machines",
+					Id: st.docID("0"),
+				},
+				expectContents: []multiwatcher.EntityInfo{
+					&multiwatcher.MachineInfo{
+						EnvUUID:                 st.EnvironUUID(),
+						Id:                      "0",
+						InstanceId:              "i-0",
+						Nonce:                   "provisioning_nonce",
+						Status:                  multiwatcher.Status("pending"),
+						StatusData:              map[string]interface{}{},
+						Life:                    multiwatcher.Life("alive"),
+						Series:                  "quantal",
+						Jobs:                    []multiwatcher.MachineJob{JobHostUnits.ToParams()},
+						Addresses:               []network.Address{},
+						HardwareCharacteristics: &instance.HardwareCharacteristics{},
+					}}}
+		},
+		func(c *gc.C, st *State) changeTestCase {
+			m, err := st.AddMachine("trusty", JobHostUnits)
+			c.Assert(err, jc.ErrorIsNil)
+			arch := "amd64"
+			mem := uint64(4096)
+			cores := uint64(4)
+			hc := &instance.HardwareCharacteristics{
+				Arch:     &arch,
+				Mem:      &mem,
+				CpuCores: &cores,
+			}
+			err = m.SetProvisioned("i-0", "provisioning_nonce", hc)
+			c.Assert(err, jc.ErrorIsNil)
+
+			return changeTestCase{
+				about: "machine series and hardware are reported when the machine is added",
+				change: watcher.Change{
+					C:  "machines",
+					Id: st.docID("0"),
+				},
+				expectContents: []multiwatcher.EntityInfo{
+					&multiwatcher.MachineInfo{
+						EnvUUID:                 st.EnvironUUID(),
+						Id:                      "0",
+						InstanceId:              "i-0",
+						Nonce:                   "provisioning_nonce",
+						Status:                  multiwatcher.Status("pending"),
+						StatusData:              map[string]interface{}{},
+						Life:                    multiwatcher.Life("alive"),
+						Series:                  "trusty",
+						Jobs:                    []multiwatcher.MachineJob{JobHostUnits.ToParams()},
+						Addresses:               []network.Address{},
+						HardwareCharacteristics: hc,
+					}}}
+		},
 		func(c *gc.C, st *State) changeTestCase {
 			m, err := st.AddMachine("trusty", JobHostUnits)
 			c.Assert(err, jc.ErrorIsNil)
@@ -1661,6 +2642,7 @@ func testChangeMachines(c *gc.C, runChangeTests func(*gc.C, []changeTestFunc)) {
 						EnvUUID:                  st.EnvironUUID(),
 						Id:                       "0",
 						InstanceId:               "i-0",
+						Nonce:                    "bootstrap_nonce",
 						Status:                   multiwatcher.Status("error"),
 						StatusInfo:               "another failure",
 						StatusData:               map[string]interface{}{},
@@ -1723,6 +2705,83 @@ func testChangeMachines(c *gc.C, runChangeTests func(*gc.C, []changeTestFunc)) {
 						StatusData: make(map[string]interface{}),
 					}}}
 		},
+		func(c *gc.C, st *State) changeTestCase {
+			m, err := st.AddMachine("quantal", JobHostUnits)
+			c.Assert(err, jc.ErrorIsNil)
+			err = m.SetProvisioned("i-0", "bootstrap_nonce", nil)
+			c.Assert(err, jc.ErrorIsNil)
+			err = m.SetInstanceDisplayName("friendly-name")
+			c.Assert(err, jc.ErrorIsNil)
+
+			return changeTestCase{
+				about: "display name is changed if the machine exists in the store",
+				initialContents: []multiwatcher.EntityInfo{&multiwatcher.MachineInfo{
+					EnvUUID:    st.EnvironUUID(),
+					Id:         "0",
+					InstanceId: "i-0",
+				}},
+				change: watcher.Change{
+					C:  "instanceData",
+					Id: st.docID("0"),
+				},
+				expectContents: []multiwatcher.EntityInfo{
+					&multiwatcher.MachineInfo{
+						EnvUUID:     st.EnvironUUID(),
+						Id:          "0",
+						InstanceId:  "i-0",
+						DisplayName: "friendly-name",
+					}}}
+		},
+		func(c *gc.C, st *State) changeTestCase {
+			m, err := st.AddMachine("quantal", JobHostUnits)
+			c.Assert(err, jc.ErrorIsNil)
+			err = m.SetProvisioned("i-0", "bootstrap_nonce", nil)
+			c.Assert(err, jc.ErrorIsNil)
+			err = m.SetInstanceStatus("provisioning")
+			c.Assert(err, jc.ErrorIsNil)
+
+			return changeTestCase{
+				about: "instance status is changed if the machine exists in the store",
+				initialContents: []multiwatcher.EntityInfo{&multiwatcher.MachineInfo{
+					EnvUUID:        st.EnvironUUID(),
+					Id:             "0",
+					InstanceId:     "i-0",
+					InstanceStatus: "pending",
+				}},
+				change: watcher.Change{
+					C:  "instanceData",
+					Id: st.docID("0"),
+				},
+				expectContents: []multiwatcher.EntityInfo{
+					&multiwatcher.MachineInfo{
+						EnvUUID:        st.EnvironUUID(),
+						Id:             "0",
+						InstanceId:     "i-0",
+						InstanceStatus: "provisioning",
+					}}}
+		},
+	}
+	runChangeTests(c, changeTestFuncs)
+}
+
+func testChangeUnknownCollection(c *gc.C, runChangeTests func(*gc.C, []changeTestFunc)) {
+	changeTestFuncs := []changeTestFunc{
+		func(c *gc.C, st *State) changeTestCase {
+			return changeTestCase{
+				about: "change in unknown collection is ignored",
+				initialContents: []multiwatcher.EntityInfo{&multiwatcher.MachineInfo{
+					EnvUUID: st.EnvironUUID(),
+					Id:      "0",
+				}},
+				change: watcher.Change{
+					C:  "widgets",
+					Id: st.docID("0"),
+				},
+				expectContents: []multiwatcher.EntityInfo{&multiwatcher.MachineInfo{
+					EnvUUID: st.EnvironUUID(),
+					Id:      "0",
+				}}}
+		},
 	}
 	runChangeTests(c, changeTestFuncs)
 }
@@ -1772,6 +2831,30 @@ func testChangeRelations(c *gc.C, owner names.UserTag, runChangeTests func(*gc.C
 							{ServiceName: "wordpress", Relation: charm.Relation{Name: "logging-dir", Role: "provider", Interface: "logging", Optional: false, Limit: 0, Scope: "container"}}},
 					}}}
 		},
+		func(c *gc.C, st *State) changeTestCase {
+			AddTestingService(c, st, "wordpress", AddTestingCharm(c, st, "wordpress"), owner)
+			AddTestingService(c, st, "logging", AddTestingCharm(c, st, "logging"), owner)
+			eps, err := st.InferEndpoints("wordpress", "logging")
+			c.Assert(err, jc.ErrorIsNil)
+			c.Assert(eps[0].ServiceName, gc.Equals, "wordpress")
+			_, err = st.AddRelation(eps...)
+			c.Assert(err, jc.ErrorIsNil)
+
+			return changeTestCase{
+				about: "relation endpoints are reported in key order",
+				change: watcher.Change{
+					C:  "relations",
+					Id: st.docID("logging:logging-directory wordpress:logging-dir"),
+				},
+				expectContents: []multiwatcher.EntityInfo{
+					&multiwatcher.RelationInfo{
+						EnvUUID: st.EnvironUUID(),
+						Key:     "logging:logging-directory wordpress:logging-dir",
+						Endpoints: []multiwatcher.Endpoint{
+							{ServiceName: "logging", Relation: charm.Relation{Name: "logging-directory", Role: "requirer", Interface: "logging", Optional: false, Limit: 1, Scope: "container"}},
+							{ServiceName: "wordpress", Relation: charm.Relation{Name: "logging-dir", Role: "provider", Interface: "logging", Optional: false, Limit: 0, Scope: "container"}}},
+					}}}
+		},
 	}
 	runChangeTests(c, changeTestFuncs)
 }
@@ -1830,6 +2913,14 @@ func testChangeServices(c *gc.C, owner names.UserTag, runChangeTests func(*gc.C,
 							Message: "Waiting for agent initialization to finish",
 							Data:    map[string]interface{}{},
 						},
+						Endpoints: []multiwatcher.Endpoint{
+							{ServiceName: "wordpress", Relation: charm.Relation{Name: "cache", Role: "requirer", Interface: "varnish", Optional: true, Limit: 2, Scope: "global"}},
+							{ServiceName: "wordpress", Relation: charm.Relation{Name: "db", Role: "requirer", Interface: "mysql", Optional: false, Limit: 1, Scope: "global"}},
+							{ServiceName: "wordpress", Relation: charm.Relation{Name: "juju-info", Role: "provider", Interface: "juju-info", Optional: false, Limit: 0, Scope: "global"}},
+							{ServiceName: "wordpress", Relation: charm.Relation{Name: "logging-dir", Role: "provider", Interface: "logging", Optional: false, Limit: 0, Scope: "container"}},
+							{ServiceName: "wordpress", Relation: charm.Relation{Name: "monitoring-port", Role: "provider", Interface: "monitoring", Optional: false, Limit: 0, Scope: "container"}},
+							{ServiceName: "wordpress", Relation: charm.Relation{Name: "url", Role: "provider", Interface: "http", Optional: false, Limit: 0, Scope: "global"}},
+						},
 					}}}
 		},
 		func(c *gc.C, st *State) changeTestCase {
@@ -1862,12 +2953,43 @@ func testChangeServices(c *gc.C, owner names.UserTag, runChangeTests func(*gc.C,
 						Config:      charm.Settings{"blog-title": "boring"},
 					}}}
 		},
+		func(c *gc.C, st *State) changeTestCase {
+			svc := AddTestingService(c, st, "wordpress", AddTestingCharm(c, st, "wordpress"), owner)
+			err := svc.SetMinUnits(2)
+			c.Assert(err, jc.ErrorIsNil)
+			_, err = svc.AddUnit()
+			c.Assert(err, jc.ErrorIsNil)
+			err = svc.Destroy()
+			c.Assert(err, jc.ErrorIsNil)
+
+			return changeTestCase{
+				about: "service life and minimum units are reported when the service is dying",
+				initialContents: []multiwatcher.EntityInfo{&multiwatcher.ServiceInfo{
+					EnvUUID:  st.EnvironUUID(),
+					Name:     "wordpress",
+					CharmURL: "local:quantal/quantal-wordpress-3",
+					Life:     multiwatcher.Life("alive"),
+				}},
+				change: watcher.Change{
+					C:  "services",
+					Id: st.docID("wordpress"),
+				},
+				expectContents: []multiwatcher.EntityInfo{
+					&multiwatcher.ServiceInfo{
+						EnvUUID:  st.EnvironUUID(),
+						Name:     "wordpress",
+						CharmURL: "local:quantal/quantal-wordpress-3",
+						OwnerTag: owner.String(),
+						Life:     multiwatcher.Life("dying"),
+						MinUnits: 2,
+					}}}
+		},
 		func(c *gc.C, st *State) changeTestCase {
 			svc := AddTestingService(c, st, "wordpress", AddTestingCharm(c, st, "wordpress"), owner)
 			setServiceConfigAttr(c, svc, "blog-title", "boring")
 
 			return changeTestCase{
-				about: "service re-reads config when charm URL changes",
+				about: "service re-reads config and endpoints when charm URL changes",
 				initialContents: []multiwatcher.EntityInfo{&multiwatcher.ServiceInfo{
 					EnvUUID: st.EnvironUUID(),
 					Name:    "wordpress",
@@ -1882,12 +3004,13 @@ func testChangeServices(c *gc.C, owner names.UserTag, runChangeTests func(*gc.C,
 				},
 				expectContents: []multiwatcher.EntityInfo{
 					&multiwatcher.ServiceInfo{
-						EnvUUID:  st.EnvironUUID(),
-						Name:     "wordpress",
-						CharmURL: "local:quantal/quantal-wordpress-3",
-						OwnerTag: owner.String(),
-						Life:     multiwatcher.Life("alive"),
-						Config:   charm.Settings{"blog-title": "boring"},
+						EnvUUID:   st.EnvironUUID(),
+						Name:      "wordpress",
+						CharmURL:  "local:quantal/quantal-wordpress-3",
+						OwnerTag:  owner.String(),
+						Life:      multiwatcher.Life("alive"),
+						Config:    charm.Settings{"blog-title": "boring"},
+						Endpoints: serviceEndpointInfos(c, svc),
 					}}}
 		},
 		// Settings.
@@ -2146,6 +3269,7 @@ func testChangeUnits(c *gc.C, owner names.UserTag, runChangeTests func(*gc.C, []
 					&multiwatcher.UnitInfo{
 						EnvUUID:   st.EnvironUUID(),
 						Name:      "wordpress/0",
+						Life:      multiwatcher.Life("alive"),
 						Service:   "wordpress",
 						Series:    "quantal",
 						MachineId: "0",
@@ -2219,6 +3343,7 @@ func testChangeUnits(c *gc.C, owner names.UserTag, runChangeTests func(*gc.C, []
 					&multiwatcher.UnitInfo{
 						EnvUUID:    st.EnvironUUID(),
 						Name:       "wordpress/0",
+						Life:       multiwatcher.Life("alive"),
 						Service:    "wordpress",
 						Series:     "quantal",
 						MachineId:  "0",
@@ -2239,6 +3364,63 @@ func testChangeUnits(c *gc.C, owner names.UserTag, runChangeTests func(*gc.C, []
 						},
 					}}}
 		},
+		func(c *gc.C, st *State) changeTestCase {
+			wordpress := AddTestingService(c, st, "wordpress", AddTestingCharm(c, st, "wordpress"), owner)
+			u, err := wordpress.AddUnit()
+			c.Assert(err, jc.ErrorIsNil)
+			m, err := st.AddMachine("quantal", JobHostUnits)
+			c.Assert(err, jc.ErrorIsNil)
+			err = u.AssignToMachine(m)
+			c.Assert(err, jc.ErrorIsNil)
+			curl, _ := wordpress.CharmURL()
+			err = u.SetCharmURL(curl)
+			c.Assert(err, jc.ErrorIsNil)
+			err = u.UnassignFromMachine()
+			c.Assert(err, jc.ErrorIsNil)
+
+			return changeTestCase{
+				about: "unit reports its charm URL, and no machine once unassigned",
+				initialContents: []multiwatcher.EntityInfo{&multiwatcher.UnitInfo{
+					EnvUUID:    st.EnvironUUID(),
+					Name:       "wordpress/0",
+					MachineId:  "0",
+					Status:     multiwatcher.Status("pending"),
+					StatusData: map[string]interface{}{},
+					AgentStatus: multiwatcher.StatusInfo{
+						Current: "allocating",
+						Data:    map[string]interface{}{},
+					},
+					WorkloadStatus: multiwatcher.StatusInfo{
+						Current: "unknown",
+						Message: "Waiting for agent initialization to finish",
+						Data:    map[string]interface{}{},
+					},
+				}},
+				change: watcher.Change{
+					C:  "units",
+					Id: st.docID("wordpress/0"),
+				},
+				expectContents: []multiwatcher.EntityInfo{
+					&multiwatcher.UnitInfo{
+						EnvUUID:    st.EnvironUUID(),
+						Name:       "wordpress/0",
+						Life:       multiwatcher.Life("alive"),
+						Service:    "wordpress",
+						Series:     "quantal",
+						CharmURL:   curl.String(),
+						Status:     multiwatcher.Status("pending"),
+						StatusData: map[string]interface{}{},
+						AgentStatus: multiwatcher.StatusInfo{
+							Current: "allocating",
+							Data:    map[string]interface{}{},
+						},
+						WorkloadStatus: multiwatcher.StatusInfo{
+							Current: "unknown",
+							Message: "Waiting for agent initialization to finish",
+							Data:    map[string]interface{}{},
+						},
+					}}}
+		},
 		func(c *gc.C, st *State) changeTestCase {
 			wordpress := AddTestingService(c, st, "wordpress", AddTestingCharm(c, st, "wordpress"), owner)
 			u, err := wordpress.AddUnit()
@@ -2310,6 +3492,7 @@ func testChangeUnits(c *gc.C, owner names.UserTag, runChangeTests func(*gc.C, []
 					&multiwatcher.UnitInfo{
 						EnvUUID:    st.EnvironUUID(),
 						Name:       "wordpress/0",
+						Life:       multiwatcher.Life("alive"),
 						Service:    "wordpress",
 						Series:     "quantal",
 						MachineId:  "0",
@@ -2360,6 +3543,7 @@ func testChangeUnits(c *gc.C, owner names.UserTag, runChangeTests func(*gc.C, []
 					&multiwatcher.UnitInfo{
 						EnvUUID:        st.EnvironUUID(),
 						Name:           "wordpress/0",
+						Life:           multiwatcher.Life("alive"),
 						Service:        "wordpress",
 						Series:         "quantal",
 						PublicAddress:  "public",
@@ -2737,6 +3921,7 @@ func testChangeUnitsNonNilPorts(c *gc.C, owner names.UserTag, runChangeTests fun
 					&multiwatcher.UnitInfo{
 						EnvUUID:    st.EnvironUUID(),
 						Name:       "wordpress/0",
+						Life:       multiwatcher.Life("alive"),
 						Service:    "wordpress",
 						Series:     "quantal",
 						MachineId:  "0",
@@ -2769,6 +3954,7 @@ func testChangeUnitsNonNilPorts(c *gc.C, owner names.UserTag, runChangeTests fun
 					&multiwatcher.UnitInfo{
 						EnvUUID:        st.EnvironUUID(),
 						Name:           "wordpress/0",
+						Life:           multiwatcher.Life("alive"),
 						Service:        "wordpress",
 						Series:         "quantal",
 						MachineId:      "0",
@@ -2803,6 +3989,7 @@ func testChangeUnitsNonNilPorts(c *gc.C, owner names.UserTag, runChangeTests fun
 					&multiwatcher.UnitInfo{
 						EnvUUID:        st.EnvironUUID(),
 						Name:           "wordpress/0",
+						Life:           multiwatcher.Life("alive"),
 						Service:        "wordpress",
 						Series:         "quantal",
 						MachineId:      "0",
@@ -2837,6 +4024,7 @@ func testChangeUnitsNonNilPorts(c *gc.C, owner names.UserTag, runChangeTests fun
 					&multiwatcher.UnitInfo{
 						EnvUUID:    st.EnvironUUID(),
 						Name:       "wordpress/0",
+						Life:       multiwatcher.Life("alive"),
 						Service:    "wordpress",
 						Series:     "quantal",
 						Ports:      []network.Port{},
@@ -2970,6 +4158,10 @@ func (tw *testWatcher) AssertChanges() {
 	tw.c.Assert(tw.NumDeltas(), jc.GreaterThan, 0)
 }
 
+// entityInfoSlice implements sort.Interface, ordering entities by
+// kind, then environment, then id. EntityId.Id is always a
+// string (relations, for example, use their key rather than their
+// numeric id), so any two entities can be ordered.
 type entityInfoSlice []multiwatcher.EntityInfo
 
 func (s entityInfoSlice) Len() int      { return len(s) }
@@ -2993,7 +4185,7 @@ func checkDeltasEqual(c *gc.C, d0, d1 []multiwatcher.Delta) {
 func deltaMap(deltas []multiwatcher.Delta) map[interface{}]multiwatcher.EntityInfo {
 	m := make(map[interface{}]multiwatcher.EntityInfo)
 	for _, d := range deltas {
-		id := d.Entity.EntityId()
+		id := entityKey(d.Source, d.Entity.EntityId())
 		if d.Removed {
 			m[id] = nil
 		} else {
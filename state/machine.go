@@ -142,6 +142,10 @@ type machineDoc struct {
 	// Placement is the placement directive that should be used when provisioning
 	// an instance for the machine.
 	Placement string `bson:",omitempty"`
+
+	// DetectedContainerType holds the type of container, if any,
+	// that the machine agent reported it is running inside.
+	DetectedContainerType string `bson:",omitempty"`
 }
 
 func newMachine(st *State, doc *machineDoc) *Machine {
@@ -171,6 +175,30 @@ func (m *Machine) ContainerType() instance.ContainerType {
 	return instance.ContainerType(m.doc.ContainerType)
 }
 
+// DetectedContainerType returns the type of container that the machine
+// agent reported it is running inside, instance.NONE if it reported that
+// it is not running inside one, or "" if it has reported nothing.
+func (m *Machine) DetectedContainerType() instance.ContainerType {
+	return instance.ContainerType(m.doc.DetectedContainerType)
+}
+
+// SetDetectedContainerType records the type of container that the
+// machine agent has found it is running inside.
+func (m *Machine) SetDetectedContainerType(ctype instance.ContainerType) (err error) {
+	defer errors.DeferredAnnotatef(&err, "cannot set detected container type of machine %v", m)
+	ops := []txn.Op{{
+		C:      machinesC,
+		Id:     m.doc.DocID,
+		Assert: notDeadDoc,
+		Update: bson.D{{"$set", bson.D{{"detectedcontainertype", string(ctype)}}}},
+	}}
+	if err = m.st.runTransaction(ops); err != nil {
+		return onAbort(err, ErrDead)
+	}
+	m.doc.DetectedContainerType = string(ctype)
+	return nil
+}
+
 // machineGlobalKey returns the global database key for the identified machine.
 func machineGlobalKey(id string) string {
 	return "m#" + id
@@ -195,6 +223,10 @@ type instanceData struct {
 	CpuPower   *uint64     `bson:"cpupower,omitempty"`
 	Tags       *[]string   `bson:"tags,omitempty"`
 	AvailZone  *string     `bson:"availzone,omitempty"`
+
+	// DisplayName holds the provider's human-friendly name
+	// for the instance, if it has one.
+	DisplayName string `bson:"displayname,omitempty"`
 }
 
 func hardwareCharacteristics(instData instanceData) *instance.HardwareCharacteristics {
@@ -986,6 +1018,42 @@ func (m *Machine) SetInstanceStatus(status string) (err error) {
 	return errors.NotProvisionedf("machine %v", m.Id())
 }
 
+// InstanceDisplayName returns the provider specific human-friendly name
+// for this machine's instance, or a NotProvisionedError if the instance
+// is not yet provisioned.
+func (m *Machine) InstanceDisplayName() (string, error) {
+	instData, err := getInstanceData(m.st, m.Id())
+	if errors.IsNotFound(err) {
+		err = errors.NotProvisionedf("machine %v", m.Id())
+	}
+	if err != nil {
+		return "", err
+	}
+	return instData.DisplayName, err
+}
+
+// SetInstanceDisplayName sets the provider specific human-friendly name
+// for a machine's instance.
+func (m *Machine) SetInstanceDisplayName(name string) (err error) {
+	defer errors.DeferredAnnotatef(&err, "cannot set instance display name for machine %q", m)
+
+	ops := []txn.Op{
+		{
+			C:      instanceDataC,
+			Id:     m.doc.DocID,
+			Assert: txn.DocExists,
+			Update: bson.D{{"$set", bson.D{{"displayname", name}}}},
+		},
+	}
+
+	if err = m.st.runTransaction(ops); err == nil {
+		return nil
+	} else if err != txn.ErrAborted {
+		return err
+	}
+	return errors.NotProvisionedf("machine %v", m.Id())
+}
+
 // AvailabilityZone returns the provier-specific instance availability
 // zone in which the machine was provisioned.
 func (m *Machine) AvailabilityZone() (string, error) {
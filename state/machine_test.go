@@ -2377,6 +2377,24 @@ func (s *MachineSuite) TestSupportsNoContainersOverwritesExisting(c *gc.C) {
 	assertSupportedContainers(c, machine, []instance.ContainerType{})
 }
 
+func (s *MachineSuite) TestSetDetectedContainerType(c *gc.C) {
+	machine, err := s.State.AddMachine("quantal", state.JobHostUnits)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(machine.DetectedContainerType(), gc.Equals, instance.ContainerType(""))
+
+	err = machine.SetDetectedContainerType(instance.LXC)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(machine.DetectedContainerType(), gc.Equals, instance.LXC)
+	err = machine.Refresh()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(machine.DetectedContainerType(), gc.Equals, instance.LXC)
+
+	err = machine.EnsureDead()
+	c.Assert(err, jc.ErrorIsNil)
+	err = machine.SetDetectedContainerType(instance.KVM)
+	c.Assert(err, gc.ErrorMatches, `cannot set detected container type of machine .*: not found or dead`)
+}
+
 func (s *MachineSuite) TestSetSupportedContainersSingle(c *gc.C) {
 	machine, err := s.State.AddMachine("quantal", state.JobHostUnits)
 	c.Assert(err, jc.ErrorIsNil)
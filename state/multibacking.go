@@ -0,0 +1,179 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package state
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/juju/state/watcher"
+)
+
+// multiBacking implements Backing by combining several
+// backings, so that a single store manager can report the
+// entities of all of them. Each backing is a separate source
+// of entities, named by its index, so that several backings
+// may report entities with the same id; the deltas sent to
+// watchers record the source of each entity.
+type multiBacking struct {
+	backings []Backing
+
+	mu      sync.Mutex
+	watches map[chan<- watcher.Change]*multiWatch
+}
+
+// multiWatch holds the channels used to forward the
+// changes from each backing to a single channel.
+type multiWatch struct {
+	sources []chan watcher.Change
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// sourceChangeId is used as the id of the changes sent by
+// a multiBacking. It records the backing that the change
+// came from along with its original id.
+type sourceChangeId struct {
+	source int
+	id     interface{}
+}
+
+var _ Backing = (*multiBacking)(nil)
+
+// NewMultiBacking returns a Backing that holds the entities
+// of all the given backings. It releases the backings when
+// it is released.
+func NewMultiBacking(backings ...Backing) Backing {
+	return &multiBacking{
+		backings: backings,
+		watches:  make(map[chan<- watcher.Change]*multiWatch),
+	}
+}
+
+// sourceName returns the source of the entities
+// reported by the backing with the given index.
+func sourceName(i int) string {
+	return strconv.Itoa(i)
+}
+
+// GetAll implements Backing.GetAll.
+func (b *multiBacking) GetAll(all *multiwatcherStore) error {
+	for i, backing := range b.backings {
+		err := all.withSource(sourceName(i), func() error {
+			return backing.GetAll(all)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// Changed implements Backing.Changed.
+func (b *multiBacking) Changed(all *multiwatcherStore, change watcher.Change) error {
+	id, ok := change.Id.(sourceChangeId)
+	if !ok || id.source < 0 || id.source >= len(b.backings) {
+		return errors.Errorf("unexpected change id %v", change.Id)
+	}
+	change.Id = id.id
+	return all.withSource(sourceName(id.source), func() error {
+		return b.backings[id.source].Changed(all, change)
+	})
+}
+
+// Watch implements Backing.Watch. The changes from each
+// backing are sent on in until Unwatch is called.
+func (b *multiBacking) Watch(in chan<- watcher.Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.watches[in]; ok {
+		panic("channel watched twice")
+	}
+	w := &multiWatch{
+		stop: make(chan struct{}),
+	}
+	for i, backing := range b.backings {
+		source := make(chan watcher.Change)
+		w.sources = append(w.sources, source)
+		w.wg.Add(1)
+		go w.forward(i, source, in)
+		backing.Watch(source)
+	}
+	b.watches[in] = w
+}
+
+// forward sends the changes received from the backing with
+// the given index on out until the watch is stopped.
+func (w *multiWatch) forward(i int, source <-chan watcher.Change, out chan<- watcher.Change) {
+	defer w.wg.Done()
+	for {
+		select {
+		case change, ok := <-source:
+			if !ok {
+				// The backing has stopped watching source.
+				return
+			}
+			change.Id = sourceChangeId{i, change.Id}
+			select {
+			case out <- change:
+			case <-w.stop:
+				return
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Unwatch implements Backing.Unwatch. Unwatching a
+// channel that is not being watched does nothing.
+func (b *multiBacking) Unwatch(in chan<- watcher.Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w, ok := b.watches[in]
+	if !ok {
+		return
+	}
+	delete(b.watches, in)
+	close(w.stop)
+	w.wg.Wait()
+	// A backing may be blocked sending a change on its source,
+	// and may not give up watching it until the change has been
+	// received, so drain each source until it has been unwatched.
+	for i, backing := range b.backings {
+		done := make(chan struct{})
+		go drainChanges(w.sources[i], done)
+		backing.Unwatch(w.sources[i])
+		close(done)
+	}
+}
+
+// drainChanges receives and discards the changes sent on source
+// until done is closed or source is closed.
+func drainChanges(source <-chan watcher.Change, done <-chan struct{}) {
+	for {
+		select {
+		case _, ok := <-source:
+			if !ok {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Release implements Backing.Release. It releases all
+// the backings, returning the first error encountered.
+func (b *multiBacking) Release() error {
+	var firstErr error
+	for _, backing := range b.backings {
+		if err := backing.Release(); err != nil && firstErr == nil {
+			firstErr = errors.Trace(err)
+		}
+	}
+	return firstErr
+}
@@ -5,10 +5,21 @@ package state
 
 import (
 	"container/list"
+	"encoding/base64"
 	stderrors "errors"
+	"fmt"
+	"io"
+	"net"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/juju/errors"
+	"github.com/juju/utils"
+	"github.com/juju/utils/clock"
 	"launchpad.net/tomb"
 
 	"github.com/juju/juju/state/multiwatcher"
@@ -23,6 +34,66 @@ type Multiwatcher struct {
 	// goroutine.
 	revno   int64
 	stopped bool
+
+	// lastDelivery holds the time at which changes were last
+	// delivered to the watcher. It is maintained by the
+	// storeManager goroutine.
+	lastDelivery time.Time
+
+	// minInterval holds the minimum time between deliveries
+	// of changes to the watcher. See SetMinInterval.
+	minInterval time.Duration
+
+	// position records the revno reached by each successful
+	// Next call, if a position hook has been set.
+	position *positionRecorder
+
+	// shareDeltas holds whether the entities in the deltas
+	// delivered to the watcher are those held by the store
+	// manager, rather than copies of them. See SetCloneDeltas.
+	shareDeltas bool
+
+	// kinds holds the kinds of entity that the watcher is
+	// interested in. If it is nil, the watcher is interested
+	// in all entities. See SetEntityKinds.
+	kinds map[string]bool
+
+	// inScope, if not nil, reports whether an entity is within
+	// the scope of the watcher. See SetService and SetMachine.
+	inScope func(multiwatcher.EntityInfo) bool
+
+	// visible holds the last information delivered to a scoped
+	// watcher about each entity that it currently believes is
+	// within its scope, by entity key. It is maintained by the
+	// storeManager goroutine. See entityKey.
+	visible map[interface{}]multiwatcher.EntityInfo
+
+	// sent holds the last information delivered to a watcher
+	// that receives partial deltas about each entity that it
+	// knows about, by entity key. It is nil if the watcher
+	// receives only full deltas. It is maintained by the
+	// storeManager goroutine. See SetPartialDeltas and entityKey.
+	sent map[interface{}]multiwatcher.EntityInfo
+
+	// maxPending holds the number of changes that may be made
+	// while the watcher is not waiting in Next before it is
+	// stopped. If it is zero, there is no limit. See
+	// SetMaxPending.
+	maxPending int64
+
+	// err holds the reason why the storeManager stopped the
+	// watcher, if it did so. It is maintained by the
+	// storeManager goroutine.
+	err error
+
+	// delivered holds the revno reached by the last successful
+	// call to Next. It is maintained by the client goroutine.
+	delivered int64
+
+	// seq records the order in which the watcher registered with
+	// the storeManager. It is maintained by the storeManager
+	// goroutine.
+	seq int64
 }
 
 // NewMultiwatcher creates a new watcher that can observe
@@ -33,45 +104,650 @@ func NewMultiwatcher(all *storeManager) *Multiwatcher {
 	}
 }
 
+// NewMultiwatcherWithSnapshot creates a new watcher on the given store
+// manager and returns it along with a snapshot of all the entities
+// currently known to the store manager. The watcher is positioned
+// exactly at the snapshot, so the first call to Next will return only
+// changes made after the snapshot was taken; nothing is missed or
+// delivered twice across the boundary.
+func NewMultiwatcherWithSnapshot(all *storeManager) (*Multiwatcher, []multiwatcher.EntityInfo, error) {
+	w := NewMultiwatcher(all)
+	req := &request{
+		w:        w,
+		reply:    make(chan bool, 1),
+		snapshot: true,
+	}
+	select {
+	case all.request <- req:
+	case <-all.tomb.Dead():
+		return nil, nil, all.deadErr()
+	}
+	<-req.reply
+	w.delivered = req.revno
+	entities := make([]multiwatcher.EntityInfo, len(req.changes))
+	for i, d := range req.changes {
+		entities[i] = d.Entity
+	}
+	return w, entities, nil
+}
+
+// ErrFellBehind is returned by Next when the watcher has been stopped
+// because too many changes were made while it was not waiting for
+// them. See Multiwatcher.SetMaxPending.
+var ErrFellBehind = stderrors.New("watcher fell behind")
+
+// ErrForceStopped is returned by Next when the watcher has been
+// stopped by a call to the store manager's ForceStop method.
+var ErrForceStopped = stderrors.New("watcher was stopped by force")
+
+// ErrRevnoExpired is returned by NewMultiwatcherAt when the requested
+// revno is too old for the watcher to be able to report all the
+// entities removed since.
+var ErrRevnoExpired = stderrors.New("revno expired")
+
+// NewMultiwatcherAt creates a new watcher on the given store manager
+// that resumes from the given revno, as previously returned by the
+// Revno method of a watcher on the same store manager. The first call
+// to Next returns only the changes made since that revno, so a client
+// that reconnects need not fetch everything again.
+//
+// Entities that were removed after the revno are reported as removed.
+// The store manager remembers the removal of only a limited number of
+// the entities that it no longer holds, so if it
+// has forgotten the removal of an entity removed after the revno,
+// ErrRevnoExpired is returned and the client must start again with a
+// new watcher. In particular, it makes no difference if the revno is
+// older than the creation of every entity still known to the store
+// manager; only forgotten removals count.
+func NewMultiwatcherAt(all *storeManager, revno int64) (*Multiwatcher, error) {
+	w := NewMultiwatcher(all)
+	req := &request{
+		w:      w,
+		reply:  make(chan bool, 1),
+		resume: true,
+		revno:  revno,
+	}
+	select {
+	case all.request <- req:
+	case <-all.tomb.Dead():
+		return nil, all.deadErr()
+	}
+	if ok := <-req.reply; !ok {
+		return nil, errors.Trace(req.err)
+	}
+	w.delivered = revno
+	return w, nil
+}
+
+// NewMultiwatcherFromNow creates a new watcher on the given store
+// manager that is told only about changes made after it is created.
+// Unlike a watcher created with NewMultiwatcher, its first call to
+// Next does not return all the entities known to the store manager;
+// it waits until something changes.
+func NewMultiwatcherFromNow(all *storeManager) (*Multiwatcher, error) {
+	w := NewMultiwatcher(all)
+	req := &request{
+		w:      w,
+		reply:  make(chan bool, 1),
+		resume: true,
+		latest: true,
+	}
+	select {
+	case all.request <- req:
+	case <-all.tomb.Dead():
+		return nil, all.deadErr()
+	}
+	if ok := <-req.reply; !ok {
+		return nil, errors.Trace(req.err)
+	}
+	w.delivered = req.revno
+	return w, nil
+}
+
+// Revno returns the revno reached by the watcher after the last
+// successful call to Next. It may be passed to NewMultiwatcherAt to
+// resume watching from the same position.
+func (w *Multiwatcher) Revno() int64 {
+	return w.delivered
+}
+
+// ResumeToken identifies the position reached by a watcher on a
+// particular store manager. Revnos from one store manager mean nothing
+// to another, so unlike a bare revno, a token can be safely kept by a
+// client across reconnections. Clients should treat the encoding of a
+// token, as returned by String, as opaque.
+type ResumeToken struct {
+	// StoreId identifies the store manager.
+	StoreId string
+
+	// Revno holds the revno reached by the watcher.
+	Revno int64
+}
+
+// String returns the encoding of the token, which may be
+// decoded with ParseResumeToken.
+func (t ResumeToken) String() string {
+	return base64.URLEncoding.EncodeToString([]byte(t.StoreId + ":" + strconv.FormatInt(t.Revno, 10)))
+}
+
+// ParseResumeToken decodes a token encoded by ResumeToken.String.
+func ParseResumeToken(s string) (ResumeToken, error) {
+	data, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return ResumeToken{}, errors.NotValidf("resume token %q", s)
+	}
+	i := strings.LastIndex(string(data), ":")
+	if i <= 0 {
+		return ResumeToken{}, errors.NotValidf("resume token %q", s)
+	}
+	revno, err := strconv.ParseInt(string(data[i+1:]), 10, 64)
+	if err != nil || revno < 0 {
+		return ResumeToken{}, errors.NotValidf("resume token %q", s)
+	}
+	return ResumeToken{
+		StoreId: string(data[:i]),
+		Revno:   revno,
+	}, nil
+}
+
+// ResumeToken returns a token for the revno reached by the watcher
+// after the last successful call to Next. It may be passed to
+// NewMultiwatcherFromToken to resume watching from the same position.
+func (w *Multiwatcher) ResumeToken() ResumeToken {
+	return ResumeToken{
+		StoreId: w.all.id,
+		Revno:   w.delivered,
+	}
+}
+
+// NewMultiwatcherFromToken is like NewMultiwatcherAt, but resumes from
+// the position identified by the given encoded token, as returned by
+// a watcher's ResumeToken. If the token was issued by a different
+// store manager, such as one that has since been restarted, or the
+// store manager can no longer report every change since the token's
+// revno, an error with the cause ErrRevnoExpired is returned and the
+// client must start again with a new watcher.
+func NewMultiwatcherFromToken(all *storeManager, token string) (*Multiwatcher, error) {
+	t, err := ParseResumeToken(token)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if t.StoreId != all.id {
+		return nil, errors.Annotate(ErrRevnoExpired, "resume token is from another store manager")
+	}
+	return NewMultiwatcherAt(all, t.Revno)
+}
+
 // Stop stops the watcher.
 func (w *Multiwatcher) Stop() error {
+	return w.stop(false)
+}
+
+// StopAndDrain stops the watcher like Stop, except that a pending
+// call to Next is first given any changes that are available, even if
+// the watcher has a minimum interval that would otherwise hold them
+// back. Only if there are none does it return ErrStopped, as any
+// later calls do.
+func (w *Multiwatcher) StopAndDrain() error {
+	return w.stop(true)
+}
+
+func (w *Multiwatcher) stop(drain bool) error {
 	select {
-	case w.all.request <- &request{w: w}:
+	case w.all.request <- &request{w: w, drain: drain}:
 		return nil
 	case <-w.all.tomb.Dead():
 	}
 	return errors.Trace(w.all.tomb.Err())
 }
 
+// SetPositionHook arranges for hook to be called with the revno
+// reached by the watcher after each successful call to Next, so that
+// clients can durably record their position in the stream. The hook
+// is called from a separate goroutine so that it never holds up
+// delivery; if it is still running when further changes are
+// delivered, intermediate revnos are skipped, but the revnos it sees
+// always increase. SetPositionHook must be called before Next.
+func (w *Multiwatcher) SetPositionHook(hook func(revno int64)) {
+	w.position = &positionRecorder{hook: hook}
+}
+
+// SetCloneDeltas sets whether the watcher receives its own copies of
+// the entities in the deltas returned by Next. By default it does, so
+// that a client changing a delta cannot corrupt the store manager or
+// the deltas of other watchers. Copying costs an allocation per entity
+// per watcher, so a client that never changes the deltas it receives
+// may call SetCloneDeltas(false) to share the entities instead.
+// SetCloneDeltas must be called before Next.
+func (w *Multiwatcher) SetCloneDeltas(clone bool) {
+	w.shareDeltas = !clone
+}
+
+// SetMinInterval sets the minimum time between successive deliveries of
+// changes to the watcher. Changes made within the interval are held back
+// and coalesced into the next delivery, so that a client calling Next in
+// a tight loop is not overwhelmed by many small batches when the state
+// is changing rapidly. A zero interval, the default, delivers changes as
+// soon as they are available. SetMinInterval must be called before Next.
+func (w *Multiwatcher) SetMinInterval(d time.Duration) {
+	w.minInterval = d
+}
+
+// SetMaxPending limits the number of changes that may be made while
+// the watcher is not waiting in Next. If the limit is exceeded, the
+// watcher is stopped so that it no longer holds on to entities that
+// other watchers have finished with, and Next returns ErrFellBehind;
+// the client must then start again with a new watcher. A zero limit,
+// the default, means that there is no limit. SetMaxPending must be
+// called before Next.
+func (w *Multiwatcher) SetMaxPending(n int64) {
+	w.maxPending = n
+}
+
+// SetPartialDeltas sets whether changes to entities that the watcher
+// has already been told about are delivered as partial deltas, holding
+// only the fields that have changed, where the kind of entity allows
+// it. The client is then responsible for merging the changes into the
+// information it already holds; see multiwatcher.PartialDelta. By
+// default, every delta holds the full entity. SetPartialDeltas must be
+// called before Next.
+func (w *Multiwatcher) SetPartialDeltas(partial bool) {
+	w.sent = nil
+	if partial {
+		w.sent = make(map[interface{}]multiwatcher.EntityInfo)
+	}
+}
+
+// compact replaces the given changes to entities that the watcher
+// has already been told about with partial deltas, where possible,
+// and records the information delivered to the watcher.
+func (w *Multiwatcher) compact(changes []multiwatcher.Delta) []multiwatcher.Delta {
+	for i, change := range changes {
+		id := entityKey(change.Source, change.Entity.EntityId())
+		if change.Removed {
+			delete(w.sent, id)
+			continue
+		}
+		if last, ok := w.sent[id]; ok {
+			if partial, ok := multiwatcher.PartialDelta(last, change.Entity); ok {
+				partial.Source = change.Source
+				changes[i] = partial
+			}
+		}
+		w.sent[id] = change.Entity
+	}
+	return changes
+}
+
+// SetEntityKinds restricts the changes delivered to the watcher to
+// those for entities of the given kinds (for example, "machine" and
+// "unit"). Entities of other kinds are never seen by the watcher. By
+// default, changes to entities of all kinds are delivered.
+// SetEntityKinds must be called before Next.
+func (w *Multiwatcher) SetEntityKinds(kinds ...string) {
+	w.kinds = make(map[string]bool)
+	for _, kind := range kinds {
+		w.kinds[kind] = true
+	}
+}
+
+// SetService scopes the watcher to the service with the given name, so
+// that only changes to the service itself and to its units are
+// delivered. If a unit the watcher has been told about stops belonging
+// to the service, the watcher sees it as removed. SetService replaces
+// any kinds set by SetEntityKinds, and must be called before Next.
+func (w *Multiwatcher) SetService(name string) {
+	w.setScope(func(info multiwatcher.EntityInfo) bool {
+		switch info := info.(type) {
+		case *multiwatcher.ServiceInfo:
+			return info.Name == name
+		case *multiwatcher.UnitInfo:
+			return info.Service == name
+		}
+		return false
+	}, "service", "unit")
+}
+
+// SetMachine scopes the watcher to the machine with the given id, so
+// that only changes to the machine itself and to the units assigned to
+// it are delivered. If a unit the watcher has been told about is no
+// longer assigned to the machine, the watcher sees it as removed.
+// SetMachine replaces any kinds set by SetEntityKinds, and must be
+// called before Next.
+func (w *Multiwatcher) SetMachine(id string) {
+	w.setScope(func(info multiwatcher.EntityInfo) bool {
+		switch info := info.(type) {
+		case *multiwatcher.MachineInfo:
+			return info.Id == id
+		case *multiwatcher.UnitInfo:
+			return info.MachineId == id
+		}
+		return false
+	}, "machine", "unit")
+}
+
+// SetFilter filters the changes delivered to the watcher, so that only
+// changes to entities for which filter returns true are delivered. If
+// an entity the watcher has been told about no longer matches, the
+// watcher sees it as removed. SetFilter may be combined with
+// SetEntityKinds, but replaces the scope set by SetService or
+// SetMachine, and must be called before Next. The filter is called by
+// the store manager goroutine, and must not change the entity.
+func (w *Multiwatcher) SetFilter(filter func(multiwatcher.EntityInfo) bool) {
+	w.inScope = filter
+	w.visible = make(map[interface{}]multiwatcher.EntityInfo)
+}
+
+// NewErrorWatcher returns a new watcher on the given store manager
+// that is told only about entities, of any kind, whose status is
+// error. When an entity recovers, the watcher sees it as removed.
+func NewErrorWatcher(all *storeManager) *Multiwatcher {
+	w := NewMultiwatcher(all)
+	w.SetFilter(inError)
+	return w
+}
+
+// inError reports whether the status of the given entity is error.
+// For a unit, either its agent or its workload may be in error.
+func inError(info multiwatcher.EntityInfo) bool {
+	const statusError = multiwatcher.Status(StatusError)
+	switch info := info.(type) {
+	case *multiwatcher.MachineInfo:
+		return info.Status == statusError
+	case *multiwatcher.UnitInfo:
+		return info.AgentStatus.Current == statusError || info.WorkloadStatus.Current == statusError
+	case *multiwatcher.ServiceInfo:
+		return info.Status.Current == statusError
+	case *multiwatcher.VolumeInfo:
+		return info.Status.Current == statusError
+	}
+	return false
+}
+
+// setScope scopes the watcher to the entities of the given
+// kinds for which inScope returns true.
+func (w *Multiwatcher) setScope(inScope func(multiwatcher.EntityInfo) bool, kinds ...string) {
+	w.SetEntityKinds(kinds...)
+	w.SetFilter(inScope)
+}
+
+// scope filters the given changes down to those within the
+// scope of the watcher, reporting entities that have left
+// the scope as removed.
+func (w *Multiwatcher) scope(changes []multiwatcher.Delta) []multiwatcher.Delta {
+	scoped := changes[:0]
+	for _, change := range changes {
+		id := entityKey(change.Source, change.Entity.EntityId())
+		last, visible := w.visible[id]
+		switch {
+		case !change.Removed && w.inScope(change.Entity):
+			w.visible[id] = change.Entity
+			scoped = append(scoped, change)
+		case visible:
+			delete(w.visible, id)
+			scoped = append(scoped, multiwatcher.Delta{
+				Removed: true,
+				Entity:  last,
+				Source:  change.Source,
+			})
+		}
+	}
+	return scoped
+}
+
+// wants reports whether the watcher is interested in
+// entities of the given kind.
+func (w *Multiwatcher) wants(kind string) bool {
+	return w.kinds == nil || w.kinds[kind]
+}
+
+// ErrStopped is returned by Next when the watcher has been stopped.
 var ErrStopped = stderrors.New("watcher was stopped")
 
+// ErrSharedWatcherStopped is returned by Next, and by the store
+// manager's methods, when the store manager shared by the watchers
+// has been stopped without error.
+var ErrSharedWatcherStopped = stderrors.New("shared state watcher was stopped")
+
+// ErrTimeout is returned by NextWithTimeout when no
+// changes become available in time.
+var ErrTimeout = stderrors.New("timed out waiting for changes")
+
 // Next retrieves all changes that have happened since the last
 // time it was called, blocking until there are some changes available.
 func (w *Multiwatcher) Next() ([]multiwatcher.Delta, error) {
+	return w.next(nil)
+}
+
+// NextWithTimeout is like Next, but returns ErrTimeout if no changes
+// become available within the given duration. A timeout leaves the
+// watcher where it was, so the changes will be returned by a later
+// call.
+func (w *Multiwatcher) NextWithTimeout(d time.Duration) ([]multiwatcher.Delta, error) {
+	return w.next(w.all.clock.After(d))
+}
+
+// next implements Next and NextWithTimeout. If timeout
+// is nil, it waits indefinitely for changes.
+func (w *Multiwatcher) next(timeout <-chan time.Time) ([]multiwatcher.Delta, error) {
 	req := &request{
 		w:     w,
-		reply: make(chan bool),
+		reply: make(chan bool, 1),
 	}
 	select {
 	case w.all.request <- req:
 	case <-w.all.tomb.Dead():
-		err := w.all.tomb.Err()
-		if err == nil {
-			err = errors.Errorf("shared state watcher was stopped")
+		return nil, w.all.deadErr()
+	}
+	var ok bool
+	select {
+	case ok = <-req.reply:
+	case <-w.all.tomb.Dead():
+		// The store manager stopped before replying.
+		return nil, w.all.deadErr()
+	case <-timeout:
+		// Withdraw the request. The store manager handles
+		// requests in turn, so once it has accepted the
+		// cancellation, any reply it made first is waiting
+		// in the reply channel.
+		select {
+		case w.all.request <- &request{w: w, cancel: req}:
+			select {
+			case ok = <-req.reply:
+			case <-w.all.tomb.Dead():
+				return nil, w.all.deadErr()
+			default:
+				return nil, errors.Trace(ErrTimeout)
+			}
+		case ok = <-req.reply:
+		case <-w.all.tomb.Dead():
+			// The store manager stopped before accepting
+			// the cancellation.
+			return nil, w.all.deadErr()
 		}
-		return nil, err
+	}
+	if !ok {
+		if req.err != nil {
+			return nil, errors.Trace(req.err)
+		}
+		return nil, errors.Trace(ErrStopped)
+	}
+	w.delivered = req.revno
+	if w.position != nil {
+		w.position.record(req.revno)
+	}
+	return req.changes, nil
+}
+
+// Peek returns the changes that a call to Next would return now,
+// without waiting for any and without consuming them, so that a
+// later call to Next still returns them. If there are no changes
+// pending, it returns none.
+func (w *Multiwatcher) Peek() ([]multiwatcher.Delta, error) {
+	req := &request{
+		w:     w,
+		reply: make(chan bool, 1),
+		peek:  true,
+	}
+	select {
+	case w.all.request <- req:
+	case <-w.all.tomb.Dead():
+		return nil, w.all.deadErr()
 	}
 	if ok := <-req.reply; !ok {
+		if req.err != nil {
+			return nil, errors.Trace(req.err)
+		}
 		return nil, errors.Trace(ErrStopped)
 	}
 	return req.changes, nil
 }
 
+// Reset makes the watcher forget what it has seen, so that the next
+// call to Next returns the complete current state, as if the watcher
+// were new. It allows a client that has lost track of the state to
+// resynchronise without stopping the watcher.
+func (w *Multiwatcher) Reset() error {
+	req := &request{
+		w:     w,
+		reply: make(chan bool, 1),
+		reset: true,
+	}
+	select {
+	case w.all.request <- req:
+	case <-w.all.tomb.Dead():
+		return w.all.deadErr()
+	}
+	if ok := <-req.reply; !ok {
+		if req.err != nil {
+			return errors.Trace(req.err)
+		}
+		return errors.Trace(ErrStopped)
+	}
+	w.delivered = 0
+	return nil
+}
+
+// DeltaChan delivers the changes seen by a Multiwatcher on a channel,
+// for clients that would rather range over a channel than call Next.
+type DeltaChan struct {
+	tomb    tomb.Tomb
+	w       *Multiwatcher
+	changes chan []multiwatcher.Delta
+	errors  chan error
+}
+
+// NewDeltaChan returns a DeltaChan that delivers the changes seen by
+// the given watcher, starting with its initial state. The DeltaChan
+// takes ownership of the watcher, which is stopped when the DeltaChan
+// is stopped.
+func NewDeltaChan(w *Multiwatcher) *DeltaChan {
+	d := &DeltaChan{
+		w:       w,
+		changes: make(chan []multiwatcher.Delta),
+		errors:  make(chan error, 1),
+	}
+	go func() {
+		defer d.tomb.Done()
+		defer close(d.errors)
+		defer close(d.changes)
+		err := d.loop()
+		cause := errors.Cause(err)
+		if err != nil && cause != tomb.ErrDying {
+			d.errors <- err
+		}
+		d.tomb.Kill(cause)
+	}()
+	return d
+}
+
+func (d *DeltaChan) loop() error {
+	for {
+		deltas, err := d.w.Next()
+		if err != nil {
+			if errors.Cause(err) == ErrStopped {
+				return nil
+			}
+			return errors.Trace(err)
+		}
+		select {
+		case d.changes <- deltas:
+		case <-d.tomb.Dying():
+			return tomb.ErrDying
+		}
+	}
+}
+
+// C returns a channel on which each batch of changes is delivered.
+// The channel is closed when the DeltaChan is stopped or fails.
+func (d *DeltaChan) C() <-chan []multiwatcher.Delta {
+	return d.changes
+}
+
+// Errors returns a channel that receives the error, if any, that
+// caused the DeltaChan to fail. It is closed once C has been closed.
+func (d *DeltaChan) Errors() <-chan error {
+	return d.errors
+}
+
+// Stop stops the DeltaChan and its underlying watcher.
+func (d *DeltaChan) Stop() error {
+	d.tomb.Kill(nil)
+	err := d.w.Stop()
+	if waitErr := d.tomb.Wait(); waitErr != nil {
+		// The watcher failed before we stopped it.
+		return errors.Trace(waitErr)
+	}
+	return errors.Trace(err)
+}
+
+// positionRecorder calls a position hook asynchronously, coalescing
+// revnos that arrive while the hook is still running.
+type positionRecorder struct {
+	hook func(revno int64)
+
+	mu      sync.Mutex
+	revno   int64
+	running bool
+}
+
+// record notes that the watcher has reached the given revno
+// and makes sure that the hook will be called with it.
+func (p *positionRecorder) record(revno int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.revno = revno
+	if p.running {
+		return
+	}
+	p.running = true
+	go p.run(revno)
+}
+
+func (p *positionRecorder) run(revno int64) {
+	for {
+		p.hook(revno)
+		p.mu.Lock()
+		if p.revno == revno {
+			p.running = false
+			p.mu.Unlock()
+			return
+		}
+		revno = p.revno
+		p.mu.Unlock()
+	}
+}
+
 // storeManager holds a shared record of current state and replies to
 // requests from Multiwatchers to tell them when it changes.
 type storeManager struct {
 	tomb tomb.Tomb
 
+	// id uniquely identifies the store manager, so that the
+	// revnos of one are never taken for those of another.
+	// See ResumeToken.
+	id string
+
 	// backing knows how to fetch information from
 	// the underlying state.
 	backing Backing
@@ -82,9 +758,65 @@ type storeManager struct {
 	// all holds information on everything the storeManager cares about.
 	all *multiwatcherStore
 
+	// clock is used to throttle deliveries to Multiwatchers
+	// that have a minimum interval set.
+	clock clock.Clock
+
 	// Each entry in the waiting map holds a linked list of Next requests
 	// outstanding for the associated Multiwatcher.
 	waiting map[*Multiwatcher]*request
+
+	// watchers holds every Multiwatcher that has made a request
+	// and has not since been stopped.
+	watchers map[*Multiwatcher]bool
+
+	// lastSeq holds the registration sequence number given
+	// to the most recently registered Multiwatcher.
+	lastSeq int64
+
+	// turn is advanced on each call to respond, so that
+	// waiting watchers take turns at being served first.
+	turn int
+
+	// heartbeat holds the last heartbeat recorded by the
+	// loop. It is guarded by heartbeatMu, so that it can be
+	// read while the loop is busy. See Heartbeat.
+	heartbeatMu sync.Mutex
+	heartbeat   MultiwatcherHeartbeat
+
+	// warnings holds the warnings logged by the loop within
+	// the last warningInterval, keyed by message. See warningf.
+	warnings map[string]*warning
+
+	// paused holds whether the store manager has been paused,
+	// in which case changes from the backing are held in held
+	// rather than being applied to the store. See Pause.
+	paused bool
+
+	// held holds the changes received while paused, at most one
+	// for each document, in the order they were first received.
+	// heldIndex maps each document to its change in held.
+	held      []watcher.Change
+	heldIndex map[heldDoc]int
+
+	// resyncHeld records that the backing stopped watching
+	// while the store manager was paused, so that the store
+	// must be resynchronised on resume.
+	resyncHeld bool
+}
+
+// heldDoc identifies a document with changes held while
+// the store manager is paused.
+type heldDoc struct {
+	c  string
+	id interface{}
+}
+
+// warning records when a warning was last logged, and how many
+// identical warnings have been suppressed since.
+type warning struct {
+	logged     time.Time
+	suppressed int
 }
 
 // Backing is the interface required by the storeManager to access the
@@ -101,7 +833,12 @@ type Backing interface {
 	Changed(all *multiwatcherStore, change watcher.Change) error
 
 	// Watch watches for any changes and sends them
-	// on the given channel.
+	// on the given channel. If the backing stops watching
+	// of its own accord, for example because its underlying
+	// watcher restarted, it closes the channel; the
+	// storeManager then watches again on a new channel and
+	// reloads all entities to catch up with any changes it
+	// missed.
 	Watch(in chan<- watcher.Change)
 
 	// Unwatch stops watching for changes on the
@@ -112,23 +849,114 @@ type Backing interface {
 	Release() error
 }
 
+// manyChanger may be implemented by a Backing that can handle several
+// changes more efficiently than by handling each of them in turn, for
+// example by fetching documents from the same collection together.
+type manyChanger interface {
+	// ChangedMany is like Changed, but handles
+	// all the given changes in order.
+	ChangedMany(all *multiwatcherStore, changes []watcher.Change) error
+}
+
+// collectionRun returns the number of changes at the start of
+// the given slice that are to the same collection. Only such
+// runs of changes may be fetched together without changing the
+// order in which changes to different collections are seen.
+func collectionRun(changes []watcher.Change) int {
+	n := 1
+	for n < len(changes) && changes[n].C == changes[0].C {
+		n++
+	}
+	return n
+}
+
 // request holds a message from the Multiwatcher to the
 // storeManager for some changes. The request will be
 // replied to when some changes are available.
 type request struct {
 	// w holds the Multiwatcher that has originated the request.
+	// It is nil for a snapshot requested by Snapshot.
 	w *Multiwatcher
 
 	// reply receives a message when deltas are ready.  If reply is
 	// nil, the Multiwatcher will be stopped.  If the reply is true,
 	// the request has been processed; if false, the Multiwatcher
-	// has been stopped,
+	// has been stopped. A request is replied to at most once, and
+	// the channel must have room for the reply, so that the
+	// storeManager never waits for the requester. See send.
 	reply chan bool
 
 	// On reply, changes will hold changes that have occurred since
 	// the last replied-to Next request.
 	changes []multiwatcher.Delta
 
+	// On reply, revno will hold the revno that the Multiwatcher
+	// has reached. For a resume request, it holds the revno to
+	// resume from.
+	revno int64
+
+	// snapshot holds whether the request is for the current
+	// contents of the store. Such a request is replied to
+	// immediately, even if there are no changes.
+	snapshot bool
+
+	// stats holds where to put the store manager's statistics
+	// for a request made by Stats.
+	stats *MultiwatcherStats
+
+	// watchers holds where to put the information about
+	// the store manager's watchers for a request made by
+	// Watchers.
+	watchers *[]MultiwatcherInfo
+
+	// forceStop holds the id of the watcher to stop for a
+	// request made by ForceStop. If no such watcher is
+	// registered, the reply is false.
+	forceStop int64
+
+	// resume holds whether the request is to position a new
+	// Multiwatcher at revno. Such a request is replied to
+	// immediately; if the reply is false, err holds the reason.
+	resume bool
+
+	// latest holds whether a resume request is to position the
+	// Multiwatcher at the latest revno of the store. On reply,
+	// revno holds that revno.
+	latest bool
+
+	// err holds the reason why a resume request failed.
+	err error
+
+	// cancel holds an earlier request from the same Multiwatcher
+	// that should be withdrawn. A cancellation is not replied to.
+	cancel *request
+
+	// drain holds whether a request to stop the watcher should
+	// first deliver any available changes to a waiting request.
+	drain bool
+
+	// peek holds whether the request is for the changes that
+	// the watcher has yet to see, without consuming them. Such
+	// a request is replied to immediately, even if there are
+	// no changes.
+	peek bool
+
+	// reset holds whether the request is to make the watcher
+	// start again from the beginning. Such a request is replied
+	// to immediately.
+	reset bool
+
+	// pause and unpause hold whether the request, made by Pause
+	// or Resume, is to pause or resume the store manager.
+	pause   bool
+	unpause bool
+
+	// get holds the id of the entity to look up for a request
+	// made by Get. The reply is true if the entity was found,
+	// in which case info holds a copy of it.
+	get  *multiwatcher.EntityId
+	info multiwatcher.EntityInfo
+
 	// next points to the next request in the list of outstanding
 	// requests on a given watcher.  It is used only by the central
 	// storeManager goroutine.
@@ -139,10 +967,14 @@ type request struct {
 // but does not start its run loop.
 func newStoreManagerNoRun(backing Backing) *storeManager {
 	return &storeManager{
-		backing: backing,
-		request: make(chan *request),
-		all:     newStore(),
-		waiting: make(map[*Multiwatcher]*request),
+		id:       utils.MustNewUUID().String(),
+		backing:  backing,
+		request:  make(chan *request),
+		all:      newStore(),
+		clock:    GetClock(),
+		waiting:  make(map[*Multiwatcher]*request),
+		watchers: make(map[*Multiwatcher]bool),
+		warnings: make(map[string]*warning),
 	}
 }
 
@@ -158,7 +990,7 @@ func newStoreManager(backing Backing) *storeManager {
 		// because we reconnect to the state on any error, but
 		// perhaps there are errors we could recover from.
 
-		err := sm.loop()
+		err := sm.run()
 		cause := errors.Cause(err)
 		// tomb expects ErrDying or ErrStillAlive as
 		// exact values, so we need to log and unwrap
@@ -171,32 +1003,584 @@ func newStoreManager(backing Backing) *storeManager {
 	return sm
 }
 
-func (sm *storeManager) loop() error {
-	in := make(chan watcher.Change)
-	sm.backing.Watch(in)
-	defer sm.backing.Unwatch(in)
-	// We have no idea what changes the watcher might be trying to
-	// send us while getAll proceeds, but we don't mind, because
-	// storeManager.changed is idempotent with respect to both updates
-	// and removals.
-	// TODO(rog) Perhaps find a way to avoid blocking all other
-	// watchers while GetAll is running.
-	if err := sm.backing.GetAll(sm.all); err != nil {
-		return err
+// run runs the store manager's loop, turning a panic in
+// the loop into an error so that the store manager dies
+// rather than leaving its watchers waiting forever.
+func (sm *storeManager) run() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("store manager loop panicked: %v", r)
+		}
+	}()
+	return sm.loop()
+}
+
+func (sm *storeManager) loop() error {
+	in := make(chan watcher.Change)
+	sm.backing.Watch(in)
+	defer func() {
+		sm.backing.Unwatch(in)
+	}()
+	// We have no idea what changes the watcher might be trying to
+	// send us while getAll proceeds, but we don't mind, because
+	// storeManager.changed is idempotent with respect to both updates
+	// and removals.
+	// TODO(rog) Perhaps find a way to avoid blocking all other
+	// watchers while GetAll is running.
+	if err := sm.backing.GetAll(sm.all); err != nil {
+		return err
+	}
+	sm.beat()
+	// wake fires at wakeTime, when changes held back from
+	// a throttled watcher may next be delivered.
+	var (
+		wake     <-chan time.Time
+		wakeTime time.Time
+	)
+	for {
+		select {
+		case <-sm.tomb.Dying():
+			return errors.Trace(tomb.ErrDying)
+		case change, ok := <-in:
+			if !ok {
+				// The backing has stopped watching in, so
+				// changes may have been missed.
+				logger.Infof("backing stopped watching; watching again")
+				in = make(chan watcher.Change)
+				sm.backing.Watch(in)
+				if sm.paused {
+					sm.resyncHeld = true
+					break
+				}
+				if err := sm.resync(); err != nil {
+					return errors.Trace(err)
+				}
+				break
+			}
+			changes := gatherChanges(in, change)
+			if sm.paused {
+				sm.hold(changes)
+				break
+			}
+			if err := sm.changed(changes); err != nil {
+				return errors.Trace(err)
+			}
+			// The store manager may have been resumed
+			// while the changes were being retried.
+			if err := sm.release(); err != nil {
+				return errors.Trace(err)
+			}
+		case req := <-sm.request:
+			sm.handle(req)
+			if err := sm.release(); err != nil {
+				return errors.Trace(err)
+			}
+		case <-wake:
+			wake = nil
+		}
+		next := sm.respond()
+		if !next.IsZero() && (wake == nil || next.Before(wakeTime)) {
+			wakeTime = next
+			wake = sm.clock.After(next.Sub(sm.clock.Now()))
+		}
+		sm.beat()
+	}
+}
+
+// resync brings the store up to date with the backing, updating
+// and adding the entities that have changed and removing those
+// that have gone away, so that watchers are told about any changes
+// that the store manager missed.
+func (sm *storeManager) resync() error {
+	fresh := newStore()
+	if err := sm.backing.GetAll(fresh); err != nil {
+		return errors.Trace(err)
+	}
+	// Entities are matched by key, so that those reported
+	// by each of several backings are kept apart.
+	var gone []*entityEntry
+	for e := sm.all.list.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*entityEntry)
+		if !entry.removed && fresh.entities[entry.key()] == nil {
+			gone = append(gone, entry)
+		}
+	}
+	for _, entry := range gone {
+		id := entry.info.EntityId()
+		sm.all.withSource(entry.source, func() error {
+			sm.all.Remove(id)
+			return nil
+		})
+	}
+	for e := fresh.list.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*entityEntry)
+		sm.all.withSource(entry.source, func() error {
+			sm.all.Update(entry.info)
+			return nil
+		})
+	}
+	return nil
+}
+
+// hold records the given changes, received while the store
+// manager is paused, so that they can be applied on resume.
+// Only the latest change to each document is kept, because
+// applying a change fetches the current state of the document.
+func (sm *storeManager) hold(changes []watcher.Change) {
+	if sm.heldIndex == nil {
+		sm.heldIndex = make(map[heldDoc]int)
+	}
+	for _, change := range changes {
+		doc := heldDoc{change.C, change.Id}
+		if i, ok := sm.heldIndex[doc]; ok {
+			sm.held[i] = change
+			continue
+		}
+		sm.heldIndex[doc] = len(sm.held)
+		sm.held = append(sm.held, change)
+	}
+}
+
+// release applies any changes held while the store manager was
+// paused, once it is no longer paused.
+func (sm *storeManager) release() error {
+	if sm.paused {
+		return nil
+	}
+	held, resync := sm.held, sm.resyncHeld
+	sm.held, sm.heldIndex, sm.resyncHeld = nil, nil, false
+	if resync {
+		// The resync brings in the held changes too.
+		return sm.resync()
+	}
+	for len(held) > 0 {
+		if sm.paused {
+			// Paused again while the changes were being
+			// retried; hold the rest until resumed.
+			sm.hold(held)
+			return nil
+		}
+		n := len(held)
+		if n > maxChangeBatch {
+			n = maxChangeBatch
+		}
+		if err := sm.changed(held[:n]); err != nil {
+			return err
+		}
+		held = held[n:]
+	}
+	return nil
+}
+
+// maxChangeBatch holds the maximum number of changes
+// that are passed to the backing together.
+const maxChangeBatch = 100
+
+// gatherChanges returns the given change along with any others
+// that are ready to be received on in, so that the backing can
+// fetch them together. If in is closed, the changes received so
+// far are returned, leaving the caller to find that in is closed
+// when it next receives on it.
+func gatherChanges(in <-chan watcher.Change, change watcher.Change) []watcher.Change {
+	changes := []watcher.Change{change}
+	for len(changes) < maxChangeBatch {
+		select {
+		case change, ok := <-in:
+			if !ok {
+				return changes
+			}
+			changes = append(changes, change)
+		default:
+			return changes
+		}
+	}
+	return changes
+}
+
+// changedRetries holds the number of times changes are retried
+// when the backing fails to handle them with a transient error.
+// changedRetryDelay holds the delay before each retry.
+var (
+	changedRetries    = 3
+	changedRetryDelay = 100 * time.Millisecond
+)
+
+// changed informs the backing about the given changes. If the
+// backing fails with a transient error, such as a timeout talking
+// to the database, the changes are retried a few times before the
+// error is returned; a warning is logged only when the changes
+// are given up on. Requests from watchers continue to be served
+// between attempts, so that watchers are not held up by a retry;
+// they see the store as it was before the changes, or with only
+// some of them applied if the backing applied some before failing.
+func (sm *storeManager) changed(changes []watcher.Change) error {
+	for attempt := 0; ; attempt++ {
+		err := sm.changedOnce(changes)
+		if err == nil {
+			return nil
+		}
+		if attempt >= changedRetries || !isTransientError(err) {
+			sm.warningf("cannot handle %s: %v", describeChanges(changes), err)
+			return err
+		}
+		logger.Debugf("cannot handle %s (retrying in %v): %v", describeChanges(changes), changedRetryDelay, err)
+		if err := sm.waitToRetry(); err != nil {
+			return err
+		}
+	}
+}
+
+// waitToRetry waits for changedRetryDelay before changes are
+// retried, serving requests from watchers in the meantime.
+func (sm *storeManager) waitToRetry() error {
+	retry := sm.clock.After(changedRetryDelay)
+	for {
+		select {
+		case <-sm.tomb.Dying():
+			return tomb.ErrDying
+		case req := <-sm.request:
+			sm.handle(req)
+			sm.respond()
+		case <-retry:
+			return nil
+		}
+	}
+}
+
+// describeChanges returns a description of the given changes
+// that names the first changed entity.
+func describeChanges(changes []watcher.Change) string {
+	desc := fmt.Sprintf("change to %s %v", changes[0].C, changes[0].Id)
+	if len(changes) > 1 {
+		desc += fmt.Sprintf(" (and %d others)", len(changes)-1)
+	}
+	return desc
+}
+
+// warningInterval holds the time within which identical
+// warnings from the store manager are logged only once.
+var warningInterval = time.Minute
+
+// warningf logs a warning, unless an identical warning has been
+// logged within the last warningInterval, so that a repeated failure
+// does not flood the log. The number of warnings suppressed is
+// reported when the warning is next logged, or when the interval
+// expires. It must only be called by the storeManager goroutine.
+func (sm *storeManager) warningf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	now := sm.clock.Now()
+	for m, w := range sm.warnings {
+		if now.Sub(w.logged) < warningInterval {
+			continue
+		}
+		if m != msg && w.suppressed > 0 {
+			logger.Warningf("%s (%d similar warnings suppressed)", m, w.suppressed)
+		}
+		if m != msg {
+			delete(sm.warnings, m)
+		}
+	}
+	w := sm.warnings[msg]
+	switch {
+	case w == nil:
+		logger.Warningf("%s", msg)
+		sm.warnings[msg] = &warning{logged: now}
+	case now.Sub(w.logged) < warningInterval:
+		w.suppressed++
+	case w.suppressed > 0:
+		logger.Warningf("%s (%d similar warnings suppressed)", msg, w.suppressed)
+		*w = warning{logged: now}
+	default:
+		logger.Warningf("%s", msg)
+		*w = warning{logged: now}
+	}
+}
+
+// isTransientError reports whether the given error returned
+// by a backing might not occur if the operation is retried.
+func isTransientError(err error) bool {
+	err = errors.Cause(err)
+	if err == io.EOF {
+		// mgo returns io.EOF when the connection to
+		// the database is lost.
+		return true
+	}
+	if err, ok := err.(net.Error); ok {
+		return err.Timeout() || err.Temporary()
+	}
+	return false
+}
+
+// changedOnce informs the backing about the given changes, all at
+// once if it implements manyChanger, or otherwise in turn.
+func (sm *storeManager) changedOnce(changes []watcher.Change) error {
+	if b, ok := sm.backing.(manyChanger); ok {
+		return b.ChangedMany(sm.all, changes)
+	}
+	for _, change := range changes {
+		if err := sm.backing.Changed(sm.all, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot returns a delta for every entity currently known to the
+// store manager, along with the revno at which the snapshot was
+// taken, which may be passed to NewMultiwatcherAt to watch for
+// subsequent changes. The snapshot is taken by the store manager
+// goroutine, so it never reflects a partially applied change, and no
+// watcher is left registered afterwards. The entities are shared with
+// the store manager and must not be changed.
+func (sm *storeManager) Snapshot() ([]multiwatcher.Delta, int64, error) {
+	req := &request{
+		reply:    make(chan bool, 1),
+		snapshot: true,
+	}
+	select {
+	case sm.request <- req:
+	case <-sm.tomb.Dead():
+		return nil, 0, sm.deadErr()
+	}
+	<-req.reply
+	return req.changes, req.revno, nil
+}
+
+// MultiwatcherStats holds statistics about the watchers
+// of a store manager. See storeManager.Stats.
+type MultiwatcherStats struct {
+	// Watchers holds the number of watchers that have
+	// made a request and have not been stopped.
+	Watchers int
+
+	// WaitingRequests holds the number of Next
+	// requests waiting for changes.
+	WaitingRequests int
+
+	// Revno holds the latest revno of the store.
+	Revno int64
+
+	// MinWatcherRevno holds the lowest revno reached
+	// by any watcher, which shows how far behind the
+	// slowest watcher is. If there are no watchers,
+	// it is the same as Revno.
+	MinWatcherRevno int64
+}
+
+// Stats returns statistics about the store manager's watchers.
+// They are gathered by the store manager goroutine, so they
+// are consistent with one another.
+func (sm *storeManager) Stats() (MultiwatcherStats, error) {
+	var stats MultiwatcherStats
+	req := &request{
+		reply: make(chan bool, 1),
+		stats: &stats,
+	}
+	select {
+	case sm.request <- req:
+	case <-sm.tomb.Dead():
+		return MultiwatcherStats{}, sm.deadErr()
+	}
+	<-req.reply
+	return stats, nil
+}
+
+// stats returns the current statistics about
+// the store manager's watchers.
+func (sm *storeManager) stats() MultiwatcherStats {
+	stats := MultiwatcherStats{
+		Watchers:        len(sm.watchers),
+		Revno:           sm.all.latestRevno,
+		MinWatcherRevno: sm.all.latestRevno,
+	}
+	for _, req := range sm.waiting {
+		for ; req != nil; req = req.next {
+			stats.WaitingRequests++
+		}
+	}
+	for w := range sm.watchers {
+		if w.revno < stats.MinWatcherRevno {
+			stats.MinWatcherRevno = w.revno
+		}
+	}
+	return stats
+}
+
+// deadErr returns the reason why the store manager,
+// which must be dead, is no longer running.
+func (sm *storeManager) deadErr() error {
+	if err := sm.tomb.Err(); err != nil {
+		return err
+	}
+	return errors.Trace(ErrSharedWatcherStopped)
+}
+
+// MultiwatcherHeartbeat records the last time that
+// a store manager's loop did some work.
+type MultiwatcherHeartbeat struct {
+	// Revno holds the latest revno of the
+	// store at the time of the heartbeat.
+	Revno int64
+
+	// Time holds the time of the heartbeat.
+	Time time.Time
+}
+
+// Heartbeat returns the last heartbeat recorded by the store
+// manager's loop. The loop records a heartbeat only when it does
+// some work, so an idle store manager's heartbeat may be old; if
+// the loop is no longer running, Heartbeat returns the reason why.
+func (sm *storeManager) Heartbeat() (MultiwatcherHeartbeat, error) {
+	select {
+	case <-sm.tomb.Dead():
+		return MultiwatcherHeartbeat{}, sm.deadErr()
+	default:
+	}
+	sm.heartbeatMu.Lock()
+	defer sm.heartbeatMu.Unlock()
+	return sm.heartbeat, nil
+}
+
+// beat records a heartbeat.
+func (sm *storeManager) beat() {
+	sm.heartbeatMu.Lock()
+	defer sm.heartbeatMu.Unlock()
+	sm.heartbeat = MultiwatcherHeartbeat{
+		Revno: sm.all.latestRevno,
+		Time:  sm.clock.Now(),
+	}
+}
+
+// MultiwatcherInfo holds information about one of
+// the watchers of a store manager. See storeManager.Watchers.
+type MultiwatcherInfo struct {
+	// Id holds the id given to the watcher when it
+	// registered with the store manager by making its
+	// first request. It can be passed to ForceStop.
+	Id int64
+
+	// Revno holds the revno that the watcher has reached.
+	Revno int64
+}
+
+// Watchers returns information about the store manager's
+// watchers, ordered by id.
+func (sm *storeManager) Watchers() ([]MultiwatcherInfo, error) {
+	var watchers []MultiwatcherInfo
+	req := &request{
+		reply:    make(chan bool, 1),
+		watchers: &watchers,
+	}
+	select {
+	case sm.request <- req:
+	case <-sm.tomb.Dead():
+		return nil, sm.deadErr()
+	}
+	<-req.reply
+	return watchers, nil
+}
+
+// watcherInfo returns information about
+// the store manager's watchers.
+func (sm *storeManager) watcherInfo() []MultiwatcherInfo {
+	ws := make([]*Multiwatcher, 0, len(sm.watchers))
+	for w := range sm.watchers {
+		ws = append(ws, w)
+	}
+	sort.Sort(multiwatchersBySeq(ws))
+	watchers := make([]MultiwatcherInfo, len(ws))
+	for i, w := range ws {
+		watchers[i] = MultiwatcherInfo{
+			Id:    w.seq,
+			Revno: w.revno,
+		}
+	}
+	return watchers
+}
+
+// ForceStop stops the watcher with the given id, as reported by
+// Watchers, releasing the entities it holds on to. Any call to Next
+// waiting on the watcher, and any later call, fails with
+// ErrForceStopped. ForceStop returns a NotFound error if no watcher
+// with the given id is registered.
+func (sm *storeManager) ForceStop(id int64) error {
+	req := &request{
+		reply:     make(chan bool, 1),
+		forceStop: id,
+	}
+	select {
+	case sm.request <- req:
+	case <-sm.tomb.Dead():
+		return sm.deadErr()
+	}
+	if !<-req.reply {
+		return errors.NotFoundf("watcher %d", id)
+	}
+	return nil
+}
+
+// Pause pauses the store manager, so that no new changes are
+// delivered to watchers until Resume is called. While paused,
+// changes from the backing are held rather than applied, so the
+// store's revno does not advance; changes that were already in the
+// store may still be delivered. Pausing a paused store manager
+// does nothing.
+func (sm *storeManager) Pause() error {
+	return sm.setPaused(&request{pause: true})
+}
+
+// Resume resumes a paused store manager. Any changes held while
+// it was paused are applied before any later request is handled,
+// so that watchers catch up with the backing. Resuming a store
+// manager that is not paused does nothing.
+func (sm *storeManager) Resume() error {
+	return sm.setPaused(&request{unpause: true})
+}
+
+// setPaused makes the given pause or unpause request.
+func (sm *storeManager) setPaused(req *request) error {
+	req.reply = make(chan bool, 1)
+	select {
+	case sm.request <- req:
+	case <-sm.tomb.Dead():
+		return sm.deadErr()
 	}
-	for {
-		select {
-		case <-sm.tomb.Dying():
-			return errors.Trace(tomb.ErrDying)
-		case change := <-in:
-			if err := sm.backing.Changed(sm.all, change); err != nil {
-				return errors.Trace(err)
-			}
-		case req := <-sm.request:
-			sm.handle(req)
-		}
-		sm.respond()
+	<-req.reply
+	return nil
+}
+
+// Get returns the current information held on the entity with the
+// given id, and whether it was found. An entity that has been removed
+// from the backing is not found, even if the store has yet to forget
+// it. The returned entity is a copy and may be changed freely.
+func (sm *storeManager) Get(id multiwatcher.EntityId) (multiwatcher.EntityInfo, bool, error) {
+	req := &request{
+		reply: make(chan bool, 1),
+		get:   &id,
+	}
+	select {
+	case sm.request <- req:
+	case <-sm.tomb.Dead():
+		return nil, false, sm.deadErr()
+	}
+	if !<-req.reply {
+		return nil, false, nil
+	}
+	return req.info, true, nil
+}
+
+// get returns a copy of the entity with the given id,
+// or nil if it is not in the store or has been removed.
+func (sm *storeManager) get(id multiwatcher.EntityId) multiwatcher.EntityInfo {
+	elem := sm.all.entities[id]
+	if elem == nil {
+		return nil
+	}
+	entry := elem.Value.(*entityEntry)
+	if entry.removed {
+		return nil
 	}
+	return entry.info.Clone()
 }
 
 // Stop stops the storeManager.
@@ -207,21 +1591,114 @@ func (sm *storeManager) Stop() error {
 
 // handle processes a request from a Multiwatcher to the storeManager.
 func (sm *storeManager) handle(req *request) {
+	if req.stats != nil {
+		*req.stats = sm.stats()
+		req.send(true)
+		return
+	}
+	if req.watchers != nil {
+		*req.watchers = sm.watcherInfo()
+		req.send(true)
+		return
+	}
+	if req.get != nil {
+		req.info = sm.get(*req.get)
+		req.send(req.info != nil)
+		return
+	}
+	if req.pause || req.unpause {
+		switch {
+		case req.pause && !sm.paused:
+			logger.Infof("pausing store manager")
+		case req.unpause && sm.paused:
+			logger.Infof("resuming store manager with %d changes held", len(sm.held))
+		}
+		sm.paused = req.pause
+		req.send(true)
+		return
+	}
+	if req.forceStop != 0 {
+		for w := range sm.watchers {
+			if w.seq == req.forceStop {
+				sm.stopWatcher(w, ErrForceStopped)
+				req.send(true)
+				return
+			}
+		}
+		req.send(false)
+		return
+	}
+	if req.w == nil {
+		// This is a request for a snapshot on behalf of
+		// no watcher, so no references need to be taken.
+		req.changes = sm.all.ChangesSince(0)
+		req.revno = sm.all.latestRevno
+		req.send(true)
+		return
+	}
+	if req.cancel != nil {
+		sm.withdraw(req.cancel)
+		return
+	}
 	if req.w.stopped {
 		// The watcher has previously been stopped.
 		if req.reply != nil {
-			req.reply <- false
+			req.err = req.w.err
+			req.send(false)
 		}
 		return
 	}
 	if req.reply == nil {
 		// This is a request to stop the watcher.
-		for req := sm.waiting[req.w]; req != nil; req = req.next {
-			req.reply <- false
+		if req.drain {
+			sm.drain(req.w)
 		}
-		delete(sm.waiting, req.w)
-		req.w.stopped = true
+		sm.stopWatcher(req.w, nil)
+		return
+	}
+	if !sm.watchers[req.w] {
+		sm.lastSeq++
+		req.w.seq = sm.lastSeq
+		sm.watchers[req.w] = true
+	}
+	if req.reset {
+		// Drop the references the watcher holds, as it
+		// will take them again when it is told about
+		// the entities afresh.
 		sm.leave(req.w)
+		req.w.revno = 0
+		if req.w.visible != nil {
+			req.w.visible = make(map[interface{}]multiwatcher.EntityInfo)
+		}
+		if req.w.sent != nil {
+			req.w.sent = make(map[interface{}]multiwatcher.EntityInfo)
+		}
+		req.send(true)
+		return
+	}
+	if req.resume {
+		if req.latest {
+			req.revno = sm.all.latestRevno
+		}
+		req.err = sm.resume(req.w, req.revno)
+		req.send(req.err == nil)
+		return
+	}
+	if req.peek {
+		req.changes = sm.peek(req.w)
+		req.revno = req.w.revno
+		req.send(true)
+		return
+	}
+	if req.snapshot {
+		// Reply straight away with everything the
+		// watcher hasn't yet seen.
+		revno := req.w.revno
+		req.changes = sm.changesSince(req.w, revno)
+		req.w.revno = sm.all.latestRevno
+		req.revno = req.w.revno
+		req.send(true)
+		sm.seen(req.w, revno)
 		return
 	}
 	// Add request to head of list.
@@ -229,37 +1706,311 @@ func (sm *storeManager) handle(req *request) {
 	sm.waiting[req.w] = req
 }
 
+// send replies to the request without blocking. The reply channel
+// has room for the reply unless the requester has broken the
+// contract documented on request.reply, in which case the reply is
+// dropped rather than stalling the storeManager and every other
+// watcher with it.
+func (req *request) send(ok bool) {
+	select {
+	case req.reply <- ok:
+	default:
+		logger.Errorf("dropping reply to request from watcher %p: no room in reply channel", req.w)
+	}
+}
+
 // respond responds to all outstanding requests that are satisfiable.
-func (sm *storeManager) respond() {
-	for w, req := range sm.waiting {
+// If any requests have changes available but are being throttled, it
+// returns the earliest time at which one of them may be responded to;
+// otherwise it returns the zero time.
+func (sm *storeManager) respond() time.Time {
+	var next time.Time
+	now := sm.clock.Now()
+	for _, w := range sm.respondOrder() {
+		req := sm.waiting[w]
 		revno := w.revno
-		changes := sm.all.ChangesSince(revno)
+		if revno == sm.all.latestRevno {
+			continue
+		}
+		if w.minInterval > 0 && !w.lastDelivery.IsZero() {
+			due := w.lastDelivery.Add(w.minInterval)
+			if now.Before(due) {
+				if next.IsZero() || due.Before(next) {
+					next = due
+				}
+				continue
+			}
+		}
+		changes := sm.changesSince(w, revno)
 		if len(changes) == 0 {
+			if w.kinds != nil {
+				// All the changes are to entities that the
+				// watcher isn't interested in, so it can
+				// skip past them without a reply.
+				w.revno = sm.all.latestRevno
+				sm.seen(w, revno)
+			}
 			continue
 		}
-		req.changes = changes
-		w.revno = sm.all.latestRevno
-		req.reply <- true
-		if req := req.next; req == nil {
-			// Last request for this watcher.
-			delete(sm.waiting, w)
-		} else {
-			sm.waiting[w] = req
+		sm.deliver(req, changes, now)
+	}
+	sm.detachLagging()
+	sm.detachStalled()
+	return next
+}
+
+// respondOrder returns the watchers with waiting requests in the order
+// in which respond should serve them. They are served in the order in
+// which they registered, starting at a different watcher each time,
+// so that no watcher is always served last.
+func (sm *storeManager) respondOrder() []*Multiwatcher {
+	ws := make(multiwatchersBySeq, 0, len(sm.waiting))
+	for w := range sm.waiting {
+		ws = append(ws, w)
+	}
+	if len(ws) == 0 {
+		return nil
+	}
+	sort.Sort(ws)
+	start := sm.turn % len(ws)
+	sm.turn++
+	order := make([]*Multiwatcher, 0, len(ws))
+	order = append(order, ws[start:]...)
+	return append(order, ws[:start]...)
+}
+
+type multiwatchersBySeq []*Multiwatcher
+
+func (ws multiwatchersBySeq) Len() int           { return len(ws) }
+func (ws multiwatchersBySeq) Swap(i, j int)      { ws[i], ws[j] = ws[j], ws[i] }
+func (ws multiwatchersBySeq) Less(i, j int) bool { return ws[i].seq < ws[j].seq }
+
+// detachLagging stops any watchers that are not waiting for
+// changes and have more changes pending than they allow.
+func (sm *storeManager) detachLagging() {
+	for w := range sm.watchers {
+		if w.maxPending == 0 || sm.waiting[w] != nil {
+			continue
+		}
+		if sm.all.latestRevno-w.revno <= w.maxPending {
+			continue
+		}
+		logger.Debugf("watcher %d has more than %d changes pending", w.seq, w.maxPending)
+		sm.stopWatcher(w, ErrFellBehind)
+	}
+}
+
+// maxRemovedEntries holds the number of removed entities that the
+// store may keep for watchers yet to be told about their removal
+// before the watchers furthest behind are stopped. See detachStalled.
+var maxRemovedEntries = 10000
+
+// detachStalled stops the watchers that are furthest behind, one at
+// a time, while the store holds more than maxRemovedEntries removed
+// entities, so that a client that stops calling Next cannot make
+// the store grow without bound. Watchers waiting for changes are
+// never stopped, and neither are watchers that have yet to be told
+// about anything, as they hold no references.
+func (sm *storeManager) detachStalled() {
+	for sm.all.removedCount > maxRemovedEntries {
+		var stalled *Multiwatcher
+		for w := range sm.watchers {
+			if sm.waiting[w] != nil || w.revno == 0 || w.revno == sm.all.latestRevno {
+				continue
+			}
+			if stalled == nil || w.revno < stalled.revno || w.revno == stalled.revno && w.seq < stalled.seq {
+				stalled = w
+			}
+		}
+		if stalled == nil {
+			return
+		}
+		logger.Debugf("store holds %d removed entities; watcher %d is furthest behind", sm.all.removedCount, stalled.seq)
+		sm.stopWatcher(stalled, ErrFellBehind)
+	}
+}
+
+// stopWatcher stops the given watcher, replying to any requests
+// waiting on it. Later requests from the watcher fail with err,
+// or with ErrStopped if err is nil.
+func (sm *storeManager) stopWatcher(w *Multiwatcher, err error) {
+	if err != nil {
+		sm.warningf("stopping watcher %d: %v", w.seq, err)
+	}
+	for req := sm.waiting[w]; req != nil; req = req.next {
+		req.err = err
+		req.send(false)
+	}
+	delete(sm.waiting, w)
+	delete(sm.watchers, w)
+	w.stopped = true
+	w.err = err
+	sm.leave(w)
+}
+
+// drain delivers any changes available to the given watcher to
+// its waiting request, if it has one, regardless of throttling.
+func (sm *storeManager) drain(w *Multiwatcher) {
+	req := sm.waiting[w]
+	if req == nil || w.revno == sm.all.latestRevno {
+		return
+	}
+	if changes := sm.changesSince(w, w.revno); len(changes) > 0 {
+		sm.deliver(req, changes, sm.clock.Now())
+	}
+}
+
+// deliver replies to the given request, which must be the first
+// waiting request for its watcher, with the given changes since
+// the watcher's revno, and brings the watcher up to date.
+func (sm *storeManager) deliver(req *request, changes []multiwatcher.Delta, now time.Time) {
+	w := req.w
+	revno := w.revno
+	if !w.shareDeltas {
+		for i := range changes {
+			changes[i].Entity = changes[i].Entity.Clone()
+		}
+	}
+	req.changes = changes
+	w.revno = sm.all.latestRevno
+	w.lastDelivery = now
+	req.revno = w.revno
+	req.send(true)
+	if req := req.next; req == nil {
+		// Last request for this watcher.
+		delete(sm.waiting, w)
+	} else {
+		sm.waiting[w] = req
+	}
+	sm.seen(w, revno)
+}
+
+// peek returns the changes that would be delivered to the given
+// watcher now, leaving the watcher, and the references it holds,
+// as they are.
+func (sm *storeManager) peek(w *Multiwatcher) []multiwatcher.Delta {
+	if w.revno == sm.all.latestRevno {
+		return nil
+	}
+	// Scoping and compacting the changes update the entities
+	// known to the watcher, so work on copies.
+	visible, sent := w.visible, w.sent
+	w.visible, w.sent = copyInfos(visible), copyInfos(sent)
+	defer func() {
+		w.visible, w.sent = visible, sent
+	}()
+	changes := sm.changesSince(w, w.revno)
+	if !w.shareDeltas {
+		for i := range changes {
+			changes[i].Entity = changes[i].Entity.Clone()
+		}
+	}
+	return changes
+}
+
+// copyInfos returns a copy of the given map,
+// or nil if it is nil.
+func copyInfos(infos map[interface{}]multiwatcher.EntityInfo) map[interface{}]multiwatcher.EntityInfo {
+	if infos == nil {
+		return nil
+	}
+	c := make(map[interface{}]multiwatcher.EntityInfo, len(infos))
+	for id, info := range infos {
+		c[id] = info
+	}
+	return c
+}
+
+// withdraw removes the given request from the list of
+// outstanding requests on its watcher, if it is there.
+func (sm *storeManager) withdraw(req *request) {
+	var prev *request
+	for r := sm.waiting[req.w]; r != nil; prev, r = r, r.next {
+		if r != req {
+			continue
+		}
+		switch {
+		case prev != nil:
+			prev.next = r.next
+		case r.next != nil:
+			sm.waiting[req.w] = r.next
+		default:
+			delete(sm.waiting, req.w)
+		}
+		return
+	}
+}
+
+// resume positions the given new watcher at the given revno,
+// taking references to all the entities it knows about
+// at that revno.
+func (sm *storeManager) resume(w *Multiwatcher, revno int64) error {
+	if revno < 0 || revno > sm.all.latestRevno {
+		return errors.NotValidf("revno %d", revno)
+	}
+	if revno < sm.all.forgottenRevno {
+		return ErrRevnoExpired
+	}
+	w.revno = revno
+	for e := sm.all.list.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*entityEntry)
+		if entry.creationRevno > revno || !w.wants(entry.info.EntityId().Kind) {
+			continue
+		}
+		if entry.removed && entry.revno <= revno {
+			// The watcher already knows the entity
+			// has been removed.
+			continue
 		}
-		sm.seen(revno)
+		entry.refCount++
+		if w.inScope != nil && !entry.removed && w.inScope(entry.info) {
+			// We can't know what the watcher was told, so
+			// assume that it knows about the entity as it is.
+			w.visible[entry.key()] = entry.info
+		}
+	}
+	return nil
+}
+
+// changesSince returns the changes since the given revno
+// to the entities that the given watcher is interested in.
+// The changes are assumed to be delivered to the watcher.
+func (sm *storeManager) changesSince(w *Multiwatcher, revno int64) []multiwatcher.Delta {
+	wanted := sm.all.ChangesSince(revno)
+	if w.kinds != nil {
+		changes := wanted
+		wanted = changes[:0]
+		for _, change := range changes {
+			if w.wants(change.Entity.EntityId().Kind) {
+				wanted = append(wanted, change)
+			}
+		}
+	}
+	if w.inScope != nil {
+		wanted = w.scope(wanted)
 	}
+	if w.sent != nil {
+		wanted = w.compact(wanted)
+	}
+	return wanted
 }
 
-// seen states that a Multiwatcher has just been given information about
-// all entities newer than the given revno.  We assume it has already
-// seen all the older entities.
-func (sm *storeManager) seen(revno int64) {
+// seen states that the given Multiwatcher has just been given
+// information about all entities newer than the given revno that it is
+// interested in. We assume it has already seen all the older entities.
+func (sm *storeManager) seen(w *Multiwatcher, revno int64) {
 	for e := sm.all.list.Front(); e != nil; {
 		next := e.Next()
 		entry := e.Value.(*entityEntry)
 		if entry.revno <= revno {
 			break
 		}
+		if !w.wants(entry.info.EntityId().Kind) {
+			// The watcher never sees entities of this
+			// kind, so holds no reference to them.
+			e = next
+			continue
+		}
 		if entry.creationRevno > revno {
 			if !entry.removed {
 				// This is a new entity that hasn't been seen yet,
@@ -283,7 +2034,7 @@ func (sm *storeManager) leave(w *Multiwatcher) {
 	for e := sm.all.list.Front(); e != nil; {
 		next := e.Next()
 		entry := e.Value.(*entityEntry)
-		if entry.creationRevno <= w.revno {
+		if entry.creationRevno <= w.revno && w.wants(entry.info.EntityId().Kind) {
 			// The watcher has seen this entry.
 			if entry.removed && entry.revno <= w.revno {
 				// The entity has been removed and the
@@ -315,6 +2066,11 @@ type entityEntry struct {
 	// removed marks whether the entity has been removed.
 	removed bool
 
+	// updated holds the time at which the entity was last
+	// changed or removed. It is for diagnostic purposes only
+	// and plays no part in deciding what watchers are sent.
+	updated time.Time
+
 	// refCount holds a count of the number of watchers that
 	// have seen this entity. When the entity is marked as removed,
 	// the ref count is decremented whenever a Multiwatcher that
@@ -325,6 +2081,33 @@ type entityEntry struct {
 
 	// info holds the actual information on the entity.
 	info multiwatcher.EntityInfo
+
+	// source identifies the backing that reported the entity
+	// when the store holds the entities of several. See
+	// multiwatcherStore.source.
+	source string
+}
+
+// key returns the key of the entry in the store's entities.
+func (entry *entityEntry) key() interface{} {
+	return entityKey(entry.source, entry.info.EntityId())
+}
+
+// sourcedEntityId identifies an entity reported by
+// one of several backings. See entityKey.
+type sourcedEntityId struct {
+	source string
+	id     multiwatcher.EntityId
+}
+
+// entityKey returns the key under which the store holds the
+// entity with the given id reported by the given source. The
+// entities of the default source are held under their ids.
+func entityKey(source string, id multiwatcher.EntityId) interface{} {
+	if source == "" {
+		return id
+	}
+	return sourcedEntityId{source, id}
 }
 
 // multiwatcherStore holds a list of all entities known
@@ -333,6 +2116,60 @@ type multiwatcherStore struct {
 	latestRevno int64
 	entities    map[interface{}]*list.Element
 	list        *list.List
+
+	// clock is used to timestamp changes to entries.
+	clock clock.Clock
+
+	// forgottenRevno holds the latest revno at which an entity
+	// was removed whose tombstone has since been dropped, so that
+	// its removal can no longer be reported. See bury.
+	forgottenRevno int64
+
+	// removedCount holds the number of entries for removed
+	// entities that some watcher has yet to be told about.
+	removedCount int
+
+	// workloadVersions holds, for each service key, the number
+	// of units in the store reporting each workload version, so
+	// that the version of a service can be found without visiting
+	// all its units. See countWorkloadVersion.
+	workloadVersions map[interface{}]map[string]int
+
+	// source identifies the backing whose entities are being
+	// added, updated and removed, when the store holds the
+	// entities of several backings, so that each backing may
+	// report entities with the same ids as another. It is set
+	// only for the duration of a call to withSource; otherwise
+	// it is empty, the default source.
+	source string
+
+	// tombstones holds the most recently removed entities in a
+	// ring of at most maxTombstones entries, the oldest of which
+	// is at tombstoneStart. See bury.
+	tombstones     []tombstone
+	tombstoneStart int
+}
+
+// maxTombstones holds the number of removed entities that
+// the store remembers so that it can report their removal.
+var maxTombstones = 1000
+
+// tombstone records an entity that has been deleted from the store.
+type tombstone struct {
+	// info holds the last information on the entity.
+	info multiwatcher.EntityInfo
+
+	// creationRevno holds the revno at which the entity was created.
+	creationRevno int64
+
+	// revno holds the revno at which the entity was removed.
+	revno int64
+
+	// removed holds the time at which the entity was removed.
+	removed time.Time
+
+	// source holds the source that reported the entity.
+	source string
 }
 
 // newStore returns an Store instance holding information about the
@@ -342,6 +2179,7 @@ func newStore() *multiwatcherStore {
 	return &multiwatcherStore{
 		entities: make(map[interface{}]*list.Element),
 		list:     list.New(),
+		clock:    GetClock(),
 	}
 }
 
@@ -359,10 +2197,48 @@ func (a *multiwatcherStore) All() []multiwatcher.EntityInfo {
 	return entities
 }
 
-// add adds a new entity with the given id and associated
+// Len returns the number of entries in the store, including
+// those for removed entities that some watchers have yet to
+// be told about.
+func (a *multiwatcherStore) Len() int {
+	return a.list.Len()
+}
+
+// ForEach calls f for each entry in the store, including those for
+// removed entities, in increasing revno order; that is, the least
+// recently changed entry comes first. Because a change moves an
+// entry to the end, this is creation order only for entries that
+// have not changed since they were added. f must not change the
+// store.
+func (a *multiwatcherStore) ForEach(f func(entry *entityEntry)) {
+	for e := a.list.Back(); e != nil; e = e.Prev() {
+		f(e.Value.(*entityEntry))
+	}
+}
+
+// withSource calls f with the store's source set to the given
+// source, so that the entities added, updated and removed by f
+// are told apart from those with the same ids reported by other
+// sources. See NewMultiBacking.
+func (a *multiwatcherStore) withSource(source string, f func() error) error {
+	old := a.source
+	a.source = source
+	defer func() {
+		a.source = old
+	}()
+	return f()
+}
+
+// key returns the key under which the store holds the entity
+// with the given id reported by the current source.
+func (a *multiwatcherStore) key(id multiwatcher.EntityId) interface{} {
+	return entityKey(a.source, id)
+}
+
+// add adds a new entity with the given key and associated
 // information to the list.
-func (a *multiwatcherStore) add(id interface{}, info multiwatcher.EntityInfo) {
-	if a.entities[id] != nil {
+func (a *multiwatcherStore) add(key interface{}, info multiwatcher.EntityInfo) {
+	if a.entities[key] != nil {
 		panic("adding new entry with duplicate id")
 	}
 	a.latestRevno++
@@ -370,8 +2246,41 @@ func (a *multiwatcherStore) add(id interface{}, info multiwatcher.EntityInfo) {
 		info:          info,
 		revno:         a.latestRevno,
 		creationRevno: a.latestRevno,
+		updated:       a.clock.Now(),
+		source:        a.source,
+	}
+	a.entities[key] = a.list.PushFront(entry)
+	a.countWorkloadVersion(a.source, info, 1)
+}
+
+// countWorkloadVersion adds n to the number of units of the service
+// reporting the workload version of the given unit, reported by the
+// given source. It does nothing if info is not a unit or the unit
+// has not reported a version.
+func (a *multiwatcherStore) countWorkloadVersion(source string, info multiwatcher.EntityInfo, n int) {
+	unit, ok := info.(*multiwatcher.UnitInfo)
+	if !ok || unit.WorkloadStatus.Version == "" {
+		return
+	}
+	service := entityKey(source, multiwatcher.EntityId{
+		Kind:    "service",
+		EnvUUID: unit.EnvUUID,
+		Id:      unit.Service,
+	})
+	if a.workloadVersions == nil {
+		a.workloadVersions = make(map[interface{}]map[string]int)
+	}
+	counts := a.workloadVersions[service]
+	if counts == nil {
+		counts = make(map[string]int)
+		a.workloadVersions[service] = counts
+	}
+	if counts[unit.WorkloadStatus.Version] += n; counts[unit.WorkloadStatus.Version] == 0 {
+		delete(counts, unit.WorkloadStatus.Version)
+		if len(counts) == 0 {
+			delete(a.workloadVersions, service)
+		}
 	}
-	a.entities[id] = a.list.PushFront(entry)
 }
 
 // decRef decrements the reference count of an entry within the list,
@@ -386,51 +2295,160 @@ func (a *multiwatcherStore) decRef(entry *entityEntry) {
 	if !entry.removed {
 		return
 	}
-	id := entry.info.EntityId()
-	elem := a.entities[id]
+	key := entry.key()
+	elem := a.entities[key]
 	if elem == nil {
 		panic("delete of non-existent entry")
 	}
-	delete(a.entities, id)
+	delete(a.entities, key)
 	a.list.Remove(elem)
+	a.removedCount--
+}
+
+// check verifies the invariants that hold between the parts of the
+// store, returning an error describing the first violation found.
+// It is intended for use in tests and when debugging.
+func (a *multiwatcherStore) check() error {
+	if len(a.entities) != a.list.Len() {
+		return errors.Errorf("store has %d entities but %d list entries", len(a.entities), a.list.Len())
+	}
+	prevRevno := a.latestRevno + 1
+	removedCount := 0
+	versions := &multiwatcherStore{}
+	for e := a.list.Front(); e != nil; e = e.Next() {
+		entry, ok := e.Value.(*entityEntry)
+		if !ok {
+			return errors.Errorf("list entry holds %T, not an entity entry", e.Value)
+		}
+		id := entry.key()
+		if a.entities[id] != e {
+			return errors.Errorf("entity %v does not refer to its list entry", id)
+		}
+		switch {
+		case entry.revno >= prevRevno:
+			return errors.Errorf("entity %v has revno %d, not below %d", id, entry.revno, prevRevno)
+		case entry.creationRevno > entry.revno:
+			return errors.Errorf("entity %v was created at revno %d after its revno %d", id, entry.creationRevno, entry.revno)
+		case entry.refCount < 0:
+			return errors.Errorf("entity %v has negative reference count %d", id, entry.refCount)
+		case entry.removed && entry.refCount == 0:
+			return errors.Errorf("entity %v is removed but unreferenced", id)
+		}
+		if entry.removed {
+			removedCount++
+		} else {
+			versions.countWorkloadVersion(entry.source, entry.info, 1)
+		}
+		prevRevno = entry.revno
+	}
+	if removedCount != a.removedCount {
+		return errors.Errorf("store has %d removed entities but records %d", removedCount, a.removedCount)
+	}
+	if len(versions.workloadVersions) != len(a.workloadVersions) || len(a.workloadVersions) > 0 && !reflect.DeepEqual(versions.workloadVersions, a.workloadVersions) {
+		return errors.Errorf("store records workload versions %v but its units report %v", a.workloadVersions, versions.workloadVersions)
+	}
+	if a.forgottenRevno > a.latestRevno {
+		return errors.Errorf("forgotten revno %d is after latest revno %d", a.forgottenRevno, a.latestRevno)
+	}
+	if a.tombstoneStart < 0 || a.tombstoneStart > 0 && a.tombstoneStart >= len(a.tombstones) {
+		return errors.Errorf("tombstone ring starts at %d of %d", a.tombstoneStart, len(a.tombstones))
+	}
+	for i := range a.tombstones {
+		dead := a.buried(i)
+		if dead.revno > a.latestRevno || dead.revno <= a.forgottenRevno || i > 0 && dead.revno <= a.buried(i-1).revno {
+			return errors.Errorf("tombstone for entity %v has revno %d out of order", dead.info.EntityId(), dead.revno)
+		}
+	}
+	return nil
 }
 
-// delete deletes the entry with the given info id.
-func (a *multiwatcherStore) delete(id multiwatcher.EntityId) {
-	elem := a.entities[id]
+// delete deletes the entry with the given key.
+func (a *multiwatcherStore) delete(key interface{}) {
+	elem := a.entities[key]
 	if elem == nil {
 		return
 	}
-	delete(a.entities, id)
+	delete(a.entities, key)
 	a.list.Remove(elem)
 }
 
+// bury records that the given entity reported by the given source,
+// created at creationRevno, was removed at revno, which must be later
+// than that of any entity already buried, so that ChangesSince can
+// report its removal even after it has been deleted from the store.
+// Only the most recently removed maxTombstones entities are
+// remembered: once the ring of tombstones is full, each new one
+// replaces the oldest, and the revno at which that entity was
+// removed is kept in forgottenRevno.
+func (a *multiwatcherStore) bury(source string, info multiwatcher.EntityInfo, creationRevno, revno int64, removed time.Time) {
+	dead := tombstone{
+		info:          info,
+		creationRevno: creationRevno,
+		revno:         revno,
+		removed:       removed,
+		source:        source,
+	}
+	switch {
+	case maxTombstones <= 0:
+		a.forgottenRevno = revno
+	case len(a.tombstones) < maxTombstones:
+		a.tombstones = append(a.tombstones, dead)
+	default:
+		oldest := &a.tombstones[a.tombstoneStart]
+		a.forgottenRevno = oldest.revno
+		*oldest = dead
+		a.tombstoneStart = (a.tombstoneStart + 1) % len(a.tombstones)
+	}
+}
+
+// buried returns the i'th oldest tombstone held by the store.
+func (a *multiwatcherStore) buried(i int) tombstone {
+	return a.tombstones[(a.tombstoneStart+i)%len(a.tombstones)]
+}
+
+// buriedSince returns the index, as passed to buried, of the oldest
+// tombstone for an entity removed after the given revno.
+func (a *multiwatcherStore) buriedSince(revno int64) int {
+	return sort.Search(len(a.tombstones), func(i int) bool {
+		return a.buried(i).revno > revno
+	})
+}
+
 // Remove marks that the entity with the given id has
 // been removed from the backing. If nothing has seen the
 // entity, then we delete it immediately.
 func (a *multiwatcherStore) Remove(id multiwatcher.EntityId) {
-	if elem := a.entities[id]; elem != nil {
+	key := a.key(id)
+	if elem := a.entities[key]; elem != nil {
 		entry := elem.Value.(*entityEntry)
 		if entry.removed {
 			return
 		}
 		a.latestRevno++
+		a.countWorkloadVersion(entry.source, entry.info, -1)
+		now := a.clock.Now()
+		// The entity is buried straight away, even if it is kept
+		// until all watchers have seen its removal, so that the
+		// tombstones are made in revno order.
+		a.bury(entry.source, entry.info, entry.creationRevno, a.latestRevno, now)
 		if entry.refCount == 0 {
-			a.delete(id)
+			a.delete(key)
 			return
 		}
 		entry.revno = a.latestRevno
 		entry.removed = true
+		a.removedCount++
+		entry.updated = now
 		a.list.MoveToFront(elem)
 	}
 }
 
 // Update updates the information for the given entity.
 func (a *multiwatcherStore) Update(info multiwatcher.EntityInfo) {
-	id := info.EntityId()
-	elem := a.entities[id]
+	key := a.key(info.EntityId())
+	elem := a.entities[key]
 	if elem == nil {
-		a.add(id, info)
+		a.add(key, info)
 		return
 	}
 	entry := elem.Value.(*entityEntry)
@@ -442,23 +2460,73 @@ func (a *multiwatcherStore) Update(info multiwatcher.EntityInfo) {
 	// We already know about the entity; update its doc.
 	a.latestRevno++
 	entry.revno = a.latestRevno
+	if !entry.removed {
+		a.countWorkloadVersion(entry.source, entry.info, -1)
+		a.countWorkloadVersion(entry.source, info, 1)
+	}
 	entry.info = info
+	entry.updated = a.clock.Now()
 	a.list.MoveToFront(elem)
 }
 
-// Get returns the stored entity with the given
-// id, or nil if none was found. The contents of the returned entity
+// Get returns the stored entity with the given id reported
+// by the current source, or nil if none was found. The contents of the returned entity
 // should not be changed.
 func (a *multiwatcherStore) Get(id multiwatcher.EntityId) multiwatcher.EntityInfo {
-	if e := a.entities[id]; e != nil {
+	if e := a.entities[a.key(id)]; e != nil {
 		return e.Value.(*entityEntry).info
 	}
 	return nil
 }
 
 // ChangesSince returns any changes that have occurred since
-// the given revno, oldest first.
+// the given revno, oldest first. The removal of an entity that
+// existed at the revno is reported even if the entity has since
+// been deleted from the store, as long as it is one of the last
+// maxTombstones entities to be removed.
 func (a *multiwatcherStore) ChangesSince(revno int64) []multiwatcher.Delta {
+	changes, _ := a.ChangesSinceLimit(revno, 0)
+	return changes
+}
+
+// ChangesSinceTime is like ChangesSince but returns the changes made
+// after the given time, as told by the store's clock. The changes are
+// found by looking for the latest revno reached at or before t, so
+// they are only accurate if the clock never goes backwards: were it
+// to be stepped back, changes made after t might be left out, or
+// changes made before it included. If nothing in the store was last
+// changed at or before t, the changes are those since the start, which
+// leave out the removal of entities that are no longer held. Times
+// taken from another clock
+// are subject to any skew between the two, so a client that wants
+// exactly the changes it has not seen should track revnos instead.
+func (a *multiwatcherStore) ChangesSinceTime(t time.Time) []multiwatcher.Delta {
+	var revno int64
+	for e := a.list.Front(); e != nil; e = e.Next() {
+		if entry := e.Value.(*entityEntry); !entry.updated.After(t) {
+			revno = entry.revno
+			break
+		}
+	}
+	for i := len(a.tombstones) - 1; i >= 0; i-- {
+		if dead := a.buried(i); !dead.removed.After(t) {
+			if dead.revno > revno {
+				revno = dead.revno
+			}
+			break
+		}
+	}
+	return a.ChangesSince(revno)
+}
+
+// ChangesSinceLimit is like ChangesSince but returns at most limit
+// changes; if limit is zero or less, all changes are returned. It also
+// returns the revno to pass to the next call to get the changes that
+// were left out. Changes are returned in revno order, so an entity
+// that changes between calls will be returned again by a later call
+// with its latest information. Within one call, each entity is
+// reported at most once, in the position of its latest change.
+func (a *multiwatcherStore) ChangesSinceLimit(revno int64, limit int) ([]multiwatcher.Delta, int64) {
 	e := a.list.Front()
 	n := 0
 	for ; e != nil; e = e.Next() {
@@ -476,18 +2544,71 @@ func (a *multiwatcherStore) ChangesSince(revno int64) []multiwatcher.Delta {
 		e = a.list.Back()
 		n++
 	}
+	t := a.buriedSince(revno)
+	n += len(a.tombstones) - t
+	if limit > 0 && n > limit {
+		n = limit
+	}
 	changes := make([]multiwatcher.Delta, 0, n)
-	for ; e != nil; e = e.Prev() {
-		entry := e.Value.(*entityEntry)
-		if entry.removed && entry.creationRevno > revno {
-			// Don't include entries that have been created
-			// and removed since the revno.
+	// index holds the position in changes of the delta reported
+	// for each entity, and existed records the entities that
+	// existed at the revno, so that each entity is reported at
+	// most once, with its latest information.
+	index := make(map[interface{}]int)
+	existed := make(map[interface{}]bool)
+	count := 0
+	report := func(d multiwatcher.Delta, creationRevno int64) {
+		id := entityKey(d.Source, d.Entity.EntityId())
+		if creationRevno <= revno {
+			existed[id] = true
+		}
+		if i, ok := index[id]; ok {
+			// Drop the earlier delta in favour of this one.
+			changes[i].Entity = nil
+			delete(index, id)
+			count--
+		}
+		if d.Removed && !existed[id] {
+			// The entity came and went since the revno.
+			return
+		}
+		index[id] = len(changes)
+		changes = append(changes, d)
+		count++
+	}
+	next := revno
+	for e != nil || t < len(a.tombstones) {
+		if limit > 0 && count >= limit {
+			break
+		}
+		if t < len(a.tombstones) && (e == nil || a.buried(t).revno < e.Value.(*entityEntry).revno) {
+			dead := a.buried(t)
+			t++
+			next = dead.revno
+			report(multiwatcher.Delta{
+				Removed: true,
+				Entity:  dead.info,
+				Source:  dead.source,
+			}, dead.creationRevno)
 			continue
 		}
-		changes = append(changes, multiwatcher.Delta{
+		entry := e.Value.(*entityEntry)
+		e = e.Prev()
+		next = entry.revno
+		report(multiwatcher.Delta{
 			Removed: entry.removed,
 			Entity:  entry.info,
-		})
+			Source:  entry.source,
+		}, entry.creationRevno)
 	}
-	return changes
+	if count < len(changes) {
+		kept := changes[:0]
+		for _, d := range changes {
+			if d.Entity != nil {
+				kept = append(kept, d)
+			}
+		}
+		changes = kept
+	}
+	return changes, next
 }
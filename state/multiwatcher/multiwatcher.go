@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/juju/names"
 	"gopkg.in/juju/charm.v6-unstable"
 
 	"github.com/juju/juju/constraints"
@@ -29,6 +30,15 @@ type EntityInfo interface {
 	// EntityId returns an identifier that will uniquely
 	// identify the entity within its kind
 	EntityId() EntityId
+
+	// EntityName returns the string form of the tag of the
+	// entity, such as "machine-0" or "unit-wordpress-0", or the
+	// empty string if the entity has no valid tag.
+	EntityName() string
+
+	// Clone returns a deep copy of the entity info, sharing
+	// no mutable data with the original.
+	Clone() EntityInfo
 }
 
 // EntityId uniquely identifies an entity being tracked by the
@@ -46,19 +56,38 @@ type Delta struct {
 	Removed bool
 	// Entity holds data about the entity that has changed.
 	Entity EntityInfo
+	// If Fields is not nil, the delta is partial: Entity holds
+	// only the fields named in Fields, which have changed, and
+	// those identifying the entity. The other fields are as
+	// they were last reported. See PartialDelta.
+	Fields []string
+	// Source identifies the backing that reported the entity
+	// when the changes of several backings are combined, so
+	// that entities with the same id can be told apart. It is
+	// empty otherwise, and is not sent to API clients.
+	Source string
 }
 
 // MarshalJSON implements json.Marshaler.
 func (d *Delta) MarshalJSON() ([]byte, error) {
-	b, err := json.Marshal(d.Entity)
+	var b []byte
+	var err error
+	if d.Fields != nil {
+		b, err = marshalPartial(d)
+	} else {
+		b, err = json.Marshal(d.Entity)
+	}
 	if err != nil {
 		return nil, err
 	}
 	var buf bytes.Buffer
 	buf.WriteByte('[')
 	c := "change"
-	if d.Removed {
+	switch {
+	case d.Removed:
 		c = "remove"
+	case d.Fields != nil:
+		c = "partial"
 	}
 	fmt.Fprintf(&buf, "%q,%q,", d.Entity.EntityId().Kind, c)
 	buf.Write(b)
@@ -84,30 +113,20 @@ func (d *Delta) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(elements[1], &operation); err != nil {
 		return err
 	}
-	if operation == "remove" {
+	switch operation {
+	case "remove":
 		d.Removed = true
-	} else if operation != "change" {
+	case "change", "partial":
+	default:
 		return fmt.Errorf("Unexpected operation %q", operation)
 	}
-	switch entityKind {
-	case "environment":
-		d.Entity = new(EnvironmentInfo)
-	case "machine":
-		d.Entity = new(MachineInfo)
-	case "service":
-		d.Entity = new(ServiceInfo)
-	case "unit":
-		d.Entity = new(UnitInfo)
-	case "relation":
-		d.Entity = new(RelationInfo)
-	case "annotation":
-		d.Entity = new(AnnotationInfo)
-	case "block":
-		d.Entity = new(BlockInfo)
-	case "action":
-		d.Entity = new(ActionInfo)
-	default:
-		return fmt.Errorf("Unexpected entity name %q", entityKind)
+	entity, err := NewEntityInfo(entityKind)
+	if err != nil {
+		return err
+	}
+	d.Entity = entity
+	if operation == "partial" {
+		return unmarshalPartial(d, elements[2])
 	}
 	return json.Unmarshal(elements[2], &d.Entity)
 }
@@ -128,9 +147,17 @@ type UnitSettings struct {
 // MachineInfo holds the information about a machine
 // that is tracked by multiwatcherStore.
 type MachineInfo struct {
-	EnvUUID                  string
-	Id                       string
-	InstanceId               string
+	EnvUUID        string
+	Id             string
+	InstanceId     string
+	DisplayName    string
+	InstanceStatus string
+	Nonce          string
+	// Status, StatusInfo and StatusData hold the status most
+	// recently set by the machine's agent, with its message,
+	// such as an error, and data. InstanceStatus holds the
+	// status of the machine's instance, as reported by the
+	// provider.
 	Status                   Status
 	StatusInfo               string
 	StatusData               map[string]interface{}
@@ -139,10 +166,13 @@ type MachineInfo struct {
 	SupportedContainers      []instance.ContainerType
 	SupportedContainersKnown bool
 	HardwareCharacteristics  *instance.HardwareCharacteristics `json:",omitempty"`
-	Jobs                     []MachineJob
+	Jobs                     []MachineJob                      `json:",omitempty"`
 	Addresses                []network.Address
 	HasVote                  bool
 	WantsVote                bool
+	// ContainerType holds the type of container the machine
+	// runs in, or is empty if it is not a container.
+	ContainerType instance.ContainerType `json:",omitempty"`
 }
 
 // EntityId returns a unique identifier for a machine across
@@ -155,6 +185,44 @@ func (i *MachineInfo) EntityId() EntityId {
 	}
 }
 
+// EntityName implements EntityInfo.
+func (i *MachineInfo) EntityName() string {
+	if !names.IsValidMachine(i.Id) {
+		return ""
+	}
+	return names.NewMachineTag(i.Id).String()
+}
+
+// Clone implements EntityInfo.
+func (i *MachineInfo) Clone() EntityInfo {
+	c := *i
+	c.StatusData = copyData(i.StatusData)
+	if i.SupportedContainers != nil {
+		c.SupportedContainers = make([]instance.ContainerType, len(i.SupportedContainers))
+		copy(c.SupportedContainers, i.SupportedContainers)
+	}
+	if i.HardwareCharacteristics != nil {
+		hc := *i.HardwareCharacteristics
+		hc.Arch = copyString(hc.Arch)
+		hc.Mem = copyUint64(hc.Mem)
+		hc.RootDisk = copyUint64(hc.RootDisk)
+		hc.CpuCores = copyUint64(hc.CpuCores)
+		hc.CpuPower = copyUint64(hc.CpuPower)
+		hc.Tags = copyStrings(hc.Tags)
+		hc.AvailabilityZone = copyString(hc.AvailabilityZone)
+		c.HardwareCharacteristics = &hc
+	}
+	if i.Jobs != nil {
+		c.Jobs = make([]MachineJob, len(i.Jobs))
+		copy(c.Jobs, i.Jobs)
+	}
+	if i.Addresses != nil {
+		c.Addresses = make([]network.Address, len(i.Addresses))
+		copy(c.Addresses, i.Addresses)
+	}
+	return &c
+}
+
 // StatusInfo holds the unit and machine status information. It is
 // used by ServiceInfo and UnitInfo.
 type StatusInfo struct {
@@ -166,6 +234,16 @@ type StatusInfo struct {
 	Data    map[string]interface{}
 }
 
+// copy returns a deep copy of the status info.
+func (i StatusInfo) copy() StatusInfo {
+	if i.Since != nil {
+		since := *i.Since
+		i.Since = &since
+	}
+	i.Data = copyData(i.Data)
+	return i
+}
+
 // ServiceInfo holds the information about a service that is tracked
 // by multiwatcherStore.
 type ServiceInfo struct {
@@ -180,6 +258,12 @@ type ServiceInfo struct {
 	Config      map[string]interface{}
 	Subordinate bool
 	Status      StatusInfo
+	// WorkloadVersion holds the workload version reported by
+	// the most units of the service.
+	WorkloadVersion string
+	// Endpoints holds the relation endpoints provided,
+	// required and used for peering by the service's charm.
+	Endpoints []Endpoint
 }
 
 // EntityId returns a unique identifier for a service across
@@ -192,6 +276,27 @@ func (i *ServiceInfo) EntityId() EntityId {
 	}
 }
 
+// EntityName implements EntityInfo.
+func (i *ServiceInfo) EntityName() string {
+	if !names.IsValidService(i.Name) {
+		return ""
+	}
+	return names.NewServiceTag(i.Name).String()
+}
+
+// Clone implements EntityInfo.
+func (i *ServiceInfo) Clone() EntityInfo {
+	c := *i
+	c.Constraints = copyConstraints(i.Constraints)
+	c.Config = copyData(i.Config)
+	c.Status = i.Status.copy()
+	if i.Endpoints != nil {
+		c.Endpoints = make([]Endpoint, len(i.Endpoints))
+		copy(c.Endpoints, i.Endpoints)
+	}
+	return &c
+}
+
 // UnitInfo holds the information about a unit
 // that is tracked by multiwatcherStore.
 type UnitInfo struct {
@@ -206,6 +311,8 @@ type UnitInfo struct {
 	Ports          []network.Port
 	PortRanges     []network.PortRange
 	Subordinate    bool
+	Leader         bool
+	Life           Life
 	// The following 3 status values are deprecated.
 	Status     Status
 	StatusInfo string
@@ -225,6 +332,31 @@ func (i *UnitInfo) EntityId() EntityId {
 	}
 }
 
+// EntityName implements EntityInfo.
+func (i *UnitInfo) EntityName() string {
+	if !names.IsValidUnit(i.Name) {
+		return ""
+	}
+	return names.NewUnitTag(i.Name).String()
+}
+
+// Clone implements EntityInfo.
+func (i *UnitInfo) Clone() EntityInfo {
+	c := *i
+	if i.Ports != nil {
+		c.Ports = make([]network.Port, len(i.Ports))
+		copy(c.Ports, i.Ports)
+	}
+	if i.PortRanges != nil {
+		c.PortRanges = make([]network.PortRange, len(i.PortRanges))
+		copy(c.PortRanges, i.PortRanges)
+	}
+	c.StatusData = copyData(i.StatusData)
+	c.WorkloadStatus = i.WorkloadStatus.copy()
+	c.AgentStatus = i.AgentStatus.copy()
+	return &c
+}
+
 // ActionInfo holds the information about a action that is tracked by
 // multiwatcherStore.
 type ActionInfo struct {
@@ -251,6 +383,22 @@ func (i *ActionInfo) EntityId() EntityId {
 	}
 }
 
+// EntityName implements EntityInfo.
+func (i *ActionInfo) EntityName() string {
+	if !names.IsValidAction(i.Id) {
+		return ""
+	}
+	return names.NewActionTag(i.Id).String()
+}
+
+// Clone implements EntityInfo.
+func (i *ActionInfo) Clone() EntityInfo {
+	c := *i
+	c.Parameters = copyData(i.Parameters)
+	c.Results = copyData(i.Results)
+	return &c
+}
+
 // RelationInfo holds the information about a relation that is tracked
 // by multiwatcherStore.
 type RelationInfo struct {
@@ -276,8 +424,30 @@ func (i *RelationInfo) EntityId() EntityId {
 	}
 }
 
+// EntityName implements EntityInfo.
+func (i *RelationInfo) EntityName() string {
+	if !names.IsValidRelation(i.Key) {
+		return ""
+	}
+	return names.NewRelationTag(i.Key).String()
+}
+
+// Clone implements EntityInfo.
+func (i *RelationInfo) Clone() EntityInfo {
+	c := *i
+	if i.Endpoints != nil {
+		c.Endpoints = make([]Endpoint, len(i.Endpoints))
+		copy(c.Endpoints, i.Endpoints)
+	}
+	return &c
+}
+
 // AnnotationInfo holds the information about an annotation that is
-// tracked by multiwatcherStore.
+// tracked by multiwatcherStore. All the annotations on an entity are
+// held in a single AnnotationInfo, identified by the annotated
+// entity's tag, rather than being folded into that entity's own info.
+// This means that changing annotations does not produce a delta for
+// the annotated entity, and that removing them is a clean removal.
 type AnnotationInfo struct {
 	EnvUUID     string
 	Tag         string
@@ -294,6 +464,24 @@ func (i *AnnotationInfo) EntityId() EntityId {
 	}
 }
 
+// EntityName implements EntityInfo. Annotations have no tag of
+// their own, so it returns the tag of the annotated entity.
+func (i *AnnotationInfo) EntityName() string {
+	return i.Tag
+}
+
+// Clone implements EntityInfo.
+func (i *AnnotationInfo) Clone() EntityInfo {
+	c := *i
+	if i.Annotations != nil {
+		c.Annotations = make(map[string]string, len(i.Annotations))
+		for k, v := range i.Annotations {
+			c.Annotations[k] = v
+		}
+	}
+	return &c
+}
+
 // MachineJob values define responsibilities that machines may be
 // expected to fulfil.
 type MachineJob string
@@ -343,6 +531,18 @@ func (i *BlockInfo) EntityId() EntityId {
 	}
 }
 
+// EntityName implements EntityInfo. Blocks have
+// no tag, so it always returns the empty string.
+func (i *BlockInfo) EntityName() string {
+	return ""
+}
+
+// Clone implements EntityInfo.
+func (i *BlockInfo) Clone() EntityInfo {
+	c := *i
+	return &c
+}
+
 // BlockType values define environment block type.
 type BlockType string
 
@@ -357,6 +557,86 @@ const (
 	BlockChange BlockType = "BlockChange"
 )
 
+// NetworkInfo holds the information about a network that is
+// tracked by multiwatcherStore.
+type NetworkInfo struct {
+	EnvUUID    string
+	Name       string
+	ProviderId string
+	CIDR       string
+	VLANTag    int
+}
+
+// EntityId returns a unique identifier for a network across
+// environments.
+func (i *NetworkInfo) EntityId() EntityId {
+	return EntityId{
+		Kind:    "network",
+		EnvUUID: i.EnvUUID,
+		Id:      i.Name,
+	}
+}
+
+// EntityName implements EntityInfo.
+func (i *NetworkInfo) EntityName() string {
+	if !names.IsValidNetwork(i.Name) {
+		return ""
+	}
+	return names.NewNetworkTag(i.Name).String()
+}
+
+// Clone implements EntityInfo.
+func (i *NetworkInfo) Clone() EntityInfo {
+	c := *i
+	return &c
+}
+
+// VolumeInfo holds the information about a volume that is
+// tracked by multiwatcherStore.
+type VolumeInfo struct {
+	EnvUUID string
+	Name    string
+	Life    Life
+	// Size holds the size of the volume in MiB; it is the
+	// requested size until the volume is provisioned.
+	Size     uint64
+	Pool     string
+	VolumeId string
+	// MachineIds holds the ids of the machines that the
+	// volume is attached to, in order.
+	MachineIds []string
+	Status     StatusInfo
+}
+
+// EntityId returns a unique identifier for a volume across
+// environments.
+func (i *VolumeInfo) EntityId() EntityId {
+	return EntityId{
+		Kind:    "volume",
+		EnvUUID: i.EnvUUID,
+		Id:      i.Name,
+	}
+}
+
+// EntityName implements EntityInfo.
+func (i *VolumeInfo) EntityName() string {
+	if !names.IsValidVolume(i.Name) {
+		return ""
+	}
+	return names.NewVolumeTag(i.Name).String()
+}
+
+// Clone implements EntityInfo.
+func (i *VolumeInfo) Clone() EntityInfo {
+	c := *i
+	c.Status = i.Status.copy()
+	if i.MachineIds != nil {
+		c.MachineIds = make([]string, len(i.MachineIds))
+		copy(c.MachineIds, i.MachineIds)
+	}
+	return &c
+}
+
 // EnvironmentInfo holds the information about an environment that is
 // tracked by multiwatcherStore.
 type EnvironmentInfo struct {
@@ -375,3 +655,86 @@ func (i *EnvironmentInfo) EntityId() EntityId {
 		Id:      i.EnvUUID,
 	}
 }
+
+// EntityName implements EntityInfo.
+func (i *EnvironmentInfo) EntityName() string {
+	if !names.IsValidEnvironment(i.EnvUUID) {
+		return ""
+	}
+	return names.NewEnvironTag(i.EnvUUID).String()
+}
+
+// Clone implements EntityInfo.
+func (i *EnvironmentInfo) Clone() EntityInfo {
+	c := *i
+	return &c
+}
+
+// copyData returns a deep copy of the given data, as found in
+// status data, charm config, and action parameters and results.
+func copyData(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		c[k] = copyValue(v)
+	}
+	return c
+}
+
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return copyData(v)
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, elem := range v {
+			c[i] = copyValue(elem)
+		}
+		return c
+	}
+	return v
+}
+
+func copyConstraints(v constraints.Value) constraints.Value {
+	v.Arch = copyString(v.Arch)
+	if v.Container != nil {
+		container := *v.Container
+		v.Container = &container
+	}
+	v.CpuCores = copyUint64(v.CpuCores)
+	v.CpuPower = copyUint64(v.CpuPower)
+	v.Mem = copyUint64(v.Mem)
+	v.RootDisk = copyUint64(v.RootDisk)
+	v.Tags = copyStrings(v.Tags)
+	v.InstanceType = copyString(v.InstanceType)
+	v.Spaces = copyStrings(v.Spaces)
+	v.Networks = copyStrings(v.Networks)
+	return v
+}
+
+func copyString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	return &c
+}
+
+func copyUint64(n *uint64) *uint64 {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	return &c
+}
+
+func copyStrings(s *[]string) *[]string {
+	if s == nil {
+		return nil
+	}
+	c := make([]string, len(*s))
+	copy(c, *s)
+	return &c
+}
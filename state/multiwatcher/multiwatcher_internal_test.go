@@ -4,10 +4,16 @@
 package multiwatcher
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju/constraints"
+	"github.com/juju/juju/instance"
+	"github.com/juju/juju/network"
 )
 
 var (
@@ -19,6 +25,7 @@ var (
 	_ EntityInfo = (*BlockInfo)(nil)
 	_ EntityInfo = (*ActionInfo)(nil)
 	_ EntityInfo = (*EnvironmentInfo)(nil)
+	_ EntityInfo = (*NetworkInfo)(nil)
 )
 
 type ConstantsSuite struct{}
@@ -37,3 +44,213 @@ func (s *ConstantsSuite) TestAnyJobNeedsState(c *gc.C) {
 	c.Assert(AnyJobNeedsState(JobManageEnviron), jc.IsTrue)
 	c.Assert(AnyJobNeedsState(JobHostUnits, JobManageEnviron), jc.IsTrue)
 }
+
+type CloneSuite struct{}
+
+var _ = gc.Suite(&CloneSuite{})
+
+func (s *CloneSuite) TestClone(c *gc.C) {
+	since := time.Now()
+	hc := instance.MustParseHardware("arch=amd64 mem=2G tags=foo,bar")
+	infos := []EntityInfo{
+		&MachineInfo{
+			Id:                      "0",
+			StatusData:              map[string]interface{}{"foo": map[string]interface{}{"bar": 1}},
+			SupportedContainers:     []instance.ContainerType{instance.LXC},
+			HardwareCharacteristics: &hc,
+			Jobs:                    []MachineJob{JobHostUnits},
+			Addresses:               []network.Address{},
+		},
+		&ServiceInfo{
+			Name:        "wordpress",
+			Constraints: constraints.MustParse("mem=4G tags=foo"),
+			Config:      map[string]interface{}{"foo": []interface{}{"bar"}},
+			Status:      StatusInfo{Since: &since, Data: map[string]interface{}{}},
+			Endpoints:   []Endpoint{{ServiceName: "wordpress"}},
+		},
+		&UnitInfo{
+			Name:           "wordpress/0",
+			Ports:          []network.Port{{Protocol: "tcp", Number: 80}},
+			PortRanges:     []network.PortRange{{FromPort: 80, ToPort: 80, Protocol: "tcp"}},
+			WorkloadStatus: StatusInfo{Since: &since},
+		},
+		&ActionInfo{
+			Id:         "1",
+			Parameters: map[string]interface{}{"foo": "bar"},
+		},
+		&RelationInfo{
+			Key:       "wordpress:db mysql:server",
+			Endpoints: []Endpoint{{ServiceName: "wordpress"}},
+		},
+		&AnnotationInfo{
+			Tag:         "machine-0",
+			Annotations: map[string]string{"foo": "bar"},
+		},
+		&BlockInfo{Id: "0"},
+		&EnvironmentInfo{EnvUUID: "uuid"},
+		&NetworkInfo{Name: "net1", CIDR: "0.1.2.0/24"},
+		&VolumeInfo{
+			Name:       "0/0",
+			MachineIds: []string{"0"},
+			Status:     StatusInfo{Since: &since, Data: map[string]interface{}{}},
+		},
+	}
+	for i, info := range infos {
+		c.Logf("test %d: %T", i, info)
+		clone := info.Clone()
+		c.Assert(clone, jc.DeepEquals, info)
+		c.Assert(clone, gc.Not(gc.Equals), info)
+	}
+
+	// Check that changing a clone does not affect the original.
+	clone := infos[0].Clone().(*MachineInfo)
+	clone.StatusData["foo"].(map[string]interface{})["bar"] = 2
+	*clone.HardwareCharacteristics.Mem = 1
+	(*clone.HardwareCharacteristics.Tags)[0] = "baz"
+	c.Assert(infos[0].(*MachineInfo).StatusData["foo"], jc.DeepEquals, map[string]interface{}{"bar": 1})
+	c.Assert(*infos[0].(*MachineInfo).HardwareCharacteristics.Mem, gc.Equals, uint64(2048))
+	c.Assert(*infos[0].(*MachineInfo).HardwareCharacteristics.Tags, jc.DeepEquals, []string{"foo", "bar"})
+}
+
+type EntityNameSuite struct{}
+
+var _ = gc.Suite(&EntityNameSuite{})
+
+func (s *EntityNameSuite) TestEntityName(c *gc.C) {
+	for i, test := range []struct {
+		info EntityInfo
+		name string
+	}{
+		{&MachineInfo{Id: "0"}, "machine-0"},
+		{&MachineInfo{Id: "0/lxc/1"}, "machine-0-lxc-1"},
+		{&MachineInfo{Id: "bad id"}, ""},
+		{&ServiceInfo{Name: "wordpress"}, "service-wordpress"},
+		{&UnitInfo{Name: "wordpress/0"}, "unit-wordpress-0"},
+		{&RelationInfo{Key: "wordpress:db mysql:server"}, "relation-wordpress.db#mysql.server"},
+		{&ActionInfo{Id: "fe7e4e48-4d52-4e76-8d6b-d4a3d8dba0aa"}, "action-fe7e4e48-4d52-4e76-8d6b-d4a3d8dba0aa"},
+		{&AnnotationInfo{Tag: "machine-0"}, "machine-0"},
+		{&BlockInfo{Id: "0", Tag: "environment-uuid"}, ""},
+		{&NetworkInfo{Name: "net1"}, "network-net1"},
+		{&VolumeInfo{Name: "0/0"}, "volume-0-0"},
+		{&VolumeInfo{Name: "bad id"}, ""},
+		{&EnvironmentInfo{EnvUUID: "fe7e4e48-4d52-4e76-8d6b-d4a3d8dba0aa"}, "environment-fe7e4e48-4d52-4e76-8d6b-d4a3d8dba0aa"},
+	} {
+		c.Logf("test %d: %T", i, test.info)
+		c.Assert(test.info.EntityName(), gc.Equals, test.name)
+	}
+}
+
+type RegistrySuite struct{}
+
+var _ = gc.Suite(&RegistrySuite{})
+
+// gadgetInfo is an entity kind that is not built in.
+type gadgetInfo struct {
+	EnvUUID string
+	Name    string
+}
+
+func (i *gadgetInfo) EntityId() EntityId {
+	return EntityId{
+		Kind:    "gadget",
+		EnvUUID: i.EnvUUID,
+		Id:      i.Name,
+	}
+}
+
+func (i *gadgetInfo) EntityName() string {
+	return ""
+}
+
+func (i *gadgetInfo) Clone() EntityInfo {
+	c := *i
+	return &c
+}
+
+func (s *RegistrySuite) TestRegisterEntityKind(c *gc.C) {
+	defer delete(entityKinds, "gadget")
+	_, err := NewEntityInfo("gadget")
+	c.Assert(err, gc.ErrorMatches, `Unexpected entity name "gadget"`)
+
+	RegisterEntityKind("gadget", func() EntityInfo { return new(gadgetInfo) })
+	info, err := NewEntityInfo("gadget")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(info, jc.DeepEquals, &gadgetInfo{})
+
+	// Deltas for the new kind round trip through JSON.
+	d := Delta{Entity: &gadgetInfo{EnvUUID: "uuid", Name: "sprocket"}}
+	data, err := json.Marshal(&d)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, `["gadget","change",{"EnvUUID":"uuid","Name":"sprocket"}]`)
+	var got Delta
+	err = json.Unmarshal(data, &got)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(got, jc.DeepEquals, d)
+	c.Assert(got.Entity.EntityId(), gc.Equals, EntityId{Kind: "gadget", EnvUUID: "uuid", Id: "sprocket"})
+}
+
+func (s *RegistrySuite) TestRegisterEntityKindErrors(c *gc.C) {
+	c.Assert(func() {
+		RegisterEntityKind("machine", func() EntityInfo { return new(MachineInfo) })
+	}, gc.PanicMatches, `entity kind "machine" registered twice`)
+	c.Assert(func() {
+		RegisterEntityKind("gadget", func() EntityInfo { return new(MachineInfo) })
+	}, gc.PanicMatches, `entity kind "gadget" registered with info of kind "machine"`)
+	_, err := NewEntityInfo("gadget")
+	c.Assert(err, gc.NotNil)
+}
+
+type PartialDeltaSuite struct{}
+
+var _ = gc.Suite(&PartialDeltaSuite{})
+
+func (s *PartialDeltaSuite) TestPartialDelta(c *gc.C) {
+	hc := &instance.HardwareCharacteristics{}
+	old := &MachineInfo{
+		EnvUUID:                 "uuid",
+		Id:                      "0",
+		Series:                  "trusty",
+		HardwareCharacteristics: hc,
+	}
+	info := &MachineInfo{
+		EnvUUID:    "uuid",
+		Id:         "0",
+		InstanceId: "i-0",
+		Series:     "trusty",
+	}
+	d, ok := PartialDelta(old, info)
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(d, jc.DeepEquals, Delta{
+		Entity: &MachineInfo{
+			EnvUUID:    "uuid",
+			Id:         "0",
+			InstanceId: "i-0",
+		},
+		Fields: []string{"InstanceId", "HardwareCharacteristics"},
+	})
+
+	// Fields that become empty are still sent.
+	data, err := json.Marshal(&d)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, `["machine","partial",{"EnvUUID":"uuid","HardwareCharacteristics":null,"Id":"0","InstanceId":"i-0"}]`)
+	var got Delta
+	err = json.Unmarshal(data, &got)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(got, jc.DeepEquals, d)
+
+	// Nothing has changed.
+	d, ok = PartialDelta(info, info)
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(d, jc.DeepEquals, Delta{
+		Entity: &MachineInfo{EnvUUID: "uuid", Id: "0"},
+		Fields: []string{},
+	})
+}
+
+func (s *PartialDeltaSuite) TestPartialDeltaUnsupported(c *gc.C) {
+	svc := &ServiceInfo{Name: "wordpress"}
+	_, ok := PartialDelta(svc, svc)
+	c.Assert(ok, jc.IsFalse)
+	_, ok = PartialDelta(svc, &MachineInfo{Id: "0"})
+	c.Assert(ok, jc.IsFalse)
+}
@@ -0,0 +1,108 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package multiwatcher
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// partialKeys maps each kind of entity that may be sent in a
+// partial delta to the fields that identify an entity of that
+// kind. The identifying fields are always sent.
+var partialKeys = map[string][]string{
+	"machine": {"EnvUUID", "Id"},
+}
+
+// PartialDelta returns a delta holding only the fields of info that
+// differ from old, along with the fields identifying the entity. The
+// names of the differing fields are held in the delta's Fields. It
+// returns false if entities of the kind of info cannot be sent in
+// partial deltas, or if old is not the same kind of entity.
+func PartialDelta(old, info EntityInfo) (Delta, bool) {
+	keys, ok := partialKeys[info.EntityId().Kind]
+	if !ok || reflect.TypeOf(old) != reflect.TypeOf(info) {
+		return Delta{}, false
+	}
+	oldv := reflect.ValueOf(old).Elem()
+	newv := reflect.ValueOf(info).Elem()
+	partial := reflect.New(newv.Type())
+	for _, key := range keys {
+		partial.Elem().FieldByName(key).Set(newv.FieldByName(key))
+	}
+	fields := []string{}
+	t := newv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if isKey(keys, name) || reflect.DeepEqual(oldv.Field(i).Interface(), newv.Field(i).Interface()) {
+			continue
+		}
+		partial.Elem().Field(i).Set(newv.Field(i))
+		fields = append(fields, name)
+	}
+	return Delta{
+		Entity: partial.Interface().(EntityInfo),
+		Fields: fields,
+	}, true
+}
+
+// marshalPartial returns the JSON encoding of the entity of the
+// given partial delta, holding only its changed and identifying
+// fields.
+func marshalPartial(d *Delta) ([]byte, error) {
+	data, err := json.Marshal(d.Entity)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	for _, name := range partialKeys[d.Entity.EntityId().Kind] {
+		fields[name] = all[name]
+	}
+	for _, name := range d.Fields {
+		value, ok := all[name]
+		if !ok {
+			// The field was omitted because it is empty, but
+			// the change to it must still be sent.
+			value = json.RawMessage("null")
+		}
+		fields[name] = value
+	}
+	return json.Marshal(fields)
+}
+
+// unmarshalPartial decodes data, the encoding of the entity of a
+// partial delta, into d.
+func unmarshalPartial(d *Delta, data []byte) error {
+	if err := json.Unmarshal(data, d.Entity); err != nil {
+		return err
+	}
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(data, &present); err != nil {
+		return err
+	}
+	keys := partialKeys[d.Entity.EntityId().Kind]
+	d.Fields = []string{}
+	t := reflect.TypeOf(d.Entity).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if _, ok := present[name]; ok && !isKey(keys, name) {
+			d.Fields = append(d.Fields, name)
+		}
+	}
+	return nil
+}
+
+// isKey reports whether name is one of the given keys.
+func isKey(keys []string, name string) bool {
+	for _, key := range keys {
+		if key == name {
+			return true
+		}
+	}
+	return false
+}
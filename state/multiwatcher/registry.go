@@ -0,0 +1,50 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package multiwatcher
+
+import (
+	"fmt"
+)
+
+// entityKinds maps each registered entity kind to a function
+// returning a new, empty EntityInfo of that kind.
+var entityKinds = make(map[string]func() EntityInfo)
+
+func init() {
+	RegisterEntityKind("environment", func() EntityInfo { return new(EnvironmentInfo) })
+	RegisterEntityKind("machine", func() EntityInfo { return new(MachineInfo) })
+	RegisterEntityKind("service", func() EntityInfo { return new(ServiceInfo) })
+	RegisterEntityKind("unit", func() EntityInfo { return new(UnitInfo) })
+	RegisterEntityKind("relation", func() EntityInfo { return new(RelationInfo) })
+	RegisterEntityKind("annotation", func() EntityInfo { return new(AnnotationInfo) })
+	RegisterEntityKind("block", func() EntityInfo { return new(BlockInfo) })
+	RegisterEntityKind("action", func() EntityInfo { return new(ActionInfo) })
+	RegisterEntityKind("network", func() EntityInfo { return new(NetworkInfo) })
+	RegisterEntityKind("volume", func() EntityInfo { return new(VolumeInfo) })
+}
+
+// RegisterEntityKind registers an entity kind so that deltas for
+// entities of that kind can be decoded. The newInfo function must
+// return a new, empty EntityInfo whose EntityId reports the given
+// kind. RegisterEntityKind is intended to be called from init
+// functions; it panics if the kind is already registered.
+func RegisterEntityKind(kind string, newInfo func() EntityInfo) {
+	if _, ok := entityKinds[kind]; ok {
+		panic(fmt.Sprintf("entity kind %q registered twice", kind))
+	}
+	if got := newInfo().EntityId().Kind; got != kind {
+		panic(fmt.Sprintf("entity kind %q registered with info of kind %q", kind, got))
+	}
+	entityKinds[kind] = newInfo
+}
+
+// NewEntityInfo returns a new, empty EntityInfo of the given kind.
+// It returns an error if the kind has not been registered.
+func NewEntityInfo(kind string) (EntityInfo, error) {
+	newInfo, ok := entityKinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("Unexpected entity name %q", kind)
+	}
+	return newInfo(), nil
+}
@@ -6,14 +6,19 @@ package state
 import (
 	"container/list"
 	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/juju/errors"
 	jc "github.com/juju/testing/checkers"
+	jujuclock "github.com/juju/utils/clock"
 	gc "gopkg.in/check.v1"
-	"gopkg.in/mgo.v2"
 
+	"github.com/juju/juju/network"
 	"github.com/juju/juju/state/multiwatcher"
 	"github.com/juju/juju/state/watcher"
 	"github.com/juju/juju/testing"
@@ -262,6 +267,417 @@ func (s *storeSuite) TestChangesSince(c *gc.C) {
 	}})
 }
 
+func (s *storeSuite) TestChangesSinceLimit(c *gc.C) {
+	a := newStore()
+	for i := 0; i < 10; i++ {
+		a.Update(&multiwatcher.MachineInfo{
+			EnvUUID: "uuid",
+			Id:      fmt.Sprint(i),
+		})
+	}
+
+	// Page through the store three changes at a time, changing
+	// a machine that has already been seen and one that has not
+	// after the first page.
+	got := make(map[multiwatcher.EntityId]multiwatcher.EntityInfo)
+	var revno int64
+	for page := 0; ; page++ {
+		changes, next := a.ChangesSinceLimit(revno, 3)
+		c.Logf("page %d: %d changes up to revno %d", page, len(changes), next)
+		if len(changes) == 0 {
+			c.Assert(next, gc.Equals, revno)
+			break
+		}
+		c.Assert(len(changes) <= 3, jc.IsTrue)
+		c.Assert(next > revno, jc.IsTrue)
+		for _, d := range changes {
+			got[d.Entity.EntityId()] = d.Entity
+		}
+		revno = next
+		if page == 0 {
+			a.Update(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"})
+			a.Update(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "5", InstanceId: "i-5"})
+		}
+	}
+	c.Assert(revno, gc.Equals, a.latestRevno)
+
+	// The pages together hold the latest information for
+	// every entity in the store.
+	want := make(map[multiwatcher.EntityId]multiwatcher.EntityInfo)
+	for _, info := range a.All() {
+		want[info.EntityId()] = info
+	}
+	c.Assert(got, jc.DeepEquals, want)
+	c.Assert(got, gc.HasLen, 10)
+
+	// Without a limit, all the changes are returned.
+	changes, next := a.ChangesSinceLimit(0, 0)
+	c.Assert(changes, gc.DeepEquals, a.ChangesSince(0))
+	c.Assert(next, gc.Equals, a.latestRevno)
+}
+
+func (s *storeSuite) TestChangesSinceDeleted(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	a := sm.all
+	w := &Multiwatcher{all: sm}
+	next := func() []multiwatcher.Delta {
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		sm.respond()
+		assertReplied(c, true, req)
+		return req.changes
+	}
+	m0 := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}
+	m1 := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"}
+	a.Update(m0)
+	a.Update(m1)
+	c.Assert(next(), gc.HasLen, 2)
+	rev := a.latestRevno
+
+	// Remove machine 0 while the watcher holds a reference to
+	// it; once the watcher has been told, the entry is deleted.
+	id0 := m0.EntityId()
+	a.Remove(id0)
+	removedRev := a.latestRevno
+	c.Assert(next(), gc.DeepEquals, []multiwatcher.Delta{
+		{Removed: true, Entity: m0},
+	})
+	c.Assert(a.entities[id0], gc.IsNil)
+	m2 := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "2"}
+	a.Update(m2)
+
+	// Something that knew about machine 0 is still told that
+	// it has been removed.
+	c.Assert(a.ChangesSince(rev), gc.DeepEquals, []multiwatcher.Delta{
+		{Removed: true, Entity: m0},
+		{Entity: m2},
+	})
+	c.Assert(a.ChangesSince(removedRev), gc.DeepEquals, []multiwatcher.Delta{
+		{Entity: m2},
+	})
+	// Something that never knew about it is not.
+	c.Assert(a.ChangesSince(0), gc.DeepEquals, []multiwatcher.Delta{
+		{Entity: m1},
+		{Entity: m2},
+	})
+
+	// If the machine comes back, only its return is reported.
+	m0 = &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"}
+	a.Update(m0)
+	c.Assert(a.ChangesSince(rev), gc.DeepEquals, []multiwatcher.Delta{
+		{Entity: m2},
+		{Entity: m0},
+	})
+	c.Assert(next(), gc.DeepEquals, []multiwatcher.Delta{
+		{Entity: m2},
+		{Entity: m0},
+	})
+
+	// Removals are reported when they happen
+	// without anything having seen the entity.
+	a.Remove(m1.EntityId())
+	c.Assert(a.ChangesSince(rev), gc.DeepEquals, []multiwatcher.Delta{
+		{Entity: m2},
+		{Entity: m0},
+		{Removed: true, Entity: m1},
+	})
+
+	// If the machine goes again, its removal is
+	// reported once.
+	a.Remove(id0)
+	c.Assert(a.ChangesSince(rev), gc.DeepEquals, []multiwatcher.Delta{
+		{Entity: m2},
+		{Removed: true, Entity: m1},
+		{Removed: true, Entity: m0},
+	})
+	c.Assert(next(), gc.DeepEquals, []multiwatcher.Delta{
+		{Removed: true, Entity: m1},
+		{Removed: true, Entity: m0},
+	})
+	c.Assert(a.check(), jc.ErrorIsNil)
+}
+
+func (s *storeSuite) TestChangesSinceForgetsOldTombstones(c *gc.C) {
+	s.PatchValue(&maxTombstones, 2)
+	a := newStore()
+	var ids []multiwatcher.EntityId
+	for i := 0; i < 3; i++ {
+		m := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: fmt.Sprint(i)}
+		a.Update(m)
+		ids = append(ids, m.EntityId())
+	}
+	rev := a.latestRevno
+	for _, id := range ids {
+		a.Remove(id)
+	}
+	c.Assert(a.ChangesSince(rev), gc.DeepEquals, []multiwatcher.Delta{
+		{Removed: true, Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"}},
+		{Removed: true, Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "2"}},
+	})
+	c.Assert(a.forgottenRevno, gc.Equals, rev+1)
+	c.Assert(a.check(), jc.ErrorIsNil)
+
+	// The tombstones are kept in a ring that
+	// is reused as more entities are removed.
+	for i := 3; i < 8; i++ {
+		m := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: fmt.Sprint(i)}
+		a.Update(m)
+		a.Remove(m.EntityId())
+		c.Assert(a.tombstones, gc.HasLen, 2)
+		c.Assert(a.forgottenRevno, gc.Equals, a.latestRevno-4)
+		c.Assert(a.check(), jc.ErrorIsNil)
+	}
+	c.Assert(a.ChangesSince(a.latestRevno-3), gc.DeepEquals, []multiwatcher.Delta{
+		{Removed: true, Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "6"}},
+	})
+}
+
+func (s *storeSuite) TestWorkloadVersions(c *gc.C) {
+	a := newStore()
+	unit := func(id, version string) *multiwatcher.UnitInfo {
+		return &multiwatcher.UnitInfo{
+			EnvUUID:        "uuid",
+			Name:           "wordpress/" + id,
+			Service:        "wordpress",
+			WorkloadStatus: multiwatcher.StatusInfo{Version: version},
+		}
+	}
+	wordpress := multiwatcher.EntityId{Kind: "service", EnvUUID: "uuid", Id: "wordpress"}
+	a.Update(unit("0", "1.0"))
+	a.Update(unit("1", "1.0"))
+	a.Update(unit("2", ""))
+	c.Assert(a.workloadVersions, jc.DeepEquals, map[interface{}]map[string]int{
+		wordpress: {"1.0": 2},
+	})
+
+	a.Update(unit("1", "1.1"))
+	a.Update(unit("2", "1.1"))
+	c.Assert(a.workloadVersions[wordpress], jc.DeepEquals, map[string]int{"1.0": 1, "1.1": 2})
+
+	// Removed units no longer count, even while
+	// watchers are yet to be told about them.
+	StoreIncRef(a, unit("1", "").EntityId())
+	a.Remove(unit("1", "").EntityId())
+	a.Remove(unit("2", "").EntityId())
+	c.Assert(a.workloadVersions[wordpress], jc.DeepEquals, map[string]int{"1.0": 1})
+	a.Remove(unit("0", "").EntityId())
+	c.Assert(a.workloadVersions, gc.HasLen, 0)
+	c.Assert(a.check(), jc.ErrorIsNil)
+}
+
+func (s *storeSuite) TestForEach(c *gc.C) {
+	a := newStore()
+	c.Assert(a.Len(), gc.Equals, 0)
+	for i := 0; i < 4; i++ {
+		a.Update(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: fmt.Sprint(i)})
+	}
+	// Change machines 1 and 0 and remove machine 2, so that they
+	// move to the end, keeping the removed entry around.
+	a.Update(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1", InstanceId: "i-1"})
+	a.Update(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"})
+	StoreIncRef(a, multiwatcher.EntityId{"machine", "uuid", "2"})
+	a.Remove(multiwatcher.EntityId{"machine", "uuid", "2"})
+	c.Assert(a.Len(), gc.Equals, 4)
+
+	visit := func() (ids []string, revnos []int64) {
+		a.ForEach(func(entry *entityEntry) {
+			ids = append(ids, entry.info.EntityId().Id)
+			revnos = append(revnos, entry.revno)
+		})
+		return ids, revnos
+	}
+	ids, revnos := visit()
+	c.Assert(ids, jc.DeepEquals, []string{"3", "1", "0", "2"})
+	c.Assert(revnos, jc.DeepEquals, []int64{4, 5, 6, 7})
+
+	// The order doesn't change while the store doesn't.
+	ids1, revnos1 := visit()
+	c.Assert(ids1, jc.DeepEquals, ids)
+	c.Assert(revnos1, jc.DeepEquals, revnos)
+}
+
+func (s *storeSuite) TestUpdateIdenticalInfo(c *gc.C) {
+	a := newStore()
+	a.Update(&multiwatcher.MachineInfo{
+		EnvUUID:    "uuid",
+		Id:         "0",
+		InstanceId: "i-0",
+	})
+	rev := a.latestRevno
+
+	// Updating with a distinct but identical value must
+	// not bump the revno or produce a delta.
+	a.Update(&multiwatcher.MachineInfo{
+		EnvUUID:    "uuid",
+		Id:         "0",
+		InstanceId: "i-0",
+	})
+	c.Assert(a.latestRevno, gc.Equals, rev)
+	c.Assert(a.ChangesSince(rev), gc.HasLen, 0)
+}
+
+func (s *storeSuite) TestUpdatedTime(c *gc.C) {
+	t0 := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := testing.NewClock(t0)
+	s.PatchValue(&GetClock, func() jujuclock.Clock { return clock })
+	a := newStore()
+	id := multiwatcher.EntityId{"machine", "uuid", "0"}
+	updated := func() time.Time {
+		return a.entities[id].Value.(*entityEntry).updated
+	}
+
+	a.Update(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"})
+	c.Assert(updated(), gc.Equals, t0)
+
+	// An identical update changes nothing.
+	clock.Advance(time.Minute)
+	a.Update(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"})
+	c.Assert(updated(), gc.Equals, t0)
+
+	a.Update(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"})
+	c.Assert(updated(), gc.Equals, t0.Add(time.Minute))
+
+	clock.Advance(time.Minute)
+	StoreIncRef(a, id)
+	a.Remove(id)
+	c.Assert(updated(), gc.Equals, t0.Add(2*time.Minute))
+	c.Assert(a.latestRevno, gc.Equals, int64(3))
+}
+
+func (s *storeSuite) TestChangesSinceTime(c *gc.C) {
+	t0 := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := testing.NewClock(t0)
+	s.PatchValue(&GetClock, func() jujuclock.Clock { return clock })
+	a := newStore()
+	m0 := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}
+	m1 := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"}
+	m2 := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "2"}
+	m3 := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "3"}
+	a.Update(m0)
+	a.Update(m1)
+	a.Update(m2)
+
+	t1 := t0.Add(time.Minute)
+	clock.Advance(time.Minute)
+	m0i := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"}
+	a.Update(m0i)
+	StoreIncRef(a, m1.EntityId())
+	a.Remove(m1.EntityId())
+
+	// Machine 3 comes and goes after t1.
+	t2 := t1.Add(time.Minute)
+	clock.Advance(time.Minute)
+	a.Update(m3)
+	a.Remove(m3.EntityId())
+	c.Assert(a.tombstones, gc.HasLen, 2)
+
+	c.Assert(a.ChangesSinceTime(t0), jc.DeepEquals, []multiwatcher.Delta{
+		{Entity: m0i},
+		{Removed: true, Entity: m1},
+	})
+	c.Assert(a.ChangesSinceTime(t0.Add(30*time.Second)), jc.DeepEquals, a.ChangesSinceTime(t0))
+	c.Assert(a.ChangesSinceTime(t1), gc.HasLen, 0)
+	c.Assert(a.ChangesSinceTime(t2), gc.HasLen, 0)
+
+	// Before anything was added, all the entities are new.
+	c.Assert(a.ChangesSinceTime(t0.Add(-time.Second)), jc.DeepEquals, []multiwatcher.Delta{
+		{Entity: m2},
+		{Entity: m0i},
+	})
+}
+
+func (*storeSuite) BenchmarkChangesSinceFewChanges(c *gc.C) {
+	benchmarkChangesSince(c, 50000, 10)
+}
+
+func (*storeSuite) BenchmarkChangesSinceAllChanges(c *gc.C) {
+	benchmarkChangesSince(c, 50000, 50000)
+}
+
+// benchmarkChangesSince measures the cost of finding the changes
+// made to a store holding the given number of entities, when the
+// given number of them have changed. The store's list is kept in
+// revno order, so the cost depends on the number of changes rather
+// than on the size of the store.
+func benchmarkChangesSince(c *gc.C, entities, changed int) {
+	a := newStore()
+	for i := 0; i < entities; i++ {
+		a.Update(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: fmt.Sprint(i)})
+	}
+	revno := a.latestRevno - int64(changed)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		changes := a.ChangesSince(revno)
+		if len(changes) != changed {
+			c.Fatalf("got %d changes, want %d", len(changes), changed)
+		}
+	}
+}
+
+func (s *storeSuite) TestCheck(c *gc.C) {
+	m0 := multiwatcher.EntityId{"machine", "uuid", "0"}
+	m1 := multiwatcher.EntityId{"machine", "uuid", "1"}
+	for i, test := range []struct {
+		about     string
+		corrupt   func(a *multiwatcherStore)
+		expectErr string
+	}{{
+		about:   "consistent store",
+		corrupt: func(*multiwatcherStore) {},
+	}, {
+		about: "entity missing from list",
+		corrupt: func(a *multiwatcherStore) {
+			a.list.Remove(a.entities[m0])
+		},
+		expectErr: "store has 2 entities but 1 list entries",
+	}, {
+		about: "entity refers to another entry",
+		corrupt: func(a *multiwatcherStore) {
+			a.entities[m0] = a.entities[m1]
+		},
+		expectErr: `entity {machine uuid 0} does not refer to its list entry`,
+	}, {
+		about: "revno after latest revno",
+		corrupt: func(a *multiwatcherStore) {
+			a.latestRevno = 1
+		},
+		expectErr: `entity {machine uuid 1} has revno 2, not below 2`,
+	}, {
+		about: "list out of revno order",
+		corrupt: func(a *multiwatcherStore) {
+			a.list.MoveToFront(a.entities[m0])
+		},
+		expectErr: `entity {machine uuid 1} has revno 2, not below 1`,
+	}, {
+		about: "negative reference count",
+		corrupt: func(a *multiwatcherStore) {
+			a.entities[m0].Value.(*entityEntry).refCount = -1
+		},
+		expectErr: `entity {machine uuid 0} has negative reference count -1`,
+	}, {
+		about: "unreferenced removed entity",
+		corrupt: func(a *multiwatcherStore) {
+			a.entities[m0].Value.(*entityEntry).removed = true
+		},
+		expectErr: `entity {machine uuid 0} is removed but unreferenced`,
+	}} {
+		c.Logf("test %d: %s", i, test.about)
+		a := newStore()
+		a.Update(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"})
+		a.Update(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"})
+		test.corrupt(a)
+		err := a.check()
+		if test.expectErr == "" {
+			c.Check(err, jc.ErrorIsNil)
+		} else {
+			c.Check(err, gc.ErrorMatches, regexp.QuoteMeta(test.expectErr))
+		}
+	}
+}
+
 func (s *storeSuite) TestGet(c *gc.C) {
 	a := newStore()
 	m := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}
@@ -278,7 +694,7 @@ type storeManagerSuite struct {
 var _ = gc.Suite(&storeManagerSuite{})
 
 func (*storeManagerSuite) TestHandle(c *gc.C) {
-	sm := newStoreManagerNoRun(newTestBacking(nil))
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
 
 	// Add request from first watcher.
 	w0 := &Multiwatcher{all: sm}
@@ -334,7 +750,7 @@ func (*storeManagerSuite) TestHandle(c *gc.C) {
 func (s *storeManagerSuite) TestHandleStopNoDecRefIfMoreRecentlyCreated(c *gc.C) {
 	// If the Multiwatcher hasn't seen the item, then we shouldn't
 	// decrement its ref count when it is stopped.
-	sm := newStoreManager(newTestBacking(nil))
+	sm := newStoreManager(NewMemoryBacking(nil))
 	mi := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}
 	sm.all.Update(mi)
 	StoreIncRef(sm.all, multiwatcher.EntityId{"machine", "uuid", "0"})
@@ -354,7 +770,7 @@ func (s *storeManagerSuite) TestHandleStopNoDecRefIfAlreadySeenRemoved(c *gc.C)
 	// If the Multiwatcher has already seen the item removed, then
 	// we shouldn't decrement its ref count when it is stopped.
 
-	sm := newStoreManager(newTestBacking(nil))
+	sm := newStoreManager(NewMemoryBacking(nil))
 	mi := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}
 	sm.all.Update(mi)
 
@@ -377,7 +793,7 @@ func (s *storeManagerSuite) TestHandleStopNoDecRefIfAlreadySeenRemoved(c *gc.C)
 func (s *storeManagerSuite) TestHandleStopDecRefIfAlreadySeenAndNotRemoved(c *gc.C) {
 	// If the Multiwatcher has already seen the item removed, then
 	// we should decrement its ref count when it is stopped.
-	sm := newStoreManager(newTestBacking(nil))
+	sm := newStoreManager(NewMemoryBacking(nil))
 	mi := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}
 	sm.all.Update(mi)
 	StoreIncRef(sm.all, multiwatcher.EntityId{"machine", "uuid", "0"})
@@ -395,7 +811,7 @@ func (s *storeManagerSuite) TestHandleStopDecRefIfAlreadySeenAndNotRemoved(c *gc
 func (s *storeManagerSuite) TestHandleStopNoDecRefIfNotSeen(c *gc.C) {
 	// If the Multiwatcher hasn't seen the item at all, it should
 	// leave the ref count untouched.
-	sm := newStoreManager(newTestBacking(nil))
+	sm := newStoreManager(NewMemoryBacking(nil))
 	mi := &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}
 	sm.all.Update(mi)
 	StoreIncRef(sm.all, multiwatcher.EntityId{"machine", "uuid", "0"})
@@ -463,7 +879,7 @@ func (s *storeManagerSuite) TestRespondResults(c *gc.C) {
 	ns := make([]int, wcount)
 	for ns[0] = 0; ns[0] < numCombinations; ns[0]++ {
 		for ns[1] = 0; ns[1] < numCombinations; ns[1]++ {
-			sm := newStoreManagerNoRun(&storeManagerTestBacking{})
+			sm := newStoreManagerNoRun(&MemoryBacking{})
 			c.Logf("test %0*b", len(respondTestChanges), ns)
 			var (
 				ws      []*Multiwatcher
@@ -538,7 +954,7 @@ func (s *storeManagerSuite) TestRespondResults(c *gc.C) {
 }
 
 func (*storeManagerSuite) TestRespondMultiple(c *gc.C) {
-	sm := newStoreManager(newTestBacking(nil))
+	sm := newStoreManager(NewMemoryBacking(nil))
 	sm.all.Update(&multiwatcher.MachineInfo{Id: "0"})
 
 	// Add one request and respond.
@@ -611,313 +1027,2044 @@ func (*storeManagerSuite) TestRespondMultiple(c *gc.C) {
 	c.Assert(req1.changes, gc.DeepEquals, deltas)
 }
 
-func (*storeManagerSuite) TestRunStop(c *gc.C) {
-	sm := newStoreManager(newTestBacking(nil))
+func (*storeManagerSuite) TestRespondCoalescesUpdates(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0"})
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "1"})
 	w := &Multiwatcher{all: sm}
-	err := sm.Stop()
-	c.Assert(err, jc.ErrorIsNil)
-	d, err := w.Next()
-	c.Assert(err, gc.ErrorMatches, "shared state watcher was stopped")
-	c.Assert(d, gc.HasLen, 0)
-}
-
-func (*storeManagerSuite) TestRun(c *gc.C) {
-	b := newTestBacking([]multiwatcher.EntityInfo{
-		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"},
-		&multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "logging"},
-		&multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "wordpress"},
+	next := func() *request {
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		return req
+	}
+	req := next()
+	sm.respond()
+	assertReplied(c, true, req)
+
+	// Several updates to the same machine between calls to
+	// Next, interleaved with an update to another, result
+	// in a single delta holding the final state.
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0", InstanceId: "i-0"})
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "1", InstanceId: "i-1"})
+	sm.all.Update(&multiwatcher.MachineInfo{
+		Id:         "0",
+		InstanceId: "i-0",
+		Addresses:  network.NewAddresses("10.0.0.1"),
 	})
-	sm := newStoreManager(b)
-	defer func() {
-		c.Check(sm.Stop(), gc.IsNil)
-	}()
-	w := &Multiwatcher{all: sm}
-	checkNext(c, w, []multiwatcher.Delta{
-		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}},
-		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "logging"}},
-		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "wordpress"}},
-	}, "")
-	b.updateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"})
-	checkNext(c, w, []multiwatcher.Delta{
-		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"}},
-	}, "")
-	b.deleteEntity(multiwatcher.EntityId{"machine", "uuid", "0"})
-	checkNext(c, w, []multiwatcher.Delta{
-		{Removed: true, Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}},
-	}, "")
-}
-
-func (*storeManagerSuite) TestMultipleEnvironments(c *gc.C) {
-	b := newTestBacking([]multiwatcher.EntityInfo{
-		&multiwatcher.MachineInfo{EnvUUID: "uuid0", Id: "0"},
-		&multiwatcher.ServiceInfo{EnvUUID: "uuid0", Name: "logging"},
-		&multiwatcher.ServiceInfo{EnvUUID: "uuid0", Name: "wordpress"},
-		&multiwatcher.MachineInfo{EnvUUID: "uuid1", Id: "0"},
-		&multiwatcher.ServiceInfo{EnvUUID: "uuid1", Name: "logging"},
-		&multiwatcher.ServiceInfo{EnvUUID: "uuid1", Name: "wordpress"},
-		&multiwatcher.MachineInfo{EnvUUID: "uuid2", Id: "0"},
+	req = next()
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "1", InstanceId: "i-1"}},
+		{Entity: &multiwatcher.MachineInfo{
+			Id:         "0",
+			InstanceId: "i-0",
+			Addresses:  network.NewAddresses("10.0.0.1"),
+		}},
 	})
-	sm := newStoreManager(b)
-	defer func() {
-		c.Check(sm.Stop(), gc.IsNil)
-	}()
-	w := &Multiwatcher{all: sm}
-	checkNext(c, w, []multiwatcher.Delta{
-		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid0", Id: "0"}},
-		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid0", Name: "logging"}},
-		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid0", Name: "wordpress"}},
-		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid1", Id: "0"}},
-		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid1", Name: "logging"}},
-		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid1", Name: "wordpress"}},
-		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid2", Id: "0"}},
-	}, "")
-	b.updateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid1", Id: "0", InstanceId: "i-0"})
-	checkNext(c, w, []multiwatcher.Delta{
-		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid1", Id: "0", InstanceId: "i-0"}},
-	}, "")
-	b.deleteEntity(multiwatcher.EntityId{"machine", "uuid2", "0"})
-	checkNext(c, w, []multiwatcher.Delta{
-		{Removed: true, Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid2", Id: "0"}},
-	}, "")
-	b.updateEntity(&multiwatcher.ServiceInfo{EnvUUID: "uuid0", Name: "logging", Exposed: true})
-	checkNext(c, w, []multiwatcher.Delta{
-		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid0", Name: "logging", Exposed: true}},
-	}, "")
+	c.Assert(sm.all.list.Len(), gc.Equals, 2)
 }
 
-func (*storeManagerSuite) TestMultiwatcherStop(c *gc.C) {
-	sm := newStoreManager(newTestBacking(nil))
-	defer func() {
-		c.Check(sm.Stop(), gc.IsNil)
-	}()
-	w := &Multiwatcher{all: sm}
+func (*storeManagerSuite) TestRespondDoesNotBlockOnReply(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0"})
+
+	// A requester that has abandoned an unbuffered reply
+	// channel must not stop the other watchers being served.
+	w0 := &Multiwatcher{all: sm}
+	req0 := &request{w: w0, reply: make(chan bool)}
+	sm.handle(req0)
+	w1 := &Multiwatcher{all: sm}
+	req1 := &request{w: w1, reply: make(chan bool, 1)}
+	sm.handle(req1)
+
 	done := make(chan struct{})
 	go func() {
-		checkNext(c, w, nil, ErrStopped.Error())
-		done <- struct{}{}
+		defer close(done)
+		sm.respond()
 	}()
-	err := w.Stop()
-	c.Assert(err, jc.ErrorIsNil)
-	<-done
+	select {
+	case <-done:
+	case <-time.After(testing.LongWait):
+		c.Fatalf("respond blocked on reply")
+	}
+	assertReplied(c, true, req1)
+	c.Assert(req1.changes, gc.HasLen, 1)
+	c.Assert(c.GetTestLog(), jc.Contains, "dropping reply to request from watcher")
 }
 
-func (*storeManagerSuite) TestMultiwatcherStopBecauseStoreManagerError(c *gc.C) {
-	b := newTestBacking([]multiwatcher.EntityInfo{&multiwatcher.MachineInfo{Id: "0"}})
-	sm := newStoreManager(b)
-	defer func() {
-		c.Check(sm.Stop(), gc.ErrorMatches, "some error")
-	}()
-	w := &Multiwatcher{all: sm}
-	// Receive one delta to make sure that the storeManager
-	// has seen the initial state.
-	checkNext(c, w, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "0"}}}, "")
-	c.Logf("setting fetch error")
-	b.setFetchError(errors.New("some error"))
-	c.Logf("updating entity")
-	b.updateEntity(&multiwatcher.MachineInfo{Id: "1"})
-	checkNext(c, w, nil, "some error")
-}
+func (*storeManagerSuite) TestRespondCloneDeltas(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	sm.all.Update(&multiwatcher.MachineInfo{
+		Id:         "0",
+		StatusData: map[string]interface{}{"foo": "bar"},
+		Jobs:       []multiwatcher.MachineJob{multiwatcher.JobHostUnits},
+	})
+	var reqs []*request
+	for i := 0; i < 2; i++ {
+		// Deltas are cloned by default.
+		w := &Multiwatcher{all: sm}
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		reqs = append(reqs, req)
+	}
+	sm.respond()
+	for _, req := range reqs {
+		assertReplied(c, true, req)
+	}
 
-func StoreIncRef(a *multiwatcherStore, id interface{}) {
-	entry := a.entities[id].Value.(*entityEntry)
-	entry.refCount++
+	// Mutate the entity delivered to the first watcher.
+	info := reqs[0].changes[0].Entity.(*multiwatcher.MachineInfo)
+	info.InstanceId = "i-0"
+	info.StatusData["foo"] = "baz"
+	info.Jobs[0] = multiwatcher.JobManageEnviron
+
+	// Neither the second watcher nor the store should see the change.
+	expect := &multiwatcher.MachineInfo{
+		Id:         "0",
+		StatusData: map[string]interface{}{"foo": "bar"},
+		Jobs:       []multiwatcher.MachineJob{multiwatcher.JobHostUnits},
+	}
+	c.Assert(reqs[1].changes[0].Entity, jc.DeepEquals, expect)
+	c.Assert(sm.all.Get(expect.EntityId()), jc.DeepEquals, expect)
 }
 
-func assertStoreContents(c *gc.C, a *multiwatcherStore, latestRevno int64, entries []entityEntry) {
-	var gotEntries []entityEntry
-	var gotElems []*list.Element
-	c.Check(a.list.Len(), gc.Equals, len(entries))
-	for e := a.list.Back(); e != nil; e = e.Prev() {
-		gotEntries = append(gotEntries, *e.Value.(*entityEntry))
-		gotElems = append(gotElems, e)
-	}
-	c.Assert(gotEntries, gc.DeepEquals, entries)
-	for i, ent := range entries {
-		c.Assert(a.entities[ent.info.EntityId()], gc.Equals, gotElems[i])
+func (*storeManagerSuite) TestRespondShareDeltas(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0"})
+	w := &Multiwatcher{all: sm}
+	w.SetCloneDeltas(false)
+	req := &request{
+		w:     w,
+		reply: make(chan bool, 1),
 	}
-	c.Assert(a.entities, gc.HasLen, len(entries))
-	c.Assert(a.latestRevno, gc.Equals, latestRevno)
+	sm.handle(req)
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, gc.HasLen, 1)
+	info := sm.all.Get(multiwatcher.EntityId{Kind: "machine", Id: "0"})
+	c.Assert(req.changes[0].Entity, gc.Equals, info)
 }
 
-// watcherState represents a Multiwatcher client's
-// current view of the state. It holds the last delta that a given
-// state watcher has seen for each entity.
-type watcherState map[interface{}]multiwatcher.Delta
+func (*storeManagerSuite) TestRespondService(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0"})
+	sm.all.Update(&multiwatcher.ServiceInfo{Name: "wordpress"})
+	sm.all.Update(&multiwatcher.ServiceInfo{Name: "mysql"})
+	sm.all.Update(&multiwatcher.UnitInfo{Name: "wordpress/0", Service: "wordpress"})
+	sm.all.Update(&multiwatcher.UnitInfo{Name: "mysql/0", Service: "mysql"})
 
-func (s watcherState) update(changes []multiwatcher.Delta) {
-	for _, d := range changes {
-		id := d.Entity.EntityId()
-		if d.Removed {
-			if _, ok := s[id]; !ok {
-				panic(fmt.Errorf("entity id %v removed when it wasn't there", id))
-			}
-			delete(s, id)
-		} else {
-			s[id] = d
+	w := &Multiwatcher{all: sm}
+	w.SetService("wordpress")
+	next := func() *request {
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
 		}
+		sm.handle(req)
+		return req
 	}
-}
+	req := next()
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{
+		{Entity: &multiwatcher.ServiceInfo{Name: "wordpress"}},
+		{Entity: &multiwatcher.UnitInfo{Name: "wordpress/0", Service: "wordpress"}},
+	})
+
+	// Changes to another service's entities don't wake the watcher.
+	req = next()
+	sm.all.Update(&multiwatcher.UnitInfo{Name: "mysql/0", Service: "mysql", Series: "trusty"})
+	sm.respond()
+	assertNotReplied(c, req)
+	c.Assert(w.revno, gc.Equals, int64(6))
+
+	// A unit that moves out of the service is reported as
+	// removed, with the information the watcher last saw,
+	// and one that moves into it is reported as changed.
+	sm.all.Update(&multiwatcher.UnitInfo{Name: "wordpress/0", Service: "mysql"})
+	sm.all.Update(&multiwatcher.UnitInfo{Name: "mysql/0", Service: "wordpress"})
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{{
+		Removed: true,
+		Entity:  &multiwatcher.UnitInfo{Name: "wordpress/0", Service: "wordpress"},
+	}, {
+		Entity: &multiwatcher.UnitInfo{Name: "mysql/0", Service: "wordpress"},
+	}})
+
+	// Once it has left, removing the unit is not reported again.
+	req = next()
+	sm.all.Remove(multiwatcher.EntityId{Kind: "unit", Id: "wordpress/0"})
+	sm.all.Remove(multiwatcher.EntityId{Kind: "unit", Id: "mysql/0"})
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{{
+		Removed: true,
+		Entity:  &multiwatcher.UnitInfo{Name: "mysql/0", Service: "wordpress"},
+	}})
+}
+
+func (*storeManagerSuite) TestRespondFilter(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	sm.all.Update(&multiwatcher.ServiceInfo{Name: "wordpress", Exposed: true})
+	sm.all.Update(&multiwatcher.ServiceInfo{Name: "mysql"})
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0"})
+
+	w := &Multiwatcher{all: sm}
+	w.SetFilter(func(info multiwatcher.EntityInfo) bool {
+		svc, ok := info.(*multiwatcher.ServiceInfo)
+		return ok && svc.Exposed
+	})
+	next := func() *request {
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		return req
+	}
+	req := next()
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{
+		{Entity: &multiwatcher.ServiceInfo{Name: "wordpress", Exposed: true}},
+	})
+
+	// Changes to entities that don't match don't wake the watcher.
+	req = next()
+	sm.all.Update(&multiwatcher.ServiceInfo{Name: "mysql", MinUnits: 1})
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0", Series: "trusty"})
+	sm.respond()
+	assertNotReplied(c, req)
+
+	// Exposing a service reports it, and unexposing one
+	// reports it as removed, with the information the
+	// watcher last saw.
+	sm.all.Update(&multiwatcher.ServiceInfo{Name: "mysql", MinUnits: 1, Exposed: true})
+	sm.all.Update(&multiwatcher.ServiceInfo{Name: "wordpress"})
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{{
+		Entity: &multiwatcher.ServiceInfo{Name: "mysql", MinUnits: 1, Exposed: true},
+	}, {
+		Removed: true,
+		Entity:  &multiwatcher.ServiceInfo{Name: "wordpress", Exposed: true},
+	}})
+
+	// Removing a matching service is reported.
+	req = next()
+	sm.all.Remove(multiwatcher.EntityId{Kind: "service", Id: "mysql"})
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{{
+		Removed: true,
+		Entity:  &multiwatcher.ServiceInfo{Name: "mysql", MinUnits: 1, Exposed: true},
+	}})
+}
+
+func (*storeManagerSuite) TestRespondMachine(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0"})
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "1"})
+	sm.all.Update(&multiwatcher.ServiceInfo{Name: "wordpress"})
+	sm.all.Update(&multiwatcher.UnitInfo{Name: "wordpress/0", Service: "wordpress", MachineId: "1"})
+	sm.all.Update(&multiwatcher.UnitInfo{Name: "wordpress/1", Service: "wordpress"})
+
+	w := &Multiwatcher{all: sm}
+	w.SetMachine("1")
+	next := func() *request {
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		return req
+	}
+	req := next()
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "1"}},
+		{Entity: &multiwatcher.UnitInfo{Name: "wordpress/0", Service: "wordpress", MachineId: "1"}},
+	})
+
+	// Changes to other machines and unassigned
+	// units don't wake the watcher.
+	req = next()
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0", Series: "trusty"})
+	sm.all.Update(&multiwatcher.UnitInfo{Name: "wordpress/1", Service: "wordpress", Series: "trusty"})
+	sm.respond()
+	assertNotReplied(c, req)
+
+	// Assigning a unit to the machine reports it as changed,
+	// and unassigning one reports it as removed, with the
+	// information the watcher last saw.
+	sm.all.Update(&multiwatcher.UnitInfo{Name: "wordpress/1", Service: "wordpress", Series: "trusty", MachineId: "1"})
+	sm.all.Update(&multiwatcher.UnitInfo{Name: "wordpress/0", Service: "wordpress"})
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{{
+		Entity: &multiwatcher.UnitInfo{Name: "wordpress/1", Service: "wordpress", Series: "trusty", MachineId: "1"},
+	}, {
+		Removed: true,
+		Entity:  &multiwatcher.UnitInfo{Name: "wordpress/0", Service: "wordpress", MachineId: "1"},
+	}})
+
+	// Removing the machine is reported.
+	req = next()
+	sm.all.Remove(multiwatcher.EntityId{Kind: "machine", Id: "1"})
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{{
+		Removed: true,
+		Entity:  &multiwatcher.MachineInfo{Id: "1"},
+	}})
+}
+
+func (*storeManagerSuite) TestRespondPartialDeltas(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0", Series: "trusty"})
+	sm.all.Update(&multiwatcher.ServiceInfo{Name: "wordpress"})
+
+	w := &Multiwatcher{all: sm}
+	w.SetPartialDeltas(true)
+	next := func() *request {
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		return req
+	}
+	// Entities are sent in full the first time.
+	req := next()
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "0", Series: "trusty"}},
+		{Entity: &multiwatcher.ServiceInfo{Name: "wordpress"}},
+	})
+
+	// After that, only the changed fields of machines
+	// are sent; other kinds are still sent in full.
+	req = next()
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0", Series: "trusty", InstanceId: "i-0"})
+	sm.all.Update(&multiwatcher.ServiceInfo{Name: "wordpress", Exposed: true})
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{{
+		Entity: &multiwatcher.MachineInfo{Id: "0", InstanceId: "i-0"},
+		Fields: []string{"InstanceId"},
+	}, {
+		Entity: &multiwatcher.ServiceInfo{Name: "wordpress", Exposed: true},
+	}})
+
+	// A machine that is removed and added
+	// again is sent in full again.
+	req = next()
+	sm.all.Remove(multiwatcher.EntityId{Kind: "machine", Id: "0"})
+	sm.respond()
+	assertReplied(c, true, req)
+	req = next()
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0", Series: "trusty"})
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "0", Series: "trusty"}},
+	})
+}
+
+func (*storeManagerSuite) TestRespondEntityKinds(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0"})
+	sm.all.Update(&multiwatcher.ServiceInfo{Name: "wordpress"})
+
+	// Two watchers on the same store manager, one of which
+	// is only interested in machines and units.
+	wFiltered := &Multiwatcher{all: sm}
+	wFiltered.SetEntityKinds("machine", "unit")
+	wAll := &Multiwatcher{all: sm}
+	next := func(w *Multiwatcher) *request {
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		return req
+	}
+	reqFiltered, reqAll := next(wFiltered), next(wAll)
+	sm.respond()
+	assertReplied(c, true, reqFiltered)
+	assertReplied(c, true, reqAll)
+	c.Assert(reqFiltered.changes, jc.DeepEquals, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "0"}},
+	})
+	c.Assert(reqAll.changes, jc.DeepEquals, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "0"}},
+		{Entity: &multiwatcher.ServiceInfo{Name: "wordpress"}},
+	})
+	// Only the watcher that saw the service holds a reference to it.
+	assertStoreContents(c, sm.all, 2, []entityEntry{{
+		creationRevno: 1,
+		revno:         1,
+		refCount:      2,
+		info:          &multiwatcher.MachineInfo{Id: "0"},
+	}, {
+		creationRevno: 2,
+		revno:         2,
+		refCount:      1,
+		info:          &multiwatcher.ServiceInfo{Name: "wordpress"},
+	}})
+
+	// A change to an entity the filtered watcher isn't
+	// interested in doesn't wake it up.
+	reqFiltered, reqAll = next(wFiltered), next(wAll)
+	sm.all.Update(&multiwatcher.ServiceInfo{Name: "wordpress", Exposed: true})
+	sm.respond()
+	assertNotReplied(c, reqFiltered)
+	assertReplied(c, true, reqAll)
+	c.Assert(wFiltered.revno, gc.Equals, int64(3))
+
+	// Removing the service and stopping the unfiltered watcher
+	// releases the service entirely; stopping the filtered
+	// watcher must not release a reference it never held.
+	sm.all.Remove(multiwatcher.EntityId{Kind: "service", Id: "wordpress"})
+	sm.handle(&request{w: wAll})
+	sm.respond()
+	assertNotReplied(c, reqFiltered)
+	assertStoreContents(c, sm.all, 4, []entityEntry{{
+		creationRevno: 1,
+		revno:         1,
+		refCount:      1,
+		info:          &multiwatcher.MachineInfo{Id: "0"},
+	}})
+	sm.handle(&request{w: wFiltered})
+	assertReplied(c, false, reqFiltered)
+	assertStoreContents(c, sm.all, 4, []entityEntry{{
+		creationRevno: 1,
+		revno:         1,
+		info:          &multiwatcher.MachineInfo{Id: "0"},
+	}})
+}
+
+func (*storeManagerSuite) BenchmarkRespond(c *gc.C) {
+	benchmarkRespond(c, false)
+}
+
+func (*storeManagerSuite) BenchmarkRespondCloneDeltas(c *gc.C) {
+	benchmarkRespond(c, true)
+}
+
+// benchmarkRespond measures the cost of responding to a watcher
+// that sees a change to each of a number of machines.
+func benchmarkRespond(c *gc.C, clone bool) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	const machines = 100
+	for i := 0; i < machines; i++ {
+		sm.all.Update(&multiwatcher.MachineInfo{
+			Id:         fmt.Sprint(i),
+			StatusData: map[string]interface{}{"foo": "bar"},
+			Jobs:       []multiwatcher.MachineJob{multiwatcher.JobHostUnits},
+		})
+	}
+	w := &Multiwatcher{all: sm}
+	w.SetCloneDeltas(clone)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		w.revno = 0
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		sm.respond()
+		<-req.reply
+	}
+}
+
+func (*storeManagerSuite) TestRunStop(c *gc.C) {
+	sm := newStoreManager(NewMemoryBacking(nil))
+	w := &Multiwatcher{all: sm}
+	err := sm.Stop()
+	c.Assert(err, jc.ErrorIsNil)
+	d, err := w.Next()
+	c.Assert(errors.Cause(err), gc.Equals, ErrSharedWatcherStopped)
+	c.Assert(d, gc.HasLen, 0)
+}
+
+func (*storeManagerSuite) TestMemoryBackingUnwatchTwice(c *gc.C) {
+	b := NewMemoryBacking(nil)
+	in := make(chan watcher.Change)
+	b.Unwatch(in)
+	b.Watch(in)
+	b.Unwatch(make(chan watcher.Change))
+	b.Unwatch(in)
+	b.Unwatch(in)
+	// The backing can be watched again.
+	b.Watch(in)
+	b.Unwatch(in)
+}
+
+func (*storeManagerSuite) TestRun(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"},
+		&multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "logging"},
+		&multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "wordpress"},
+	})
+	sm := NewMemoryStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.IsNil)
+	}()
+	w := NewMultiwatcher(sm)
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}},
+		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "logging"}},
+		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "wordpress"}},
+	}, "")
+	b.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"}},
+	}, "")
+	b.DeleteEntity(multiwatcher.EntityId{"machine", "uuid", "0"})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Removed: true, Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}},
+	}, "")
+}
+
+func (*storeManagerSuite) TestPeek(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"},
+		&multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "logging"},
+	})
+	sm := NewMemoryStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.IsNil)
+	}()
+	w := NewMultiwatcher(sm)
+
+	peeked, err := w.Peek()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(w.Revno(), gc.Equals, int64(0))
+	checkNext(c, w, peeked, "")
+	revno := w.Revno()
+	c.Assert(revno, gc.Equals, int64(2))
+
+	// With nothing pending, Peek returns straight away.
+	peeked, err = w.Peek()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(peeked, gc.HasLen, 0)
+
+	// Peeking at a removal doesn't drop the watcher's reference
+	// to the removed entity, so Next still sees it.
+	b.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"})
+	b.DeleteEntity(multiwatcher.EntityId{"service", "uuid", "logging"})
+	expect := []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"}},
+		{Removed: true, Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "logging"}},
+	}
+	for attempt := testing.LongAttempt.Start(); attempt.Next(); {
+		peeked, err = w.Peek()
+		c.Assert(err, jc.ErrorIsNil)
+		if len(peeked) == len(expect) {
+			break
+		}
+	}
+	checkDeltasEqual(c, peeked, expect)
+	peeked, err = w.Peek()
+	c.Assert(err, jc.ErrorIsNil)
+	checkDeltasEqual(c, peeked, expect)
+	c.Assert(w.Revno(), gc.Equals, revno)
+	checkNext(c, w, expect, "")
+	c.Assert(w.Revno() > revno, jc.IsTrue)
+}
+
+func (*storeManagerSuite) TestReset(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"},
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"},
+		&multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "wordpress"},
+	})
+	sm := NewMemoryStoreManager(b)
+	w := NewMultiwatcher(sm)
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}},
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"}},
+		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "wordpress"}},
+	}, "")
+	b.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"})
+	b.DeleteEntity(multiwatcher.EntityId{"machine", "uuid", "1"})
+	expect := []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"}},
+		{Removed: true, Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"}},
+	}
+	var deltas []multiwatcher.Delta
+	for len(deltas) < len(expect) {
+		d, err := getNext(c, w, testing.LongWait)
+		c.Assert(err, jc.ErrorIsNil)
+		deltas = append(deltas, d...)
+	}
+	checkDeltasEqual(c, deltas, expect)
+
+	err := w.Reset()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(w.Revno(), gc.Equals, int64(0))
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"}},
+		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "wordpress"}},
+	}, "")
+
+	// Once the watcher has gone, no references remain.
+	c.Assert(w.Stop(), jc.ErrorIsNil)
+	c.Assert(sm.Stop(), jc.ErrorIsNil)
+	sm.all.ForEach(func(entry *entityEntry) {
+		c.Check(entry.refCount, gc.Equals, 0, gc.Commentf("%v", entry.info.EntityId()))
+	})
+}
+
+func (*storeManagerSuite) TestMultipleEnvironments(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{EnvUUID: "uuid0", Id: "0"},
+		&multiwatcher.ServiceInfo{EnvUUID: "uuid0", Name: "logging"},
+		&multiwatcher.ServiceInfo{EnvUUID: "uuid0", Name: "wordpress"},
+		&multiwatcher.MachineInfo{EnvUUID: "uuid1", Id: "0"},
+		&multiwatcher.ServiceInfo{EnvUUID: "uuid1", Name: "logging"},
+		&multiwatcher.ServiceInfo{EnvUUID: "uuid1", Name: "wordpress"},
+		&multiwatcher.MachineInfo{EnvUUID: "uuid2", Id: "0"},
+	})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.IsNil)
+	}()
+	w := &Multiwatcher{all: sm}
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid0", Id: "0"}},
+		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid0", Name: "logging"}},
+		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid0", Name: "wordpress"}},
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid1", Id: "0"}},
+		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid1", Name: "logging"}},
+		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid1", Name: "wordpress"}},
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid2", Id: "0"}},
+	}, "")
+	b.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid1", Id: "0", InstanceId: "i-0"})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid1", Id: "0", InstanceId: "i-0"}},
+	}, "")
+	b.DeleteEntity(multiwatcher.EntityId{"machine", "uuid2", "0"})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Removed: true, Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid2", Id: "0"}},
+	}, "")
+	b.UpdateEntity(&multiwatcher.ServiceInfo{EnvUUID: "uuid0", Name: "logging", Exposed: true})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.ServiceInfo{EnvUUID: "uuid0", Name: "logging", Exposed: true}},
+	}, "")
+}
+
+func (*storeManagerSuite) TestMultipleBackings(c *gc.C) {
+	// Both backings report machine 0 in the same
+	// environment; the deltas tell them apart.
+	b0 := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"},
+	})
+	b1 := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"},
+	})
+	sm := newStoreManager(NewMultiBacking(b0, b1))
+	defer func() {
+		c.Check(sm.Stop(), gc.IsNil)
+	}()
+	w := NewMultiwatcher(sm)
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}, Source: "0"},
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}, Source: "1"},
+	}, "")
+	b1.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-1"})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-1"}, Source: "1"},
+	}, "")
+	b0.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"}, Source: "0"},
+	}, "")
+	b0.DeleteEntity(multiwatcher.EntityId{"machine", "uuid", "0"})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Removed: true, Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"}, Source: "0"},
+	}, "")
+	c.Assert(sm.all.All(), jc.DeepEquals, []multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-1"},
+	})
+}
+
+func (*storeManagerSuite) TestMultiBackingUnwatchWhileSending(c *gc.C) {
+	b := NewMemoryBacking(nil)
+	mb := NewMultiBacking(b)
+	in := make(chan watcher.Change)
+	mb.Watch(in)
+
+	// Nothing receives on in, so the first change is held by
+	// the multi-backing, and the backing blocks sending the
+	// second with its lock held.
+	updated := make(chan struct{})
+	go func() {
+		defer close(updated)
+		b.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"})
+		b.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"})
+	}()
+	time.Sleep(testing.ShortWait)
+
+	unwatched := make(chan struct{})
+	go func() {
+		defer close(unwatched)
+		mb.Unwatch(in)
+	}()
+	for _, done := range []chan struct{}{unwatched, updated} {
+		select {
+		case <-done:
+		case <-time.After(testing.LongWait):
+			c.Fatalf("unwatch deadlocked with a blocked backing")
+		}
+	}
+}
+
+func (*storeManagerSuite) TestChangedMany(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"},
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"},
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "2"},
+		&multiwatcher.ServiceInfo{EnvUUID: "uuid", Name: "wordpress"},
+	})
+	fetches := countFetches(b)
+	sm := newStoreManagerNoRun(b)
+	machineChange := func(id string) watcher.Change {
+		return watcher.Change{C: machinesC, Id: ensureEnvUUID("uuid", id)}
+	}
+	err := sm.changed([]watcher.Change{
+		machineChange("0"),
+		machineChange("1"),
+		machineChange("2"),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(fetches(), gc.Equals, 1)
+	c.Assert(sm.all.Len(), gc.Equals, 3)
+
+	// Changes to different collections are fetched
+	// separately, so their order is preserved.
+	err = sm.changed([]watcher.Change{
+		machineChange("0"),
+		{C: servicesC, Id: ensureEnvUUID("uuid", "wordpress")},
+		machineChange("1"),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(fetches(), gc.Equals, 4)
+	c.Assert(sm.all.Len(), gc.Equals, 4)
+}
+
+func (*storeManagerSuite) TestGatherChanges(c *gc.C) {
+	in := make(chan watcher.Change, 3)
+	in <- watcher.Change{C: "machine", Id: "1"}
+	in <- watcher.Change{C: "machine", Id: "2"}
+	changes := gatherChanges(in, watcher.Change{C: "machine", Id: "0"})
+	c.Assert(changes, jc.DeepEquals, []watcher.Change{
+		{C: "machine", Id: "0"},
+		{C: "machine", Id: "1"},
+		{C: "machine", Id: "2"},
+	})
+}
+
+func (*storeManagerSuite) TestGatherChangesClosed(c *gc.C) {
+	in := make(chan watcher.Change, 1)
+	in <- watcher.Change{C: "machine", Id: "1"}
+	close(in)
+	changes := gatherChanges(in, watcher.Change{C: "machine", Id: "0"})
+	c.Assert(changes, jc.DeepEquals, []watcher.Change{
+		{C: "machine", Id: "0"},
+		{C: "machine", Id: "1"},
+	})
+}
+
+func (*storeManagerSuite) TestPositionHook(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"},
+	})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.IsNil)
+	}()
+	var (
+		mu     sync.Mutex
+		revnos []int64
+	)
+	recorded := make(chan int64, 10)
+	w := &Multiwatcher{all: sm}
+	w.SetPositionHook(func(revno int64) {
+		mu.Lock()
+		revnos = append(revnos, revno)
+		mu.Unlock()
+		recorded <- revno
+	})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}},
+	}, "")
+	b.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"}},
+	}, "")
+	b.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"}},
+	}, "")
+
+	// Wait for the hook to see the final position.
+	for {
+		select {
+		case revno := <-recorded:
+			if revno < 3 {
+				continue
+			}
+		case <-time.After(testing.LongWait):
+			c.Fatalf("position hook not called with final revno")
+		}
+		break
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(revnos[len(revnos)-1], gc.Equals, int64(3))
+	for i := 1; i < len(revnos); i++ {
+		c.Assert(revnos[i] > revnos[i-1], jc.IsTrue, gc.Commentf("revnos %v", revnos))
+	}
+}
+
+func (s *storeManagerSuite) TestMinInterval(c *gc.C) {
+	clock := testing.NewClock(time.Now())
+	s.PatchValue(&GetClock, func() jujuclock.Clock { return clock })
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"},
+	})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.IsNil)
+	}()
+	w := &Multiwatcher{all: sm}
+	w.SetMinInterval(time.Second)
+
+	// The first delivery is not held back.
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}},
+	}, "")
+	delivered := clock.Now()
+
+	type nextResult struct {
+		deltas []multiwatcher.Delta
+		err    error
+	}
+	done := make(chan nextResult, 1)
+	go func() {
+		deltas, err := w.Next()
+		done <- nextResult{deltas, err}
+	}()
+	b.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"})
+	b.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"})
+	b.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1", InstanceId: "i-1"})
+	clock.Advance(time.Second / 2)
+	select {
+	case <-done:
+		c.Fatalf("changes delivered before minimum interval elapsed")
+	case <-time.After(testing.ShortWait):
+	}
+
+	clock.Advance(time.Second / 2)
+	select {
+	case result := <-done:
+		c.Assert(result.err, jc.ErrorIsNil)
+		c.Assert(clock.Now().Sub(delivered) >= time.Second, jc.IsTrue)
+		checkDeltasEqual(c, result.deltas, []multiwatcher.Delta{
+			{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0", InstanceId: "i-0"}},
+			{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1", InstanceId: "i-1"}},
+		})
+	case <-time.After(testing.LongWait):
+		c.Fatalf("changes not delivered after minimum interval elapsed")
+	}
+}
+
+func (*storeManagerSuite) TestNewMultiwatcherWithSnapshot(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"},
+	})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.IsNil)
+	}()
+
+	// Add machines concurrently with the registration.
+	const count = 20
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= count; i++ {
+			b.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: fmt.Sprint(i)})
+		}
+	}()
+	w, snapshot, err := NewMultiwatcherWithSnapshot(sm)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Every machine must be seen exactly once across the
+	// snapshot and the subsequent stream of deltas.
+	seen := make(map[string]int)
+	for _, info := range snapshot {
+		seen[info.(*multiwatcher.MachineInfo).Id]++
+	}
+	for len(seen) < count+1 {
+		deltas, err := getNext(c, w, testing.LongWait)
+		c.Assert(err, jc.ErrorIsNil)
+		for _, d := range deltas {
+			seen[d.Entity.(*multiwatcher.MachineInfo).Id]++
+		}
+	}
+	<-done
+	for id, n := range seen {
+		c.Check(n, gc.Equals, 1, gc.Commentf("machine %s", id))
+	}
+}
+
+func (*storeManagerSuite) TestResumeToken(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{&multiwatcher.MachineInfo{Id: "0"}})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.IsNil)
+	}()
+
+	// A client sees several deltas, keeps a token, then disconnects.
+	w1 := &Multiwatcher{all: sm}
+	checkNext(c, w1, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "0"}}}, "")
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "1"})
+	checkNext(c, w1, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "1"}}}, "")
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "0", Series: "trusty"})
+	checkNext(c, w1, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "0", Series: "trusty"}}}, "")
+	token := w1.ResumeToken().String()
+	c.Assert(w1.Stop(), jc.ErrorIsNil)
+
+	t, err := ParseResumeToken(token)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(t, gc.Equals, ResumeToken{StoreId: sm.id, Revno: 3})
+
+	// On resuming from the token, it sees only what it missed.
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "2"})
+	w2, err := NewMultiwatcherFromToken(sm, token)
+	c.Assert(err, jc.ErrorIsNil)
+	defer w2.Stop()
+	checkNext(c, w2, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "2"}}}, "")
+
+	// A token from another store manager cannot be used.
+	other := newStoreManager(NewMemoryBacking(nil))
+	defer other.Stop()
+	_, err = NewMultiwatcherFromToken(other, token)
+	c.Assert(errors.Cause(err), gc.Equals, ErrRevnoExpired)
+
+	_, err = NewMultiwatcherFromToken(sm, "bad token")
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (*storeManagerSuite) TestNewMultiwatcherAt(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{Id: "0"},
+		&multiwatcher.MachineInfo{Id: "1"},
+	})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.IsNil)
+	}()
+
+	// Resuming from before every entity was created is
+	// the same as starting afresh.
+	w0, err := NewMultiwatcherAt(sm, 0)
+	c.Assert(err, jc.ErrorIsNil)
+	defer w0.Stop()
+	checkNext(c, w0, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "0"}},
+		{Entity: &multiwatcher.MachineInfo{Id: "1"}},
+	}, "")
+	c.Assert(w0.Revno(), gc.Equals, int64(2))
+
+	// A client sees everything, then disconnects.
+	w1 := &Multiwatcher{all: sm}
+	checkNext(c, w1, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "0"}},
+		{Entity: &multiwatcher.MachineInfo{Id: "1"}},
+	}, "")
+	revno := w1.Revno()
+	c.Assert(w1.Stop(), jc.ErrorIsNil)
+
+	// While it is disconnected, a machine is added and
+	// another removed.
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "2"})
+	b.DeleteEntity(multiwatcher.EntityId{Kind: "machine", Id: "1"})
+
+	// On resuming, it sees only what it missed.
+	w2, err := NewMultiwatcherAt(sm, revno)
+	c.Assert(err, jc.ErrorIsNil)
+	defer w2.Stop()
+	c.Assert(w2.Revno(), gc.Equals, revno)
+	checkNext(c, w2, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "2"}},
+		{Removed: true, Entity: &multiwatcher.MachineInfo{Id: "1"}},
+	}, "")
+	c.Assert(w2.Revno(), gc.Equals, int64(4))
+
+	// Once every watcher has seen the removal, the store
+	// deletes the removed machine, but remembers its removal,
+	// so it is still possible to resume from before it.
+	checkNext(c, w0, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "2"}},
+		{Removed: true, Entity: &multiwatcher.MachineInfo{Id: "1"}},
+	}, "")
+	w3, err := NewMultiwatcherAt(sm, revno)
+	c.Assert(err, jc.ErrorIsNil)
+	checkNext(c, w3, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "2"}},
+		{Removed: true, Entity: &multiwatcher.MachineInfo{Id: "1"}},
+	}, "")
+	c.Assert(w3.Stop(), jc.ErrorIsNil)
+
+	_, err = NewMultiwatcherAt(sm, 5)
+	c.Assert(err, gc.ErrorMatches, "revno 5 not valid")
+}
+
+func (s *storeManagerSuite) TestNewMultiwatcherAtForgottenRemoval(c *gc.C) {
+	s.PatchValue(&maxTombstones, 1)
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{Id: "0"},
+		&multiwatcher.MachineInfo{Id: "1"},
+	})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.IsNil)
+	}()
+	w0, err := NewMultiwatcherFromNow(sm)
+	c.Assert(err, jc.ErrorIsNil)
+	defer w0.Stop()
+	revno := w0.Revno()
+
+	// Removals are remembered, so resuming
+	// from before them is possible...
+	b.DeleteEntity(multiwatcher.EntityId{Kind: "machine", Id: "0"})
+	checkNext(c, w0, []multiwatcher.Delta{
+		{Removed: true, Entity: &multiwatcher.MachineInfo{Id: "0"}},
+	}, "")
+	w1, err := NewMultiwatcherAt(sm, revno)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(w1.Stop(), jc.ErrorIsNil)
+
+	// ... until the store forgets them, when only revnos
+	// after the forgotten removal may be resumed from.
+	b.DeleteEntity(multiwatcher.EntityId{Kind: "machine", Id: "1"})
+	checkNext(c, w0, []multiwatcher.Delta{
+		{Removed: true, Entity: &multiwatcher.MachineInfo{Id: "1"}},
+	}, "")
+	_, err = NewMultiwatcherAt(sm, revno)
+	c.Assert(errors.Cause(err), gc.Equals, ErrRevnoExpired)
+	w2, err := NewMultiwatcherAt(sm, revno+1)
+	c.Assert(err, jc.ErrorIsNil)
+	defer w2.Stop()
+	checkNext(c, w2, []multiwatcher.Delta{
+		{Removed: true, Entity: &multiwatcher.MachineInfo{Id: "1"}},
+	}, "")
+}
+
+func (*storeManagerSuite) TestSnapshot(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{Id: "0"},
+		&multiwatcher.MachineInfo{Id: "1"},
+	})
+	sm := newStoreManager(b)
+	deltas, revno, err := sm.Snapshot()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(revno, gc.Equals, int64(2))
+	checkDeltasEqual(c, deltas, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "0"}},
+		{Entity: &multiwatcher.MachineInfo{Id: "1"}},
+	})
+
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "2"})
+	b.DeleteEntity(multiwatcher.EntityId{Kind: "machine", Id: "1"})
+	deltas, revno, err = sm.Snapshot()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(revno, gc.Equals, int64(4))
+	checkDeltasEqual(c, deltas, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "0"}},
+		{Entity: &multiwatcher.MachineInfo{Id: "2"}},
+	})
+
+	// A watcher can carry on from the snapshot.
+	w, err := NewMultiwatcherAt(sm, revno)
+	c.Assert(err, jc.ErrorIsNil)
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "3"})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "3"}},
+	}, "")
+	c.Assert(w.Stop(), jc.ErrorIsNil)
+
+	// The snapshot leaves no watcher or references behind.
+	c.Assert(sm.Stop(), jc.ErrorIsNil)
+	c.Assert(sm.waiting, gc.HasLen, 0)
+	for e := sm.all.list.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*entityEntry)
+		c.Check(entry.refCount, gc.Equals, 0, gc.Commentf("entity %v", entry.info.EntityId()))
+	}
+
+	_, _, err = sm.Snapshot()
+	c.Assert(errors.Cause(err), gc.Equals, ErrSharedWatcherStopped)
+}
+
+func (*storeManagerSuite) TestPauseAndResume(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{&multiwatcher.MachineInfo{Id: "0"}})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), jc.ErrorIsNil)
+	}()
+	w := &Multiwatcher{all: sm}
+	checkNext(c, w, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "0"}}}, "")
+
+	// While paused, changes to the backing are held,
+	// so the revno does not advance.
+	err := sm.Pause()
+	c.Assert(err, jc.ErrorIsNil)
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "1"})
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "2"})
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "0", InstanceId: "i-0"})
+	b.DeleteEntity(multiwatcher.EntityId{Kind: "machine", Id: "2"})
+	_, err = w.NextWithTimeout(testing.ShortWait)
+	c.Assert(errors.Cause(err), gc.Equals, ErrTimeout)
+	stats, err := sm.Stats()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(stats.Revno, gc.Equals, int64(1))
+
+	// On resume, the watcher catches up with the backing.
+	err = sm.Resume()
+	c.Assert(err, jc.ErrorIsNil)
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "1"}},
+		{Entity: &multiwatcher.MachineInfo{Id: "0", InstanceId: "i-0"}},
+	}, "")
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "3"})
+	checkNext(c, w, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "3"}}}, "")
+}
+
+func (*storeManagerSuite) TestGet(c *gc.C) {
+	b := NewMemoryBacking(nil)
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), jc.ErrorIsNil)
+	}()
+	id := multiwatcher.EntityId{Kind: "machine", Id: "0"}
+	info, found, err := sm.Get(id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(found, jc.IsFalse)
+	c.Assert(info, gc.IsNil)
+
+	w0 := &Multiwatcher{all: sm}
+	w1 := &Multiwatcher{all: sm}
+	m0 := &multiwatcher.MachineInfo{Id: "0", InstanceId: "i-0"}
+	b.UpdateEntity(m0)
+	checkNext(c, w0, []multiwatcher.Delta{{Entity: m0}}, "")
+	checkNext(c, w1, []multiwatcher.Delta{{Entity: m0}}, "")
+	info, found, err = sm.Get(id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(found, jc.IsTrue)
+	c.Assert(info, jc.DeepEquals, m0)
+
+	// The entity is removed, but is still held in the
+	// store until w1 has seen the removal.
+	b.DeleteEntity(id)
+	checkNext(c, w0, []multiwatcher.Delta{{Removed: true, Entity: m0}}, "")
+	info, found, err = sm.Get(id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(found, jc.IsFalse)
+	c.Assert(info, gc.IsNil)
+}
+
+func (*storeManagerSuite) TestGetStopped(c *gc.C) {
+	sm := newStoreManager(NewMemoryBacking(nil))
+	c.Assert(sm.Stop(), jc.ErrorIsNil)
+	_, _, err := sm.Get(multiwatcher.EntityId{Kind: "machine", Id: "0"})
+	c.Assert(errors.Cause(err), gc.Equals, ErrSharedWatcherStopped)
+}
+
+func (*storeManagerSuite) TestNewMultiwatcherFromNow(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{Id: "0"},
+		&multiwatcher.MachineInfo{Id: "1"},
+	})
+	sm := newStoreManager(b)
+	w, err := NewMultiwatcherFromNow(sm)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(w.Revno(), gc.Equals, int64(2))
+
+	// Nothing has changed yet, so there's nothing to tell.
+	_, err = w.NextWithTimeout(testing.ShortWait)
+	c.Assert(errors.Cause(err), gc.Equals, ErrTimeout)
+
+	// Only entities that change are reported, including the
+	// removal of one that the watcher was never told about.
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "2"})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "2"}},
+	}, "")
+	b.DeleteEntity(multiwatcher.EntityId{Kind: "machine", Id: "0"})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Removed: true, Entity: &multiwatcher.MachineInfo{Id: "0"}},
+	}, "")
+	c.Assert(w.Stop(), jc.ErrorIsNil)
+
+	// Stopping the watcher releases exactly the references it
+	// took, so the store forgets the removed entity.
+	c.Assert(sm.Stop(), jc.ErrorIsNil)
+	c.Assert(sm.all.Get(multiwatcher.EntityId{Kind: "machine", Id: "0"}), gc.IsNil)
+	for e := sm.all.list.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*entityEntry)
+		c.Check(entry.refCount, gc.Equals, 0, gc.Commentf("entity %v", entry.info.EntityId()))
+	}
+}
+
+func (*storeManagerSuite) TestRemovedDeltaForLateWatcher(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	m0 := &multiwatcher.MachineInfo{Id: "0", InstanceId: "i-0"}
+	sm.all.Update(m0)
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "1"})
+	next := func(w *Multiwatcher) *request {
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		sm.respond()
+		return req
+	}
+
+	// The first watcher sees machine 0, so the store keeps
+	// it, with its last known information, when it is removed.
+	w1 := &Multiwatcher{all: sm}
+	assertReplied(c, true, next(w1))
+	sm.all.Remove(m0.EntityId())
+
+	// A watcher that resumes from before the removal registers
+	// after it but before the first watcher has been told.
+	w2 := &Multiwatcher{all: sm}
+	resume := &request{w: w2, reply: make(chan bool, 1), resume: true, revno: 2}
+	sm.handle(resume)
+	assertReplied(c, true, resume)
+	// A brand new watcher is never told about the machine at all.
+	w3 := &Multiwatcher{all: sm}
+	req := next(w3)
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "1"}},
+	})
+
+	// Telling the first watcher doesn't release the
+	// entry, because the second still needs to know.
+	req = next(w1)
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{{Removed: true, Entity: m0}})
+	c.Assert(sm.all.Get(m0.EntityId()), gc.Equals, m0)
+
+	req = next(w2)
+	assertReplied(c, true, req)
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{{Removed: true, Entity: m0}})
+	c.Assert(sm.all.Get(m0.EntityId()), gc.IsNil)
+}
+
+func (*storeManagerSuite) TestStats(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	for i := 0; i < 3; i++ {
+		sm.all.Update(&multiwatcher.MachineInfo{Id: fmt.Sprint(i)})
+	}
+	c.Assert(sm.stats(), jc.DeepEquals, MultiwatcherStats{
+		Revno:           3,
+		MinWatcherRevno: 3,
+	})
+
+	// Register two watchers at different revnos, and
+	// leave a request waiting on the up-to-date one.
+	w1 := &Multiwatcher{all: sm}
+	sm.handle(&request{w: w1, reply: make(chan bool, 1), resume: true, revno: 1})
+	w2 := &Multiwatcher{all: sm}
+	sm.handle(&request{w: w2, reply: make(chan bool, 1), resume: true, revno: 3})
+	sm.handle(&request{w: w2, reply: make(chan bool, 1)})
+	c.Assert(sm.stats(), jc.DeepEquals, MultiwatcherStats{
+		Watchers:        2,
+		WaitingRequests: 1,
+		Revno:           3,
+		MinWatcherRevno: 1,
+	})
+
+	// Once the lagging watcher is stopped, it no longer counts.
+	sm.handle(&request{w: w1})
+	c.Assert(sm.stats(), jc.DeepEquals, MultiwatcherStats{
+		Watchers:        1,
+		WaitingRequests: 1,
+		Revno:           3,
+		MinWatcherRevno: 3,
+	})
+}
+
+func (*storeManagerSuite) TestStatsRequest(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{Id: "0"},
+	})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.IsNil)
+	}()
+	w, err := NewMultiwatcherAt(sm, 0)
+	c.Assert(err, jc.ErrorIsNil)
+	defer w.Stop()
+	stats, err := sm.Stats()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(stats, jc.DeepEquals, MultiwatcherStats{
+		Watchers:        1,
+		Revno:           1,
+		MinWatcherRevno: 0,
+	})
+}
+
+func (*storeManagerSuite) TestNextWithTimeout(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{&multiwatcher.MachineInfo{Id: "0"}})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.IsNil)
+	}()
+	w := &Multiwatcher{all: sm}
+	defer w.Stop()
+	deltas, err := w.NextWithTimeout(testing.LongWait)
+	c.Assert(err, jc.ErrorIsNil)
+	checkDeltasEqual(c, deltas, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "0"}}})
+	revno := w.Revno()
+
+	deltas, err = w.NextWithTimeout(testing.ShortWait)
+	c.Assert(errors.Cause(err), gc.Equals, ErrTimeout)
+	c.Assert(deltas, gc.IsNil)
+	c.Assert(w.Revno(), gc.Equals, revno)
+
+	// The abandoned request must not be replied to, and
+	// the timeout must not lose any changes.
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "1"})
+	deltas, err = w.NextWithTimeout(testing.LongWait)
+	c.Assert(err, jc.ErrorIsNil)
+	checkDeltasEqual(c, deltas, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "1"}},
+	})
+}
+
+func (*storeManagerSuite) TestNextWithTimeoutStoreManagerDies(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	w := &Multiwatcher{all: sm}
+	// Accept the request, then die while the
+	// watcher is trying to withdraw it.
+	go func() {
+		<-sm.request
+		time.Sleep(testing.ShortWait)
+		sm.tomb.Kill(errors.New("store manager failed"))
+		sm.tomb.Done()
+	}()
+	timeout := make(chan time.Time, 1)
+	timeout <- time.Now()
+	_, err := w.next(timeout)
+	c.Assert(err, gc.ErrorMatches, "store manager failed")
+}
+
+func (*storeManagerSuite) TestWithdraw(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	w := &Multiwatcher{all: sm}
+	var reqs []*request
+	for i := 0; i < 3; i++ {
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		reqs = append(reqs, req)
+	}
+	sm.handle(&request{w: w, cancel: reqs[1]})
+	assertWaitingRequests(c, sm, map[*Multiwatcher][]*request{
+		w: {reqs[2], reqs[0]},
+	})
+	sm.handle(&request{w: w, cancel: reqs[2]})
+	assertWaitingRequests(c, sm, map[*Multiwatcher][]*request{
+		w: {reqs[0]},
+	})
+	sm.handle(&request{w: w, cancel: reqs[0]})
+	assertWaitingRequests(c, sm, nil)
+
+	// Withdrawing a request that has gone is a no-op.
+	sm.handle(&request{w: w, cancel: reqs[0]})
+	assertWaitingRequests(c, sm, nil)
+}
+
+func (*storeManagerSuite) TestHandleStopAndDrain(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0"})
+	var ws []*Multiwatcher
+	var reqs []*request
+	for i := 0; i < 2; i++ {
+		w := &Multiwatcher{all: sm}
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		ws = append(ws, w)
+		reqs = append(reqs, req)
+	}
+	// Both watchers have changes pending, but
+	// neither has been responded to yet.
+	sm.handle(&request{w: ws[0], drain: true})
+	sm.handle(&request{w: ws[1]})
+	assertReplied(c, true, reqs[0])
+	c.Assert(reqs[0].changes, jc.DeepEquals, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "0"}},
+	})
+	assertReplied(c, false, reqs[1])
+	assertWaitingRequests(c, sm, nil)
+
+	// Both watchers have now gone, so nothing
+	// holds a reference to the machine.
+	assertStoreContents(c, sm.all, 1, []entityEntry{{
+		creationRevno: 1,
+		revno:         1,
+		info:          &multiwatcher.MachineInfo{Id: "0"},
+	}})
+
+	// Later requests find the watcher stopped.
+	req := &request{
+		w:     ws[0],
+		reply: make(chan bool, 1),
+	}
+	sm.handle(req)
+	assertReplied(c, false, req)
+}
+
+func (*storeManagerSuite) TestRespondRoundRobin(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	var ws []*Multiwatcher
+	for i := 0; i < 3; i++ {
+		ws = append(ws, &Multiwatcher{all: sm})
+	}
+	next := func(w *Multiwatcher) *request {
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		return req
+	}
+	reqs := make(map[*Multiwatcher]*request)
+	for _, w := range ws {
+		reqs[w] = next(w)
+	}
+
+	// Each watcher takes its turn at being served first.
+	for i := 0; i < 4; i++ {
+		order := sm.respondOrder()
+		c.Assert(order, gc.HasLen, len(ws))
+		for j, w := range order {
+			c.Assert(w, gc.Equals, ws[(i+j)%len(ws)])
+		}
+	}
+
+	// With changes arriving steadily, every watcher is
+	// brought up to date by every call to respond.
+	for i := 0; i < 6; i++ {
+		c.Logf("round %d", i)
+		sm.all.Update(&multiwatcher.MachineInfo{Id: fmt.Sprint(i)})
+		sm.respond()
+		for _, w := range ws {
+			assertReplied(c, true, reqs[w])
+			c.Assert(w.revno, gc.Equals, sm.all.latestRevno)
+			reqs[w] = next(w)
+		}
+	}
+}
+
+func (*storeManagerSuite) TestMaxPending(c *gc.C) {
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0"})
+	w := &Multiwatcher{all: sm}
+	w.SetMaxPending(3)
+	next := func() *request {
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		return req
+	}
+	req := next()
+	sm.respond()
+	assertReplied(c, true, req)
+
+	// The watcher is not waiting, but is still within its limit.
+	for i := 1; i <= 3; i++ {
+		sm.all.Update(&multiwatcher.MachineInfo{Id: fmt.Sprint(i)})
+		sm.respond()
+	}
+	c.Assert(sm.watchers[w], jc.IsTrue)
+
+	// A watcher waiting for changes is never stopped.
+	req = next()
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "4"})
+	sm.respond()
+	assertReplied(c, true, req)
+	c.Assert(req.changes, gc.HasLen, 4)
+
+	// The watcher never advances while changes accumulate.
+	for i := 5; i <= 9; i++ {
+		sm.all.Update(&multiwatcher.MachineInfo{Id: fmt.Sprint(i)})
+		sm.respond()
+	}
+	c.Assert(w.stopped, jc.IsTrue)
+	c.Assert(sm.watchers, gc.HasLen, 0)
+	// It has released its references to the machines it saw.
+	for e := sm.all.list.Front(); e != nil; e = e.Next() {
+		c.Check(e.Value.(*entityEntry).refCount, gc.Equals, 0)
+	}
+
+	req = next()
+	assertReplied(c, false, req)
+	c.Assert(req.err, gc.Equals, ErrFellBehind)
+}
+
+func (s *storeManagerSuite) TestMaxRemovedEntries(c *gc.C) {
+	s.PatchValue(&maxRemovedEntries, 2)
+	sm := newStoreManagerNoRun(NewMemoryBacking(nil))
+	for i := 0; i < 4; i++ {
+		sm.all.Update(&multiwatcher.MachineInfo{Id: fmt.Sprint(i)})
+	}
+	next := func(w *Multiwatcher) *request {
+		req := &request{
+			w:     w,
+			reply: make(chan bool, 1),
+		}
+		sm.handle(req)
+		return req
+	}
+	w0 := &Multiwatcher{all: sm}
+	w1 := &Multiwatcher{all: sm}
+	req0, req1 := next(w0), next(w1)
+	sm.respond()
+	assertReplied(c, true, req0)
+	assertReplied(c, true, req1)
+
+	// The second watcher stops calling Next, so the removed
+	// machines are kept for it, up to the limit.
+	req0 = next(w0)
+	sm.all.Remove(multiwatcher.EntityId{Kind: "machine", Id: "0"})
+	sm.all.Remove(multiwatcher.EntityId{Kind: "machine", Id: "1"})
+	sm.respond()
+	assertReplied(c, true, req0)
+	c.Assert(sm.all.removedCount, gc.Equals, 2)
+	c.Assert(sm.watchers[w1], jc.IsTrue)
+
+	// Going over the limit stops the stalled watcher,
+	// releasing the removed machines.
+	req0 = next(w0)
+	sm.all.Remove(multiwatcher.EntityId{Kind: "machine", Id: "2"})
+	sm.respond()
+	assertReplied(c, true, req0)
+	c.Assert(sm.watchers[w0], jc.IsTrue)
+	c.Assert(w1.stopped, jc.IsTrue)
+	c.Assert(sm.all.removedCount, gc.Equals, 0)
+	c.Assert(sm.all.check(), jc.ErrorIsNil)
+	c.Assert(c.GetTestLog(), jc.Contains, "watcher fell behind")
 
-// check checks that the watcher state matches that
-// held in current.
-func (s watcherState) check(c *gc.C, current *multiwatcherStore) {
-	currentEntities := make(watcherState)
-	for id, elem := range current.entities {
-		entry := elem.Value.(*entityEntry)
-		if !entry.removed {
-			currentEntities[id] = multiwatcher.Delta{Entity: entry.info}
-		}
-	}
-	c.Assert(s, gc.DeepEquals, currentEntities)
+	req1 = next(w1)
+	assertReplied(c, false, req1)
+	c.Assert(req1.err, gc.Equals, ErrFellBehind)
 }
 
-func assertNotReplied(c *gc.C, req *request) {
-	select {
-	case v := <-req.reply:
-		c.Fatalf("request was unexpectedly replied to (got %v)", v)
-	default:
-	}
+func (*storeManagerSuite) TestMultiwatcherStop(c *gc.C) {
+	sm := newStoreManager(NewMemoryBacking(nil))
+	defer func() {
+		c.Check(sm.Stop(), gc.IsNil)
+	}()
+	w := &Multiwatcher{all: sm}
+	done := make(chan struct{})
+	go func() {
+		_, err := w.Next()
+		c.Check(errors.Cause(err), gc.Equals, ErrStopped)
+		done <- struct{}{}
+	}()
+	err := w.Stop()
+	c.Assert(err, jc.ErrorIsNil)
+	<-done
 }
 
-func assertReplied(c *gc.C, val bool, req *request) {
-	select {
-	case v := <-req.reply:
-		c.Assert(v, gc.Equals, val)
-	default:
-		c.Fatalf("request was not replied to")
-	}
+func (*storeManagerSuite) TestMultiwatcherStopBecauseStoreManagerError(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{&multiwatcher.MachineInfo{Id: "0"}})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.ErrorMatches, "some error")
+	}()
+	w := &Multiwatcher{all: sm}
+	// Receive one delta to make sure that the storeManager
+	// has seen the initial state.
+	checkNext(c, w, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "0"}}}, "")
+	c.Logf("setting fetch error")
+	b.SetFetchError(errors.New("some error"))
+	c.Logf("updating entity")
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "1"})
+	checkNext(c, w, nil, "some error")
 }
 
-func assertWaitingRequests(c *gc.C, sm *storeManager, waiting map[*Multiwatcher][]*request) {
-	c.Assert(sm.waiting, gc.HasLen, len(waiting))
-	for w, reqs := range waiting {
-		i := 0
-		for req := sm.waiting[w]; ; req = req.next {
-			if i >= len(reqs) {
-				c.Assert(req, gc.IsNil)
+// panickingBacking is a backing that panics
+// when told about any change.
+type panickingBacking struct {
+	*MemoryBacking
+}
+
+func (b panickingBacking) Changed(all *multiwatcherStore, change watcher.Change) error {
+	panic("changed")
+}
+
+func (b panickingBacking) ChangedMany(all *multiwatcherStore, changes []watcher.Change) error {
+	panic("changed")
+}
+
+func (*storeManagerSuite) TestWaitingNextFailsWhenLoopExits(c *gc.C) {
+	for i, test := range []struct {
+		about     string
+		backing   func(b *MemoryBacking) Backing
+		expectErr string
+	}{{
+		about: "loop fails",
+		backing: func(b *MemoryBacking) Backing {
+			b.SetFetchError(errors.New("some error"))
+			return b
+		},
+		expectErr: "some error",
+	}, {
+		about: "loop panics",
+		backing: func(b *MemoryBacking) Backing {
+			return panickingBacking{b}
+		},
+		expectErr: "store manager loop panicked: changed",
+	}} {
+		c.Logf("test %d: %s", i, test.about)
+		b := NewMemoryBacking([]multiwatcher.EntityInfo{&multiwatcher.MachineInfo{Id: "0"}})
+		sm := newStoreManager(test.backing(b))
+		w := &Multiwatcher{all: sm}
+		checkNext(c, w, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "0"}}}, "")
+		heartbeat, err := sm.Heartbeat()
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(heartbeat.Revno, gc.Equals, int64(1))
+
+		// Wait until a Next call is waiting for changes
+		// before making the loop exit.
+		done := make(chan error, 1)
+		go func() {
+			_, err := w.Next()
+			done <- err
+		}()
+		for a := testing.LongAttempt.Start(); a.Next(); {
+			stats, err := sm.Stats()
+			c.Assert(err, jc.ErrorIsNil)
+			if stats.WaitingRequests == 1 {
 				break
 			}
-			c.Assert(req, gc.Equals, reqs[i])
-			assertNotReplied(c, req)
-			i++
 		}
+		b.UpdateEntity(&multiwatcher.MachineInfo{Id: "1"})
+		select {
+		case err := <-done:
+			c.Assert(err, gc.ErrorMatches, test.expectErr)
+		case <-time.After(testing.LongWait):
+			c.Fatalf("timed out waiting for Next to fail")
+		}
+		_, err = sm.Heartbeat()
+		c.Assert(err, gc.ErrorMatches, test.expectErr)
+		c.Assert(sm.Stop(), gc.ErrorMatches, test.expectErr)
 	}
 }
 
-type storeManagerTestBacking struct {
-	mu       sync.Mutex
-	fetchErr error
-	entities map[multiwatcher.EntityId]multiwatcher.EntityInfo
-	watchc   chan<- watcher.Change
-	txnRevno int64
-}
+func (*storeManagerSuite) TestForceStop(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{&multiwatcher.MachineInfo{Id: "0"}})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), jc.ErrorIsNil)
+	}()
+	w1 := &Multiwatcher{all: sm}
+	w2 := &Multiwatcher{all: sm}
+	checkNext(c, w1, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "0"}}}, "")
+	checkNext(c, w2, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "0"}}}, "")
+	watchers, err := sm.Watchers()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(watchers, jc.DeepEquals, []MultiwatcherInfo{
+		{Id: 1, Revno: 1},
+		{Id: 2, Revno: 1},
+	})
 
-func newTestBacking(initial []multiwatcher.EntityInfo) *storeManagerTestBacking {
-	b := &storeManagerTestBacking{
-		entities: make(map[multiwatcher.EntityId]multiwatcher.EntityInfo),
+	// Stopping the first watcher fails the
+	// call to Next waiting on it.
+	done := make(chan error, 1)
+	go func() {
+		_, err := w1.Next()
+		done <- err
+	}()
+	for a := testing.LongAttempt.Start(); a.Next(); {
+		stats, err := sm.Stats()
+		c.Assert(err, jc.ErrorIsNil)
+		if stats.WaitingRequests == 1 {
+			break
+		}
 	}
-	for _, info := range initial {
-		b.entities[info.EntityId()] = info
+	err = sm.ForceStop(1)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case err := <-done:
+		c.Assert(errors.Cause(err), gc.Equals, ErrForceStopped)
+	case <-time.After(testing.LongWait):
+		c.Fatalf("timed out waiting for Next to fail")
 	}
-	return b
+	_, err = w1.Next()
+	c.Assert(errors.Cause(err), gc.Equals, ErrForceStopped)
+	c.Assert(c.GetTestLog(), jc.Contains, "stopping watcher 1: watcher was stopped by force")
+	err = sm.ForceStop(1)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+
+	// The other watcher carries on.
+	watchers, err = sm.Watchers()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(watchers, jc.DeepEquals, []MultiwatcherInfo{{Id: 2, Revno: 1}})
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "1"})
+	checkNext(c, w2, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "1"}}}, "")
+	c.Assert(w1.Stop(), jc.ErrorIsNil)
+	c.Assert(w2.Stop(), jc.ErrorIsNil)
+}
+
+// reopeningBacking is a MemoryBacking whose
+// watch can be stopped as if by a restart.
+type reopeningBacking struct {
+	*MemoryBacking
+}
+
+// restart stops the watch, calling missed to make changes
+// while nothing is watching, before closing the channel.
+func (b reopeningBacking) restart(missed func(b *MemoryBacking)) {
+	b.mu.Lock()
+	in := b.watchc
+	b.watchc = nil
+	b.mu.Unlock()
+	missed(b.MemoryBacking)
+	close(in)
+}
+
+func (*storeManagerSuite) TestWatchAgainWhenBackingStopsWatching(c *gc.C) {
+	b := reopeningBacking{NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{Id: "0"},
+		&multiwatcher.MachineInfo{Id: "1"},
+	})}
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), jc.ErrorIsNil)
+	}()
+	w := &Multiwatcher{all: sm}
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "0"}},
+		{Entity: &multiwatcher.MachineInfo{Id: "1"}},
+	}, "")
+
+	// The changes made while the backing wasn't
+	// watching are found when it watches again.
+	b.restart(func(b *MemoryBacking) {
+		b.UpdateEntity(&multiwatcher.MachineInfo{Id: "0", Series: "trusty"})
+		b.DeleteEntity(multiwatcher.EntityId{Kind: "machine", Id: "1"})
+		b.UpdateEntity(&multiwatcher.MachineInfo{Id: "2"})
+	})
+	checkNext(c, w, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "0", Series: "trusty"}},
+		{Removed: true, Entity: &multiwatcher.MachineInfo{Id: "1"}},
+		{Entity: &multiwatcher.MachineInfo{Id: "2"}},
+	}, "")
+
+	// Changes are then watched as usual.
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "3"})
+	checkNext(c, w, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "3"}}}, "")
+
+	// A watcher that starts afresh sees the same state.
+	w1 := &Multiwatcher{all: sm}
+	checkNext(c, w1, []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{Id: "0", Series: "trusty"}},
+		{Entity: &multiwatcher.MachineInfo{Id: "2"}},
+		{Entity: &multiwatcher.MachineInfo{Id: "3"}},
+	}, "")
+}
+
+func (s *storeManagerSuite) TestChangedRetriesTransientError(c *gc.C) {
+	s.PatchValue(&changedRetryDelay, time.Millisecond)
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{&multiwatcher.MachineInfo{Id: "0"}})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), jc.ErrorIsNil)
+	}()
+	w := &Multiwatcher{all: sm}
+	checkNext(c, w, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "0"}}}, "")
+	setFetchErrorCount(b, io.EOF, 2)
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "1"})
+	checkNext(c, w, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "1"}}}, "")
+	// Retries are not worth a warning.
+	c.Assert(c.GetTestLog(), gc.Not(jc.Contains), "WARNING juju.state cannot handle")
 }
 
-func (b *storeManagerTestBacking) Changed(all *multiwatcherStore, change watcher.Change) error {
-	envUUID, changeId, ok := splitDocID(change.Id.(string))
-	if !ok {
-		return errors.Errorf("unexpected id format: %v", change.Id)
+func (s *storeManagerSuite) TestChangedServesRequestsWhileRetrying(c *gc.C) {
+	clock := testing.NewClock(time.Now())
+	s.PatchValue(&GetClock, func() jujuclock.Clock { return clock })
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{Id: "0"},
+		&multiwatcher.MachineInfo{Id: "1"},
+	})
+	sm := newStoreManagerNoRun(b)
+	sm.all.Update(&multiwatcher.MachineInfo{Id: "0"})
+	setFetchErrorCount(b, io.EOF, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- sm.changed([]watcher.Change{{C: machinesC, Id: ensureEnvUUID("", "1")}})
+	}()
+
+	// The request is served while the change waits to be retried.
+	req := &request{
+		w:     &Multiwatcher{all: sm},
+		reply: make(chan bool, 1),
 	}
-	id := multiwatcher.EntityId{
-		Kind:    change.C,
-		EnvUUID: envUUID,
-		Id:      changeId,
+	select {
+	case sm.request <- req:
+	case <-time.After(testing.LongWait):
+		c.Fatalf("request not received while retrying")
 	}
-	info, err := b.fetch(id)
-	if err == mgo.ErrNotFound {
-		all.Remove(id)
-		return nil
+	select {
+	case ok := <-req.reply:
+		c.Assert(ok, jc.IsTrue)
+	case <-time.After(testing.LongWait):
+		c.Fatalf("request not served while retrying")
 	}
-	if err != nil {
-		return err
+	c.Assert(req.changes, jc.DeepEquals, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "0"}}})
+
+	clock.Advance(changedRetryDelay)
+	select {
+	case err := <-done:
+		c.Assert(err, jc.ErrorIsNil)
+	case <-time.After(testing.LongWait):
+		c.Fatalf("change not retried")
 	}
-	all.Update(info)
-	return nil
+	c.Assert(sm.all.Get(multiwatcher.EntityId{Kind: "machine", Id: "1"}), gc.NotNil)
 }
 
-func (b *storeManagerTestBacking) fetch(id multiwatcher.EntityId) (multiwatcher.EntityInfo, error) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	if b.fetchErr != nil {
-		return nil, b.fetchErr
-	}
-	if info, ok := b.entities[id]; ok {
-		return info, nil
+func (s *storeManagerSuite) TestChangedGivesUpOnTransientError(c *gc.C) {
+	s.PatchValue(&changedRetryDelay, time.Millisecond)
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{&multiwatcher.MachineInfo{Id: "0"}})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.ErrorMatches, "EOF")
+	}()
+	w := &Multiwatcher{all: sm}
+	checkNext(c, w, []multiwatcher.Delta{{Entity: &multiwatcher.MachineInfo{Id: "0"}}}, "")
+	setFetchErrorCount(b, io.EOF, changedRetries+1)
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "1"})
+	checkNext(c, w, nil, "EOF")
+}
+
+func (s *storeManagerSuite) TestChangedWarningsAreRateLimited(c *gc.C) {
+	clock := testing.NewClock(time.Now())
+	s.PatchValue(&GetClock, func() jujuclock.Clock { return clock })
+	b := NewMemoryBacking(nil)
+	b.SetFetchError(errors.New("some error"))
+	sm := newStoreManagerNoRun(b)
+	changes := []watcher.Change{{C: machinesC, Id: "uuid:0"}}
+	const warning = "cannot handle change to machines uuid:0: some error"
+
+	// Identical errors within the interval are logged once.
+	for i := 0; i < 3; i++ {
+		err := sm.changed(changes)
+		c.Assert(err, gc.ErrorMatches, "some error")
+		clock.Advance(time.Second)
 	}
-	return nil, mgo.ErrNotFound
+	c.Assert(strings.Count(c.GetTestLog(), warning), gc.Equals, 1)
+
+	// Once the interval has passed, the error is logged
+	// again along with the number suppressed.
+	clock.Advance(warningInterval)
+	err := sm.changed(changes)
+	c.Assert(err, gc.ErrorMatches, "some error")
+	c.Assert(strings.Count(c.GetTestLog(), warning), gc.Equals, 2)
+	c.Assert(c.GetTestLog(), jc.Contains, warning+" (2 similar warnings suppressed)")
 }
 
-func (b *storeManagerTestBacking) Watch(c chan<- watcher.Change) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	if b.watchc != nil {
-		panic("test backing can only watch once")
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return false }
+
+var _ net.Error = timeoutError{}
+
+func (*storeManagerSuite) TestIsTransientError(c *gc.C) {
+	c.Check(isTransientError(io.EOF), jc.IsTrue)
+	c.Check(isTransientError(errors.Trace(io.EOF)), jc.IsTrue)
+	c.Check(isTransientError(timeoutError{}), jc.IsTrue)
+	c.Check(isTransientError(errors.New("some error")), jc.IsFalse)
+}
+
+func (*storeManagerSuite) TestDeltaChan(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{
+		&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"},
+	})
+	sm := newStoreManager(b)
+	d := NewDeltaChan(&Multiwatcher{all: sm})
+
+	var received [][]multiwatcher.Delta
+	for deltas := range d.C() {
+		received = append(received, deltas)
+		if len(received) == 1 {
+			b.UpdateEntity(&multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"})
+			continue
+		}
+		c.Assert(d.Stop(), jc.ErrorIsNil)
+	}
+	c.Assert(received, gc.HasLen, 2)
+	checkDeltasEqual(c, received[0], []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "0"}},
+	})
+	checkDeltasEqual(c, received[1], []multiwatcher.Delta{
+		{Entity: &multiwatcher.MachineInfo{EnvUUID: "uuid", Id: "1"}},
+	})
+	err, ok := <-d.Errors()
+	c.Assert(ok, jc.IsFalse)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Stopping the watcher must have released its
+	// references to the entities it has seen.
+	c.Assert(sm.Stop(), jc.ErrorIsNil)
+	for e := sm.all.list.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*entityEntry)
+		c.Check(entry.refCount, gc.Equals, 0, gc.Commentf("entity %v", entry.info.EntityId()))
 	}
-	b.watchc = c
 }
 
-func (b *storeManagerTestBacking) Unwatch(c chan<- watcher.Change) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	if c != b.watchc {
-		panic("unwatching wrong channel")
+func (*storeManagerSuite) TestDeltaChanError(c *gc.C) {
+	b := NewMemoryBacking([]multiwatcher.EntityInfo{&multiwatcher.MachineInfo{Id: "0"}})
+	sm := newStoreManager(b)
+	defer func() {
+		c.Check(sm.Stop(), gc.ErrorMatches, "some error")
+	}()
+	d := NewDeltaChan(&Multiwatcher{all: sm})
+	select {
+	case <-d.C():
+	case <-time.After(testing.LongWait):
+		c.Fatalf("timed out waiting for initial deltas")
 	}
-	b.watchc = nil
+	b.SetFetchError(errors.New("some error"))
+	b.UpdateEntity(&multiwatcher.MachineInfo{Id: "1"})
+	select {
+	case _, ok := <-d.C():
+		c.Assert(ok, jc.IsFalse)
+	case <-time.After(testing.LongWait):
+		c.Fatalf("timed out waiting for channel to be closed")
+	}
+	c.Assert(<-d.Errors(), gc.ErrorMatches, "some error")
+	c.Assert(d.Stop(), gc.ErrorMatches, "some error")
 }
 
-func (b *storeManagerTestBacking) GetAll(all *multiwatcherStore) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	for _, info := range b.entities {
-		all.Update(info)
+func StoreIncRef(a *multiwatcherStore, id interface{}) {
+	entry := a.entities[id].Value.(*entityEntry)
+	entry.refCount++
+}
+
+// assertStoreContents checks that the store holds the given
+// entries, in the same order as ForEach visits them.
+func assertStoreContents(c *gc.C, a *multiwatcherStore, latestRevno int64, entries []entityEntry) {
+	var gotEntries []entityEntry
+	var gotElems []*list.Element
+	c.Check(a.list.Len(), gc.Equals, len(entries))
+	for e := a.list.Back(); e != nil; e = e.Prev() {
+		entry := *e.Value.(*entityEntry)
+		// Timestamps are checked separately in TestUpdatedTime.
+		entry.updated = time.Time{}
+		gotEntries = append(gotEntries, entry)
+		gotElems = append(gotElems, e)
+	}
+	c.Assert(gotEntries, gc.DeepEquals, entries)
+	for i, ent := range entries {
+		c.Assert(a.entities[ent.info.EntityId()], gc.Equals, gotElems[i])
 	}
-	return nil
+	c.Assert(a.entities, gc.HasLen, len(entries))
+	c.Assert(a.latestRevno, gc.Equals, latestRevno)
+	c.Assert(a.check(), jc.ErrorIsNil)
 }
 
-func (b *storeManagerTestBacking) Release() error {
-	return nil
+// watcherState represents a Multiwatcher client's
+// current view of the state. It holds the last delta that a given
+// state watcher has seen for each entity.
+type watcherState map[interface{}]multiwatcher.Delta
+
+func (s watcherState) update(changes []multiwatcher.Delta) {
+	for _, d := range changes {
+		id := d.Entity.EntityId()
+		if d.Removed {
+			if _, ok := s[id]; !ok {
+				panic(fmt.Errorf("entity id %v removed when it wasn't there", id))
+			}
+			delete(s, id)
+		} else {
+			s[id] = d
+		}
+	}
 }
 
-func (b *storeManagerTestBacking) updateEntity(info multiwatcher.EntityInfo) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	id := info.EntityId()
-	b.entities[id] = info
-	b.txnRevno++
-	if b.watchc != nil {
-		b.watchc <- watcher.Change{
-			C:     id.Kind,
-			Id:    ensureEnvUUID(id.EnvUUID, id.Id),
-			Revno: b.txnRevno, // This is actually ignored, but fill it in anyway.
+// check checks that the watcher state matches that
+// held in current.
+func (s watcherState) check(c *gc.C, current *multiwatcherStore) {
+	currentEntities := make(watcherState)
+	for id, elem := range current.entities {
+		entry := elem.Value.(*entityEntry)
+		if !entry.removed {
+			currentEntities[id] = multiwatcher.Delta{Entity: entry.info}
 		}
 	}
+	c.Assert(s, gc.DeepEquals, currentEntities)
 }
 
-func (b *storeManagerTestBacking) setFetchError(err error) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	b.fetchErr = err
+func assertNotReplied(c *gc.C, req *request) {
+	select {
+	case v := <-req.reply:
+		c.Fatalf("request was unexpectedly replied to (got %v)", v)
+	default:
+	}
 }
 
-func (b *storeManagerTestBacking) deleteEntity(id multiwatcher.EntityId) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	delete(b.entities, id)
-	b.txnRevno++
-	if b.watchc != nil {
-		b.watchc <- watcher.Change{
-			C:     id.Kind,
-			Id:    ensureEnvUUID(id.EnvUUID, id.Id),
-			Revno: -1,
+func assertReplied(c *gc.C, val bool, req *request) {
+	select {
+	case v := <-req.reply:
+		c.Assert(v, gc.Equals, val)
+	default:
+		c.Fatalf("request was not replied to")
+	}
+}
+
+func assertWaitingRequests(c *gc.C, sm *storeManager, waiting map[*Multiwatcher][]*request) {
+	c.Assert(sm.waiting, gc.HasLen, len(waiting))
+	for w, reqs := range waiting {
+		i := 0
+		for req := sm.waiting[w]; ; req = req.next {
+			if i >= len(reqs) {
+				c.Assert(req, gc.IsNil)
+				break
+			}
+			c.Assert(req, gc.Equals, reqs[i])
+			assertNotReplied(c, req)
+			i++
 		}
 	}
 }
@@ -940,6 +3087,38 @@ func getNext(c *gc.C, w *Multiwatcher, timeout time.Duration) ([]multiwatcher.De
 	return nil, errTimeout
 }
 
+// setFetchErrorCount makes the next n fetches of entities
+// from the given backing fail with err.
+func setFetchErrorCount(b *MemoryBacking, err error, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fetchHook = func([]multiwatcher.EntityId) error {
+		if n == 0 {
+			return nil
+		}
+		n--
+		return err
+	}
+}
+
+// countFetches returns a function that reports the number
+// of times entities have since been fetched from the given
+// backing, whether singly or together.
+func countFetches(b *MemoryBacking) func() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	b.fetchHook = func([]multiwatcher.EntityId) error {
+		n++
+		return nil
+	}
+	return func() int {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return n
+	}
+}
+
 func checkNext(c *gc.C, w *Multiwatcher, deltas []multiwatcher.Delta, expectErr string) {
 	d, err := getNext(c, w, 1*time.Second)
 	if expectErr != "" {
@@ -0,0 +1,257 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package state
+
+import (
+	"sync"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+
+	"github.com/juju/juju/state/multiwatcher"
+	"github.com/juju/juju/state/watcher"
+)
+
+// MemoryBacking implements Backing by holding entities in memory
+// rather than fetching them from mongo. It allows the multiwatcher
+// to be exercised without a running database. Changes are reported
+// with the name of the collection that holds entities of their kind
+// in state, as registered with registerAllWatcherCollection, and the
+// environment UUID prefixed entity id as the document id.
+type MemoryBacking struct {
+	mu       sync.Mutex
+	fetchErr error
+	entities map[multiwatcher.EntityId]multiwatcher.EntityInfo
+	watchc   chan<- watcher.Change
+	txnRevno int64
+
+	// fetchHook, if not nil, is called with mu held whenever
+	// entities are fetched, with their ids. If it returns an
+	// error, the fetch fails with that error. It allows tests
+	// to observe and interfere with fetches.
+	fetchHook func(ids []multiwatcher.EntityId) error
+}
+
+var (
+	_ Backing     = (*MemoryBacking)(nil)
+	_ manyChanger = (*MemoryBacking)(nil)
+)
+
+// NewMemoryBacking returns a new MemoryBacking holding
+// the given entities.
+func NewMemoryBacking(initial []multiwatcher.EntityInfo) *MemoryBacking {
+	b := &MemoryBacking{
+		entities: make(map[multiwatcher.EntityId]multiwatcher.EntityInfo),
+	}
+	for _, info := range initial {
+		b.entities[info.EntityId()] = info
+	}
+	return b
+}
+
+// NewMemoryStoreManager returns a running store manager that takes
+// its entities from the given backing. Watchers on it are created
+// with NewMultiwatcher, and it should be stopped when no longer
+// needed.
+func NewMemoryStoreManager(b *MemoryBacking) *storeManager {
+	return newStoreManager(b)
+}
+
+// Changed implements Backing.Changed.
+func (b *MemoryBacking) Changed(all *multiwatcherStore, change watcher.Change) error {
+	envUUID, changeId, ok := splitDocID(change.Id.(string))
+	if !ok {
+		return errors.Errorf("unexpected id format: %v", change.Id)
+	}
+	id := multiwatcher.EntityId{
+		Kind:    collectionKind(change.C),
+		EnvUUID: envUUID,
+		Id:      changeId,
+	}
+	info, err := b.fetch(id)
+	if err == mgo.ErrNotFound {
+		all.Remove(id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	all.Update(info)
+	return nil
+}
+
+// ChangedMany implements manyChanger. The entities for each
+// run of changes to the same collection are fetched together.
+func (b *MemoryBacking) ChangedMany(all *multiwatcherStore, changes []watcher.Change) error {
+	for len(changes) > 0 {
+		n := collectionRun(changes)
+		ids := make([]multiwatcher.EntityId, n)
+		for i, change := range changes[:n] {
+			envUUID, changeId, ok := splitDocID(change.Id.(string))
+			if !ok {
+				return errors.Errorf("unexpected id format: %v", change.Id)
+			}
+			ids[i] = multiwatcher.EntityId{
+				Kind:    collectionKind(change.C),
+				EnvUUID: envUUID,
+				Id:      changeId,
+			}
+		}
+		infos, err := b.fetchMany(ids)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if info, ok := infos[id]; ok {
+				all.Update(info)
+			} else {
+				all.Remove(id)
+			}
+		}
+		changes = changes[n:]
+	}
+	return nil
+}
+
+// fetchMany returns the entities with the given ids
+// that are held by the backing.
+func (b *MemoryBacking) fetchMany(ids []multiwatcher.EntityId) (map[multiwatcher.EntityId]multiwatcher.EntityInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.beforeFetch(ids); err != nil {
+		return nil, err
+	}
+	infos := make(map[multiwatcher.EntityId]multiwatcher.EntityInfo)
+	for _, id := range ids {
+		if info, ok := b.entities[id]; ok {
+			infos[id] = info
+		}
+	}
+	return infos, nil
+}
+
+func (b *MemoryBacking) fetch(id multiwatcher.EntityId) (multiwatcher.EntityInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.beforeFetch([]multiwatcher.EntityId{id}); err != nil {
+		return nil, err
+	}
+	if info, ok := b.entities[id]; ok {
+		return info, nil
+	}
+	return nil, mgo.ErrNotFound
+}
+
+// Watch implements Backing.Watch. Only one
+// channel may be watched at a time.
+func (b *MemoryBacking) Watch(c chan<- watcher.Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.watchc != nil {
+		panic("memory backing can only watch once")
+	}
+	b.watchc = c
+}
+
+// Unwatch implements Backing.Unwatch. Unwatching a
+// channel that is not being watched does nothing.
+func (b *MemoryBacking) Unwatch(c chan<- watcher.Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c == b.watchc {
+		b.watchc = nil
+	}
+}
+
+// GetAll implements Backing.GetAll.
+func (b *MemoryBacking) GetAll(all *multiwatcherStore) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, info := range b.entities {
+		all.Update(info)
+	}
+	return nil
+}
+
+// Release implements Backing.Release.
+func (b *MemoryBacking) Release() error {
+	return nil
+}
+
+// UpdateEntity adds or replaces the given entity and
+// reports the change to the watching channel, if any.
+func (b *MemoryBacking) UpdateEntity(info multiwatcher.EntityInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := info.EntityId()
+	b.entities[id] = info
+	b.txnRevno++
+	if b.watchc != nil {
+		b.watchc <- watcher.Change{
+			C:     kindCollection(id.Kind),
+			Id:    ensureEnvUUID(id.EnvUUID, id.Id),
+			Revno: b.txnRevno, // This is actually ignored, but fill it in anyway.
+		}
+	}
+}
+
+// SetFetchError sets the error returned when an entity
+// is fetched in response to a change. If err is nil,
+// entities are fetched normally.
+func (b *MemoryBacking) SetFetchError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fetchErr = err
+}
+
+// beforeFetch returns the error that a fetch of the entities
+// with the given ids should fail with, if any. It must be
+// called with b.mu held.
+func (b *MemoryBacking) beforeFetch(ids []multiwatcher.EntityId) error {
+	if b.fetchErr != nil {
+		return b.fetchErr
+	}
+	if b.fetchHook != nil {
+		return b.fetchHook(ids)
+	}
+	return nil
+}
+
+// kindCollection returns the name of the collection that holds
+// entities of the given kind. A kind that no registered collection
+// holds is taken to be held in a collection of the same name.
+func kindCollection(kind string) string {
+	for name, collection := range allWatcherCollections {
+		if collection.kind == kind {
+			return name
+		}
+	}
+	return kind
+}
+
+// collectionKind returns the kind of entity held in the
+// named collection. The kind of an unregistered collection
+// is taken to be its name. See kindCollection.
+func collectionKind(name string) string {
+	if collection, ok := allWatcherCollections[name]; ok && collection.kind != "" {
+		return collection.kind
+	}
+	return name
+}
+
+// DeleteEntity removes the entity with the given id and
+// reports the change to the watching channel, if any.
+func (b *MemoryBacking) DeleteEntity(id multiwatcher.EntityId) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.entities, id)
+	b.txnRevno++
+	if b.watchc != nil {
+		b.watchc <- watcher.Change{
+			C:     kindCollection(id.Kind),
+			Id:    ensureEnvUUID(id.EnvUUID, id.Id),
+			Revno: -1,
+		}
+	}
+}
@@ -33,6 +33,7 @@ import (
 	"github.com/juju/juju/state/cloudimagemetadata"
 	"github.com/juju/juju/state/leadership"
 	"github.com/juju/juju/state/lease"
+	"github.com/juju/juju/state/multiwatcher"
 	"github.com/juju/juju/state/presence"
 	"github.com/juju/juju/state/watcher"
 	"github.com/juju/juju/version"
@@ -305,13 +306,68 @@ func (st *State) MongoSession() *mgo.Session {
 
 type closeFunc func()
 
+// Watch returns a watcher that observes changes to all the entities
+// in the state's environment, for use by clients both inside and
+// outside this package. Successive calls to its Next method return the
+// entities as they are when the watcher starts and then the changes
+// made to them, as multiwatcher.Delta values. It should be stopped
+// with its Stop method when no longer needed.
 func (st *State) Watch() *Multiwatcher {
+	return NewMultiwatcher(st.allWatcherManager())
+}
+
+// allWatcherManager returns the store manager shared by the
+// watchers on the state's environment, starting it if needed.
+func (st *State) allWatcherManager() *storeManager {
 	st.mu.Lock()
+	defer st.mu.Unlock()
 	if st.allManager == nil {
 		st.allManager = newStoreManager(newAllWatcherStateBacking(st))
 	}
-	st.mu.Unlock()
-	return NewMultiwatcher(st.allManager)
+	return st.allManager
+}
+
+// WatchService returns a watcher that observes changes to the
+// service with the given name and its units. See Multiwatcher.SetService.
+func (st *State) WatchService(name string) *Multiwatcher {
+	w := st.Watch()
+	w.SetService(name)
+	return w
+}
+
+// WatchWithSnapshot returns a new Multiwatcher for the environment
+// along with a snapshot of all the entities it currently knows about.
+// The watcher's first Next call returns only changes made after the
+// snapshot.
+func (st *State) WatchWithSnapshot() (*Multiwatcher, []multiwatcher.EntityInfo, error) {
+	return NewMultiwatcherWithSnapshot(st.allWatcherManager())
+}
+
+// WatchFromNow returns a new Multiwatcher for the environment that
+// is told only about changes made after it is created, rather than
+// first being told about every entity. See NewMultiwatcherFromNow.
+func (st *State) WatchFromNow() (*Multiwatcher, error) {
+	return NewMultiwatcherFromNow(st.allWatcherManager())
+}
+
+// WatchErrors returns a new Multiwatcher for the environment that is
+// told only about entities whose status is error. See NewErrorWatcher.
+func (st *State) WatchErrors() *Multiwatcher {
+	return NewErrorWatcher(st.allWatcherManager())
+}
+
+// Snapshot returns a delta for every entity in the environment,
+// taken consistently at a single point, without leaving a watcher
+// registered. It also returns the revno at which the snapshot was
+// taken.
+func (st *State) Snapshot() ([]multiwatcher.Delta, int64, error) {
+	return st.allWatcherManager().Snapshot()
+}
+
+// WatcherStats returns statistics about the environment's
+// Multiwatchers, for operational visibility.
+func (st *State) WatcherStats() (MultiwatcherStats, error) {
+	return st.allWatcherManager().Stats()
 }
 
 func (st *State) WatchAllEnvs() *Multiwatcher {
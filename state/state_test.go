@@ -201,6 +201,23 @@ func (s *StateSuite) TestWatch(c *gc.C) {
 	}
 }
 
+func (s *StateSuite) TestWatchStop(c *gc.C) {
+	s.Factory.MakeMachine(c, nil)
+	w := s.State.Watch()
+	deltasC := makeMultiwatcherOutput(w)
+	s.State.StartSync()
+	select {
+	case <-deltasC:
+	case <-time.After(testing.LongWait):
+		c.Fatal("timed out")
+	}
+
+	err := w.Stop()
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = w.Next()
+	c.Assert(errors.Cause(err), gc.Equals, state.ErrStopped)
+}
+
 func makeMultiwatcherOutput(w *state.Multiwatcher) chan []multiwatcher.Delta {
 	deltasC := make(chan []multiwatcher.Delta)
 	go func() {
@@ -251,6 +268,36 @@ func (s *StateSuite) TestWatchAllEnvs(c *gc.C) {
 	c.Assert(machineSeen, jc.IsTrue)
 }
 
+func (s *StateSuite) TestWatchMultiwatcherScenario(c *gc.C) {
+	expect := statetesting.SetUpMultiwatcherScenario(c, s.State, s.Owner, 2)
+
+	w := s.State.Watch()
+	defer w.Stop()
+	deltasC := makeMultiwatcherOutput(w)
+	s.State.StartSync()
+
+	// The first deltas hold all the entities in the state.
+	var entities []multiwatcher.EntityInfo
+	select {
+	case deltas := <-deltasC:
+		for _, delta := range deltas {
+			c.Assert(delta.Removed, jc.IsFalse)
+			entities = append(entities, delta.Entity)
+		}
+	case <-time.After(testing.LongWait):
+		c.Fatal("timed out")
+	}
+	statetesting.ZeroSinceTimes(entities)
+	got := make(map[multiwatcher.EntityId]multiwatcher.EntityInfo)
+	for _, info := range entities {
+		got[info.EntityId()] = info
+	}
+	c.Assert(got, gc.HasLen, len(expect))
+	for _, info := range expect {
+		c.Check(got[info.EntityId()], jc.DeepEquals, info)
+	}
+}
+
 type MultiEnvStateSuite struct {
 	ConnSuite
 	OtherState *state.State
@@ -0,0 +1,287 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package testing
+
+import (
+	"fmt"
+
+	"github.com/juju/names"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+
+	"github.com/juju/juju/instance"
+	"github.com/juju/juju/network"
+	"github.com/juju/juju/state"
+	"github.com/juju/juju/state/multiwatcher"
+	"github.com/juju/juju/testcharms"
+)
+
+// SetUpMultiwatcherScenario adds a canonical set of entities to the
+// given state and returns the information that a multiwatcher on the
+// state is expected to report for them. The state must not hold any
+// machines, services or networks beforehand.
+//
+// The scenario holds a provisioned machine 0, a network, the services
+// wordpress and logging related to each other, and the given number of
+// wordpress units, each with a logging subordinate and placed on a
+// machine of its own. Machine and instance ids are deterministic.
+//
+// The status timestamps of the returned entities are nil; use
+// ZeroSinceTimes to make the entities reported by a multiwatcher
+// comparable to them.
+func SetUpMultiwatcherScenario(c *gc.C, st *state.State, owner names.UserTag, units int) []multiwatcher.EntityInfo {
+	var entities []multiwatcher.EntityInfo
+	add := func(e multiwatcher.EntityInfo) {
+		entities = append(entities, e)
+	}
+	envUUID := st.EnvironUUID()
+	m, err := st.AddMachine("quantal", state.JobHostUnits)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(m.Tag(), gc.Equals, names.NewMachineTag("0"))
+	err = m.SetHasVote(true)
+	c.Assert(err, jc.ErrorIsNil)
+	err = m.SetProvisioned(instance.Id("i-"+m.Tag().String()), "fake_nonce", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	err = m.SetInstanceStatus("running")
+	c.Assert(err, jc.ErrorIsNil)
+	err = m.SetSupportedContainers([]instance.ContainerType{instance.LXC})
+	c.Assert(err, jc.ErrorIsNil)
+	hc, err := m.HardwareCharacteristics()
+	c.Assert(err, jc.ErrorIsNil)
+	err = m.SetProviderAddresses(network.NewAddress("example.com"))
+	c.Assert(err, jc.ErrorIsNil)
+	add(&multiwatcher.MachineInfo{
+		EnvUUID:                  envUUID,
+		Id:                       "0",
+		InstanceId:               "i-machine-0",
+		InstanceStatus:           "running",
+		Nonce:                    "fake_nonce",
+		Status:                   multiwatcher.Status("pending"),
+		StatusData:               map[string]interface{}{},
+		Life:                     multiwatcher.Life("alive"),
+		Series:                   "quantal",
+		Jobs:                     []multiwatcher.MachineJob{state.JobHostUnits.ToParams()},
+		Addresses:                m.Addresses(),
+		HardwareCharacteristics:  hc,
+		SupportedContainers:      []instance.ContainerType{instance.LXC},
+		SupportedContainersKnown: true,
+		HasVote:                  true,
+		WantsVote:                false,
+	})
+
+	_, err = st.AddNetwork(state.NetworkInfo{
+		Name:       "net1",
+		ProviderId: "provider-net1",
+		CIDR:       "0.1.2.0/24",
+		VLANTag:    42,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	add(&multiwatcher.NetworkInfo{
+		EnvUUID:    envUUID,
+		Name:       "net1",
+		ProviderId: "provider-net1",
+		CIDR:       "0.1.2.0/24",
+		VLANTag:    42,
+	})
+
+	wordpress := addService(c, st, "wordpress", owner)
+	err = wordpress.SetExposed()
+	c.Assert(err, jc.ErrorIsNil)
+	err = wordpress.SetMinUnits(units)
+	c.Assert(err, jc.ErrorIsNil)
+	err = wordpress.UpdateConfigSettings(charm.Settings{"blog-title": "boring"})
+	c.Assert(err, jc.ErrorIsNil)
+	add(serviceInfo(c, wordpress, owner, &multiwatcher.ServiceInfo{
+		EnvUUID:  envUUID,
+		Exposed:  true,
+		MinUnits: units,
+		Config:   charm.Settings{"blog-title": "boring"},
+	}))
+	pairs := map[string]string{"x": "12", "y": "99"}
+	err = st.SetAnnotations(wordpress, pairs)
+	c.Assert(err, jc.ErrorIsNil)
+	add(&multiwatcher.AnnotationInfo{
+		EnvUUID:     envUUID,
+		Tag:         "service-wordpress",
+		Annotations: pairs,
+	})
+
+	logging := addService(c, st, "logging", owner)
+	add(serviceInfo(c, logging, owner, &multiwatcher.ServiceInfo{
+		EnvUUID:     envUUID,
+		Config:      charm.Settings{},
+		Subordinate: true,
+	}))
+
+	eps, err := st.InferEndpoints("logging", "wordpress")
+	c.Assert(err, jc.ErrorIsNil)
+	rel, err := st.AddRelation(eps...)
+	c.Assert(err, jc.ErrorIsNil)
+	add(&multiwatcher.RelationInfo{
+		EnvUUID: envUUID,
+		Key:     "logging:logging-directory wordpress:logging-dir",
+		Id:      rel.Id(),
+		Endpoints: []multiwatcher.Endpoint{
+			{ServiceName: "logging", Relation: charm.Relation{Name: "logging-directory", Role: "requirer", Interface: "logging", Optional: false, Limit: 1, Scope: "container"}},
+			{ServiceName: "wordpress", Relation: charm.Relation{Name: "logging-dir", Role: "provider", Interface: "logging", Optional: false, Limit: 0, Scope: "container"}}},
+	})
+
+	for i := 0; i < units; i++ {
+		wu, err := wordpress.AddUnit()
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(wu.Tag().String(), gc.Equals, fmt.Sprintf("unit-wordpress-%d", i))
+
+		m, err := st.AddMachine("quantal", state.JobHostUnits)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(m.Tag().String(), gc.Equals, fmt.Sprintf("machine-%d", i+1))
+
+		unitInfo := newUnitInfo(envUUID, wu.Name(), "wordpress")
+		unitInfo.MachineId = m.Id()
+		add(unitInfo)
+		pairs := map[string]string{"name": fmt.Sprintf("bar %d", i)}
+		err = st.SetAnnotations(wu, pairs)
+		c.Assert(err, jc.ErrorIsNil)
+		add(&multiwatcher.AnnotationInfo{
+			EnvUUID:     envUUID,
+			Tag:         wu.Tag().String(),
+			Annotations: pairs,
+		})
+
+		err = m.SetProvisioned(instance.Id("i-"+m.Tag().String()), "fake_nonce", nil)
+		c.Assert(err, jc.ErrorIsNil)
+		err = m.SetStatus(state.StatusError, m.Tag().String(), nil)
+		c.Assert(err, jc.ErrorIsNil)
+		hc, err := m.HardwareCharacteristics()
+		c.Assert(err, jc.ErrorIsNil)
+		machineInfo := &multiwatcher.MachineInfo{
+			EnvUUID:                 envUUID,
+			Id:                      m.Id(),
+			InstanceId:              "i-" + m.Tag().String(),
+			Nonce:                   "fake_nonce",
+			Status:                  multiwatcher.Status("error"),
+			StatusInfo:              m.Tag().String(),
+			StatusData:              map[string]interface{}{},
+			Life:                    multiwatcher.Life("alive"),
+			Series:                  "quantal",
+			Jobs:                    []multiwatcher.MachineJob{state.JobHostUnits.ToParams()},
+			Addresses:               []network.Address{},
+			HardwareCharacteristics: hc,
+			HasVote:                 false,
+			WantsVote:               false,
+		}
+		add(machineInfo)
+		err = wu.AssignToMachine(m)
+		c.Assert(err, jc.ErrorIsNil)
+
+		// Give the first unit addresses and an open port so that
+		// they're reported for it and its subordinate.
+		if i == 0 {
+			err = m.SetProviderAddresses(
+				network.NewScopedAddress("1.2.3.4", network.ScopePublic),
+				network.NewScopedAddress("4.3.2.1", network.ScopeCloudLocal),
+			)
+			c.Assert(err, jc.ErrorIsNil)
+			err = wu.OpenPorts("tcp", 12345, 12345)
+			c.Assert(err, jc.ErrorIsNil)
+			machineInfo.Addresses = m.Addresses()
+			unitInfo.PublicAddress = "1.2.3.4"
+			unitInfo.PrivateAddress = "4.3.2.1"
+			unitInfo.Ports = []network.Port{{"tcp", 12345}}
+			unitInfo.PortRanges = []network.PortRange{{12345, 12345, "tcp"}}
+		}
+
+		// Create the subordinate unit as a side-effect of entering
+		// scope in the principal's relation-unit.
+		wru, err := rel.Unit(wu)
+		c.Assert(err, jc.ErrorIsNil)
+		err = wru.EnterScope(nil)
+		c.Assert(err, jc.ErrorIsNil)
+
+		lu, err := st.Unit(fmt.Sprintf("logging/%d", i))
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(lu.IsPrincipal(), jc.IsFalse)
+		subInfo := newUnitInfo(envUUID, lu.Name(), "logging")
+		subInfo.PublicAddress = unitInfo.PublicAddress
+		subInfo.PrivateAddress = unitInfo.PrivateAddress
+		subInfo.Subordinate = true
+		add(subInfo)
+	}
+	return entities
+}
+
+// ZeroSinceTimes sets the status timestamps held by
+// the given entities to nil.
+func ZeroSinceTimes(entities []multiwatcher.EntityInfo) {
+	for _, entity := range entities {
+		switch info := entity.(type) {
+		case *multiwatcher.UnitInfo:
+			info.WorkloadStatus.Since = nil
+			info.AgentStatus.Since = nil
+		case *multiwatcher.ServiceInfo:
+			info.Status.Since = nil
+		}
+	}
+}
+
+// addService adds a service running the testing charm with
+// the same name.
+func addService(c *gc.C, st *state.State, name string, owner names.UserTag) *state.Service {
+	ch := testcharms.Repo.CharmDir(name)
+	ident := fmt.Sprintf("quantal-%s-%d", ch.Meta().Name, ch.Revision())
+	curl := charm.MustParseURL("local:quantal/" + ident)
+	sch, err := st.AddCharm(ch, curl, "dummy-path", ident+"-sha256")
+	c.Assert(err, jc.ErrorIsNil)
+	svc, err := st.AddService(name, owner.String(), sch, nil, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	return svc
+}
+
+// serviceInfo fills in the fields of info that are
+// the same for every service in the scenario.
+func serviceInfo(c *gc.C, svc *state.Service, owner names.UserTag, info *multiwatcher.ServiceInfo) *multiwatcher.ServiceInfo {
+	curl, _ := svc.CharmURL()
+	eps, err := svc.Endpoints()
+	c.Assert(err, jc.ErrorIsNil)
+	info.Name = svc.Name()
+	info.CharmURL = curl.String()
+	info.OwnerTag = owner.String()
+	info.Life = multiwatcher.Life("alive")
+	info.Status = multiwatcher.StatusInfo{
+		Current: "unknown",
+		Message: "Waiting for agent initialization to finish",
+		Data:    map[string]interface{}{},
+	}
+	for _, ep := range eps {
+		info.Endpoints = append(info.Endpoints, multiwatcher.Endpoint{
+			ServiceName: ep.ServiceName,
+			Relation:    ep.Relation,
+		})
+	}
+	return info
+}
+
+// newUnitInfo returns the information expected
+// for a newly added unit of the given service.
+func newUnitInfo(envUUID, name, service string) *multiwatcher.UnitInfo {
+	return &multiwatcher.UnitInfo{
+		EnvUUID:    envUUID,
+		Name:       name,
+		Service:    service,
+		Series:     "quantal",
+		Life:       multiwatcher.Life("alive"),
+		Ports:      []network.Port{},
+		Status:     multiwatcher.Status("pending"),
+		StatusData: map[string]interface{}{},
+		WorkloadStatus: multiwatcher.StatusInfo{
+			Current: "unknown",
+			Message: "Waiting for agent initialization to finish",
+			Data:    map[string]interface{}{},
+		},
+		AgentStatus: multiwatcher.StatusInfo{
+			Current: "allocating",
+			Data:    map[string]interface{}{},
+		},
+	}
+}
@@ -96,6 +96,7 @@ type unitDoc struct {
 	MachineId              string
 	Resolved               ResolvedMode
 	Tools                  *tools.Tools `bson:",omitempty"`
+	WorkloadVersion        string       `bson:"workloadversion,omitempty"`
 	Life                   Life
 	TxnRevno               int64 `bson:"txn-revno"`
 	PasswordHash           string
@@ -228,6 +229,29 @@ func (u *Unit) SetAgentVersion(v version.Binary) (err error) {
 	return nil
 }
 
+// WorkloadVersion returns the version of the workload that the unit's
+// charm last reported, or the empty string if none has been reported.
+func (u *Unit) WorkloadVersion() string {
+	return u.doc.WorkloadVersion
+}
+
+// SetWorkloadVersion records the version of the workload that the
+// unit's charm is running.
+func (u *Unit) SetWorkloadVersion(version string) (err error) {
+	defer errors.DeferredAnnotatef(&err, "cannot set workload version for unit %q", u)
+	ops := []txn.Op{{
+		C:      unitsC,
+		Id:     u.doc.DocID,
+		Assert: notDeadDoc,
+		Update: bson.D{{"$set", bson.D{{"workloadversion", version}}}},
+	}}
+	if err := u.st.runTransaction(ops); err != nil {
+		return onAbort(err, ErrDead)
+	}
+	u.doc.WorkloadVersion = version
+	return nil
+}
+
 // SetPassword sets the password for the machine's agent.
 func (u *Unit) SetPassword(password string) error {
 	if len(password) < utils.MinAgentPasswordLength {
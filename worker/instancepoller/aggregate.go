@@ -4,14 +4,16 @@
 package instancepoller
 
 import (
+	"sync"
 	"time"
 
 	"github.com/juju/errors"
-	"github.com/juju/ratelimit"
+	"github.com/juju/utils/clock"
 	"launchpad.net/tomb"
 
 	"github.com/juju/juju/environs"
 	"github.com/juju/juju/instance"
+	"github.com/juju/juju/network"
 )
 
 type instanceGetter interface {
@@ -20,14 +22,61 @@ type instanceGetter interface {
 
 type aggregator struct {
 	environ instanceGetter
+	clock   clock.Clock
 	reqc    chan instanceInfoReq
 	tomb    tomb.Tomb
+
+	// batchc receives requests for the last dispatched batch.
+	batchc chan chan<- batchInfo
+
+	// lastBatch records the most recently dispatched batch.
+	// It is only accessed by the loop goroutine.
+	lastBatch batchInfo
+
+	// statsc receives requests for the aggregator's statistics.
+	statsc chan chan<- aggregatorStats
+
+	// stats holds the aggregator's statistics.
+	// It is only accessed by the loop goroutine.
+	stats aggregatorStats
+
+	// lastAddresses records the addresses last seen for each
+	// instance that has been successfully resolved at least once
+	// and has not since been found to be missing.
+	// It is only accessed by the loop goroutine.
+	lastAddresses map[instance.Id][]network.Address
+
+	// cache holds the last successful reply for each instance,
+	// used to answer requests made within cacheTTL of it.
+	// It is only accessed by the loop goroutine.
+	cache map[instance.Id]instanceInfoReply
+
+	// maxInFlight holds the maximum number of provider
+	// calls that may be in progress at once.
+	maxInFlight int
+
+	// calls tracks the provider calls in progress.
+	calls sync.WaitGroup
 }
 
-func newAggregator(env instanceGetter) *aggregator {
+// newAggregator returns a new aggregator that fetches instance
+// information from env, making no more than maxInFlight provider
+// calls at once. The given clock is used to time the window in
+// which requests are gathered into a single call. Batches of requests that are ready to go when
+// that many calls are in progress wait for one to finish.
+func newAggregator(env instanceGetter, clock clock.Clock, maxInFlight int) *aggregator {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
 	a := &aggregator{
-		environ: env,
-		reqc:    make(chan instanceInfoReq),
+		environ:       env,
+		clock:         clock,
+		reqc:          make(chan instanceInfoReq),
+		batchc:        make(chan chan<- batchInfo),
+		statsc:        make(chan chan<- aggregatorStats),
+		lastAddresses: make(map[instance.Id][]network.Address),
+		cache:         make(map[instance.Id]instanceInfoReply),
+		maxInFlight:   maxInFlight,
 	}
 	go func() {
 		defer a.tomb.Done()
@@ -39,62 +88,459 @@ func newAggregator(env instanceGetter) *aggregator {
 type instanceInfoReq struct {
 	instId instance.Id
 	reply  chan<- instanceInfoReply
+
+	// done, if not nil, is closed when the requester no longer
+	// wants the reply. The request is then dropped from its
+	// batch, and no reply is sent.
+	done <-chan struct{}
+}
+
+// cancelled reports whether the requester
+// has abandoned the request.
+func (req instanceInfoReq) cancelled() bool {
+	select {
+	case <-req.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// send sends the given reply, unless the
+// requester abandons the request first.
+func (req instanceInfoReq) send(r instanceInfoReply) {
+	select {
+	case req.reply <- r:
+	case <-req.done:
+	}
+}
+
+// dropCancelled returns the given requests
+// without those that have been abandoned.
+func dropCancelled(reqs []instanceInfoReq) []instanceInfoReq {
+	live := reqs[:0]
+	for _, req := range reqs {
+		if !req.cancelled() {
+			live = append(live, req)
+		}
+	}
+	return live
 }
 
 type instanceInfoReply struct {
 	info instanceInfo
 	err  error
+
+	// lastUpdated holds the time of the provider call
+	// from which info was successfully fetched.
+	lastUpdated time.Time
+
+	// changed reports whether info holds different addresses
+	// from those last fetched for the instance. It is always
+	// true the first time an instance is resolved.
+	changed bool
+
+	// prevAddresses holds the addresses last fetched
+	// for the instance, if any.
+	prevAddresses []network.Address
 }
 
+// instanceInfo returns the info for the instance with the given id.
+// If the aggregator is stopped before the request is answered, it
+// returns ErrAggregatorStopped; if the provider call fails, it
+// returns an error satisfying IsProviderError.
 func (a *aggregator) instanceInfo(id instance.Id) (instanceInfo, error) {
-	reply := make(chan instanceInfoReply)
-	a.reqc <- instanceInfoReq{
+	// The reply channel is buffered so that the loop never
+	// blocks replying to a request that we have abandoned.
+	reply := make(chan instanceInfoReply, 1)
+	req := instanceInfoReq{
 		instId: id,
 		reply:  reply,
 	}
-	r := <-reply
-	return r.info, r.err
+	select {
+	case a.reqc <- req:
+	case <-a.tomb.Dying():
+		return instanceInfo{}, ErrAggregatorStopped
+	}
+	select {
+	case r := <-reply:
+		return r.info, r.err
+	case <-a.tomb.Dying():
+		return instanceInfo{}, ErrAggregatorStopped
+	}
+}
+
+// batchInfo describes a batch of instances
+// requested in a single provider call.
+type batchInfo struct {
+	// ids holds the ids of the requested instances.
+	ids []instance.Id
+
+	// time holds the time the call was started.
+	time time.Time
+}
+
+// lastBatchInfo returns the ids queried in the most recent provider
+// call, and the time it was made. If no call has been made yet,
+// it returns a zero batchInfo.
+func (a *aggregator) lastBatchInfo() (batchInfo, error) {
+	reply := make(chan batchInfo, 1)
+	select {
+	case a.batchc <- reply:
+	case <-a.tomb.Dying():
+		return batchInfo{}, ErrAggregatorStopped
+	}
+	select {
+	case info := <-reply:
+		return info, nil
+	case <-a.tomb.Dying():
+		return batchInfo{}, ErrAggregatorStopped
+	}
+}
+
+// aggregatorStats holds counters describing the work done by an
+// aggregator since it was started, for use in tuning its poll
+// intervals.
+type aggregatorStats struct {
+	// Requests holds the number of requests received.
+	Requests int
+
+	// CacheHits holds the number of requests
+	// answered from the cache.
+	CacheHits int
+
+	// Batches holds the number of batches of requests
+	// sent to the provider, and Instances the total
+	// number of instances asked for in them.
+	Batches   int
+	Instances int
+
+	// ProviderCalls holds the number of Instances calls
+	// made, including Retries, the number of those that
+	// retried a failed call. Retries are only counted
+	// once their batch is complete.
+	ProviderCalls int
+	Retries       int
+}
+
+// AverageBatchSize returns the average number of instances asked
+// for in each batch, or zero if no batch has been sent.
+func (s aggregatorStats) AverageBatchSize() float64 {
+	if s.Batches == 0 {
+		return 0
+	}
+	return float64(s.Instances) / float64(s.Batches)
+}
+
+// Stats returns statistics about the work done by the aggregator.
+// They are gathered by the aggregator's loop, so they are consistent
+// with one another.
+func (a *aggregator) Stats() (aggregatorStats, error) {
+	reply := make(chan aggregatorStats, 1)
+	select {
+	case a.statsc <- reply:
+	case <-a.tomb.Dying():
+		return aggregatorStats{}, ErrAggregatorStopped
+	}
+	select {
+	case stats := <-reply:
+		return stats, nil
+	case <-a.tomb.Dying():
+		return aggregatorStats{}, ErrAggregatorStopped
+	}
 }
 
 var gatherTime = 3 * time.Second
 
+// cacheTTL holds the time for which the information fetched for an
+// instance is used to answer further requests for it without asking
+// the provider again. If it is zero, every request asks the provider.
+var cacheTTL time.Duration
+
+// retryCount holds the number of times a failed Instances call
+// is retried before the error is returned to the requesters.
+// retryDelay holds the delay before the first retry; it is
+// doubled before each subsequent one.
+var (
+	retryCount = 3
+	retryDelay = 500 * time.Millisecond
+)
+
 func (a *aggregator) loop() error {
-	timer := time.NewTimer(0)
-	timer.Stop()
-	var reqs []instanceInfoReq
-	// We use a capacity of 1 so that sporadic requests will
-	// be serviced immediately without having to wait.
-	bucket := ratelimit.NewBucket(gatherTime, 1)
+	// timeout is non-nil while we are waiting for
+	// the gathering window to close.
+	var timeout <-chan time.Time
+	// Requests for instances that have never been resolved are
+	// kept apart from refreshes of known instances, so that newly
+	// provisioned instances are asked for first and get their
+	// addresses as soon as possible.
+	var newReqs, refreshReqs []instanceInfoReq
+	// ready is set when the gathered requests may be sent
+	// to the provider as soon as there is a free call slot.
+	var ready bool
+	var inFlight int
+	results := make(chan batchResult)
+	defer func() {
+		// Don't leave any requester waiting for a reply.
+		replyStopped(newReqs)
+		replyStopped(refreshReqs)
+		a.calls.Wait()
+	}()
+	// nextBatch holds the earliest time at which the next bulk
+	// call may be made. Calls are spaced at least gatherTime
+	// apart, but sporadic requests are serviced immediately
+	// without having to wait.
+	var nextBatch time.Time
+	startWindow := func() {
+		now := a.clock.Now()
+		if nextBatch.Before(now) {
+			nextBatch = now
+		}
+		timeout = a.clock.After(nextBatch.Sub(now))
+		nextBatch = nextBatch.Add(gatherTime)
+	}
 	for {
 		select {
 		case <-a.tomb.Dying():
 			return tomb.ErrDying
 		case req := <-a.reqc:
-			if len(reqs) == 0 {
-				waitTime := bucket.Take(1)
-				timer.Reset(waitTime)
+			a.stats.Requests++
+			if reply, ok := a.cached(req.instId); ok {
+				a.stats.CacheHits++
+				req.send(reply)
+				break
+			}
+			if len(newReqs) == 0 && len(refreshReqs) == 0 {
+				startWindow()
+			}
+			if _, ok := a.lastAddresses[req.instId]; ok {
+				refreshReqs = append(refreshReqs, req)
+			} else {
+				newReqs = append(newReqs, req)
+			}
+		case <-timeout:
+			timeout = nil
+			ready = true
+		case r := <-results:
+			inFlight--
+			a.stats.ProviderCalls += r.retries
+			a.stats.Retries += r.retries
+			a.reply(r)
+		case reply := <-a.batchc:
+			reply <- batchInfo{
+				ids:  append([]instance.Id(nil), a.lastBatch.ids...),
+				time: a.lastBatch.time,
 			}
-			reqs = append(reqs, req)
-		case <-timer.C:
-			ids := make([]instance.Id, len(reqs))
-			for i, req := range reqs {
-				ids[i] = req.instId
+		case reply := <-a.statsc:
+			reply <- a.stats
+		}
+		if !ready || inFlight >= a.maxInFlight {
+			continue
+		}
+		ready = false
+		newReqs = dropCancelled(newReqs)
+		refreshReqs = dropCancelled(refreshReqs)
+		if len(newReqs) == 0 && len(refreshReqs) == 0 {
+			// Every request was abandoned, so
+			// there's nothing to ask the provider.
+			continue
+		}
+		inFlight++
+		// The refreshes follow the new requests in the same bulk
+		// call, rather than waiting for the next one, so that a
+		// steady stream of new instances cannot hold them back.
+		a.process(append(newReqs, refreshReqs...), results)
+		newReqs, refreshReqs = nil, nil
+	}
+}
+
+// batchResult holds the result of the provider
+// call made for a batch of requests.
+type batchResult struct {
+	reqs  []instanceInfoReq
+	ids   []instance.Id
+	insts []instance.Instance
+	err   error
+
+	// retries holds the number of times
+	// the provider call was retried.
+	retries int
+}
+
+// process starts fetching the instances for the given requests in a
+// single bulk call, and sends the result on the given channel. It
+// records the batch in a.lastBatch. If the
+// aggregator is stopped first, it replies to the requests itself.
+func (a *aggregator) process(reqs []instanceInfoReq, results chan<- batchResult) {
+	// Each instance is asked for only once, however
+	// many requests there are for it.
+	var ids []instance.Id
+	seen := make(map[instance.Id]bool)
+	for _, req := range reqs {
+		if !seen[req.instId] {
+			seen[req.instId] = true
+			ids = append(ids, req.instId)
+		}
+	}
+	a.lastBatch = batchInfo{
+		ids:  ids,
+		time: a.clock.Now(),
+	}
+	a.stats.Batches++
+	a.stats.Instances += len(ids)
+	a.stats.ProviderCalls++
+	a.calls.Add(1)
+	go func() {
+		defer a.calls.Done()
+		insts, retries, err := a.instances(ids)
+		if err == tomb.ErrDying {
+			replyStopped(reqs)
+			return
+		}
+		select {
+		case results <- batchResult{reqs, ids, insts, err, retries}:
+		case <-a.tomb.Dying():
+			replyStopped(reqs)
+		}
+	}()
+}
+
+// reply replies to each of the requests in the given batch.
+func (a *aggregator) reply(r batchResult) {
+	now := a.clock.Now()
+	a.evictExpired(now)
+	replies := make(map[instance.Id]instanceInfoReply)
+	found := matchInstances(r.insts)
+	for _, id := range r.ids {
+		var reply instanceInfoReply
+		if r.err != nil && r.err != environs.ErrPartialInstances {
+			reply.err = newProviderError(r.err)
+		} else {
+			reply.info, reply.err = a.instInfo(id, found[id])
+		}
+		if reply.err == nil {
+			reply.lastUpdated = now
+			prev, ok := a.lastAddresses[id]
+			reply.changed = !ok || !addressesEqual(prev, reply.info.addresses)
+			reply.prevAddresses = prev
+			a.lastAddresses[id] = reply.info.addresses
+			if cacheTTL > 0 {
+				// The new reply replaces any cached one, so a
+				// change is seen by all later requests.
+				a.cache[id] = reply
 			}
-			insts, err := a.environ.Instances(ids)
-			for i, req := range reqs {
-				var reply instanceInfoReply
-				if err != nil && err != environs.ErrPartialInstances {
-					reply.err = err
-				} else {
-					reply.info, reply.err = a.instInfo(req.instId, insts[i])
-				}
-				req.reply <- reply
+		} else {
+			delete(a.cache, id)
+			if errors.IsNotFound(reply.err) {
+				// The instance has gone, so there
+				// are no addresses to remember.
+				delete(a.lastAddresses, id)
 			}
-			reqs = nil
+		}
+		replies[id] = reply
+	}
+	for _, req := range r.reqs {
+		req.send(replies[req.instId])
+	}
+}
+
+// cached returns the reply cached for the given instance, if the
+// cache is enabled and the reply was fetched within cacheTTL. The
+// reply reports no change, as nothing has been fetched since.
+func (a *aggregator) cached(id instance.Id) (instanceInfoReply, bool) {
+	if cacheTTL <= 0 {
+		return instanceInfoReply{}, false
+	}
+	reply, ok := a.cache[id]
+	if !ok {
+		return instanceInfoReply{}, false
+	}
+	if a.clock.Now().Sub(reply.lastUpdated) >= cacheTTL {
+		delete(a.cache, id)
+		return instanceInfoReply{}, false
+	}
+	reply.changed = false
+	reply.prevAddresses = reply.info.addresses
+	return reply, true
+}
+
+// evictExpired removes from the cache any replies fetched
+// cacheTTL or more before now, so that the cache does not
+// keep instances that are no longer asked about.
+func (a *aggregator) evictExpired(now time.Time) {
+	for id, reply := range a.cache {
+		if now.Sub(reply.lastUpdated) >= cacheTTL {
+			delete(a.cache, id)
 		}
 	}
 }
 
+// matchInstances returns the instances returned by the provider keyed
+// by id. An id for which no instance was returned is absent from the
+// map, so that the instance is reported as not found.
+//
+// Providers should return an instance for each id, in the same order,
+// with nil in place of each instance that was not found. Instances
+// are nonetheless matched by id, so that a provider that leaves out
+// missing instances, or returns them in another order, cannot cause
+// one instance's information to be reported for another.
+func matchInstances(insts []instance.Instance) map[instance.Id]instance.Instance {
+	found := make(map[instance.Id]instance.Instance)
+	for _, inst := range insts {
+		if inst != nil {
+			found[inst.Id()] = inst
+		}
+	}
+	return found
+}
+
+// instances calls Instances on the environ, retrying with
+// exponential backoff while the call fails. It also returns
+// the number of times the call was retried. It returns
+// tomb.ErrDying if the aggregator is stopped while waiting
+// to retry.
+func (a *aggregator) instances(ids []instance.Id) ([]instance.Instance, int, error) {
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		insts, err := a.environ.Instances(ids)
+		if err == nil || err == environs.ErrPartialInstances || attempt >= retryCount {
+			return insts, attempt, err
+		}
+		logger.Debugf("cannot get instances (retrying in %v): %v", delay, err)
+		select {
+		case <-a.tomb.Dying():
+			return nil, attempt, tomb.ErrDying
+		case <-a.clock.After(delay):
+		}
+		// Both may have been ready at once; never start
+		// a provider call once the aggregator is stopping.
+		select {
+		case <-a.tomb.Dying():
+			return nil, attempt, tomb.ErrDying
+		default:
+		}
+		delay *= 2
+	}
+}
+
+// originProvider is the origin recorded for addresses
+// reported by the provider itself.
+const originProvider = "provider"
+
+// addressOriginer is implemented by instances that know where
+// their addresses came from. AddressOrigin returns the origin
+// of the given address, or "" if it came from the provider.
+type addressOriginer interface {
+	AddressOrigin(addr network.Address) string
+}
+
+// instanceDisplayNamer is implemented by instances to which
+// the provider gives a human-friendly name, such as the one
+// shown in the cloud's console.
+type instanceDisplayNamer interface {
+	DisplayName() string
+}
+
 // instInfo returns the instance info for the given id
 // and instance. If inst is nil, it returns a not-found error.
 func (*aggregator) instInfo(id instance.Id, inst instance.Instance) (instanceInfo, error) {
@@ -103,14 +549,50 @@ func (*aggregator) instInfo(id instance.Id, inst instance.Instance) (instanceInf
 	}
 	addr, err := inst.Addresses()
 	if err != nil {
-		return instanceInfo{}, err
+		return instanceInfo{}, newProviderError(err)
+	}
+	originer, _ := inst.(addressOriginer)
+	origins := make(map[network.Address]string, len(addr))
+	for _, a := range addr {
+		origin := originProvider
+		if originer != nil {
+			if o := originer.AddressOrigin(a); o != "" {
+				origin = o
+			}
+		}
+		origins[a] = origin
+	}
+	var displayName string
+	if namer, ok := inst.(instanceDisplayNamer); ok {
+		displayName = namer.DisplayName()
 	}
 	return instanceInfo{
-		addr,
-		inst.Status(),
+		addresses:   addr,
+		status:      inst.Status(),
+		displayName: displayName,
+		origins:     origins,
 	}, nil
 }
 
+// replyStopped replies to each of the given requests
+// that the aggregator has stopped.
+func replyStopped(reqs []instanceInfoReq) {
+	for _, req := range reqs {
+		req.send(instanceInfoReply{err: ErrAggregatorStopped})
+	}
+}
+
+// Stop stops the aggregator and waits for it to finish. Any requests
+// that have not yet been served are answered with ErrAggregatorStopped.
+// Stop does not return until every provider call in progress has
+// finished, and no provider call is made after it returns, so the
+// provider may be released as soon as it does. It is safe to call
+// Stop more than once.
+func (a *aggregator) Stop() error {
+	a.Kill()
+	return a.Wait()
+}
+
 func (a *aggregator) Kill() {
 	a.tomb.Kill(nil)
 }
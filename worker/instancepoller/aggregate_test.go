@@ -11,6 +11,7 @@ import (
 
 	"github.com/juju/errors"
 	jc "github.com/juju/testing/checkers"
+	"github.com/juju/utils/clock"
 	gc "gopkg.in/check.v1"
 
 	"github.com/juju/juju/environs"
@@ -56,11 +57,25 @@ type testInstanceGetter struct {
 	results map[instance.Id]instance.Instance
 	err     error
 	counter int32
+
+	// omitMissing, if set, causes Instances to leave out the
+	// instances that are not found, rather than returning nil
+	// in their place, and to return the rest in reverse order.
+	omitMissing bool
 }
 
 func (tig *testInstanceGetter) Instances(ids []instance.Id) (result []instance.Instance, err error) {
 	tig.ids = ids
 	atomic.AddInt32(&tig.counter, 1)
+	if tig.omitMissing {
+		var results []instance.Instance
+		for i := len(ids) - 1; i >= 0; i-- {
+			if inst, ok := tig.results[ids[i]]; ok {
+				results = append(results, inst)
+			}
+		}
+		return results, tig.err
+	}
 	results := make([]instance.Instance, len(ids))
 	for i, id := range ids {
 		// We don't check 'ok' here, because we want the Instance{nil}
@@ -86,13 +101,17 @@ func (tig *testInstanceGetter) newTestInstance(id instance.Id, status string, ad
 func (s *aggregateSuite) TestSingleRequest(c *gc.C) {
 	testGetter := new(testInstanceGetter)
 	instance1 := testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1", "192.168.1.1"})
-	aggregator := newAggregator(testGetter)
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
 
 	info, err := aggregator.instanceInfo("foo")
 	c.Assert(err, jc.ErrorIsNil)
 	c.Assert(info, gc.DeepEquals, instanceInfo{
 		status:    "foobar",
 		addresses: instance1.addresses,
+		origins: map[network.Address]string{
+			instance1.addresses[0]: "provider",
+			instance1.addresses[1]: "provider",
+		},
 	})
 	c.Assert(testGetter.ids, gc.DeepEquals, []instance.Id{"foo"})
 }
@@ -102,7 +121,7 @@ func (s *aggregateSuite) TestMultipleResponseHandling(c *gc.C) {
 	testGetter := new(testInstanceGetter)
 
 	testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1", "192.168.1.1"})
-	aggregator := newAggregator(testGetter)
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
 
 	replyChan := make(chan instanceInfoReply)
 	req := instanceInfoReq{
@@ -171,7 +190,7 @@ func (g *batchingInstanceGetter) startRequest() {
 func (s *aggregateSuite) TestBatching(c *gc.C) {
 	s.PatchValue(&gatherTime, 10*time.Millisecond)
 	var testGetter batchingInstanceGetter
-	testGetter.aggregator = newAggregator(&testGetter)
+	testGetter.aggregator = newAggregator(&testGetter, clock.WallClock, 1)
 	// We only need to inform the system about 1 instance, because all the
 	// requests are for the same instance.
 	testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1", "192.168.1.1"})
@@ -187,26 +206,657 @@ func (s *aggregateSuite) TestBatching(c *gc.C) {
 	c.Assert(testGetter.counter, gc.Equals, int32(testGetter.totalCount/testGetter.batchSize)+1)
 }
 
+type recordingInstanceGetter struct {
+	testInstanceGetter
+	mu    sync.Mutex
+	calls [][]instance.Id
+}
+
+func (g *recordingInstanceGetter) Instances(ids []instance.Id) ([]instance.Instance, error) {
+	g.mu.Lock()
+	g.calls = append(g.calls, ids)
+	g.mu.Unlock()
+	return g.testInstanceGetter.Instances(ids)
+}
+
+func (s *aggregateSuite) TestNewInstancesResolvedFirst(c *gc.C) {
+	s.PatchValue(&gatherTime, 200*time.Millisecond)
+	testGetter := new(recordingInstanceGetter)
+	testGetter.newTestInstance("known", "foobar", []string{"127.0.0.1"})
+	testGetter.newTestInstance("new", "foobar", []string{"192.168.1.1"})
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+
+	_, err := aggregator.instanceInfo("known")
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Queue a refresh of the known instance followed by a request
+	// for the new one; both arrive within the same gathering window.
+	knownReply := make(chan instanceInfoReply, 1)
+	aggregator.reqc <- instanceInfoReq{instId: "known", reply: knownReply}
+	newReply := make(chan instanceInfoReply, 1)
+	aggregator.reqc <- instanceInfoReq{instId: "new", reply: newReply}
+
+	for _, reply := range []chan instanceInfoReply{newReply, knownReply} {
+		select {
+		case r := <-reply:
+			c.Assert(r.err, jc.ErrorIsNil)
+		case <-time.After(testing.LongWait):
+			c.Fatalf("timed out waiting for reply")
+		}
+	}
+	testGetter.mu.Lock()
+	defer testGetter.mu.Unlock()
+	// The new instance is asked for first, in the
+	// same call as the refresh of the known one.
+	c.Assert(testGetter.calls, jc.DeepEquals, [][]instance.Id{
+		{"known"},
+		{"new", "known"},
+	})
+}
+
+func (s *aggregateSuite) TestConcurrentRequestsBatched(c *gc.C) {
+	s.PatchValue(&gatherTime, 200*time.Millisecond)
+	testGetter := new(recordingInstanceGetter)
+	testGetter.newTestInstance("warm", "foobar", []string{"127.0.0.1"})
+	ids := []instance.Id{"foo0", "foo1", "foo2", "foo3", "foo4"}
+	for i, id := range ids {
+		testGetter.newTestInstance(id, "foobar", []string{fmt.Sprintf("192.168.1.%d", i)})
+	}
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+
+	// The first request uses up the rate limit, so the
+	// following ones are all gathered into the next call.
+	_, err := aggregator.instanceInfo("warm")
+	c.Assert(err, jc.ErrorIsNil)
+
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id instance.Id) {
+			defer wg.Done()
+			info, err := aggregator.instanceInfo(id)
+			c.Check(err, jc.ErrorIsNil)
+			c.Check(info.addresses, jc.DeepEquals, network.NewAddresses(fmt.Sprintf("192.168.1.%d", i)))
+		}(i, id)
+	}
+	wg.Wait()
+
+	testGetter.mu.Lock()
+	defer testGetter.mu.Unlock()
+	c.Assert(testGetter.calls, gc.HasLen, 2)
+	c.Assert(testGetter.calls[1], jc.SameContents, ids)
+}
+
+func (s *aggregateSuite) TestDuplicateRequests(c *gc.C) {
+	s.PatchValue(&gatherTime, 200*time.Millisecond)
+	testGetter := new(recordingInstanceGetter)
+	testGetter.newTestInstance("warm", "foobar", []string{"127.0.0.1"})
+	inst := testGetter.newTestInstance("foo", "foobar", []string{"192.168.1.1"})
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+
+	// The first request uses up the rate limit, so the
+	// following ones are all gathered into the next call.
+	_, err := aggregator.instanceInfo("warm")
+	c.Assert(err, jc.ErrorIsNil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info, err := aggregator.instanceInfo("foo")
+			c.Check(err, jc.ErrorIsNil)
+			c.Check(info.addresses, jc.DeepEquals, inst.addresses)
+		}()
+	}
+	wg.Wait()
+
+	testGetter.mu.Lock()
+	defer testGetter.mu.Unlock()
+	c.Assert(testGetter.calls, jc.DeepEquals, [][]instance.Id{
+		{"warm"},
+		{"foo"},
+	})
+}
+
+func (s *aggregateSuite) TestGatheringWindow(c *gc.C) {
+	testGetter := new(recordingInstanceGetter)
+	testGetter.newTestInstance("warm", "foobar", []string{"127.0.0.1"})
+	testGetter.newTestInstance("foo", "foobar", []string{"192.168.1.1"})
+	testGetter.newTestInstance("bar", "foobar", []string{"192.168.1.2"})
+	testClock := testing.NewClock(time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC))
+	aggregator := newAggregator(testGetter, testClock, 1)
+	defer aggregator.Stop()
+
+	// The first request uses up the rate limit, so the
+	// following ones must wait for the window to close.
+	_, err := aggregator.instanceInfo("warm")
+	c.Assert(err, jc.ErrorIsNil)
+
+	fooReply := make(chan instanceInfoReply, 1)
+	aggregator.reqc <- instanceInfoReq{instId: "foo", reply: fooReply}
+	barReply := make(chan instanceInfoReply, 1)
+	aggregator.reqc <- instanceInfoReq{instId: "bar", reply: barReply}
+
+	select {
+	case <-fooReply:
+		c.Fatalf("request answered before the window closed")
+	case <-time.After(testing.ShortWait):
+	}
+
+	testClock.Advance(gatherTime)
+	for _, reply := range []chan instanceInfoReply{fooReply, barReply} {
+		select {
+		case r := <-reply:
+			c.Assert(r.err, jc.ErrorIsNil)
+		case <-time.After(testing.LongWait):
+			c.Fatalf("timed out waiting for reply")
+		}
+	}
+	testGetter.mu.Lock()
+	defer testGetter.mu.Unlock()
+	c.Assert(testGetter.calls, jc.DeepEquals, [][]instance.Id{
+		{"warm"},
+		{"foo", "bar"},
+	})
+}
+
+func (s *aggregateSuite) TestCancelledRequest(c *gc.C) {
+	testGetter := new(recordingInstanceGetter)
+	testGetter.newTestInstance("warm", "foobar", []string{"127.0.0.1"})
+	testGetter.newTestInstance("foo", "foobar", []string{"192.168.1.1"})
+	testGetter.newTestInstance("bar", "foobar", []string{"192.168.1.2"})
+	testGetter.newTestInstance("baz", "foobar", []string{"192.168.1.3"})
+	testClock := testing.NewClock(time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC))
+	aggregator := newAggregator(testGetter, testClock, 1)
+	defer aggregator.Stop()
+
+	_, err := aggregator.instanceInfo("warm")
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Cancel the request for foo while it waits for the window
+	// to close; it should be dropped from the batch.
+	fooDone := make(chan struct{})
+	fooReply := make(chan instanceInfoReply, 1)
+	aggregator.reqc <- instanceInfoReq{instId: "foo", reply: fooReply, done: fooDone}
+	barReply := make(chan instanceInfoReply, 1)
+	aggregator.reqc <- instanceInfoReq{instId: "bar", reply: barReply}
+	close(fooDone)
+
+	testClock.Advance(gatherTime)
+	select {
+	case r := <-barReply:
+		c.Assert(r.err, jc.ErrorIsNil)
+	case <-time.After(testing.LongWait):
+		c.Fatalf("timed out waiting for reply")
+	}
+
+	// A request cancelled before it is sent never
+	// reaches the provider either.
+	bazDone := make(chan struct{})
+	close(bazDone)
+	aggregator.reqc <- instanceInfoReq{instId: "baz", reply: make(chan instanceInfoReply, 1), done: bazDone}
+	warmReply := make(chan instanceInfoReply, 1)
+	aggregator.reqc <- instanceInfoReq{instId: "warm", reply: warmReply}
+	timeout := time.After(testing.LongWait)
+	for replied := false; !replied; {
+		select {
+		case r := <-warmReply:
+			c.Assert(r.err, jc.ErrorIsNil)
+			replied = true
+		case <-time.After(testing.ShortWait):
+			testClock.Advance(gatherTime)
+		case <-timeout:
+			c.Fatalf("timed out waiting for reply")
+		}
+	}
+
+	select {
+	case <-fooReply:
+		c.Fatalf("cancelled request was answered")
+	case <-time.After(testing.ShortWait):
+	}
+	testGetter.mu.Lock()
+	defer testGetter.mu.Unlock()
+	c.Assert(testGetter.calls, jc.DeepEquals, [][]instance.Id{
+		{"warm"},
+		{"bar"},
+		{"warm"},
+	})
+}
+
+func (s *aggregateSuite) TestLastBatchInfo(c *gc.C) {
+	testGetter := new(testInstanceGetter)
+	testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	t0 := time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)
+	aggregator := newAggregator(testGetter, testing.NewClock(t0), 1)
+	defer aggregator.Stop()
+
+	info, err := aggregator.lastBatchInfo()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(info, jc.DeepEquals, batchInfo{})
+
+	_, err = aggregator.instanceInfo("foo")
+	c.Assert(err, jc.ErrorIsNil)
+	info, err = aggregator.lastBatchInfo()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(info, jc.DeepEquals, batchInfo{
+		ids:  []instance.Id{"foo"},
+		time: t0,
+	})
+
+	err = aggregator.Stop()
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = aggregator.lastBatchInfo()
+	c.Assert(err, gc.Equals, ErrAggregatorStopped)
+}
+
+type originInstance struct {
+	*testInstance
+	origins map[network.Address]string
+}
+
+func (t *originInstance) AddressOrigin(addr network.Address) string {
+	return t.origins[addr]
+}
+
+func (s *aggregateSuite) TestAddressOrigins(c *gc.C) {
+	testGetter := new(testInstanceGetter)
+	inst := testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1", "192.168.1.1", "10.0.0.1"})
+	testGetter.results["foo"] = &originInstance{
+		testInstance: inst,
+		origins: map[network.Address]string{
+			inst.addresses[1]: "dns",
+			inst.addresses[2]: "probe",
+		},
+	}
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+
+	info, err := aggregator.instanceInfo("foo")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(info.addresses, jc.DeepEquals, inst.addresses)
+	c.Assert(info.origins, jc.DeepEquals, map[network.Address]string{
+		inst.addresses[0]: "provider",
+		inst.addresses[1]: "dns",
+		inst.addresses[2]: "probe",
+	})
+}
+
+type namedInstance struct {
+	*testInstance
+	name string
+}
+
+func (t *namedInstance) DisplayName() string {
+	return t.name
+}
+
+func (s *aggregateSuite) TestDisplayName(c *gc.C) {
+	testGetter := new(testInstanceGetter)
+	inst := testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	testGetter.results["foo"] = &namedInstance{
+		testInstance: inst,
+		name:         "web-server",
+	}
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+
+	info, err := aggregator.instanceInfo("foo")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(info.displayName, gc.Equals, "web-server")
+}
+
+func (s *aggregateSuite) TestLastUpdated(c *gc.C) {
+	s.PatchValue(&gatherTime, 10*time.Millisecond)
+	testGetter := new(testInstanceGetter)
+	testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	t0 := time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)
+	testClock := testing.NewClock(t0)
+	aggregator := newAggregator(testGetter, testClock, 1)
+
+	getReply := func() instanceInfoReply {
+		reply := make(chan instanceInfoReply)
+		aggregator.reqc <- instanceInfoReq{instId: "foo", reply: reply}
+		return <-reply
+	}
+	reply := getReply()
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(reply.lastUpdated, gc.Equals, t0)
+
+	testClock.Advance(time.Minute)
+	reply = getReply()
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(reply.lastUpdated, gc.Equals, t0.Add(time.Minute))
+}
+
+func (s *aggregateSuite) TestCache(c *gc.C) {
+	s.PatchValue(&gatherTime, 10*time.Millisecond)
+	s.PatchValue(&cacheTTL, time.Minute)
+	testGetter := new(testInstanceGetter)
+	inst := testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	t0 := time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)
+	testClock := testing.NewClock(t0)
+	aggregator := newAggregator(testGetter, testClock, 1)
+	defer aggregator.Stop()
+
+	getReply := func() instanceInfoReply {
+		reply := make(chan instanceInfoReply)
+		aggregator.reqc <- instanceInfoReq{instId: "foo", reply: reply}
+		return <-reply
+	}
+	reply := getReply()
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(reply.changed, jc.IsTrue)
+	c.Assert(atomic.LoadInt32(&testGetter.counter), gc.Equals, int32(1))
+
+	// A request within the TTL is answered from the cache.
+	testClock.Advance(30 * time.Second)
+	reply = getReply()
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(reply.changed, jc.IsFalse)
+	c.Assert(reply.lastUpdated, gc.Equals, t0)
+	c.Assert(reply.info.addresses, jc.DeepEquals, inst.addresses)
+	c.Assert(atomic.LoadInt32(&testGetter.counter), gc.Equals, int32(1))
+
+	// Once the TTL has passed, the provider is asked again,
+	// and a change it reports replaces the cached reply.
+	testClock.Advance(30 * time.Second)
+	inst.addresses = network.NewAddresses("127.0.0.1", "192.168.1.1")
+	reply = getReply()
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(reply.changed, jc.IsTrue)
+	c.Assert(atomic.LoadInt32(&testGetter.counter), gc.Equals, int32(2))
+	reply = getReply()
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(reply.info.addresses, jc.DeepEquals, inst.addresses)
+	c.Assert(atomic.LoadInt32(&testGetter.counter), gc.Equals, int32(2))
+}
+
+func (s *aggregateSuite) TestCacheEviction(c *gc.C) {
+	s.PatchValue(&gatherTime, 10*time.Millisecond)
+	testGetter := new(testInstanceGetter)
+	testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	testGetter.newTestInstance("bar", "foobar", []string{"127.0.0.2"})
+	t0 := time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)
+	testClock := testing.NewClock(t0)
+	aggregator := newAggregator(testGetter, testClock, 1)
+	defer aggregator.Stop()
+
+	getReply := func(id instance.Id) instanceInfoReply {
+		reply := make(chan instanceInfoReply)
+		aggregator.reqc <- instanceInfoReq{instId: id, reply: reply}
+		return <-reply
+	}
+
+	// Nothing is cached when the cache is disabled.
+	reply := getReply("foo")
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(aggregator.cache, gc.HasLen, 0)
+
+	// Replies that have expired are evicted when the
+	// next batch is fetched, even if they are never
+	// asked for again.
+	s.PatchValue(&cacheTTL, time.Minute)
+	testClock.Advance(time.Second)
+	reply = getReply("foo")
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(aggregator.cache, gc.HasLen, 1)
+	testClock.Advance(time.Minute)
+	reply = getReply("bar")
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(aggregator.cache, gc.HasLen, 1)
+	_, ok := aggregator.cache["bar"]
+	c.Assert(ok, jc.IsTrue)
+}
+
+func (s *aggregateSuite) TestAddressesChanged(c *gc.C) {
+	s.PatchValue(&gatherTime, 10*time.Millisecond)
+	testGetter := new(testInstanceGetter)
+	inst := testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+
+	getReply := func() instanceInfoReply {
+		reply := make(chan instanceInfoReply)
+		aggregator.reqc <- instanceInfoReq{instId: "foo", reply: reply}
+		return <-reply
+	}
+	reply := getReply()
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(reply.changed, jc.IsTrue)
+	c.Assert(reply.prevAddresses, gc.IsNil)
+
+	reply = getReply()
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(reply.changed, jc.IsFalse)
+	c.Assert(reply.prevAddresses, jc.DeepEquals, inst.addresses)
+
+	oldAddresses := inst.addresses
+	inst.addresses = network.NewAddresses("127.0.0.1", "192.168.1.1")
+	reply = getReply()
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(reply.changed, jc.IsTrue)
+	c.Assert(reply.prevAddresses, jc.DeepEquals, oldAddresses)
+	c.Assert(reply.info.addresses, jc.DeepEquals, inst.addresses)
+}
+
+func (s *aggregateSuite) TestMissingInstanceForgotten(c *gc.C) {
+	s.PatchValue(&gatherTime, 10*time.Millisecond)
+	testGetter := new(testInstanceGetter)
+	testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+	defer aggregator.Stop()
+
+	getReply := func() instanceInfoReply {
+		reply := make(chan instanceInfoReply)
+		aggregator.reqc <- instanceInfoReq{instId: "foo", reply: reply}
+		return <-reply
+	}
+	reply := getReply()
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(aggregator.lastAddresses, gc.HasLen, 1)
+
+	// Once the instance has gone, its addresses are forgotten,
+	// so it is treated as new should it ever come back.
+	delete(testGetter.results, "foo")
+	reply = getReply()
+	c.Assert(reply.err, jc.Satisfies, errors.IsNotFound)
+	c.Assert(aggregator.lastAddresses, gc.HasLen, 0)
+
+	testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	reply = getReply()
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(reply.changed, jc.IsTrue)
+	c.Assert(reply.prevAddresses, gc.IsNil)
+}
+
+func (s *aggregateSuite) TestScopedAddresses(c *gc.C) {
+	s.PatchValue(&gatherTime, 10*time.Millisecond)
+	testGetter := new(testInstanceGetter)
+	inst := testGetter.newTestInstance("foo", "foobar", nil)
+	public := network.NewScopedAddress("203.0.113.1", network.ScopePublic)
+	public.NetworkName = "external"
+	private := network.NewScopedAddress("10.0.0.1", network.ScopeCloudLocal)
+	private.NetworkName = "internal"
+	inst.addresses = []network.Address{public, private}
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+
+	getReply := func() instanceInfoReply {
+		reply := make(chan instanceInfoReply)
+		aggregator.reqc <- instanceInfoReq{instId: "foo", reply: reply}
+		return <-reply
+	}
+	reply := getReply()
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(reply.info.addresses, jc.DeepEquals, []network.Address{public, private})
+
+	// A change of scope alone is reported as a change.
+	public.Scope = network.ScopeCloudLocal
+	inst.addresses = []network.Address{public, private}
+	reply = getReply()
+	c.Assert(reply.err, jc.ErrorIsNil)
+	c.Assert(reply.changed, jc.IsTrue)
+	c.Assert(reply.info.addresses[0].Scope, gc.Equals, network.ScopeCloudLocal)
+	c.Assert(reply.info.addresses[0].NetworkName, gc.Equals, "external")
+}
+
 func (s *aggregateSuite) TestError(c *gc.C) {
+	s.PatchValue(&retryDelay, time.Millisecond)
 	testGetter := new(testInstanceGetter)
 	ourError := fmt.Errorf("Some error")
 	testGetter.err = ourError
 
-	aggregator := newAggregator(testGetter)
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
 
 	_, err := aggregator.instanceInfo("foo")
-	c.Assert(err, gc.Equals, ourError)
+	c.Assert(err, gc.ErrorMatches, "provider call failed: Some error")
+	c.Assert(err, jc.Satisfies, IsProviderError)
+	c.Assert(err, gc.Not(jc.Satisfies), IsAggregatorStopped)
+	c.Assert(testGetter.counter, gc.Equals, int32(retryCount+1))
+}
+
+type flakyInstanceGetter struct {
+	testInstanceGetter
+	failures int
+}
+
+func (g *flakyInstanceGetter) Instances(ids []instance.Id) ([]instance.Instance, error) {
+	insts, err := g.testInstanceGetter.Instances(ids)
+	if int(g.counter) <= g.failures {
+		return nil, fmt.Errorf("attempt %d failed", g.counter)
+	}
+	return insts, err
+}
+
+func (s *aggregateSuite) TestRetry(c *gc.C) {
+	s.PatchValue(&retryDelay, time.Millisecond)
+	testGetter := &flakyInstanceGetter{failures: 2}
+	inst := testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+
+	info, err := aggregator.instanceInfo("foo")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(info.addresses, jc.DeepEquals, inst.addresses)
+	c.Assert(testGetter.counter, gc.Equals, int32(3))
+}
+
+func (s *aggregateSuite) TestStats(c *gc.C) {
+	s.PatchValue(&gatherTime, 10*time.Millisecond)
+	s.PatchValue(&retryDelay, time.Millisecond)
+	s.PatchValue(&cacheTTL, time.Minute)
+	testGetter := &flakyInstanceGetter{failures: 1}
+	testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	testGetter.newTestInstance("bar", "foobar", []string{"127.0.0.2"})
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+	defer aggregator.Stop()
+
+	stats, err := aggregator.Stats()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(stats, jc.DeepEquals, aggregatorStats{})
+	c.Assert(stats.AverageBatchSize(), gc.Equals, 0.0)
+
+	// The first request for foo is retried once; later requests
+	// for it are answered from the cache.
+	for _, id := range []instance.Id{"foo", "foo", "bar", "foo"} {
+		_, err := aggregator.instanceInfo(id)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	stats, err = aggregator.Stats()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(stats, jc.DeepEquals, aggregatorStats{
+		Requests:      4,
+		CacheHits:     2,
+		Batches:       2,
+		Instances:     2,
+		ProviderCalls: 3,
+		Retries:       1,
+	})
+	c.Assert(stats.ProviderCalls, gc.Equals, int(atomic.LoadInt32(&testGetter.counter)))
+	c.Assert(stats.AverageBatchSize(), gc.Equals, 1.0)
+
+	c.Assert(aggregator.Stop(), jc.ErrorIsNil)
+	_, err = aggregator.Stats()
+	c.Assert(err, gc.Equals, ErrAggregatorStopped)
+}
+
+func (s *aggregateSuite) TestStopWhileRetrying(c *gc.C) {
+	s.PatchValue(&retryDelay, testing.LongWait)
+	testGetter := new(testInstanceGetter)
+	testGetter.err = fmt.Errorf("Some error")
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := aggregator.instanceInfo("foo")
+		errc <- err
+	}()
+	time.Sleep(testing.ShortWait)
+	aggregator.Kill()
+	select {
+	case err := <-errc:
+		c.Assert(err, jc.Satisfies, IsAggregatorStopped)
+	case <-time.After(testing.LongWait):
+		c.Fatalf("timed out waiting for reply")
+	}
+	c.Assert(aggregator.Wait(), jc.ErrorIsNil)
+	c.Assert(testGetter.counter, gc.Equals, int32(1))
 }
 
 func (s *aggregateSuite) TestPartialErrResponse(c *gc.C) {
 	testGetter := new(testInstanceGetter)
 	testGetter.err = environs.ErrPartialInstances
 
-	aggregator := newAggregator(testGetter)
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
 	_, err := aggregator.instanceInfo("foo")
 
 	c.Assert(err, gc.ErrorMatches, "instance foo not found")
 	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	c.Assert(err, gc.Not(jc.Satisfies), IsProviderError)
+}
+
+func (s *aggregateSuite) TestPartialResultsMatchedById(c *gc.C) {
+	s.PatchValue(&gatherTime, 200*time.Millisecond)
+	testGetter := &testInstanceGetter{
+		err:         environs.ErrPartialInstances,
+		omitMissing: true,
+	}
+	foo := testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	baz := testGetter.newTestInstance("baz", "bazbar", []string{"127.0.0.2"})
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+	defer aggregator.Stop()
+
+	// The first request uses up the rate limit, so the following
+	// ones are all gathered into the next call, which returns
+	// only foo and baz, in a different order.
+	_, err := aggregator.instanceInfo("foo")
+	c.Assert(err, jc.ErrorIsNil)
+	type result struct {
+		info instanceInfo
+		err  error
+	}
+	ids := []instance.Id{"foo", "bar", "baz"}
+	results := make([]chan result, len(ids))
+	for i, id := range ids {
+		results[i] = make(chan result, 1)
+		go func(id instance.Id, resultc chan<- result) {
+			info, err := aggregator.instanceInfo(id)
+			resultc <- result{info, err}
+		}(id, results[i])
+	}
+	got := make([]result, len(ids))
+	for i, resultc := range results {
+		select {
+		case got[i] = <-resultc:
+		case <-time.After(testing.LongWait):
+			c.Fatalf("timed out waiting for instance %v", ids[i])
+		}
+	}
+	c.Assert(atomic.LoadInt32(&testGetter.counter), gc.Equals, int32(2))
+
+	c.Assert(got[0].err, jc.ErrorIsNil)
+	c.Assert(got[0].info.addresses, jc.DeepEquals, foo.addresses)
+	c.Assert(got[1].err, gc.ErrorMatches, "instance bar not found")
+	c.Assert(got[1].err, jc.Satisfies, errors.IsNotFound)
+	c.Assert(got[2].err, jc.ErrorIsNil)
+	c.Assert(got[2].info.addresses, jc.DeepEquals, baz.addresses)
 }
 
 func (s *aggregateSuite) TestAddressesError(c *gc.C) {
@@ -215,15 +865,224 @@ func (s *aggregateSuite) TestAddressesError(c *gc.C) {
 	ourError := fmt.Errorf("gotcha")
 	instance1.err = ourError
 
-	aggregator := newAggregator(testGetter)
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
 	_, err := aggregator.instanceInfo("foo")
-	c.Assert(err, gc.Equals, ourError)
+	c.Assert(err, gc.ErrorMatches, "provider call failed: gotcha")
+	c.Assert(err, jc.Satisfies, IsProviderError)
 }
 
 func (s *aggregateSuite) TestKillAndWait(c *gc.C) {
 	testGetter := new(testInstanceGetter)
-	aggregator := newAggregator(testGetter)
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
 	aggregator.Kill()
 	err := aggregator.Wait()
 	c.Assert(err, jc.ErrorIsNil)
 }
+
+func (s *aggregateSuite) TestRequestAfterStop(c *gc.C) {
+	testGetter := new(testInstanceGetter)
+	testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+	aggregator.Kill()
+	c.Assert(aggregator.Wait(), jc.ErrorIsNil)
+
+	_, err := aggregator.instanceInfo("foo")
+	c.Assert(err, gc.Equals, ErrAggregatorStopped)
+	c.Assert(err, jc.Satisfies, IsAggregatorStopped)
+	c.Assert(err, gc.Not(jc.Satisfies), IsProviderError)
+	c.Assert(testGetter.counter, gc.Equals, int32(0))
+}
+
+func (s *aggregateSuite) TestStop(c *gc.C) {
+	// Make the gathering window long enough that the
+	// request is still outstanding when the aggregator stops.
+	s.PatchValue(&gatherTime, testing.LongWait)
+	testGetter := new(testInstanceGetter)
+	testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+	_, err := aggregator.instanceInfo("foo")
+	c.Assert(err, jc.ErrorIsNil)
+
+	reply := make(chan instanceInfoReply, 1)
+	aggregator.reqc <- instanceInfoReq{instId: "foo", reply: reply}
+	c.Assert(aggregator.Stop(), jc.ErrorIsNil)
+	select {
+	case r := <-reply:
+		c.Assert(r.err, gc.Equals, ErrAggregatorStopped)
+	case <-time.After(testing.LongWait):
+		c.Fatalf("timed out waiting for reply")
+	}
+	c.Assert(testGetter.counter, gc.Equals, int32(1))
+
+	// Stopping again is harmless.
+	c.Assert(aggregator.Stop(), jc.ErrorIsNil)
+}
+
+func (s *aggregateSuite) TestStopWaitsForProviderCalls(c *gc.C) {
+	s.PatchValue(&retryDelay, time.Duration(0))
+	testGetter := &blockingInstanceGetter{
+		started: make(chan []instance.Id, retryCount+1),
+		release: make(chan struct{}),
+	}
+	testGetter.err = fmt.Errorf("Some error")
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := aggregator.instanceInfo("foo")
+		errc <- err
+	}()
+	select {
+	case <-testGetter.started:
+	case <-time.After(testing.LongWait):
+		c.Fatalf("timed out waiting for provider call")
+	}
+
+	// Stop waits for the call in progress to finish.
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- aggregator.Stop()
+	}()
+	select {
+	case err := <-errc:
+		c.Assert(err, jc.Satisfies, IsAggregatorStopped)
+	case <-time.After(testing.LongWait):
+		c.Fatalf("timed out waiting for reply")
+	}
+	select {
+	case <-stopped:
+		c.Fatalf("Stop returned while a provider call was in progress")
+	case <-time.After(testing.ShortWait):
+	}
+	close(testGetter.release)
+	select {
+	case err := <-stopped:
+		c.Assert(err, jc.ErrorIsNil)
+	case <-time.After(testing.LongWait):
+		c.Fatalf("timed out waiting for Stop")
+	}
+
+	// The failed call is not retried once the aggregator is stopping.
+	time.Sleep(testing.ShortWait)
+	c.Assert(testGetter.started, gc.HasLen, 0)
+	c.Assert(atomic.LoadInt32(&testGetter.counter), gc.Equals, int32(1))
+}
+
+func (s *aggregateSuite) TestStopWhilePending(c *gc.C) {
+	// Make the gathering window long enough that the
+	// request is still pending when the aggregator stops.
+	s.PatchValue(&gatherTime, testing.LongWait)
+	testGetter := new(testInstanceGetter)
+	testGetter.newTestInstance("foo", "foobar", []string{"127.0.0.1"})
+	aggregator := newAggregator(testGetter, clock.WallClock, 1)
+
+	// The first request is serviced immediately and
+	// uses up the rate limit, so the second one waits.
+	_, err := aggregator.instanceInfo("foo")
+	c.Assert(err, jc.ErrorIsNil)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := aggregator.instanceInfo("foo")
+		errc <- err
+	}()
+	time.Sleep(testing.ShortWait)
+	aggregator.Kill()
+	select {
+	case err := <-errc:
+		c.Assert(err, jc.Satisfies, IsAggregatorStopped)
+	case <-time.After(testing.LongWait):
+		c.Fatalf("timed out waiting for reply")
+	}
+	c.Assert(aggregator.Wait(), jc.ErrorIsNil)
+	c.Assert(testGetter.counter, gc.Equals, int32(1))
+}
+
+// blockingInstanceGetter records how many Instances calls run at
+// once; each call blocks until it is released.
+type blockingInstanceGetter struct {
+	testInstanceGetter
+	started chan []instance.Id
+	release chan struct{}
+
+	mu         sync.Mutex
+	running    int
+	maxRunning int
+}
+
+func (g *blockingInstanceGetter) Instances(ids []instance.Id) ([]instance.Instance, error) {
+	g.mu.Lock()
+	g.running++
+	if g.running > g.maxRunning {
+		g.maxRunning = g.running
+	}
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		g.running--
+		g.mu.Unlock()
+	}()
+	g.started <- ids
+	<-g.release
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.testInstanceGetter.Instances(ids)
+}
+
+func (s *aggregateSuite) TestMaxInFlight(c *gc.C) {
+	s.PatchValue(&gatherTime, 10*time.Millisecond)
+	testGetter := &blockingInstanceGetter{
+		started: make(chan []instance.Id, 3),
+		release: make(chan struct{}),
+	}
+	for _, id := range []instance.Id{"a", "b", "c"} {
+		testGetter.newTestInstance(id, "foobar", []string{"127.0.0.1"})
+	}
+	aggregator := newAggregator(testGetter, clock.WallClock, 2)
+	defer aggregator.Stop()
+
+	errc := make(chan error, 3)
+	request := func(id instance.Id) {
+		go func() {
+			_, err := aggregator.instanceInfo(id)
+			errc <- err
+		}()
+	}
+	assertStarted := func(expect instance.Id) {
+		select {
+		case ids := <-testGetter.started:
+			c.Assert(ids, jc.DeepEquals, []instance.Id{expect})
+		case <-time.After(testing.LongWait):
+			c.Fatalf("timed out waiting for provider call")
+		}
+	}
+
+	// Each request falls into a batch of its own, so
+	// the first two use up all the provider calls.
+	request("a")
+	assertStarted("a")
+	request("b")
+	assertStarted("b")
+	request("c")
+	select {
+	case ids := <-testGetter.started:
+		c.Fatalf("unexpected provider call for %v", ids)
+	case <-time.After(testing.ShortWait):
+	}
+
+	// The third batch waits for a free slot rather than being dropped.
+	testGetter.release <- struct{}{}
+	assertStarted("c")
+	close(testGetter.release)
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errc:
+			c.Assert(err, jc.ErrorIsNil)
+		case <-time.After(testing.LongWait):
+			c.Fatalf("timed out waiting for reply")
+		}
+	}
+	testGetter.mu.Lock()
+	defer testGetter.mu.Unlock()
+	c.Assert(testGetter.maxRunning, gc.Equals, 2)
+}
@@ -0,0 +1,42 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package instancepoller
+
+import (
+	"github.com/juju/errors"
+)
+
+// ErrAggregatorStopped is returned in reply to instance info
+// requests that cannot be served because the aggregator is
+// shutting down. Callers should give up rather than retry.
+var ErrAggregatorStopped = errors.New("instance aggregator stopped")
+
+// IsAggregatorStopped reports whether err was caused by
+// the aggregator shutting down.
+func IsAggregatorStopped(err error) bool {
+	return errors.Cause(err) == ErrAggregatorStopped
+}
+
+// providerError wraps an error returned by a call to the provider.
+// Such failures are usually transient, so callers may retry later.
+type providerError struct {
+	err error
+}
+
+func (e *providerError) Error() string {
+	return "provider call failed: " + e.err.Error()
+}
+
+// newProviderError returns an error which satisfies
+// IsProviderError, wrapping the given provider error.
+func newProviderError(err error) error {
+	return &providerError{err}
+}
+
+// IsProviderError reports whether err was caused by
+// a failed call to the provider.
+func IsProviderError(err error) bool {
+	_, ok := errors.Cause(err).(*providerError)
+	return ok
+}
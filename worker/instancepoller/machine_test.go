@@ -58,6 +58,28 @@ func (s *machineSuite) TestSetsInstanceInfoInitially(c *gc.C) {
 	c.Assert(m.instStatus, gc.Equals, "running")
 }
 
+func (s *machineSuite) TestSetsInstanceDisplayName(c *gc.C) {
+	context := &testMachineContext{
+		getInstanceInfo: func(id instance.Id) (instanceInfo, error) {
+			return instanceInfo{
+				addresses:   testAddrs,
+				status:      "running",
+				displayName: "web-server",
+			}, nil
+		},
+		dyingc: make(chan struct{}),
+	}
+	m := &testMachine{
+		tag:        names.NewMachineTag("99"),
+		instanceId: "i1234",
+		refresh:    func() error { return nil },
+		life:       params.Alive,
+	}
+	_, err := pollInstanceInfo(context, m)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(m.displayName, gc.Equals, "web-server")
+}
+
 func (s *machineSuite) TestShortPollIntervalWhenNoAddress(c *gc.C) {
 	s.PatchValue(&ShortPoll, 1*time.Millisecond)
 	s.PatchValue(&LongPoll, coretesting.LongWait)
@@ -121,7 +143,7 @@ func countPolls(c *gc.C, addrs []network.Address, instId, instStatus string, mac
 		if addrs == nil {
 			return instanceInfo{}, fmt.Errorf("no instance addresses available")
 		}
-		return instanceInfo{addrs, instStatus}, nil
+		return instanceInfo{addresses: addrs, status: instStatus}, nil
 	}
 	context := &testMachineContext{
 		getInstanceInfo: getInstanceInfo,
@@ -178,6 +200,32 @@ func (s *machineSuite) TestSinglePollWhenInstancInfoUnimplemented(c *gc.C) {
 	c.Assert(count, gc.Equals, int32(1))
 }
 
+func (s *machineSuite) TestStopsWhenAggregatorStopped(c *gc.C) {
+	s.PatchValue(&ShortPoll, 1*time.Millisecond)
+	s.PatchValue(&LongPoll, 1*time.Millisecond)
+	context := &testMachineContext{
+		getInstanceInfo: instanceInfoGetter(c, "i1234", nil, "", ErrAggregatorStopped),
+		dyingc:          make(chan struct{}),
+	}
+	m := &testMachine{
+		tag:        names.NewMachineTag("99"),
+		instanceId: "i1234",
+		refresh:    func() error { return nil },
+		life:       params.Alive,
+	}
+	died := make(chan machine)
+
+	go runMachine(context, m, nil, died)
+
+	select {
+	case diedm := <-died:
+		c.Assert(diedm, gc.Equals, m)
+	case <-time.After(coretesting.LongWait):
+		c.Fatalf("timed out waiting for machine to die")
+	}
+	c.Assert(context.killAllErr, gc.Equals, nil)
+}
+
 func (*machineSuite) TestChangedRefreshes(c *gc.C) {
 	context := &testMachineContext{
 		getInstanceInfo: instanceInfoGetter(c, "i1234", testAddrs, "running", nil),
@@ -299,7 +347,7 @@ func instanceInfoGetter(
 
 	return func(id instance.Id) (instanceInfo, error) {
 		c.Check(id, gc.Equals, expectId)
-		return instanceInfo{addrs, status}, err
+		return instanceInfo{addresses: addrs, status: status}, err
 	}
 }
 
@@ -329,6 +377,7 @@ type testMachine struct {
 	instanceIdErr   error
 	tag             names.MachineTag
 	instStatus      string
+	displayName     string
 	status          params.Status
 	refresh         func() error
 	setAddressesErr error
@@ -391,6 +440,19 @@ func (m *testMachine) SetInstanceStatus(status string) error {
 	return nil
 }
 
+func (m *testMachine) InstanceDisplayName() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.displayName, nil
+}
+
+func (m *testMachine) SetInstanceDisplayName(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.displayName = name
+	return nil
+}
+
 func (m *testMachine) SetProviderAddresses(addrs ...network.Address) error {
 	if m.setAddressesErr != nil {
 		return m.setAddressesErr
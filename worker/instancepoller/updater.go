@@ -39,6 +39,8 @@ type machine interface {
 	SetProviderAddresses(...network.Address) error
 	InstanceStatus() (string, error)
 	SetInstanceStatus(status string) error
+	InstanceDisplayName() (string, error)
+	SetInstanceDisplayName(name string) error
 	String() string
 	Refresh() error
 	Life() params.Life
@@ -49,6 +51,14 @@ type machine interface {
 type instanceInfo struct {
 	addresses []network.Address
 	status    string
+
+	// displayName holds the human-friendly name the provider
+	// gives the instance, if any.
+	displayName string
+
+	// origins records where each address in addresses
+	// came from, keyed by the address itself.
+	origins map[network.Address]string
 }
 
 type machineContext interface {
@@ -183,6 +193,11 @@ func machineLoop(context machineContext, m machine, changed <-chan struct{}) err
 	for {
 		if pollInstance {
 			instInfo, err := pollInstanceInfo(context, m)
+			if IsAggregatorStopped(err) {
+				// We're shutting down, so there's no point
+				// polling any more.
+				return nil
+			}
 			if err != nil && !params.IsCodeNotProvisioned(err) {
 				// If the provider doesn't implement Addresses/Status now,
 				// it never will until we're upgraded, so don't bother
@@ -231,8 +246,9 @@ func machineLoop(context machineContext, m machine, changed <-chan struct{}) err
 	}
 }
 
-// pollInstanceInfo checks the current provider addresses and status
-// for the given machine's instance, and sets them on the machine if they've changed.
+// pollInstanceInfo checks the current provider addresses, status and
+// display name for the given machine's instance, and sets them on the
+// machine if they've changed.
 func pollInstanceInfo(context machineContext, m machine) (instInfo instanceInfo, err error) {
 	instInfo = instanceInfo{}
 	instId, err := m.InstanceId()
@@ -245,7 +261,7 @@ func pollInstanceInfo(context machineContext, m machine) (instInfo instanceInfo,
 	}
 	instInfo, err = context.instanceInfo(instId)
 	if err != nil {
-		if params.IsCodeNotImplemented(err) {
+		if params.IsCodeNotImplemented(err) || IsAggregatorStopped(err) {
 			return instInfo, err
 		}
 		logger.Warningf("cannot get instance info for instance %q: %v", instId, err)
@@ -265,6 +281,17 @@ func pollInstanceInfo(context machineContext, m machine) (instInfo instanceInfo,
 			}
 		}
 	}
+	if instInfo.displayName != "" {
+		currentName, err := m.InstanceDisplayName()
+		if err != nil {
+			logger.Warningf("cannot get current instance display name for machine %v: %v", m.Id(), err)
+		} else if instInfo.displayName != currentName {
+			logger.Infof("machine %q instance display name changed from %q to %q", m.Id(), currentName, instInfo.displayName)
+			if err = m.SetInstanceDisplayName(instInfo.displayName); err != nil {
+				logger.Errorf("cannot set instance display name on %q: %v", m, err)
+			}
+		}
+	}
 	providerAddresses, err := m.ProviderAddresses()
 	if err != nil {
 		return instInfo, err
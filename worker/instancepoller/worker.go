@@ -5,6 +5,7 @@ package instancepoller
 
 import (
 	"github.com/juju/names"
+	"github.com/juju/utils/clock"
 	"launchpad.net/tomb"
 
 	apiinstancepoller "github.com/juju/juju/api/instancepoller"
@@ -12,6 +13,10 @@ import (
 	"github.com/juju/juju/worker"
 )
 
+// maxProviderCalls holds the maximum number of Instances
+// calls the worker makes to the provider at once.
+const maxProviderCalls = 1
+
 type updaterWorker struct {
 	st   *apiinstancepoller.API
 	tomb tomb.Tomb
@@ -48,10 +53,17 @@ func (u *updaterWorker) loop() (err error) {
 	if err != nil {
 		return err
 	}
-	u.aggregator = newAggregator(u.observer.Environ())
+	u.aggregator = newAggregator(u.observer.Environ(), clock.WallClock, maxProviderCalls)
 	logger.Infof("instance poller received inital environment configuration")
 	defer func() {
+		// The aggregator is stopped first, so that no
+		// provider call is in progress when the environ
+		// observer is stopped.
+		aggErr := u.aggregator.Stop()
 		obsErr := worker.Stop(u.observer)
+		if err == nil {
+			err = aggErr
+		}
 		if err == nil {
 			err = obsErr
 		}
@@ -12,6 +12,8 @@ import (
 	"github.com/juju/juju/agent"
 	"github.com/juju/juju/api/watcher"
 	"github.com/juju/juju/apiserver/params"
+	"github.com/juju/juju/container/lxc/lxcutils"
+	"github.com/juju/juju/instance"
 	"github.com/juju/juju/network"
 	"github.com/juju/juju/worker"
 )
@@ -56,6 +58,11 @@ func (mr *Machiner) SetUp() (watcher.NotifyWatcher, error) {
 		}
 	}
 
+	// Report the type of container, if any, that we are running inside.
+	if err := setDetectedContainerType(mr.tag, m); err != nil {
+		return nil, errors.Annotate(err, "setting detected container type")
+	}
+
 	// Mark the machine as started and log it.
 	if err := m.SetStatus(params.StatusStarted, "", nil); err != nil {
 		return nil, errors.Annotatef(err, "%s failed to set status started", mr.tag)
@@ -101,6 +108,21 @@ func setMachineAddresses(tag names.MachineTag, m Machine) error {
 	return m.SetMachineAddresses(hostAddresses)
 }
 
+var runningInsideContainer = lxcutils.RunningInsideContainer
+
+// setDetectedContainerType records the type of container, if any, that
+// the host is running inside. A failure to detect the type is logged
+// rather than returned, as it must not stop the machine from starting.
+func setDetectedContainerType(tag names.MachineTag, m Machine) error {
+	ctype, err := runningInsideContainer()
+	if err != nil {
+		logger.Warningf("cannot detect container type for %v: %v", tag, err)
+		return nil
+	}
+	logger.Infof("setting detected container type for %v to %q", tag, ctype)
+	return m.SetDetectedContainerType(instance.ContainerType(ctype))
+}
+
 func (mr *Machiner) Handle(_ <-chan struct{}) error {
 	if err := mr.machine.Refresh(); params.IsCodeNotFoundOrCodeUnauthorized(err) {
 		return worker.ErrTerminateAgent
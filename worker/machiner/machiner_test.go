@@ -19,9 +19,12 @@ import (
 	"github.com/juju/juju/api"
 	apimachiner "github.com/juju/juju/api/machiner"
 	"github.com/juju/juju/apiserver/params"
+	"github.com/juju/juju/container/lxc/lxcutils"
+	"github.com/juju/juju/instance"
 	"github.com/juju/juju/juju/testing"
 	"github.com/juju/juju/network"
 	"github.com/juju/juju/state"
+	"github.com/juju/juju/state/multiwatcher"
 	coretesting "github.com/juju/juju/testing"
 	"github.com/juju/juju/worker"
 	"github.com/juju/juju/worker/machiner"
@@ -49,6 +52,9 @@ func (s *MachinerSuite) SetUpTest(c *gc.C) {
 	s.PatchValue(machiner.InterfaceAddrs, func() ([]net.Addr, error) {
 		return s.addresses, nil
 	})
+	s.PatchValue(machiner.RunningInsideContainer, func() (lxcutils.ContainerType, error) {
+		return lxcutils.LXCContainer, nil
+	})
 }
 
 func (s *MachinerSuite) TestMachinerStorageAttached(c *gc.C) {
@@ -58,6 +64,7 @@ func (s *MachinerSuite) TestMachinerStorageAttached(c *gc.C) {
 	s.accessor.machine.life = params.Dying
 	s.accessor.machine.SetErrors(
 		nil, // SetMachineAddresses
+		nil, // SetDetectedContainerType
 		nil, // SetStatus
 		nil, // Watch
 		nil, // Refresh
@@ -87,6 +94,9 @@ func (s *MachinerSuite) TestMachinerStorageAttached(c *gc.C) {
 				"0.0.0.0",
 			),
 		},
+	}, {
+		FuncName: "SetDetectedContainerType",
+		Args:     []interface{}{instance.LXC},
 	}, {
 		FuncName: "SetStatus",
 		Args: []interface{}{
@@ -154,7 +164,9 @@ func (s *MachinerStateSuite) SetUpTest(c *gc.C) {
 		return nil, nil
 	})
 	s.PatchValue(&network.LXCNetDefaultConfig, "")
-
+	s.PatchValue(machiner.RunningInsideContainer, func() (lxcutils.ContainerType, error) {
+		return lxcutils.NoContainer, nil
+	})
 }
 
 func (s *MachinerStateSuite) waitMachineStatus(c *gc.C, m *state.Machine, expectStatus state.Status) {
@@ -226,6 +238,33 @@ func (s *MachinerStateSuite) TestStartSetsStatus(c *gc.C) {
 	s.waitMachineStatus(c, s.machine, state.StatusStarted)
 }
 
+func (s *MachinerStateSuite) TestStartSetsDetectedContainerType(c *gc.C) {
+	s.PatchValue(machiner.RunningInsideContainer, func() (lxcutils.ContainerType, error) {
+		return lxcutils.LXCContainer, nil
+	})
+	mr := s.makeMachiner(false)
+	defer worker.Stop(mr)
+
+	// The container type is reported before the status is set.
+	s.waitMachineStatus(c, s.machine, state.StatusStarted)
+	c.Assert(s.machine.Refresh(), jc.ErrorIsNil)
+	c.Assert(s.machine.DetectedContainerType(), gc.Equals, instance.LXC)
+
+	// Watchers are shown the type the agent reported.
+	w := s.State.Watch()
+	defer w.Stop()
+	deltas, err := w.Next()
+	c.Assert(err, jc.ErrorIsNil)
+	var info *multiwatcher.MachineInfo
+	for _, delta := range deltas {
+		if m, ok := delta.Entity.(*multiwatcher.MachineInfo); ok && m.Id == s.machine.Id() {
+			info = m
+		}
+	}
+	c.Assert(info, gc.NotNil)
+	c.Assert(info.ContainerType, gc.Equals, instance.LXC)
+}
+
 func (s *MachinerStateSuite) TestSetsStatusWhenDying(c *gc.C) {
 	mr := s.makeMachiner(false)
 	defer worker.Stop(mr)
@@ -9,6 +9,7 @@ import (
 
 	"github.com/juju/juju/api/watcher"
 	"github.com/juju/juju/apiserver/params"
+	"github.com/juju/juju/instance"
 	"github.com/juju/juju/network"
 	"github.com/juju/juju/worker/machiner"
 )
@@ -60,6 +61,11 @@ func (m *mockMachine) SetMachineAddresses(addresses []network.Address) error {
 	return m.NextErr()
 }
 
+func (m *mockMachine) SetDetectedContainerType(ctype instance.ContainerType) error {
+	m.MethodCall(m, "SetDetectedContainerType", ctype)
+	return m.NextErr()
+}
+
 func (m *mockMachine) SetStatus(status params.Status, info string, data map[string]interface{}) error {
 	m.MethodCall(m, "SetStatus", status, info, data)
 	return m.NextErr()
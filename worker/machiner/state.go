@@ -9,6 +9,7 @@ import (
 	"github.com/juju/juju/api/machiner"
 	"github.com/juju/juju/api/watcher"
 	"github.com/juju/juju/apiserver/params"
+	"github.com/juju/juju/instance"
 	"github.com/juju/juju/network"
 )
 
@@ -21,6 +22,7 @@ type Machine interface {
 	Life() params.Life
 	EnsureDead() error
 	SetMachineAddresses(addresses []network.Address) error
+	SetDetectedContainerType(ctype instance.ContainerType) error
 	SetStatus(status params.Status, info string, data map[string]interface{}) error
 	Watch() (watcher.NotifyWatcher, error)
 }